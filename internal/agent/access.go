@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/deploy"
+	"github.com/k8sdeploy/agent/internal/agent/info"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	"github.com/k8sdeploy/agent/internal/agent/workload"
+)
+
+// ReviewAccess works out what the agent is allowed to do in every cluster so
+// a missing Role shows up at startup rather than halfway through a deploy
+func (a *Agent) ReviewAccess() {
+	for _, name := range a.Clusters.Names() {
+		kc, err := a.Clusters.Get(name)
+		if err != nil {
+			continue
+		}
+
+		a.reviewAccess(name, kc)
+	}
+}
+
+// handlerPermissions is what the deploy, info and workload handlers check, so
+// every request the agent can be sent is covered by the review
+func handlerPermissions() (namespaced, clusterWide []scope.Permission) {
+	namespaced, clusterWide = info.Permissions()
+	namespaced = append(namespaced, deploy.Permissions()...)
+	namespaced = append(namespaced, workload.Permissions()...)
+
+	return namespaced, clusterWide
+}
+
+func (a *Agent) reviewAccess(name string, kc *KubernetesClient) {
+	namespaced, clusterWide := handlerPermissions()
+	perms := scope.Required(kc.Namespaces, namespaced, clusterWide)
+	if self := a.Config.K8sDeploy.Self; a.Config.SelfUpdate && name == a.Clusters.Default() {
+		perms = append(perms,
+			scope.Permission{Group: "apps", Resource: "deployments", Verb: "get", Namespace: self.Namespace, Name: self.Deployment},
+			scope.Permission{Group: "apps", Resource: "deployments", Verb: "patch", Namespace: self.Namespace, Name: self.Deployment},
+		)
+	}
+
+	caps, err := scope.Review(kc.Context, kc.ClientSet, perms)
+	if err != nil {
+		_ = logs.Errorf("failed to review %s permissions: %v", name, err)
+		return
+	}
+	kc.Capabilities = caps
+
+	for _, p := range caps.Missing() {
+		_ = logs.Errorf("cluster %s is missing permission: %s", name, p)
+	}
+}
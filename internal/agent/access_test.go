@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReviewAccessNamespaced(t *testing.T) {
+	h := newHarness(t)
+	kc := h.Agent.KubernetesClient
+	kc.Namespaces = []string{"team"}
+
+	var reviewed []*authorizationv1.ResourceAttributes
+	h.Client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		reviewed = append(reviewed, attrs)
+
+		review.Status.Allowed = !(attrs.Resource == "deployments" && attrs.Verb == "delete")
+		return true, review, nil
+	})
+
+	h.Agent.reviewAccess("local", kc)
+
+	seen := map[string]bool{}
+	for _, attrs := range reviewed {
+		seen[attrs.Verb+" "+attrs.Resource] = true
+		if attrs.Namespace != "team" {
+			t.Errorf("reviewed %s %s in %q, want only namespace team", attrs.Verb, attrs.Resource, attrs.Namespace)
+		}
+		if attrs.Resource == "namespaces" {
+			t.Errorf("reviewed cluster scoped namespaces access while namespace scoped")
+		}
+	}
+
+	// the handlers' own permissions are reviewed, not a list kept beside them
+	for _, want := range []string{
+		"patch statefulsets",
+		"patch horizontalpodautoscalers",
+		"patch configmaps",
+		"list controllerrevisions",
+	} {
+		if !seen[want] {
+			t.Errorf("%s wasn't reviewed", want)
+		}
+	}
+
+	missing := kc.Capabilities.Missing()
+	if len(missing) != 1 {
+		t.Fatalf("missing = %v, want only delete deployments", missing)
+	}
+	if got := missing[0].String(); got != "delete deployments.apps in team" {
+		t.Errorf("missing = %s, want delete deployments.apps in team", got)
+	}
+}
@@ -7,24 +7,57 @@ import (
 	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"net/http"
-	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	"github.com/k8sdeploy/agent/internal/agent/operation"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
 	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/health"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
 )
 
 type KubernetesClient struct {
 	Context   context.Context
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Metadata  metadata.Interface
+
+	// Namespaces limits the client to namespaced calls, it is empty when the
+	// agent can see the whole cluster
+	Namespaces   scope.Namespaces
+	Capabilities scope.Capabilities
 }
 
 type Agent struct {
 	Config           *config.Config
 	KubernetesClient *KubernetesClient
+	Clusters         *Clusters
+	Health           *health.Health
+	HTTPClient       *httpclient.Client
+	Analysis         analysis.Provider
+	Operations       *operation.Tracker
+	Keys             sealed.Opener
+	Keyring          *sealed.Keyring
+
+	startedAt         time.Time
+	started           chan struct{}
+	refresh           chan struct{}
+	credentialsMu     sync.RWMutex
+	credentialsExpiry time.Time
+	queuesSet         bool
+
+	updateMu       sync.Mutex
+	updating       bool
+	handledUpdates map[string]bool
 }
 
 type EventClient struct {
@@ -35,21 +68,56 @@ type EventClient struct {
 }
 
 func NewAgent(cfg *config.Config) *Agent {
-	return &Agent{
-		Config: cfg,
+	a := &Agent{
+		Config:     cfg,
+		Clusters:   NewClusters(cfg.K8sDeploy.Clusters.Default),
+		Health:     health.NewHealth(cfg.K8sDeploy.PollInterval, cfg.K8sDeploy.MaxMissedPolls),
+		HTTPClient: httpclient.NewClient(cfg),
+		Operations: operation.NewTracker(cfg.K8sDeploy.Self.Pod),
+		startedAt:  time.Now(),
+		started:    make(chan struct{}),
+		refresh:    make(chan struct{}, 1),
+
+		handledUpdates: map[string]bool{},
+	}
+	a.HTTPClient.AuthFailed = a.queueAuthFailed
+	if cfg.K8sDeploy.Analysis.PrometheusAddress != "" {
+		a.Analysis = analysis.NewPrometheus(cfg.K8sDeploy.Analysis.PrometheusAddress, cfg.K8sDeploy.Analysis.PrometheusToken, a.HTTPClient)
 	}
+	if cfg.K8sDeploy.Sealing.SealingKey != "" {
+		key, err := sealed.NewKey(cfg.K8sDeploy.Sealing.SealingKey)
+		if err != nil {
+			_ = logs.Errorf("secrets won't be accepted: %v", err)
+		} else {
+			a.Keys = key
+		}
+	}
+	a.registerHealthChecks()
+
+	return a
 }
 
 func (a *Agent) Start() error {
 	errChan := make(chan error)
-	billingTime := 5
 
-	if err := a.connectOrchestrator(); err != nil {
-		return logs.Errorf("failed to connect to orchestrator: %v", err)
-	}
 	if err := a.GetKubernetesClient(); err != nil {
 		return logs.Errorf("failed to get kubernetes client: %v", err)
 	}
+	// the public key goes out with the registration
+	if err := a.loadKeyring(a.KubernetesClient.Context); err != nil {
+		_ = logs.Errorf("no key pair, secrets can only use the shared key: %v", err)
+	}
+
+	a.register()
+	if err := a.LoadClusters(); err != nil {
+		return logs.Errorf("failed to load clusters: %v", err)
+	}
+	a.startClusters()
+	close(a.started)
+	go a.maintainRegistration(context.Background())
+	go a.reportUpdate(context.Background())
+
+	a.Health.StartPolling()
 	for {
 		select {
 		case err := <-errChan:
@@ -57,7 +125,7 @@ func (a *Agent) Start() error {
 				logs.Infof("error in agent loop: %v", err)
 				continue
 			}
-		case <-time.After(time.Duration(billingTime) * time.Second):
+		case <-time.After(a.Config.K8sDeploy.PollInterval):
 			go a.listenForEvents(errChan)
 
 			if a.Config.SelfUpdate {
@@ -68,16 +136,42 @@ func (a *Agent) Start() error {
 	}
 }
 
+// Started is closed once the clusters are loaded and their access reviewed,
+// anything sharing the agent's clusters waits on it
+func (a *Agent) Started() <-chan struct{} {
+	return a.started
+}
+
+// register keeps trying to connect to the orchestrator, an outage on the api
+// side shouldn't take the agent down with it, the registration post isn't
+// retried by the http client so this loop is the only retry
+func (a *Agent) register() {
+	for attempt := 0; ; attempt++ {
+		err := a.connectOrchestrator()
+		if err == nil {
+			a.Health.SetRegistered(true)
+			return
+		}
+		a.Health.SetRegistered(false)
+
+		wait := a.HTTPClient.Backoff(attempt)
+		logs.Infof("failed to connect to orchestrator, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+	}
+}
+
 func (a *Agent) connectOrchestrator() error {
 	type AgentBody struct {
-		Key       string `json:"key"`
-		Secret    string `json:"secret"`
-		CompanyID string `json:"company_id"`
+		Key       string     `json:"key"`
+		Secret    string     `json:"secret"`
+		CompanyID string     `json:"company_id"`
+		PublicKey *PublicKey `json:"public_key,omitempty"`
 	}
 	b, err := json.Marshal(&AgentBody{
 		Key:       a.Config.K8sDeploy.Credentials.Agent.Key,
 		Secret:    a.Config.K8sDeploy.Credentials.Agent.Secret,
 		CompanyID: a.Config.K8sDeploy.Credentials.Agent.CompanyID,
+		PublicKey: a.publicKey(),
 	})
 	if err != nil {
 		return logs.Errorf("failed to marshal agent body: %v", err)
@@ -87,12 +181,18 @@ func (a *Agent) connectOrchestrator() error {
 	if err != nil {
 		return logs.Errorf("failed to create request: %v", err)
 	}
-	res, err := http.DefaultClient.Do(req)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return logs.Errorf("failed to connect to orchestrator: %v", err)
 	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			_ = logs.Errorf("failed to close orchestrator body: %v", err)
+		}
+	}()
 	if res.StatusCode != http.StatusOK {
-		return logs.Error("failed to connect to orchestrator")
+		return logs.Errorf("failed to connect to orchestrator: %s", res.Status)
 	}
 
 	type QueueName string
@@ -108,8 +208,9 @@ func (a *Agent) connectOrchestrator() error {
 	}
 
 	type Credentials struct {
-		Key    string `json:"key"`
-		Secret string `json:"secret"`
+		Key       string    `json:"key"`
+		Secret    string    `json:"secret"`
+		ExpiresAt time.Time `json:"expires_at"`
 	}
 
 	type AgentDetails struct {
@@ -122,8 +223,14 @@ func (a *Agent) connectOrchestrator() error {
 		return logs.Errorf("failed to decode agent details: %v", err)
 	}
 
-	a.Config.K8sDeploy.Credentials.Queue.Key = agentDetails.Credentials.Key
-	a.Config.K8sDeploy.Credentials.Queue.Secret = agentDetails.Credentials.Secret
+	a.Config.K8sDeploy.SetQueueCredentials(agentDetails.Credentials.Key, agentDetails.Credentials.Secret)
+	a.setCredentialsExpiry(agentDetails.Credentials.ExpiresAt)
+
+	// queue paths are read without locking by the event loop, so they are only
+	// taken from the first registration
+	if !a.claimQueues() {
+		return nil
+	}
 
 	for _, queue := range agentDetails.Queues {
 		switch queue.Name {
@@ -140,37 +247,100 @@ func (a *Agent) connectOrchestrator() error {
 }
 
 func (a *Agent) GetKubernetesClient() error {
-	// get kubernetes config
-	if a.Config.Development {
-		cfgPath := filepath.Join(homedir.HomeDir(), ".kube", "config")
-		cfg, err := clientcmd.BuildConfigFromFlags("", cfgPath)
-		if err != nil {
-			return logs.Errorf("failed to build config from flags: %v", err)
-		}
+	cfg, namespaces, err := a.restConfig()
+	if err != nil {
+		return logs.Errorf("failed to get kubernetes config: %v", err)
+	}
+	cfg.Wrap(telemetry.WrapTransport)
 
-		clientSet, err := kubernetes.NewForConfig(cfg)
-		if err != nil {
-			return logs.Errorf("failed to create clientset: %v", err)
-		}
-		a.KubernetesClient = &KubernetesClient{
-			Context:   context.Background(),
-			ClientSet: clientSet,
-		}
-		return nil
+	kc, err := NewKubernetesClient(context.Background(), cfg)
+	if err != nil {
+		return logs.Errorf("failed to create kubernetes client: %v", err)
+	}
+	kc.Namespaces = namespaces
+	if len(a.Config.K8sDeploy.Namespaces) > 0 {
+		kc.Namespaces = a.Config.K8sDeploy.Namespaces
+	}
+	a.KubernetesClient = kc
+
+	return nil
+}
+
+func (a *Agent) restConfig() (*rest.Config, scope.Namespaces, error) {
+	if a.Config.Development {
+		return a.devConfig()
 	}
 
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
-		return logs.Errorf("failed to get in cluster config: %v", err)
+		return nil, nil, logs.Errorf("failed to get in cluster config: %v", err)
 	}
+	return cfg, nil, nil
+}
 
-	clientset, err := kubernetes.NewForConfig(cfg)
+// devConfig loads the developer's kubeconfig, when namespace scoped the agent
+// sticks to the context namespace so a Role binding is all it needs
+func (a *Agent) devConfig() (*rest.Config, scope.Namespaces, error) {
+	kube := a.Config.K8sDeploy.Kube
+	clientConfig := a.kubeconfig(kube.Context)
+
+	cfg, err := clientConfig.ClientConfig()
 	if err != nil {
-		return logs.Errorf("failed to create clientset: %v", err)
+		return nil, nil, logs.Errorf("failed to load kubeconfig: %v", err)
 	}
-	a.KubernetesClient = &KubernetesClient{
-		Context:   context.Background(),
-		ClientSet: clientset,
+
+	if !kube.NamespaceScoped {
+		return cfg, nil, nil
 	}
-	return nil
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, nil, logs.Errorf("failed to get kubeconfig namespace: %v", err)
+	}
+	logs.Infof("namespace scoped to %s", namespace)
+
+	return cfg, scope.Namespaces{namespace}, nil
+}
+
+// kubeconfig merges KUBECONFIG the same way kubectl does, an explicit path
+// replaces the merge entirely
+func (a *Agent) kubeconfig(context string) clientcmd.ClientConfig {
+	kube := a.Config.K8sDeploy.Kube
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kube.Kubeconfig != "" {
+		rules.ExplicitPath = kube.Kubeconfig
+	}
+
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: context,
+	}
+	overrides.AuthInfo.Impersonate = kube.ImpersonateUser
+	overrides.AuthInfo.ImpersonateGroups = kube.ImpersonateGroups
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+}
+
+func NewKubernetesClient(ctx context.Context, cfg *rest.Config) (*KubernetesClient, error) {
+	clientSet, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, logs.Errorf("failed to create clientset: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, logs.Errorf("failed to create dynamic client: %v", err)
+	}
+
+	metadataClient, err := metadata.NewForConfig(cfg)
+	if err != nil {
+		return nil, logs.Errorf("failed to create metadata client: %v", err)
+	}
+
+	return &KubernetesClient{
+		Context:   ctx,
+		ClientSet: clientSet,
+		Dynamic:   dynamicClient,
+		Metadata:  metadataClient,
+	}, nil
 }
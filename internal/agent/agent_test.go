@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/config"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: https://%[1]s.test
+contexts:
+- name: %[1]s
+  context:
+    cluster: %[1]s
+    user: %[1]s
+    namespace: %[1]s-team
+users:
+- name: %[1]s
+  user:
+    token: %[1]s-token
+current-context: %[1]s
+`
+
+func writeKubeconfig(t *testing.T, name string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(testKubeconfig, name)), 0o600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+
+	return path
+}
+
+func TestDevConfigMergedKubeconfig(t *testing.T) {
+	first := writeKubeconfig(t, "first")
+	second := writeKubeconfig(t, "second")
+	t.Setenv("KUBECONFIG", strings.Join([]string{first, second}, string(os.PathListSeparator)))
+
+	cfg := &config.Config{}
+	cfg.K8sDeploy.Kube.Context = "second"
+	cfg.K8sDeploy.Kube.ImpersonateUser = "dev@test"
+	cfg.K8sDeploy.Kube.ImpersonateGroups = []string{"developers"}
+	cfg.K8sDeploy.Kube.NamespaceScoped = true
+
+	rc, namespaces, err := NewAgent(cfg).devConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if rc.Host != "https://second.test" {
+		t.Errorf("host = %s, want https://second.test", rc.Host)
+	}
+	if rc.Impersonate.UserName != "dev@test" {
+		t.Errorf("impersonated user = %s, want dev@test", rc.Impersonate.UserName)
+	}
+	if len(rc.Impersonate.Groups) != 1 || rc.Impersonate.Groups[0] != "developers" {
+		t.Errorf("impersonated groups = %v, want [developers]", rc.Impersonate.Groups)
+	}
+	if len(namespaces) != 1 || namespaces[0] != "second-team" {
+		t.Errorf("namespaces = %v, want [second-team]", namespaces)
+	}
+}
+
+func TestDevConfigExplicitPath(t *testing.T) {
+	t.Setenv("KUBECONFIG", writeKubeconfig(t, "ignored"))
+
+	cfg := &config.Config{}
+	cfg.K8sDeploy.Kube.Kubeconfig = writeKubeconfig(t, "explicit")
+
+	rc, namespaces, err := NewAgent(cfg).devConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if rc.Host != "https://explicit.test" {
+		t.Errorf("host = %s, want https://explicit.test", rc.Host)
+	}
+	if namespaces.Scoped() {
+		t.Errorf("namespaces = %v, want cluster wide", namespaces)
+	}
+}
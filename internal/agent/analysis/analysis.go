@@ -0,0 +1,186 @@
+package analysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"time"
+)
+
+const defaultInterval = 30 * time.Second
+
+var (
+	ErrFailed   = errors.New("analysis failed")
+	ErrNotReady = errors.New("rollout not ready in time")
+)
+
+// Provider runs a query and gives back a single value, ok is false when the
+// query matched nothing, a service with no traffic has no error rate
+type Provider interface {
+	Query(ctx context.Context, query string) (value float64, ok bool, err error)
+}
+
+// Check fails when the query result goes over Max or under Min
+type Check struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Max   *float64 `json:"max,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+}
+
+// Details is what a deploy request asks for, the checks run every interval
+// while the rollout happens and for the duration after it's done
+type Details struct {
+	Checks       []Check `json:"checks"`
+	Interval     string  `json:"interval"`
+	Duration     string  `json:"duration"`
+	FailureLimit int     `json:"failure_limit"`
+}
+
+type Measurement struct {
+	Check  string    `json:"check"`
+	Value  *float64  `json:"value,omitempty"`
+	Passed bool      `json:"passed"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type Result struct {
+	Passed       bool          `json:"passed"`
+	Failures     int           `json:"failures"`
+	Measurements []Measurement `json:"measurements"`
+}
+
+type Analysis struct {
+	Provider Provider
+	Checks   []Check
+	Result   Result
+
+	interval     time.Duration
+	duration     time.Duration
+	failureLimit int
+}
+
+func New(provider Provider, details Details) (*Analysis, error) {
+	if provider == nil {
+		return nil, logs.Error("no analysis provider configured")
+	}
+	if len(details.Checks) == 0 {
+		return nil, logs.Error("analysis needs at least one check")
+	}
+	for _, c := range details.Checks {
+		if c.Query == "" {
+			return nil, logs.Errorf("check %s has no query", c.Name)
+		}
+		if c.Max == nil && c.Min == nil {
+			return nil, logs.Errorf("check %s has no max or min", c.Name)
+		}
+	}
+
+	interval, err := duration(details.Interval, defaultInterval)
+	if err != nil {
+		return nil, logs.Errorf("failed to parse interval: %v", err)
+	}
+	after, err := duration(details.Duration, 0)
+	if err != nil {
+		return nil, logs.Errorf("failed to parse duration: %v", err)
+	}
+
+	return &Analysis{
+		Provider:     provider,
+		Checks:       details.Checks,
+		Result:       Result{Passed: true},
+		interval:     interval,
+		duration:     after,
+		failureLimit: details.FailureLimit,
+	}, nil
+}
+
+// Evaluate runs every check once, a query that errors counts as a failure so
+// an analysis that can't be trusted doesn't pass
+func (a *Analysis) Evaluate(ctx context.Context) error {
+	for _, c := range a.Checks {
+		m := Measurement{
+			Check:  c.Name,
+			Passed: true,
+			Time:   time.Now(),
+		}
+
+		value, ok, err := a.Provider.Query(ctx, c.Query)
+		switch {
+		case err != nil:
+			m.Passed = false
+			m.Error = err.Error()
+		case ok:
+			m.Value = &value
+			m.Passed = c.passes(value)
+		}
+
+		a.Result.Measurements = append(a.Result.Measurements, m)
+		if !m.Passed {
+			a.Result.Failures++
+		}
+	}
+
+	if a.Result.Failures > a.failureLimit {
+		a.Result.Passed = false
+		return fmt.Errorf("%w: %d failed measurements", ErrFailed, a.Result.Failures)
+	}
+
+	return nil
+}
+
+// Run evaluates the checks every interval until ready says the rollout is
+// done and the duration has passed since, or the rollout takes longer than
+// timeout to get ready
+func (a *Analysis) Run(ctx context.Context, ready func(context.Context) (bool, error), timeout time.Duration) error {
+	start := time.Now()
+	var readyAt time.Time
+
+	for {
+		if err := a.Evaluate(ctx); err != nil {
+			return err
+		}
+
+		if readyAt.IsZero() {
+			ok, err := ready(ctx)
+			if err != nil {
+				return err
+			}
+			if ok {
+				readyAt = time.Now()
+			} else if time.Since(start) > timeout {
+				return ErrNotReady
+			}
+		}
+		if !readyAt.IsZero() && time.Since(readyAt) >= a.duration {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.interval):
+		}
+	}
+}
+
+func (c Check) passes(value float64) bool {
+	if c.Max != nil && value > *c.Max {
+		return false
+	}
+	if c.Min != nil && value < *c.Min {
+		return false
+	}
+
+	return true
+}
+
+func duration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	return time.ParseDuration(value)
+}
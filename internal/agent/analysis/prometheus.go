@@ -0,0 +1,117 @@
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Prometheus queries anything that speaks the prometheus http api, thanos
+// and mimir included
+type Prometheus struct {
+	Address    string
+	Token      string
+	HTTPClient *httpclient.Client
+}
+
+type promResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+type promSample struct {
+	Value [2]interface{} `json:"value"`
+}
+
+func NewPrometheus(address, token string, client *httpclient.Client) *Prometheus {
+	return &Prometheus{
+		Address:    address,
+		Token:      token,
+		HTTPClient: client,
+	}
+}
+
+func (p *Prometheus) Query(ctx context.Context, query string) (float64, bool, error) {
+	u := fmt.Sprintf("%s/api/v1/query?%s", p.Address, url.Values{"query": {query}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, false, logs.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return 0, false, logs.Errorf("failed to query prometheus: %v", err)
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			_ = logs.Errorf("failed to close prometheus body: %v", err)
+		}
+	}()
+
+	var pr promResponse
+	if err := json.NewDecoder(res.Body).Decode(&pr); err != nil {
+		return 0, false, logs.Errorf("failed to decode prometheus response: %v", err)
+	}
+	if pr.Status != "success" {
+		return 0, false, logs.Errorf("prometheus query failed: %s %s", res.Status, pr.Error)
+	}
+
+	return sampleValue(pr.Data.ResultType, pr.Data.Result)
+}
+
+// sampleValue takes the only sample of a vector, or the scalar, queries have to
+// aggregate down to a single series since there's no telling which of several
+// the check meant. NaN, what a ratio over no traffic gives, counts as no data
+func sampleValue(resultType string, result json.RawMessage) (float64, bool, error) {
+	var value [2]interface{}
+
+	switch resultType {
+	case "scalar":
+		if err := json.Unmarshal(result, &value); err != nil {
+			return 0, false, logs.Errorf("failed to decode scalar: %v", err)
+		}
+	case "vector":
+		var samples []promSample
+		if err := json.Unmarshal(result, &samples); err != nil {
+			return 0, false, logs.Errorf("failed to decode vector: %v", err)
+		}
+		switch len(samples) {
+		case 0:
+			return 0, false, nil
+		case 1:
+			value = samples[0].Value
+		default:
+			return 0, false, logs.Errorf("query returned %d series, aggregate it down to one", len(samples))
+		}
+	default:
+		return 0, false, logs.Errorf("unsupported result type: %s", resultType)
+	}
+
+	s, ok := value[1].(string)
+	if !ok {
+		return 0, false, logs.Error("sample value isn't a string")
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, logs.Errorf("failed to parse sample value: %v", err)
+	}
+	if math.IsNaN(f) {
+		return 0, false, nil
+	}
+
+	return f, true, nil
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/health"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type Clusters struct {
+	mu          sync.RWMutex
+	clients     map[string]*KubernetesClient
+	defaultName string
+}
+
+func NewClusters(defaultName string) *Clusters {
+	return &Clusters{
+		clients:     map[string]*KubernetesClient{},
+		defaultName: defaultName,
+	}
+}
+
+func (c *Clusters) Add(name string, kc *KubernetesClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clients[name] = kc
+}
+
+// Get returns the named cluster, an empty name is the cluster the agent runs in
+func (c *Clusters) Get(name string) (*KubernetesClient, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if name == "" {
+		name = c.defaultName
+	}
+
+	kc, ok := c.clients[name]
+	if !ok {
+		return nil, logs.Errorf("unknown cluster: %s", name)
+	}
+
+	return kc, nil
+}
+
+func (c *Clusters) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.clients))
+	for name := range c.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (c *Clusters) Default() string {
+	return c.defaultName
+}
+
+// LoadClusters registers the local cluster along with every extra cluster
+// from kubeconfig contexts and mounted kubeconfig secrets
+func (a *Agent) LoadClusters() error {
+	a.Clusters.Add(a.Clusters.Default(), a.KubernetesClient)
+
+	for _, name := range a.Config.K8sDeploy.Clusters.Contexts {
+		cfg, err := a.kubeconfig(name).ClientConfig()
+		if err != nil {
+			return logs.Errorf("failed to load context %s: %v", name, err)
+		}
+
+		if err := a.addCluster(name, cfg); err != nil {
+			return logs.Errorf("failed to add cluster %s: %v", name, err)
+		}
+	}
+
+	dir := a.Config.K8sDeploy.Clusters.SecretsDir
+	if dir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return logs.Errorf("failed to read cluster secrets: %v", err)
+	}
+	for _, entry := range entries {
+		// secret mounts are full of ..data style symlinks
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			continue
+		}
+
+		cfg, err := clientcmd.BuildConfigFromFlags("", path)
+		if err != nil {
+			return logs.Errorf("failed to load kubeconfig %s: %v", path, err)
+		}
+
+		if err := a.addCluster(entry.Name(), cfg); err != nil {
+			return logs.Errorf("failed to add cluster %s: %v", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Agent) addCluster(name string, cfg *rest.Config) error {
+	cfg.Wrap(telemetry.WrapTransport)
+
+	kc, err := NewKubernetesClient(context.Background(), cfg)
+	if err != nil {
+		return logs.Errorf("failed to create kubernetes client: %v", err)
+	}
+	kc.Namespaces = a.Config.K8sDeploy.Namespaces
+	a.Clusters.Add(name, kc)
+
+	return nil
+}
+
+func (a *Agent) startClusters() {
+	a.ReviewAccess()
+
+	for _, name := range a.Clusters.Names() {
+		kc, err := a.Clusters.Get(name)
+		if err != nil {
+			continue
+		}
+
+		a.Health.AddCheck("kubernetes_api/"+name, health.Readiness, kc.checkAPI)
+	}
+}
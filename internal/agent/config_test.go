@@ -0,0 +1,335 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testSealingKey(t *testing.T) *sealed.Key {
+	t.Helper()
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	key, err := sealed.NewKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+
+	return key
+}
+
+func seal(t *testing.T, key *sealed.Key, value string) string {
+	t.Helper()
+
+	s, err := key.Seal([]byte(value))
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	return s
+}
+
+// consumer reads the api-config configmap through envFrom and optionally the
+// api-secret secret through a volume
+func consumer(name string, secret bool) *appsv1.Deployment {
+	dep := testRolloutDeployment(name, "default", "registry.test/"+name+":v1", 1)
+	dep.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "api-config"}},
+	}}
+	if secret {
+		dep.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name:         "creds",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "api-secret"}},
+		}}
+	}
+
+	return dep
+}
+
+func configRequest(requestID string, config map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"action":     "deploy",
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": "config",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"config": config,
+		},
+	}
+}
+
+type configResponse struct {
+	Updated bool `json:"updated"`
+	Secrets []struct {
+		Name    string   `json:"name"`
+		Created bool     `json:"created"`
+		Keys    []string `json:"keys"`
+	} `json:"secrets"`
+	Env       []string `json:"env"`
+	Restarted []string `json:"restarted"`
+	Conflicts int32    `json:"conflicts"`
+}
+
+func TestListenForEventsDeployConfig(t *testing.T) {
+	key := testSealingKey(t)
+	h := newHarness(t,
+		consumer("api", true),
+		consumer("worker", false),
+		testRolloutDeployment("other", "default", "registry.test/other:v1", 1),
+	)
+	h.Agent.Keys = key
+
+	request := configRequest("req-60", map[string]interface{}{
+		"env": map[string]string{"LOG_LEVEL": "debug"},
+		"configmaps": []map[string]interface{}{{
+			"name": "api-config",
+			"data": map[string]string{"FEATURE_X": "on"},
+		}},
+		"secrets": []map[string]interface{}{{
+			"name": "api-secret",
+			"data": map[string]string{"password": seal(t, key, "hunter2")},
+		}},
+	})
+	if errs := h.process(t, request); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	cm, err := h.Client.CoreV1().ConfigMaps("default").Get(ctx, "api-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	if cm.Data["FEATURE_X"] != "on" {
+		t.Errorf("configmap data = %v", cm.Data)
+	}
+	secret, err := h.Client.CoreV1().Secrets("default").Get(ctx, "api-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get secret: %v", err)
+	}
+	if string(secret.Data["password"]) != "hunter2" || secret.Type != corev1.SecretTypeOpaque {
+		t.Errorf("secret = %s %q, want opaque hunter2", secret.Type, secret.Data["password"])
+	}
+
+	hashes := map[string]string{}
+	for _, name := range []string{"api", "worker", "other"} {
+		dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get deployment %s: %v", name, err)
+		}
+		hashes[name] = dep.Spec.Template.Annotations["k8sdeploy.dev/config-hash"]
+		if rolled := hashes[name] != ""; rolled != (dep.Annotations["k8sdeploy.dev/request-id"] != "") {
+			t.Errorf("%s annotations = %v, want the request id only on a rolled deployment", name, dep.Annotations)
+		}
+
+		if name == "api" {
+			env := dep.Spec.Template.Spec.Containers[0].Env
+			if len(env) != 1 || env[0].Name != "LOG_LEVEL" || env[0].Value != "debug" {
+				t.Errorf("api env = %+v, want LOG_LEVEL=debug", env)
+			}
+		}
+	}
+	if hashes["api"] == "" || hashes["worker"] == "" || hashes["other"] != "" {
+		t.Errorf("config hashes = %v, want api and worker only", hashes)
+	}
+	if hashes["api"] == hashes["worker"] {
+		t.Error("api and worker consume different config but share a hash")
+	}
+
+	responses := h.Server.responses()
+	for _, r := range responses {
+		if strings.Contains(r.Payload, "hunter2") {
+			t.Fatal("secret value published in a response")
+		}
+	}
+	var resp configResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || strings.Join(resp.Restarted, ",") != "api,worker" || strings.Join(resp.Env, ",") != "LOG_LEVEL" {
+		t.Errorf("response = %+v, want api and worker restarted", resp)
+	}
+	if len(resp.Secrets) != 1 || !resp.Secrets[0].Created || resp.Secrets[0].Keys[0] != "password" {
+		t.Errorf("secrets = %+v, want api-secret created with password", resp.Secrets)
+	}
+
+	// the same config again leaves every pod alone
+	if errs := h.process(t, request); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	resp = configResponse{}
+	if err := json.Unmarshal([]byte(h.Server.responses()[1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Restarted) != 0 {
+		t.Errorf("restarted = %v, want nothing for unchanged config", resp.Restarted)
+	}
+}
+
+func TestListenForEventsDeployConfigPatches(t *testing.T) {
+	api := consumer("api", false)
+	api.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "KEEP", Value: "1"},
+		{Name: "DROP", Value: "2"},
+		{Name: "LOG_LEVEL", Value: "info"},
+	}
+	h := newHarness(t, api, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-config", Namespace: "default"},
+		Data:       map[string]string{"FEATURE_X": "off", "OLD": "gone"},
+	})
+	staleOnce(h.Client, "configmaps")
+	staleOnce(h.Client, "deployments")
+
+	request := configRequest("req-61", map[string]interface{}{
+		"env": map[string]interface{}{"LOG_LEVEL": "debug", "DROP": nil},
+		"configmaps": []map[string]interface{}{{
+			"name": "api-config",
+			"data": map[string]string{"FEATURE_X": "on"},
+		}},
+	})
+	if errs := h.process(t, request); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	cm, err := h.Client.CoreV1().ConfigMaps("default").Get(ctx, "api-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	if len(cm.Data) != 1 || cm.Data["FEATURE_X"] != "on" {
+		t.Errorf("configmap data = %v, want only FEATURE_X=on", cm.Data)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	env := dep.Spec.Template.Spec.Containers[0].Env
+	if len(env) != 2 || env[0].Name != "KEEP" || env[1].Name != "LOG_LEVEL" || env[1].Value != "debug" {
+		t.Errorf("env = %+v, want KEEP and LOG_LEVEL=debug", env)
+	}
+
+	// env goes out as a strategic merge patch, never as the whole deployment
+	for _, action := range h.Client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("%s was updated, want patches only", action.GetResource().Resource)
+		}
+	}
+
+	var resp configResponse
+	if err := json.Unmarshal([]byte(h.Server.responses()[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.Conflicts != 2 || strings.Join(resp.Env, ",") != "DROP,LOG_LEVEL" {
+		t.Errorf("response = %+v, want updated after 2 conflicts", resp)
+	}
+}
+
+func TestListenForEventsDeployConfigSecretNotSealed(t *testing.T) {
+	h := newHarness(t, consumer("api", true))
+	h.Agent.Keys = testSealingKey(t)
+
+	errs := h.process(t, configRequest("req-61", map[string]interface{}{
+		"secrets": []map[string]interface{}{{
+			"name": "api-secret",
+			"data": map[string]string{"password": base64.StdEncoding.EncodeToString([]byte("hunter2-plaintext-value"))},
+		}},
+	}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error for a secret that wasn't sealed")
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("error leaks the value: %v", err)
+		}
+	}
+	if _, err := h.Client.CoreV1().Secrets("default").Get(context.Background(), "api-secret", metav1.GetOptions{}); err == nil {
+		t.Error("secret written from an unsealed value")
+	}
+
+	h.Agent.Keys = nil
+	if errs := h.process(t, configRequest("req-62", map[string]interface{}{
+		"secrets": []map[string]interface{}{{
+			"name": "api-secret",
+			"data": map[string]string{"password": "anything"},
+		}},
+	})); len(errs) == 0 {
+		t.Fatal("expected an error accepting secrets without a sealing key")
+	}
+}
+
+func TestListenForEventsDeployConfigRollsEveryKind(t *testing.T) {
+	template := consumer("api", false).Spec.Template
+	h := newHarness(t,
+		consumer("api", false),
+		// shares the deployment's name, but the env is only for the deployment
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Template: *template.DeepCopy()},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+			Spec:       appsv1.DaemonSetSpec{Template: *template.DeepCopy()},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "logs", Namespace: "default"},
+			Spec:       appsv1.DaemonSetSpec{Template: testRolloutDeployment("logs", "default", "registry.test/logs:v1", 1).Spec.Template},
+		},
+	)
+
+	errs := h.process(t, configRequest("req-63", map[string]interface{}{
+		"env": map[string]string{"LOG_LEVEL": "debug"},
+		"configmaps": []map[string]interface{}{{
+			"name": "api-config",
+			"data": map[string]string{"FEATURE_X": "on"},
+		}},
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	sts, err := h.Client.AppsV1().StatefulSets("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get statefulset: %v", err)
+	}
+	if sts.Spec.Template.Annotations["k8sdeploy.dev/config-hash"] == "" || len(sts.Spec.Template.Spec.Containers[0].Env) != 0 {
+		t.Errorf("statefulset template = %+v, want the config hash and no env", sts.Spec.Template)
+	}
+	// controller revisions only keep the template, so the id has to be on it
+	if id := sts.Spec.Template.Annotations["k8sdeploy.dev/request-id"]; id != "req-63" {
+		t.Errorf("statefulset template request id = %q, want req-63", id)
+	}
+	for name, want := range map[string]bool{"agent": true, "logs": false} {
+		ds, err := h.Client.AppsV1().DaemonSets("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get daemonset %s: %v", name, err)
+		}
+		if got := ds.Spec.Template.Annotations["k8sdeploy.dev/config-hash"] != ""; got != want {
+			t.Errorf("daemonset %s stamped = %t, want %t", name, got, want)
+		}
+	}
+
+	var resp configResponse
+	if err := json.Unmarshal([]byte(h.Server.responses()[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if got := strings.Join(resp.Restarted, ","); got != "api,statefulset/api,daemonset/agent" {
+		t.Errorf("restarted = %s, want the deployment, statefulset and consuming daemonset", got)
+	}
+}
@@ -0,0 +1,183 @@
+package conflict
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"sync/atomic"
+)
+
+// Counter counts the writes that lost a race with another writer and had to
+// be worked out again, every deploy and workload response reports it
+type Counter struct {
+	count atomic.Int32
+}
+
+func (c *Counter) Count() int32 {
+	return c.count.Load()
+}
+
+// retry runs write again whenever it conflicts, write has to read what it
+// changes itself and return the client error as it is
+func (c *Counter) retry(write func() error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := write()
+		if k8serrors.IsConflict(err) {
+			c.count.Add(1)
+		}
+		return err
+	})
+}
+
+// Client is the part of a typed or dynamic client Patch uses
+type Client[T metav1.Object] interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (T, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (T, error)
+}
+
+type dynamicClient struct {
+	dynamic.ResourceInterface
+}
+
+func (d dynamicClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*unstructured.Unstructured, error) {
+	return d.ResourceInterface.Get(ctx, name, opts)
+}
+
+// Dynamic lets Patch write custom resources
+func Dynamic(ri dynamic.ResourceInterface) Client[*unstructured.Unstructured] {
+	return dynamicClient{ri}
+}
+
+// Patch sends the patch build works out from obj, guarded by the resource
+// version obj was read at so the api server refuses it once anyone else has
+// written the object. The object is then read again and build run on that,
+// a nil patch means there's nothing to change and obj is returned as it is
+func Patch[T metav1.Object](ctx context.Context, c *Counter, client Client[T], obj T, pt types.PatchType, build func(T) ([]byte, error)) (T, error) {
+	current := obj
+	attempt := 0
+
+	err := c.retry(func() error {
+		if attempt > 0 {
+			fresh, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current = fresh
+		}
+		attempt++
+
+		patch, err := build(current)
+		if err != nil || patch == nil {
+			return err
+		}
+		if patch, err = guard(pt, patch, current.GetResourceVersion()); err != nil {
+			return err
+		}
+
+		patched, err := client.Patch(ctx, obj.GetName(), pt, patch, metav1.PatchOptions{})
+		if pt == types.JSONPatchType && k8serrors.IsInvalid(err) {
+			return failedTest(ctx, client, current, err)
+		}
+		if err != nil {
+			return err
+		}
+		current = patched
+		return nil
+	})
+
+	return current, err
+}
+
+// failedTest tells a json patch whose test op failed from one that was
+// invalid, both come back unprocessable but only the first moved the version
+func failedTest[T metav1.Object](ctx context.Context, client Client[T], sent T, err error) error {
+	fresh, getErr := client.Get(ctx, sent.GetName(), metav1.GetOptions{})
+	if getErr != nil || sent.GetResourceVersion() == "" || fresh.GetResourceVersion() == sent.GetResourceVersion() {
+		return err
+	}
+
+	return k8serrors.NewConflict(schema.GroupResource{}, sent.GetName(), err)
+}
+
+// guard adds the resource version to the patch, a json patch gets a test op
+// in front and a merge patch sets it, which the api server takes as a
+// precondition
+func guard(pt types.PatchType, patch []byte, resourceVersion string) ([]byte, error) {
+	if resourceVersion == "" {
+		return patch, nil
+	}
+
+	if pt == types.JSONPatchType {
+		var ops []json.RawMessage
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, logs.Errorf("failed to decode json patch: %v", err)
+		}
+		test, err := json.Marshal(map[string]string{
+			"op":    "test",
+			"path":  "/metadata/resourceVersion",
+			"value": resourceVersion,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(append([]json.RawMessage{test}, ops...))
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, logs.Errorf("failed to decode merge patch: %v", err)
+	}
+	meta := map[string]json.RawMessage{}
+	if raw, ok := fields["metadata"]; ok {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, logs.Errorf("failed to decode patch metadata: %v", err)
+		}
+	}
+
+	var err error
+	if meta["resourceVersion"], err = json.Marshal(resourceVersion); err != nil {
+		return nil, err
+	}
+	if fields["metadata"], err = json.Marshal(meta); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+// Diff is the strategic merge patch that turns original into modified, for
+// changes easier to make on a copy than to write out, lists with a merge key
+// like env are merged on it and a removed entry is sent as a delete
+func Diff(original, modified, dataStruct interface{}) ([]byte, error) {
+	from, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	to, err := json.Marshal(modified)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := strategicpatch.CreateTwoWayMergePatch(from, to, dataStruct)
+	if err != nil {
+		return nil, logs.Errorf("failed to create patch: %v", err)
+	}
+	if string(patch) == "{}" {
+		return nil, nil
+	}
+
+	return patch, nil
+}
+
+func ReplicasPatch(count int32) []byte {
+	return []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, count))
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+)
+
+func (a *Agent) setCredentialsExpiry(expiry time.Time) {
+	a.credentialsMu.Lock()
+	defer a.credentialsMu.Unlock()
+
+	a.credentialsExpiry = expiry
+}
+
+func (a *Agent) claimQueues() bool {
+	a.credentialsMu.Lock()
+	defer a.credentialsMu.Unlock()
+
+	if a.queuesSet {
+		return false
+	}
+	a.queuesSet = true
+
+	return true
+}
+
+// untilRefresh is how long until the queue credentials should be renewed,
+// credentials without an expiry are still renewed periodically, and never
+// sooner than a poll apart
+func (a *Agent) untilRefresh() time.Duration {
+	a.credentialsMu.RLock()
+	defer a.credentialsMu.RUnlock()
+
+	if a.credentialsExpiry.IsZero() {
+		return a.Config.K8sDeploy.CredentialsRefresh
+	}
+
+	wait := time.Until(a.credentialsExpiry) - a.Config.K8sDeploy.CredentialsLeeway
+	if poll := a.Config.K8sDeploy.PollInterval; wait < poll {
+		// credentials that only last as long as the leeway would otherwise
+		// have it re-register straight away, over and over
+		logs.Infof("queue credentials expire %s, within the %s leeway, renewing in %s", a.credentialsExpiry.Format(time.RFC3339), a.Config.K8sDeploy.CredentialsLeeway, poll)
+		return poll
+	}
+
+	return wait
+}
+
+func (a *Agent) queueAuthFailed(host string) {
+	u, err := url.Parse(a.Config.K8sDeploy.RabbitHost)
+	if err != nil || u.Host != host {
+		return
+	}
+
+	select {
+	case a.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// maintainRegistration renews the queue credentials before they expire and
+// whenever the queue rejects them, heartbeats go out in between without
+// moving the renewal
+func (a *Agent) maintainRegistration(ctx context.Context) {
+	heartbeat := time.NewTicker(a.Config.K8sDeploy.HeartbeatInterval)
+	defer heartbeat.Stop()
+	renew := time.NewTimer(a.untilRefresh())
+	defer renew.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if err := a.sendHeartbeat(); err != nil {
+				_ = logs.Errorf("failed to send heartbeat: %v", err)
+			}
+			continue
+		case <-a.refresh:
+			logs.Infof("queue rejected credentials, re-registering with orchestrator")
+			a.register()
+		case <-renew.C:
+			logs.Infof("refreshing queue credentials")
+			a.register()
+		}
+
+		// the new credentials come with a new expiry
+		if !renew.Stop() {
+			select {
+			case <-renew.C:
+			default:
+			}
+		}
+		renew.Reset(a.untilRefresh())
+	}
+}
+
+func (a *Agent) sendHeartbeat() error {
+	type Heartbeat struct {
+		Version        string            `json:"version"`
+		ClusterVersion string            `json:"cluster_version"`
+		Clusters       map[string]string `json:"clusters"`
+		StartedAt      time.Time         `json:"started_at"`
+		Uptime         int64             `json:"uptime_seconds"`
+	}
+
+	hb := Heartbeat{
+		Version:   a.Config.K8sDeploy.BuildVersion,
+		Clusters:  map[string]string{},
+		StartedAt: a.startedAt,
+		Uptime:    int64(time.Since(a.startedAt).Seconds()),
+	}
+	for _, name := range a.Clusters.Names() {
+		kc, err := a.Clusters.Get(name)
+		if err != nil {
+			continue
+		}
+
+		sv, err := kc.ClientSet.Discovery().ServerVersion()
+		if err != nil {
+			_ = logs.Errorf("failed to get cluster %s version: %v", name, err)
+			hb.Clusters[name] = ""
+			continue
+		}
+		hb.Clusters[name] = sv.GitVersion
+	}
+	hb.ClusterVersion = hb.Clusters[a.Clusters.Default()]
+
+	b, err := json.Marshal(hb)
+	if err != nil {
+		return logs.Errorf("failed to marshal heartbeat: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), "POST", fmt.Sprintf("%s/agent/heartbeat", a.Config.K8sDeploy.APIAddress), bytes.NewBuffer(b))
+	if err != nil {
+		return logs.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Agent-Key", a.Config.K8sDeploy.Credentials.Agent.Key)
+	req.Header.Set("X-Agent-Secret", a.Config.K8sDeploy.Credentials.Agent.Secret)
+
+	// a repeated heartbeat only reports the same state again
+	res, err := a.HTTPClient.Do(httpclient.RetrySafe(req))
+	if err != nil {
+		return logs.Errorf("failed to send heartbeat: %v", err)
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			_ = logs.Errorf("failed to close heartbeat body: %v", err)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return logs.Errorf("failed to send heartbeat: %s", res.Status)
+	}
+
+	return nil
+}
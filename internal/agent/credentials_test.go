@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// maintain runs the registration loop until the test ends
+func (h *harness) maintain(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Agent.maintainRegistration(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForCount waits until count reaches want
+func (h *harness) waitForCount(t *testing.T, what string, count func() int, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if count() >= want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%d %s, want %d", count(), what, want)
+}
+
+func (h *harness) registered() int {
+	h.Server.mu.Lock()
+	defer h.Server.mu.Unlock()
+
+	return len(h.Server.registrations)
+}
+
+func (h *harness) heartbeats() int {
+	h.Server.mu.Lock()
+	defer h.Server.mu.Unlock()
+
+	return len(h.Server.heartbeats)
+}
+
+func TestUntilRefresh(t *testing.T) {
+	h := newHarness(t)
+	k := &h.Agent.Config.K8sDeploy
+	k.CredentialsRefresh = time.Hour
+	k.CredentialsLeeway = 5 * time.Minute
+	k.PollInterval = 5 * time.Second
+
+	// the stub hands out credentials without an expiry
+	if got := h.Agent.untilRefresh(); got != time.Hour {
+		t.Errorf("untilRefresh = %s without an expiry, want the refresh interval", got)
+	}
+
+	h.Agent.setCredentialsExpiry(time.Now().Add(20 * time.Minute))
+	if got := h.Agent.untilRefresh(); got < 14*time.Minute || got > 15*time.Minute {
+		t.Errorf("untilRefresh = %s, want the leeway before expiry", got)
+	}
+
+	// a ttl shorter than the leeway mustn't re-register in a tight loop
+	for _, ttl := range []time.Duration{time.Minute, -time.Minute} {
+		h.Agent.setCredentialsExpiry(time.Now().Add(ttl))
+		if got := h.Agent.untilRefresh(); got != 5*time.Second {
+			t.Errorf("untilRefresh = %s with a %s ttl, want the poll interval", got, ttl)
+		}
+	}
+}
+
+func TestMaintainRegistrationRefreshes(t *testing.T) {
+	h := newHarness(t)
+	k := &h.Agent.Config.K8sDeploy
+	k.CredentialsRefresh = 30 * time.Millisecond
+	// heartbeats far more often than the refresh mustn't hold it off
+	k.HeartbeatInterval = 5 * time.Millisecond
+	h.maintain(t)
+
+	// the harness registered once already
+	h.waitForCount(t, "registrations", h.registered, 3)
+	if h.heartbeats() == 0 {
+		t.Error("no heartbeats sent between refreshes")
+	}
+}
+
+func TestMaintainRegistrationReregistersOnAuthFailure(t *testing.T) {
+	h := newHarness(t)
+	k := &h.Agent.Config.K8sDeploy
+	k.CredentialsRefresh = time.Hour
+	k.HeartbeatInterval = time.Hour
+	h.maintain(t)
+
+	// a rejection from some other host isn't about the queue credentials
+	h.Agent.queueAuthFailed("elsewhere.test")
+	u, err := url.Parse(h.Server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server url: %v", err)
+	}
+	h.Agent.queueAuthFailed(u.Host)
+
+	h.waitForCount(t, "registrations", h.registered, 2)
+	time.Sleep(20 * time.Millisecond)
+	if got := h.registered(); got != 2 {
+		t.Errorf("%d registrations, want 2", got)
+	}
+	if user, _ := k.QueueCredentials(); user != "queue-key" {
+		t.Errorf("queue key = %q after re-registering, want queue-key", user)
+	}
+}
+
+func TestMaintainRegistrationHeartbeat(t *testing.T) {
+	h := newHarness(t)
+	k := &h.Agent.Config.K8sDeploy
+	k.BuildVersion = "1.2.0"
+	k.CredentialsRefresh = time.Hour
+	k.HeartbeatInterval = 5 * time.Millisecond
+	h.maintain(t)
+
+	h.waitForCount(t, "heartbeats", h.heartbeats, 2)
+	if got := h.registered(); got != 1 {
+		t.Errorf("%d registrations, want heartbeats to leave the credentials alone", got)
+	}
+
+	h.Server.mu.Lock()
+	hb := h.Server.heartbeats[0]
+	h.Server.mu.Unlock()
+	clusters, _ := hb["clusters"].(map[string]interface{})
+	if hb["version"] != "1.2.0" || len(clusters) != 1 || hb["cluster_version"] != clusters["local"] {
+		t.Errorf("heartbeat = %v, want the build version and the local cluster", hb)
+	}
+}
@@ -0,0 +1,397 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const (
+	colourBlue  = "blue"
+	colourGreen = "green"
+
+	defaultGrace = time.Minute
+)
+
+const (
+	phaseDeploying  = "deploying"
+	phaseReady      = "ready"
+	phaseSwitched   = "switched"
+	phaseReverted   = "reverted"
+	phaseScaledDown = "scaled_down"
+)
+
+// BlueGreenDetails service is the one flipped between colours, the previous
+// colour is kept running for the grace period so it can be switched back to
+type BlueGreenDetails struct {
+	Service string `json:"service"`
+	Grace   string `json:"grace"`
+	Timeout string `json:"timeout"`
+}
+
+type BlueGreenRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+	Reporter  Reporter
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	Image    string
+	Colour   string
+	Previous string
+	Updated  bool
+	Reverted bool
+	Reason   string
+	Phases   []Progress
+
+	Conflicts conflict.Counter
+}
+
+func NewBlueGreen(cs kubernetes.Interface, ctx context.Context) *BlueGreenRequest {
+	return &BlueGreenRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (b *BlueGreenRequest) SetRequestID(rid string) {
+	b.RequestID = rid
+}
+
+func validateBlueGreenRequest(details RequestDetails) error {
+	if err := validateImageRequest(details); err != nil {
+		return err
+	}
+
+	if details.BlueGreen == nil || details.BlueGreen.Service == "" {
+		return logs.Error("bluegreen service is required")
+	}
+
+	return nil
+}
+
+func (b *BlueGreenRequest) ProcessRequest(details RequestDetails) error {
+	if err := validateBlueGreenRequest(details); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	b.RequestDetails = details
+	b.Image = details.Image.Reference()
+
+	grace, err := parseDuration(details.BlueGreen.Grace, defaultGrace)
+	if err != nil {
+		return logs.Errorf("failed to parse grace: %v", err)
+	}
+	timeout, err := parseDuration(details.BlueGreen.Timeout, defaultTimeout)
+	if err != nil {
+		return logs.Errorf("failed to parse timeout: %v", err)
+	}
+
+	namespace := details.Kube.Namespace
+	svc, err := b.ClientSet.CoreV1().Services(namespace).Get(b.Context, details.BlueGreen.Service, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get service: %v", err)
+	}
+	original := copySelector(svc.Spec.Selector)
+
+	active, err := b.active(svc)
+	if err != nil {
+		return logs.Errorf("failed to find active deployment: %v", err)
+	}
+	b.Previous = active.Name
+	b.Colour = colourBlue
+	if svc.Spec.Selector[trackLabel] == colourBlue {
+		b.Colour = colourGreen
+	}
+
+	// the service has to stop selecting on the shared labels alone before the
+	// new colour comes up, or it would get traffic as soon as it's ready
+	previous, err := b.pin(svc, active)
+	if err != nil {
+		return logs.Errorf("failed to pin service: %v", err)
+	}
+
+	name := colourName(details.Kube.Name, b.Colour)
+	if err := b.deployColour(active, name); err != nil {
+		return b.abort(svc.Name, original, name, logs.Errorf("failed to deploy %s: %v", b.Colour, err))
+	}
+	b.progress(phaseDeploying, name)
+
+	if err := waitReady(b.Context, b.ClientSet, namespace, name, timeout); err != nil {
+		return b.abort(svc.Name, original, name, err)
+	}
+	b.progress(phaseReady, name)
+
+	switched := copySelector(previous)
+	delete(switched, appsv1.DefaultDeploymentUniqueLabelKey)
+	switched[trackLabel] = b.Colour
+	if err := b.setSelector(b.Context, svc.Name, switched); err != nil {
+		return b.abort(svc.Name, original, name, err)
+	}
+	b.progress(phaseSwitched, name)
+
+	if err := b.watch(name, grace); err != nil {
+		return b.revert(svc.Name, previous, name, err)
+	}
+
+	if err := scale(b.Context, b.ClientSet, &b.Conflicts, namespace, active.Name, 0); err != nil {
+		return logs.Errorf("failed to scale down %s: %v", active.Name, err)
+	}
+	b.Updated = true
+	b.progress(phaseScaledDown, active.Name)
+
+	return nil
+}
+
+// active is the deployment the service points at, before the first blue/green
+// deploy that's the original deployment rather than a colour
+func (b *BlueGreenRequest) active(svc *corev1.Service) (*appsv1.Deployment, error) {
+	name := b.RequestDetails.Kube.Name
+	if colour := svc.Spec.Selector[trackLabel]; colour != "" {
+		name = colourName(name, colour)
+	}
+
+	dep, err := b.ClientSet.AppsV1().Deployments(svc.Namespace).Get(b.Context, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to get deployment %s: %v", name, err)
+	}
+
+	return dep, nil
+}
+
+// pin narrows an uncoloured service down to the pods of the active replica
+// set, a coloured service already only selects one colour
+func (b *BlueGreenRequest) pin(svc *corev1.Service, active *appsv1.Deployment) (map[string]string, error) {
+	if svc.Spec.Selector[trackLabel] != "" {
+		return copySelector(svc.Spec.Selector), nil
+	}
+
+	hash, err := b.templateHash(active)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := copySelector(svc.Spec.Selector)
+	pinned[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+	if err := b.setSelector(b.Context, svc.Name, pinned); err != nil {
+		return nil, err
+	}
+
+	return pinned, nil
+}
+
+// templateHash is the pod-template-hash of the replica set running the
+// deployment's current revision
+func (b *BlueGreenRequest) templateHash(dep *appsv1.Deployment) (string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(dep.Spec.Selector)
+	if err != nil {
+		return "", logs.Errorf("failed to parse deployment selector: %v", err)
+	}
+
+	reps, err := b.ClientSet.AppsV1().ReplicaSets(dep.Namespace).List(b.Context, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to list replica sets: %v", err)
+	}
+
+	for _, rep := range reps.Items {
+		if !metav1.IsControlledBy(&rep, dep) {
+			continue
+		}
+		if rep.Annotations[revisionAnnotation] != dep.Annotations[revisionAnnotation] {
+			continue
+		}
+		if hash := rep.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "" {
+			return hash, nil
+		}
+	}
+
+	return "", logs.Errorf("no current replica set for %s", dep.Name)
+}
+
+// deployColour creates the colour, or reuses it when an earlier deploy left
+// it scaled down
+func (b *BlueGreenRequest) deployColour(active *appsv1.Deployment, name string) error {
+	deps := b.ClientSet.AppsV1().Deployments(active.Namespace)
+	want := parallelDeployment(active, name, b.Colour, b.Image, b.RequestID)
+
+	existing, err := deps.Get(b.Context, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err := deps.Create(b.Context, want, metav1.CreateOptions{}); err != nil {
+			return logs.Errorf("failed to create deployment: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return logs.Errorf("failed to get deployment: %v", err)
+	}
+
+	// the colour is the agent's own copy, so its spec is brought in line with
+	// the active one
+	return updateParallel(b.Context, &b.Conflicts, deps, existing, want, b.RequestID)
+}
+
+// watch keeps an eye on the new colour for the grace period, losing ready
+// replicas in that time switches traffic back
+func (b *BlueGreenRequest) watch(name string, grace time.Duration) error {
+	if grace <= 0 {
+		return nil
+	}
+
+	deps := b.ClientSet.AppsV1().Deployments(b.RequestDetails.Kube.Namespace)
+	err := wait.PollUntilContextTimeout(b.Context, pollInterval, grace, true, func(ctx context.Context) (bool, error) {
+		dep, err := deps.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		ready, err := rollout.DeploymentReady(dep)
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			return false, logs.Errorf("deployment %s lost ready replicas", name)
+		}
+
+		return false, nil
+	})
+	if wait.Interrupted(err) && b.Context.Err() == nil {
+		return nil
+	}
+
+	return err
+}
+
+// abort gives up before any traffic has moved
+func (b *BlueGreenRequest) abort(service string, selector map[string]string, name string, reason error) error {
+	ctx := context.WithoutCancel(b.Context)
+	b.Reason = rollout.Failure(b.Context, reason).Error()
+	b.progress(phaseAborted, name)
+
+	if err := b.setSelector(ctx, service, selector); err != nil {
+		return logs.Errorf("failed to restore service after abort: %v", err)
+	}
+	// the colour isn't there to scale down when creating it is what failed
+	_, err := b.ClientSet.AppsV1().Deployments(b.RequestDetails.Kube.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err := scale(ctx, b.ClientSet, &b.Conflicts, b.RequestDetails.Kube.Namespace, name, 0); err != nil {
+		return logs.Errorf("failed to scale down %s after abort: %v", name, err)
+	}
+
+	return nil
+}
+
+// revert switches traffic straight back to the previous colour, which is
+// still running, a cancel during the grace period reverts too
+func (b *BlueGreenRequest) revert(service string, selector map[string]string, name string, reason error) error {
+	ctx := context.WithoutCancel(b.Context)
+	b.Reason = rollout.Failure(b.Context, reason).Error()
+
+	if err := b.setSelector(ctx, service, selector); err != nil {
+		return logs.Errorf("failed to revert service: %v", err)
+	}
+	b.Reverted = true
+	b.progress(phaseReverted, b.Previous)
+
+	if err := scale(ctx, b.ClientSet, &b.Conflicts, b.RequestDetails.Kube.Namespace, name, 0); err != nil {
+		return logs.Errorf("failed to scale down %s after revert: %v", name, err)
+	}
+
+	return nil
+}
+
+// setSelector replaces the selector in a single json patch, so the service
+// never selects both colours or neither and nothing else on it is touched.
+// The selector is set outright, there's no earlier read to be guarded
+func (b *BlueGreenRequest) setSelector(ctx context.Context, service string, selector map[string]string) error {
+	patch, err := json.Marshal([]map[string]interface{}{{
+		"op":    "add",
+		"path":  "/spec/selector",
+		"value": selector,
+	}})
+	if err != nil {
+		return logs.Errorf("failed to marshal selector patch: %v", err)
+	}
+
+	svcs := b.ClientSet.CoreV1().Services(b.RequestDetails.Kube.Namespace)
+	if _, err := svcs.Patch(ctx, service, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		return logs.Errorf("failed to update service selector: %v", err)
+	}
+
+	return nil
+}
+
+func (b *BlueGreenRequest) progress(phase, deployment string) {
+	p := Progress{
+		RequestID: b.RequestID,
+		Type:      string(blueGreenRequestType),
+		Phase:     phase,
+		Message:   deployment,
+	}
+	if phase == phaseAborted || phase == phaseReverted {
+		p.Message = fmt.Sprintf("%s: %s", deployment, b.Reason)
+	}
+
+	b.Phases = append(b.Phases, p)
+	report(b.Reporter, p)
+}
+
+func (b *BlueGreenRequest) GetResponse() (string, error) {
+	type Resp struct {
+		Updated    bool       `json:"updated"`
+		Reverted   bool       `json:"reverted"`
+		Reason     string     `json:"reason,omitempty"`
+		Image      string     `json:"image"`
+		Colour     string     `json:"colour"`
+		Previous   string     `json:"previous"`
+		Phases     []Progress `json:"phases"`
+		Conflicts  int32      `json:"conflicts"`
+		UpdateTime time.Time  `json:"update_time"`
+		RequestID  string     `json:"request_id"`
+	}
+
+	resp, err := json.Marshal(Resp{
+		Updated:    b.Updated,
+		Reverted:   b.Reverted,
+		Reason:     b.Reason,
+		Image:      b.Image,
+		Colour:     b.Colour,
+		Previous:   b.Previous,
+		Phases:     b.Phases,
+		Conflicts:  b.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  b.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
+
+func colourName(name, colour string) string {
+	return fmt.Sprintf("%s-%s", name, colour)
+}
+
+func copySelector(selector map[string]string) map[string]string {
+	out := make(map[string]string, len(selector))
+	for k, v := range selector {
+		out[k] = v
+	}
+
+	return out
+}
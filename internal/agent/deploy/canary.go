@@ -0,0 +1,660 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/gateway"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	appsv1 "k8s.io/api/apps/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"strconv"
+	"time"
+)
+
+const (
+	trafficReplicas  = "replicas"
+	trafficNginx     = "nginx"
+	trafficHTTPRoute = "httproute"
+
+	trackCanary = "canary"
+
+	nginxCanary       = "nginx.ingress.kubernetes.io/canary"
+	nginxCanaryWeight = "nginx.ingress.kubernetes.io/canary-weight"
+)
+
+const (
+	phaseProgressing = "progressing"
+	phaseHealthy     = "healthy"
+	phasePromoted    = "promoted"
+	phaseAborted     = "aborted"
+)
+
+// CanaryDetails steps are the percentage of traffic the canary gets at each
+// step, traffic is shifted by replica ratio unless an ingress or route is named
+type CanaryDetails struct {
+	Steps     []int  `json:"steps"`
+	Pause     string `json:"pause"`
+	Timeout   string `json:"timeout"`
+	Traffic   string `json:"traffic"`
+	Service   string `json:"service"`
+	Ingress   string `json:"ingress"`
+	HTTPRoute string `json:"httproute"`
+}
+
+type CanaryRequest struct {
+	ClientSet kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Analysis  analysis.Provider
+	Context   context.Context
+	Reporter  Reporter
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	Image    string
+	Promoted bool
+	Aborted  bool
+	Reason   string
+	Steps    []Progress
+	Result   *analysis.Result
+
+	Conflicts conflict.Counter
+}
+
+func NewCanary(cs kubernetes.Interface, ctx context.Context) *CanaryRequest {
+	return &CanaryRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (c *CanaryRequest) SetRequestID(rid string) {
+	c.RequestID = rid
+}
+
+func validateCanaryRequest(details RequestDetails) error {
+	if err := validateImageRequest(details); err != nil {
+		return err
+	}
+
+	canary := details.Canary
+	if canary == nil || len(canary.Steps) == 0 {
+		return logs.Error("canary steps are required")
+	}
+	for _, w := range canary.Steps {
+		if w < 1 || w > 100 {
+			return logs.Errorf("canary step weight %d is outside 1-100", w)
+		}
+	}
+
+	switch canary.Traffic {
+	case "", trafficReplicas:
+	case trafficNginx:
+		if canary.Ingress == "" || canary.Service == "" {
+			return logs.Error("nginx canary needs an ingress and service")
+		}
+	case trafficHTTPRoute:
+		if canary.HTTPRoute == "" || canary.Service == "" {
+			return logs.Error("httproute canary needs a route and service")
+		}
+	default:
+		return logs.Errorf("unknown canary traffic: %s", canary.Traffic)
+	}
+
+	return nil
+}
+
+func (c *CanaryRequest) ProcessRequest(details RequestDetails) error {
+	if err := validateCanaryRequest(details); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	c.RequestDetails = details
+	c.Image = details.Image.Reference()
+
+	pauseFor, err := parseDuration(details.Canary.Pause, 0)
+	if err != nil {
+		return logs.Errorf("failed to parse pause: %v", err)
+	}
+	timeout, err := parseDuration(details.Canary.Timeout, defaultTimeout)
+	if err != nil {
+		return logs.Errorf("failed to parse timeout: %v", err)
+	}
+	gate, err := newAnalysis(c.Analysis, details.Analysis)
+	if err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	if gate != nil {
+		c.Result = &gate.Result
+	}
+
+	namespace := details.Kube.Namespace
+	deps := c.ClientSet.AppsV1().Deployments(namespace)
+	stable, err := deps.Get(c.Context, details.Kube.Name, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get deployment: %v", err)
+	}
+	total := replicas(stable)
+
+	canary := parallelDeployment(stable, canaryName(stable.Name), trackCanary, c.Image, c.RequestID)
+	canary.Spec.Replicas = canaryReplicas(total, details.Canary.Steps[0])
+	if err := c.deployCanary(canary); err != nil {
+		return logs.Errorf("failed to create canary deployment: %v", err)
+	}
+
+	traffic := c.traffic(stable, total)
+	for idx, weight := range details.Canary.Steps {
+		step := Progress{
+			RequestID: c.RequestID,
+			Type:      string(canaryRequestType),
+			Step:      idx + 1,
+			Steps:     len(details.Canary.Steps),
+			Weight:    weight,
+		}
+
+		if err := scale(c.Context, c.ClientSet, &c.Conflicts, namespace, canary.Name, *canaryReplicas(total, weight)); err != nil {
+			return c.abort(traffic, step, err)
+		}
+		if err := traffic.setWeight(weight); err != nil {
+			return c.abort(traffic, step, err)
+		}
+		step.Phase = phaseProgressing
+		c.progress(step)
+
+		if err := pause(c.Context, pauseFor); err != nil {
+			return c.abort(traffic, step, err)
+		}
+		if err := waitReady(c.Context, c.ClientSet, namespace, canary.Name, timeout); err != nil {
+			return c.abort(traffic, step, err)
+		}
+		if err := c.analyse(gate, timeout); err != nil {
+			return c.abort(traffic, step, err)
+		}
+		step.Phase = phaseHealthy
+		c.progress(step)
+	}
+
+	return c.promote(traffic, stable, total, timeout)
+}
+
+// deployCanary creates the canary, one a run that never got to clean up left
+// behind is taken over, anything else under the name is left alone
+func (c *CanaryRequest) deployCanary(want *appsv1.Deployment) error {
+	deps := c.ClientSet.AppsV1().Deployments(want.Namespace)
+	_, err := deps.Create(c.Context, want, metav1.CreateOptions{})
+	if err == nil || !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := deps.Get(c.Context, want.Name, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get deployment: %v", err)
+	}
+	if existing.Labels[trackLabel] != trackCanary {
+		return logs.Errorf("%s already exists and isn't a canary", want.Name)
+	}
+
+	return updateParallel(c.Context, &c.Conflicts, deps, existing, want, c.RequestID)
+}
+
+// analyse gates a step on the metrics, the canary is already ready so it's
+// only the analysis duration that's waited on
+func (c *CanaryRequest) analyse(gate *analysis.Analysis, timeout time.Duration) error {
+	if gate == nil {
+		return nil
+	}
+
+	return gate.Run(c.Context, func(context.Context) (bool, error) {
+		return true, nil
+	}, timeout)
+}
+
+// promote rolls the stable deployment onto the canary image before the
+// canary is removed, so traffic never drops to a single copy. A promotion
+// that doesn't roll out aborts like any other step, with stable put back the
+// way it was first
+func (c *CanaryRequest) promote(traffic canaryTraffic, stable *appsv1.Deployment, total int32, timeout time.Duration) error {
+	namespace := c.RequestDetails.Kube.Namespace
+	step := Progress{
+		RequestID: c.RequestID,
+		Type:      string(canaryRequestType),
+		Weight:    100,
+	}
+
+	_, err := patchDeployment(c.Context, c.ClientSet, &c.Conflicts, namespace, stable.Name, func(current *appsv1.Deployment) ([]byte, error) {
+		return overridePatch(current, c.Image, c.RequestID, &Overrides{Replicas: &total})
+	})
+	if err != nil {
+		return c.abort(traffic, step, logs.Errorf("failed to promote canary: %v", err))
+	}
+	if err := waitReady(c.Context, c.ClientSet, namespace, stable.Name, timeout); err != nil {
+		revertErr := c.revert(stable, total)
+		if err := c.abort(traffic, step, logs.Errorf("failed to promote canary: %v", err)); err != nil {
+			return err
+		}
+		return revertErr
+	}
+
+	if err := c.cleanup(traffic); err != nil {
+		return logs.Errorf("failed to remove canary: %v", err)
+	}
+
+	c.Promoted = true
+	step.Phase = phasePromoted
+	c.progress(step)
+
+	return nil
+}
+
+// revert undoes a promotion, worked out from stable as it was before the
+// canary started whatever it looks like now
+func (c *CanaryRequest) revert(stable *appsv1.Deployment, total int32) error {
+	ctx := context.WithoutCancel(c.Context)
+	_, err := patchDeployment(ctx, c.ClientSet, &c.Conflicts, stable.Namespace, stable.Name, func(*appsv1.Deployment) ([]byte, error) {
+		return revertPatch(stable, &Overrides{Replicas: &total})
+	})
+	if err != nil {
+		return logs.Errorf("failed to revert stable deployment: %v", err)
+	}
+
+	return nil
+}
+
+// abort puts the stable deployment back the way it was. A cancel always
+// aborts, a half shifted canary isn't a state to leave behind
+func (c *CanaryRequest) abort(traffic canaryTraffic, step Progress, reason error) error {
+	c.Aborted = true
+	c.Reason = rollout.Failure(c.Context, reason).Error()
+
+	step.Phase = phaseAborted
+	step.Message = c.Reason
+	c.progress(step)
+
+	if err := c.cleanup(traffic); err != nil {
+		return logs.Errorf("failed to remove canary after abort: %v", err)
+	}
+
+	return nil
+}
+
+func (c *CanaryRequest) cleanup(traffic canaryTraffic) error {
+	// the request context may be what ended the canary
+	ctx := context.WithoutCancel(c.Context)
+
+	if err := traffic.reset(ctx); err != nil {
+		return logs.Errorf("failed to reset traffic: %v", err)
+	}
+
+	name := canaryName(c.RequestDetails.Kube.Name)
+	err := c.ClientSet.AppsV1().Deployments(c.RequestDetails.Kube.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return logs.Errorf("failed to delete canary deployment: %v", err)
+	}
+
+	return nil
+}
+
+func (c *CanaryRequest) progress(p Progress) {
+	c.Steps = append(c.Steps, p)
+	report(c.Reporter, p)
+}
+
+func (c *CanaryRequest) GetResponse() (string, error) {
+	type Resp struct {
+		Updated    bool             `json:"updated"`
+		Promoted   bool             `json:"promoted"`
+		Aborted    bool             `json:"aborted"`
+		Reason     string           `json:"reason,omitempty"`
+		Image      string           `json:"image"`
+		Steps      []Progress       `json:"steps"`
+		Analysis   *analysis.Result `json:"analysis,omitempty"`
+		Conflicts  int32            `json:"conflicts"`
+		UpdateTime time.Time        `json:"update_time"`
+		RequestID  string           `json:"request_id"`
+	}
+
+	resp, err := json.Marshal(Resp{
+		Updated:    c.Promoted,
+		Promoted:   c.Promoted,
+		Aborted:    c.Aborted,
+		Reason:     c.Reason,
+		Image:      c.Image,
+		Steps:      c.Steps,
+		Analysis:   c.Result,
+		Conflicts:  c.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  c.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
+
+func canaryName(name string) string {
+	return fmt.Sprintf("%s-canary", name)
+}
+
+// canaryReplicas is the canary's share of the stable replica count, never
+// less than one so the canary always gets some traffic
+func canaryReplicas(total int32, weight int) *int32 {
+	count := (int(total)*weight + 99) / 100
+	if count < 1 {
+		count = 1
+	}
+	r := int32(count)
+
+	return &r
+}
+
+// canaryTraffic moves a percentage of requests onto the canary
+type canaryTraffic interface {
+	setWeight(weight int) error
+	reset(ctx context.Context) error
+}
+
+func (c *CanaryRequest) traffic(stable *appsv1.Deployment, total int32) canaryTraffic {
+	details := c.RequestDetails.Canary
+	base := canaryBase{
+		ClientSet: c.ClientSet,
+		Conflicts: &c.Conflicts,
+		Context:   c.Context,
+		Namespace: stable.Namespace,
+		Service:   details.Service,
+	}
+
+	switch details.Traffic {
+	case trafficNginx:
+		return &nginxTraffic{canaryBase: base, Ingress: details.Ingress}
+	case trafficHTTPRoute:
+		return &routeTraffic{canaryBase: base, Dynamic: c.Dynamic, Route: details.HTTPRoute}
+	}
+
+	return &replicaTraffic{canaryBase: base, Deployment: stable.Name, Total: total}
+}
+
+type canaryBase struct {
+	ClientSet kubernetes.Interface
+	Conflicts *conflict.Counter
+	Context   context.Context
+	Namespace string
+	Service   string
+}
+
+// ensureService gives the canary pods a service of their own for weighted
+// routing to point at
+func (b *canaryBase) ensureService() error {
+	svcs := b.ClientSet.CoreV1().Services(b.Namespace)
+	if _, err := svcs.Get(b.Context, canaryName(b.Service), metav1.GetOptions{}); err == nil {
+		return nil
+	}
+
+	stable, err := svcs.Get(b.Context, b.Service, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get service: %v", err)
+	}
+	if _, err := svcs.Create(b.Context, parallelService(stable, canaryName(b.Service), trackCanary), metav1.CreateOptions{}); err != nil {
+		return logs.Errorf("failed to create canary service: %v", err)
+	}
+
+	return nil
+}
+
+func (b *canaryBase) deleteService(ctx context.Context) error {
+	err := b.ClientSet.CoreV1().Services(b.Namespace).Delete(ctx, canaryName(b.Service), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return logs.Errorf("failed to delete canary service: %v", err)
+	}
+
+	return nil
+}
+
+// replicaTraffic relies on the service selecting both deployments, the split
+// is only as fine as the replica count allows
+type replicaTraffic struct {
+	canaryBase
+	Deployment string
+	Total      int32
+}
+
+func (r *replicaTraffic) setWeight(weight int) error {
+	stable := r.Total - *canaryReplicas(r.Total, weight)
+	if stable < 1 && weight < 100 {
+		stable = 1
+	}
+
+	return scale(r.Context, r.ClientSet, r.Conflicts, r.Namespace, r.Deployment, stable)
+}
+
+func (r *replicaTraffic) reset(ctx context.Context) error {
+	return scale(ctx, r.ClientSet, r.Conflicts, r.Namespace, r.Deployment, r.Total)
+}
+
+// nginxTraffic uses a copy of the stable ingress marked as the canary, nginx
+// sends the weighted share of requests to the canary service
+type nginxTraffic struct {
+	canaryBase
+	Ingress string
+}
+
+func (n *nginxTraffic) setWeight(weight int) error {
+	if err := n.ensureService(); err != nil {
+		return err
+	}
+
+	ings := n.ClientSet.NetworkingV1().Ingresses(n.Namespace)
+	if _, err := ings.Get(n.Context, canaryName(n.Ingress), metav1.GetOptions{}); err == nil {
+		// the weight is set outright, so there's no earlier read for another
+		// write to have invalidated
+		patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, nginxCanaryWeight, strconv.Itoa(weight)))
+		if _, err := ings.Patch(n.Context, canaryName(n.Ingress), types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return logs.Errorf("failed to update canary ingress: %v", err)
+		}
+		return nil
+	}
+
+	stable, err := ings.Get(n.Context, n.Ingress, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get ingress: %v", err)
+	}
+
+	annotations := map[string]string{}
+	for k, v := range stable.Annotations {
+		annotations[k] = v
+	}
+	annotations[nginxCanary] = "true"
+	annotations[nginxCanaryWeight] = strconv.Itoa(weight)
+
+	spec := stable.Spec.DeepCopy()
+	// the tls secret belongs to the stable ingress
+	spec.TLS = nil
+	n.backends(spec)
+
+	canary := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        canaryName(n.Ingress),
+			Namespace:   n.Namespace,
+			Labels:      withTrack(stable.Labels, trackCanary),
+			Annotations: annotations,
+		},
+		Spec: *spec,
+	}
+	if _, err := ings.Create(n.Context, canary, metav1.CreateOptions{}); err != nil {
+		return logs.Errorf("failed to create canary ingress: %v", err)
+	}
+
+	return nil
+}
+
+func (n *nginxTraffic) backends(spec *networkingv1.IngressSpec) {
+	swap := func(be *networkingv1.IngressBackend) {
+		if be != nil && be.Service != nil && be.Service.Name == n.Service {
+			be.Service.Name = canaryName(n.Service)
+		}
+	}
+
+	swap(spec.DefaultBackend)
+	for _, rule := range spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			swap(&rule.HTTP.Paths[i].Backend)
+		}
+	}
+}
+
+func (n *nginxTraffic) reset(ctx context.Context) error {
+	err := n.ClientSet.NetworkingV1().Ingresses(n.Namespace).Delete(ctx, canaryName(n.Ingress), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return logs.Errorf("failed to delete canary ingress: %v", err)
+	}
+
+	return n.deleteService(ctx)
+}
+
+// routeTraffic weights the backend refs on a gateway api route, the rules are
+// kept as they were before the first step so reset can put them back
+type routeTraffic struct {
+	canaryBase
+	Dynamic dynamic.Interface
+	Route   string
+
+	resource schema.GroupVersionResource
+	original []interface{}
+}
+
+// routes is the route client for whichever httproute version the cluster
+// serves, found on the first step
+func (r *routeTraffic) routes() (conflict.Client[*unstructured.Unstructured], error) {
+	if r.resource.Resource == "" {
+		gvr, ok := gateway.RouteResource(r.ClientSet.Discovery())
+		if !ok {
+			return nil, logs.Error("httproute api not available")
+		}
+		r.resource = gvr
+	}
+
+	return conflict.Dynamic(r.Dynamic.Resource(r.resource).Namespace(r.Namespace)), nil
+}
+
+func (r *routeTraffic) setWeight(weight int) error {
+	if r.Dynamic == nil {
+		return logs.Error("dynamic client not available")
+	}
+	if err := r.ensureService(); err != nil {
+		return err
+	}
+
+	// the rules are a list, so they're replaced whole, guarded by the version
+	// of the route they were worked out from
+	routes, err := r.routes()
+	if err != nil {
+		return err
+	}
+	route, err := routes.Get(r.Context, r.Route, metav1.GetOptions{})
+	if err != nil {
+		return logs.Errorf("failed to get httproute: %v", err)
+	}
+	_, err = conflict.Patch(r.Context, r.Conflicts, routes, route, types.JSONPatchType, func(route *unstructured.Unstructured) ([]byte, error) {
+		rules, _, err := unstructured.NestedSlice(route.Object, "spec", "rules")
+		if err != nil {
+			return nil, err
+		}
+		if r.original == nil {
+			r.original = runtime.DeepCopyJSONValue(rules).([]interface{})
+		}
+
+		for _, rule := range rules {
+			ruleMap, ok := rule.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			refs, _, _ := unstructured.NestedSlice(ruleMap, "backendRefs")
+			ruleMap["backendRefs"] = r.weighted(refs, weight)
+		}
+
+		return rulesPatch(rules)
+	})
+	if err != nil {
+		return logs.Errorf("failed to update httproute: %v", err)
+	}
+
+	return nil
+}
+
+func rulesPatch(rules []interface{}) ([]byte, error) {
+	return json.Marshal([]map[string]interface{}{{
+		"op":    "add",
+		"path":  "/spec/rules",
+		"value": rules,
+	}})
+}
+
+// weighted splits any ref to the stable service between it and the canary
+func (r *routeTraffic) weighted(refs []interface{}, weight int) []interface{} {
+	var out []interface{}
+	var canary map[string]interface{}
+
+	for _, ref := range refs {
+		refMap, ok := ref.(map[string]interface{})
+		if !ok {
+			out = append(out, ref)
+			continue
+		}
+
+		switch refMap["name"] {
+		case canaryName(r.Service):
+			continue
+		case r.Service:
+			refMap["weight"] = int64(100 - weight)
+			canary = map[string]interface{}{
+				"name":   canaryName(r.Service),
+				"weight": int64(weight),
+			}
+			if port, ok := refMap["port"]; ok {
+				canary["port"] = port
+			}
+		}
+		out = append(out, refMap)
+	}
+
+	if canary != nil {
+		out = append(out, canary)
+	}
+
+	return out
+}
+
+func (r *routeTraffic) reset(ctx context.Context) error {
+	if r.original != nil {
+		routes, err := r.routes()
+		if err != nil {
+			return err
+		}
+		route, err := routes.Get(ctx, r.Route, metav1.GetOptions{})
+		if err != nil {
+			return logs.Errorf("failed to get httproute: %v", err)
+		}
+		_, err = conflict.Patch(ctx, r.Conflicts, routes, route, types.JSONPatchType, func(*unstructured.Unstructured) ([]byte, error) {
+			return rulesPatch(r.original)
+		})
+		if err != nil {
+			return logs.Errorf("failed to reset httproute: %v", err)
+		}
+	}
+
+	return r.deleteService(ctx)
+}
@@ -0,0 +1,620 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configHashAnnotation changes whenever config a workload consumes changes,
+// which is what rolls its pods
+const configHashAnnotation = "k8sdeploy.dev/config-hash"
+
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+// ConfigDetails env is set on the named containers, or every container when
+// none are named, a null value removes the variable. Secret data is only
+// accepted sealed
+type ConfigDetails struct {
+	Containers []string           `json:"containers"`
+	Env        map[string]*string `json:"env"`
+	ConfigMaps []ConfigMapDetails `json:"configmaps"`
+	Secrets    []SecretDetails    `json:"secrets"`
+}
+
+type ConfigMapDetails struct {
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
+
+type SecretDetails struct {
+	Name string            `json:"name"`
+	Type corev1.SecretType `json:"type"`
+	Data map[string]string `json:"data"`
+}
+
+// ConfigObject is what the response says about a configmap or secret, never
+// its data
+type ConfigObject struct {
+	Name    string   `json:"name"`
+	Created bool     `json:"created"`
+	Keys    []string `json:"keys"`
+}
+
+type ConfigRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+	Keys      sealed.Opener
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	ConfigMaps []ConfigObject
+	Secrets    []ConfigObject
+	Env        []string
+	Restarted  []string
+	Updated    bool
+
+	Conflicts conflict.Counter
+}
+
+func NewConfig(cs kubernetes.Interface, ctx context.Context) *ConfigRequest {
+	return &ConfigRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (c *ConfigRequest) SetRequestID(rid string) {
+	c.RequestID = rid
+}
+
+func validateConfigRequest(details RequestDetails, keys sealed.Opener) error {
+	if details.Kube.Namespace == "" {
+		return logs.Error("namespace is required")
+	}
+
+	cfg := details.Config
+	if cfg == nil || (len(cfg.Env) == 0 && len(cfg.ConfigMaps) == 0 && len(cfg.Secrets) == 0) {
+		return logs.Error("config needs env, configmaps or secrets")
+	}
+	if len(cfg.Env) > 0 && details.Kube.Name == "" {
+		return logs.Error("name is required to set env")
+	}
+	for _, cm := range cfg.ConfigMaps {
+		if cm.Name == "" {
+			return logs.Error("configmap name is required")
+		}
+	}
+	for _, s := range cfg.Secrets {
+		if s.Name == "" {
+			return logs.Error("secret name is required")
+		}
+	}
+	if len(cfg.Secrets) > 0 && keys == nil {
+		return logs.Error("no sealing key configured, secrets can't be accepted")
+	}
+
+	return nil
+}
+
+func (c *ConfigRequest) ProcessRequest(details RequestDetails) error {
+	if err := validateConfigRequest(details, c.Keys); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	c.RequestDetails = details
+
+	// everything is opened before anything is written, a bad value shouldn't
+	// leave half the config applied
+	secrets, err := c.openSecrets()
+	if err != nil {
+		return err
+	}
+	if len(details.Config.Env) > 0 {
+		if _, err := c.ClientSet.AppsV1().Deployments(details.Kube.Namespace).Get(c.Context, details.Kube.Name, metav1.GetOptions{}); err != nil {
+			return logs.Errorf("failed to get deployment: %v", err)
+		}
+	}
+
+	written := map[string]string{}
+	for _, cm := range details.Config.ConfigMaps {
+		obj, err := c.applyConfigMap(cm)
+		if err != nil {
+			return err
+		}
+		c.ConfigMaps = append(c.ConfigMaps, obj)
+		written[configRef("configmap", cm.Name)] = hashData(cm.Data, nil)
+	}
+	for _, s := range secrets {
+		obj, err := c.applySecret(s)
+		if err != nil {
+			return err
+		}
+		c.Secrets = append(c.Secrets, obj)
+		written[configRef("secret", s.Name)] = hashData(nil, s.Data)
+	}
+
+	if err := c.rollConsumers(written); err != nil {
+		return err
+	}
+	c.Updated = true
+
+	return nil
+}
+
+func (c *ConfigRequest) openSecrets() ([]*corev1.Secret, error) {
+	var secrets []*corev1.Secret
+	for _, s := range c.RequestDetails.Config.Secrets {
+		data := make(map[string][]byte, len(s.Data))
+		for k, v := range s.Data {
+			plain, err := c.Keys.Open(v)
+			if err != nil {
+				return nil, logs.Errorf("failed to open secret %s key %s: %v", s.Name, k, err)
+			}
+			data[k] = plain
+		}
+
+		secretType := s.Type
+		if secretType == "" {
+			secretType = corev1.SecretTypeOpaque
+		}
+		secrets = append(secrets, &corev1.Secret{
+			ObjectMeta: c.meta(s.Name),
+			Type:       secretType,
+			Data:       data,
+		})
+	}
+
+	return secrets, nil
+}
+
+func (c *ConfigRequest) meta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: c.RequestDetails.Kube.Namespace,
+		Labels:    map[string]string{managedByLabel: "k8sdeploy"},
+	}
+}
+
+// applyConfigMap replaces the data, the payload is the whole configmap
+func (c *ConfigRequest) applyConfigMap(details ConfigMapDetails) (ConfigObject, error) {
+	cms := c.ClientSet.CoreV1().ConfigMaps(c.RequestDetails.Kube.Namespace)
+	obj := ConfigObject{Name: details.Name, Keys: sortedKeys(details.Data)}
+
+	existing, err := cms.Get(c.Context, details.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		cm := &corev1.ConfigMap{ObjectMeta: c.meta(details.Name), Data: details.Data}
+		if _, err := cms.Create(c.Context, cm, metav1.CreateOptions{}); err != nil {
+			return obj, logs.Errorf("failed to create configmap %s: %v", details.Name, err)
+		}
+		obj.Created = true
+		return obj, nil
+	}
+	if err != nil {
+		return obj, logs.Errorf("failed to get configmap %s: %v", details.Name, err)
+	}
+
+	_, err = conflict.Patch(c.Context, &c.Conflicts, cms, existing, types.MergePatchType, func(cm *corev1.ConfigMap) ([]byte, error) {
+		return json.Marshal(map[string]interface{}{
+			"data":       dataPatch(cm.Data, details.Data),
+			"binaryData": nil,
+		})
+	})
+	if err != nil {
+		return obj, logs.Errorf("failed to write configmap %s: %v", details.Name, err)
+	}
+
+	return obj, nil
+}
+
+func (c *ConfigRequest) applySecret(secret *corev1.Secret) (ConfigObject, error) {
+	secrets := c.ClientSet.CoreV1().Secrets(c.RequestDetails.Kube.Namespace)
+	keys := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	obj := ConfigObject{Name: secret.Name, Keys: keys}
+
+	existing, err := secrets.Get(c.Context, secret.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err := secrets.Create(c.Context, secret, metav1.CreateOptions{}); err != nil {
+			return obj, logs.Errorf("failed to create secret %s: %v", secret.Name, err)
+		}
+		obj.Created = true
+		return obj, nil
+	}
+	if err != nil {
+		return obj, logs.Errorf("failed to get secret %s: %v", secret.Name, err)
+	}
+
+	var typeErr error
+	_, err = conflict.Patch(c.Context, &c.Conflicts, secrets, existing, types.MergePatchType, func(current *corev1.Secret) ([]byte, error) {
+		if current.Type != secret.Type {
+			typeErr = logs.Errorf("secret %s is %s, can't change it to %s", secret.Name, current.Type, secret.Type)
+			return nil, nil
+		}
+		return json.Marshal(map[string]interface{}{
+			"data": dataPatch(current.Data, secret.Data),
+		})
+	})
+	if typeErr != nil {
+		return obj, typeErr
+	}
+	if err != nil {
+		return obj, logs.Errorf("failed to write secret %s: %v", secret.Name, err)
+	}
+
+	return obj, nil
+}
+
+// dataPatch is the merge patch that replaces current with data, keys that
+// aren't in data any more are removed with a null
+func dataPatch[V any](current, data map[string]V) map[string]interface{} {
+	patch := make(map[string]interface{}, len(current)+len(data))
+	for k := range current {
+		patch[k] = nil
+	}
+	for k, v := range data {
+		patch[k] = v
+	}
+
+	return patch
+}
+
+// rollConsumers sets the env on the named deployment and restamps the config
+// hash on every deployment, statefulset and daemonset using what was
+// written, an unchanged hash leaves the pods alone. Deployments are reported
+// restarted by name and the others by kind and name
+func (c *ConfigRequest) rollConsumers(written map[string]string) error {
+	namespace := c.RequestDetails.Kube.Namespace
+	apps := c.ClientSet.AppsV1()
+
+	deps, err := apps.Deployments(namespace).List(c.Context, metav1.ListOptions{})
+	if err != nil {
+		return logs.Errorf("failed to list deployments: %v", err)
+	}
+	for i := range deps.Items {
+		dep := &deps.Items[i]
+		env := dep.Name == c.RequestDetails.Kube.Name
+		if err := rollConsumer(c, apps.Deployments(namespace), dep, dep.Name, env, written, appsv1.Deployment{}, func(d *appsv1.Deployment) *corev1.PodTemplateSpec {
+			return &d.Spec.Template
+		}); err != nil {
+			return logs.Errorf("failed to patch deployment %s: %v", dep.Name, err)
+		}
+	}
+
+	sets, err := apps.StatefulSets(namespace).List(c.Context, metav1.ListOptions{})
+	if err != nil {
+		return logs.Errorf("failed to list statefulsets: %v", err)
+	}
+	for i := range sets.Items {
+		sts := &sets.Items[i]
+		if err := rollConsumer(c, apps.StatefulSets(namespace), sts, "statefulset/"+sts.Name, false, written, appsv1.StatefulSet{}, func(s *appsv1.StatefulSet) *corev1.PodTemplateSpec {
+			return &s.Spec.Template
+		}); err != nil {
+			return logs.Errorf("failed to patch statefulset %s: %v", sts.Name, err)
+		}
+	}
+
+	daemons, err := apps.DaemonSets(namespace).List(c.Context, metav1.ListOptions{})
+	if err != nil {
+		return logs.Errorf("failed to list daemonsets: %v", err)
+	}
+	for i := range daemons.Items {
+		ds := &daemons.Items[i]
+		if err := rollConsumer(c, apps.DaemonSets(namespace), ds, "daemonset/"+ds.Name, false, written, appsv1.DaemonSet{}, func(d *appsv1.DaemonSet) *corev1.PodTemplateSpec {
+			return &d.Spec.Template
+		}); err != nil {
+			return logs.Errorf("failed to patch daemonset %s: %v", ds.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// workloadObject is a deployment, statefulset or daemonset
+type workloadObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// rollConsumer patches obj with what consume changes on a copy of its pod
+// template, env merges on the variable name so only the variables in the
+// request are touched, the request id only goes on obj along with a template
+// change so a deployment's current replica set isn't relabelled
+func rollConsumer[T workloadObject](c *ConfigRequest, client conflict.Client[T], obj T, name string, env bool, written map[string]string, dataStruct interface{}, template func(T) *corev1.PodTemplateSpec) error {
+	changed := false
+	_, err := conflict.Patch(c.Context, &c.Conflicts, client, obj, types.StrategicMergePatchType, func(current T) ([]byte, error) {
+		modified := current.DeepCopyObject().(T)
+		var err error
+		if changed, err = c.consume(template(modified), env, written); err != nil || !changed {
+			return nil, err
+		}
+		modified.SetAnnotations(withRequestID(modified.GetAnnotations(), c.RequestID))
+		return conflict.Diff(current, modified, dataStruct)
+	})
+	if err != nil {
+		return err
+	}
+	if changed {
+		c.Restarted = append(c.Restarted, name)
+	}
+
+	return nil
+}
+
+// consume applies the env, config hash and request id to a pod template, it's
+// run again on a fresh copy when the patch conflicts
+func (c *ConfigRequest) consume(template *corev1.PodTemplateSpec, env bool, written map[string]string) (bool, error) {
+	changed := false
+
+	if env && len(c.RequestDetails.Config.Env) > 0 {
+		c.Env = c.setEnv(template)
+		changed = len(c.Env) > 0
+	}
+
+	refs := configRefs(&template.Spec)
+	consumes := false
+	for _, ref := range refs {
+		if _, ok := written[ref]; ok {
+			consumes = true
+		}
+	}
+	if consumes {
+		hash, err := c.configHash(refs, written)
+		if err != nil {
+			return false, err
+		}
+		if template.Annotations[configHashAnnotation] != hash {
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			template.Annotations[configHashAnnotation] = hash
+			changed = true
+		}
+	}
+	if changed {
+		template.Annotations = withRequestID(template.Annotations, c.RequestID)
+	}
+
+	return changed, nil
+}
+
+func (c *ConfigRequest) setEnv(template *corev1.PodTemplateSpec) []string {
+	only := map[string]bool{}
+	for _, name := range c.RequestDetails.Config.Containers {
+		only[name] = true
+	}
+
+	changed := map[string]bool{}
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if len(only) > 0 && !only[container.Name] {
+			continue
+		}
+
+		for name, value := range c.RequestDetails.Config.Env {
+			if setEnvVar(container, name, value) {
+				changed[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func setEnvVar(container *corev1.Container, name string, value *string) bool {
+	for i, env := range container.Env {
+		if env.Name != name {
+			continue
+		}
+		if value == nil {
+			container.Env = append(container.Env[:i], container.Env[i+1:]...)
+			return true
+		}
+		if env.Value == *value && env.ValueFrom == nil {
+			return false
+		}
+		container.Env[i] = corev1.EnvVar{Name: name, Value: *value}
+		return true
+	}
+
+	if value == nil {
+		return false
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: *value})
+	return true
+}
+
+// configHash covers every configmap and secret the pod uses, not just the
+// ones written, so sending the same config twice doesn't roll the pods
+func (c *ConfigRequest) configHash(refs []string, written map[string]string) (string, error) {
+	h := sha256.New()
+	for _, ref := range refs {
+		hash, ok := written[ref]
+		if !ok {
+			var err error
+			if hash, err = c.currentHash(ref); err != nil {
+				return "", err
+			}
+		}
+		h.Write([]byte(ref))
+		h.Write([]byte(hash))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+func (c *ConfigRequest) currentHash(ref string) (string, error) {
+	namespace := c.RequestDetails.Kube.Namespace
+	kind, name, _ := strings.Cut(ref, "/")
+
+	switch kind {
+	case "configmap":
+		cm, err := c.ClientSet.CoreV1().ConfigMaps(namespace).Get(c.Context, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", logs.Errorf("failed to get configmap %s: %v", name, err)
+		}
+		return hashData(cm.Data, cm.BinaryData), nil
+	default:
+		secret, err := c.ClientSet.CoreV1().Secrets(namespace).Get(c.Context, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", logs.Errorf("failed to get secret %s: %v", name, err)
+		}
+		return hashData(nil, secret.Data), nil
+	}
+}
+
+func (c *ConfigRequest) GetResponse() (string, error) {
+	type Resp struct {
+		Updated    bool           `json:"updated"`
+		ConfigMaps []ConfigObject `json:"configmaps,omitempty"`
+		Secrets    []ConfigObject `json:"secrets,omitempty"`
+		Env        []string       `json:"env,omitempty"`
+		Restarted  []string       `json:"restarted"`
+		Conflicts  int32          `json:"conflicts"`
+		UpdateTime time.Time      `json:"update_time"`
+		RequestID  string         `json:"request_id"`
+	}
+
+	resp, err := json.Marshal(Resp{
+		Updated:    c.Updated,
+		ConfigMaps: c.ConfigMaps,
+		Secrets:    c.Secrets,
+		Env:        c.Env,
+		Restarted:  c.Restarted,
+		Conflicts:  c.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  c.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
+
+// configRefs lists the configmaps and secrets a pod reads through env,
+// envFrom or volumes, sorted so the hash is stable
+func configRefs(spec *corev1.PodSpec) []string {
+	seen := map[string]bool{}
+	add := func(kind, name string) {
+		if name != "" {
+			seen[configRef(kind, name)] = true
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range containers {
+		for _, from := range container.EnvFrom {
+			if from.ConfigMapRef != nil {
+				add("configmap", from.ConfigMapRef.Name)
+			}
+			if from.SecretRef != nil {
+				add("secret", from.SecretRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+				add("configmap", ref.Name)
+			}
+			if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+				add("secret", ref.Name)
+			}
+		}
+	}
+	for _, vol := range spec.Volumes {
+		if vol.ConfigMap != nil {
+			add("configmap", vol.ConfigMap.Name)
+		}
+		if vol.Secret != nil {
+			add("secret", vol.Secret.SecretName)
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.ConfigMap != nil {
+					add("configmap", src.ConfigMap.Name)
+				}
+				if src.Secret != nil {
+					add("secret", src.Secret.Name)
+				}
+			}
+		}
+	}
+
+	refs := make([]string, 0, len(seen))
+	for ref := range seen {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	return refs
+}
+
+func configRef(kind, name string) string {
+	return kind + "/" + name
+}
+
+func hashData(data map[string]string, binary map[string][]byte) string {
+	h := sha256.New()
+	for _, k := range sortedKeys(data) {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(data[k]))
+		h.Write([]byte{0})
+	}
+
+	keys := make([]string, 0, len(binary))
+	for k := range binary {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(binary[k])
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -1,28 +1,120 @@
 package deploy
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	"github.com/k8sdeploy/agent/internal/agent/queue"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
 	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"net/http"
 )
 
 type TypeDeploy string
 
 const (
-	imageRequestType TypeDeploy = "image"
+	imageRequestType     TypeDeploy = "image"
+	canaryRequestType    TypeDeploy = "canary"
+	blueGreenRequestType TypeDeploy = "bluegreen"
+	configRequestType    TypeDeploy = "config"
 )
 
+// permissions is what each deploy type needs in the target namespace
+var permissions = map[TypeDeploy][]scope.Permission{
+	imageRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "deployments", Verb: "patch"},
+	},
+	canaryRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "deployments", Verb: "create"},
+		{Group: "apps", Resource: "deployments", Verb: "patch"},
+		{Group: "apps", Resource: "deployments", Verb: "delete"},
+	},
+	blueGreenRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "deployments", Verb: "create"},
+		{Group: "apps", Resource: "deployments", Verb: "patch"},
+		{Group: "apps", Resource: "replicasets", Verb: "list"},
+		{Group: "", Resource: "services", Verb: "get"},
+		{Group: "", Resource: "services", Verb: "patch"},
+	},
+	configRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "deployments", Verb: "list"},
+		{Group: "apps", Resource: "deployments", Verb: "patch"},
+		{Group: "apps", Resource: "statefulsets", Verb: "list"},
+		{Group: "apps", Resource: "statefulsets", Verb: "patch"},
+		{Group: "apps", Resource: "daemonsets", Verb: "list"},
+		{Group: "apps", Resource: "daemonsets", Verb: "patch"},
+		{Group: "", Resource: "configmaps", Verb: "get"},
+		{Group: "", Resource: "configmaps", Verb: "create"},
+		{Group: "", Resource: "configmaps", Verb: "patch"},
+		{Group: "", Resource: "secrets", Verb: "get"},
+		{Group: "", Resource: "secrets", Verb: "create"},
+		{Group: "", Resource: "secrets", Verb: "patch"},
+	},
+}
+
+// canaryPermissions is what each way of shifting canary traffic needs on top
+// of the canary deployment, replica traffic only scales the deployments
+var canaryPermissions = map[string][]scope.Permission{
+	trafficNginx: {
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "get"},
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "create"},
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "patch"},
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "delete"},
+		{Group: "", Resource: "services", Verb: "get"},
+		{Group: "", Resource: "services", Verb: "create"},
+		{Group: "", Resource: "services", Verb: "delete"},
+	},
+	trafficHTTPRoute: {
+		{Group: "gateway.networking.k8s.io", Resource: "httproutes", Verb: "get"},
+		{Group: "gateway.networking.k8s.io", Resource: "httproutes", Verb: "patch"},
+		{Group: "", Resource: "services", Verb: "get"},
+		{Group: "", Resource: "services", Verb: "create"},
+		{Group: "", Resource: "services", Verb: "delete"},
+	},
+}
+
+// Permissions is everything the deploy types check, for the agent to review
+// up front
+func Permissions() []scope.Permission {
+	var perms []scope.Permission
+	for _, p := range permissions {
+		perms = append(perms, p...)
+	}
+	for _, p := range canaryPermissions {
+		perms = append(perms, p...)
+	}
+
+	return perms
+}
+
+// Reporter publishes progress for deploy types that run over several steps,
+// the final response still goes out through SendResponse
+type Reporter func(response string) error
+
 type Deployment struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Analysis  analysis.Provider
+	Keys      sealed.Opener
 	Context   context.Context
+	Reporter  Reporter
 
-	Type      TypeDeploy
-	RequestID string
+	Type         TypeDeploy
+	RequestID    string
+	Namespaces   scope.Namespaces
+	Capabilities scope.Capabilities
 
 	Response string
 }
@@ -43,13 +135,28 @@ type Issuer struct {
 	Key     string `json:"key"`
 }
 
+// Reference is the image to deploy, a hash wins over a tag
+func (i Image) Reference() string {
+	if i.Hash != "" {
+		return fmt.Sprintf("%s:%s", i.ContainerURL, i.Hash)
+	}
+
+	return fmt.Sprintf("%s:%s", i.ContainerURL, i.Tag)
+}
+
 type RequestDetails struct {
 	Kube   Kube   `json:"k8s"`
 	Image  Image  `json:"image"`
 	Issuer Issuer `json:"issuer"`
+
+	Canary    *CanaryDetails    `json:"canary,omitempty"`
+	BlueGreen *BlueGreenDetails `json:"bluegreen,omitempty"`
+	Analysis  *analysis.Details `json:"analysis,omitempty"`
+	Config    *ConfigDetails    `json:"config,omitempty"`
+	Overrides *Overrides        `json:"overrides,omitempty"`
 }
 
-func NewDeployment(cs *kubernetes.Clientset, ctx context.Context) *Deployment {
+func NewDeployment(cs kubernetes.Interface, ctx context.Context) *Deployment {
 	return &Deployment{
 		ClientSet: cs,
 		Context:   ctx,
@@ -64,6 +171,35 @@ func (d *Deployment) SetRequestID(rid string) {
 	d.RequestID = rid
 }
 
+func (d *Deployment) SetNamespaces(ns scope.Namespaces) {
+	d.Namespaces = ns
+}
+
+func (d *Deployment) SetCapabilities(caps scope.Capabilities) {
+	d.Capabilities = caps
+}
+
+// SetDynamic is only needed for deploys that shift traffic on gateway api routes
+func (d *Deployment) SetDynamic(dyn dynamic.Interface) {
+	d.Dynamic = dyn
+}
+
+// SetAnalysis is the provider deploys gate on when the request asks for
+// analysis, nil when no metrics backend is configured
+func (d *Deployment) SetAnalysis(p analysis.Provider) {
+	d.Analysis = p
+}
+
+// SetKeys opens the secret values in config deploys, nil when the agent has
+// no sealing key and can't accept secrets
+func (d *Deployment) SetKeys(keys sealed.Opener) {
+	d.Keys = keys
+}
+
+func (d *Deployment) SetReporter(r Reporter) {
+	d.Reporter = r
+}
+
 type System interface {
 	SetRequestID(rid string)
 	ProcessRequest(details RequestDetails) error
@@ -84,12 +220,28 @@ func requestToDetails(deploymentRequest interface{}) (RequestDetails, error) {
 	return deployDetails, nil
 }
 
-func (d *Deployment) getSystem() (System, error) {
+func (d *Deployment) getSystem(ctx context.Context) (System, error) {
 	var sys System
 
 	switch d.Type {
 	case imageRequestType:
-		sys = NewImage(d.ClientSet, d.Context)
+		im := NewImage(d.ClientSet, ctx)
+		im.Analysis = d.Analysis
+		sys = im
+	case canaryRequestType:
+		c := NewCanary(d.ClientSet, ctx)
+		c.Dynamic = d.Dynamic
+		c.Analysis = d.Analysis
+		c.Reporter = d.Reporter
+		sys = c
+	case blueGreenRequestType:
+		b := NewBlueGreen(d.ClientSet, ctx)
+		b.Reporter = d.Reporter
+		sys = b
+	case configRequestType:
+		c := NewConfig(d.ClientSet, ctx)
+		c.Keys = d.Keys
+		sys = c
 	default:
 		return nil, logs.Errorf("unknown deployment_type: %s", d.Type)
 	}
@@ -98,13 +250,50 @@ func (d *Deployment) getSystem() (System, error) {
 	return sys, nil
 }
 
-func (d *Deployment) ParseRequest(deploymentRequest interface{}) error {
+func (d *Deployment) permitted(details RequestDetails) error {
+	namespace := details.Kube.Namespace
+	if err := d.Namespaces.Check(namespace); err != nil {
+		return err
+	}
+
+	perms := permissions[d.Type]
+	if d.Type == canaryRequestType && details.Canary != nil {
+		perms = append(append([]scope.Permission{}, perms...), canaryPermissions[details.Canary.Traffic]...)
+	}
+
+	return d.Capabilities.Check(scope.In(namespace, perms...)...)
+}
+
+func (d *Deployment) ParseRequest(deploymentRequest interface{}) (err error) {
+	ctx, span := telemetry.Start(d.Context, "deploy.ParseRequest", trace.WithAttributes(
+		attribute.String("deploy.type", string(d.Type)),
+		attribute.String("request_id", d.RequestID),
+	))
+	defer func() {
+		telemetry.End(span, err)
+	}()
+
 	deployDetails, err := requestToDetails(deploymentRequest)
 	if err != nil {
 		return logs.Errorf("failed to parse request: %v", err)
 	}
+	span.SetAttributes(
+		attribute.String("k8s.namespace", deployDetails.Kube.Namespace),
+		attribute.String("k8s.name", deployDetails.Kube.Name),
+	)
+
+	// canary and blue/green copy the deployment they start from, overriding
+	// it part way through would leave the copies out of step
+	if deployDetails.Overrides != nil && d.Type != imageRequestType {
+		return logs.Errorf("overrides are only supported for %s deploys", imageRequestType)
+	}
+
+	if err := d.permitted(deployDetails); err != nil {
+		d.Response = scope.DeniedResponse(d.RequestID, err)
+		return logs.Errorf("failed to check permissions: %v", err)
+	}
 
-	is, err := d.getSystem()
+	is, err := d.getSystem(ctx)
 	if err != nil {
 		return logs.Errorf("failed to get system: %v", err)
 	}
@@ -122,58 +311,23 @@ func (d *Deployment) ParseRequest(deploymentRequest interface{}) error {
 	return nil
 }
 
-func (d *Deployment) createPayload(cfg *config.Config) ([]byte, error) {
-	type Props struct {
-		RequestID string `json:"request_id"`
-	}
-
-	type Payload struct {
-		Props           Props  `json:"properties"`
-		PayloadEncoding string `json:"payload_encoding"`
-		RoutingKey      string `json:"routing_key"`
-		Payload         string `json:"payload"`
-	}
-
-	payload, err := json.Marshal(Payload{
-		Props: Props{
-			RequestID: d.RequestID,
-		},
-		PayloadEncoding: "string",
-		RoutingKey:      cfg.K8sDeploy.Queues.Response,
-		Payload:         d.Response,
-	})
-	if err != nil {
-		return nil, logs.Errorf("failed to marshal payload: %v", err)
-	}
+// SendResponse still goes out when the request was cancelled, the response is
+// how the orchestrator finds out what the cancel left behind
+func (d *Deployment) SendResponse(cfg *config.Config, client *httpclient.Client) (err error) {
+	ctx, span := telemetry.Start(context.WithoutCancel(d.Context), "deploy.SendResponse", trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() {
+		telemetry.End(span, err)
+	}()
 
-	return payload, nil
+	return queue.Publish(ctx, cfg, client, d.RequestID, d.Response)
 }
 
-func (d *Deployment) SendResponse(cfg *config.Config) error {
-	payload, err := d.createPayload(cfg)
-	if err != nil {
-		return logs.Errorf("failed to create payload: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/exchanges/%s/amq.default/publish", cfg.K8sDeploy.RabbitHost, cfg.K8sDeploy.Queues.Agent), bytes.NewBuffer(payload))
-	if err != nil {
-		return logs.Errorf("failed to create request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(cfg.K8sDeploy.Credentials.Queue.Key, cfg.K8sDeploy.Credentials.Queue.Secret)
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return logs.Errorf("failed to get events: %v", err)
-	}
+// Publish sends a response for the request before the deploy has finished
+func (d *Deployment) Publish(cfg *config.Config, client *httpclient.Client, response string) (err error) {
+	ctx, span := telemetry.Start(context.WithoutCancel(d.Context), "deploy.Publish", trace.WithSpanKind(trace.SpanKindProducer))
 	defer func() {
-		if err := res.Body.Close(); err != nil {
-			_ = logs.Errorf("failed to close queue body: %v", err)
-		}
+		telemetry.End(span, err)
 	}()
-	if res.StatusCode != http.StatusOK {
-		return logs.Errorf("failed get events: %s", res.Status)
-	}
 
-	return nil
+	return queue.Publish(ctx, cfg, client, d.RequestID, response)
 }
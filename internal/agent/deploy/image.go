@@ -3,24 +3,36 @@ package deploy
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/operation"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"time"
 )
 
 type ImageRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
+	Analysis  analysis.Provider
 	Context   context.Context
 
 	RequestDetails RequestDetails
 	RequestID      string
 
 	UpdateStatus bool
+	RolledBack   bool
+	Cancelled    bool
+	Reason       string
+	Result       *analysis.Result
+
+	Conflicts conflict.Counter
 }
 
-func NewImage(cs *kubernetes.Clientset, ctx context.Context) *ImageRequest {
+func NewImage(cs kubernetes.Interface, ctx context.Context) *ImageRequest {
 	return &ImageRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -48,7 +60,7 @@ func validateImageRequest(details RequestDetails) error {
 		return logs.Error("hash or tag is required")
 	}
 
-	return nil
+	return validateOverrides(details.Overrides)
 }
 
 func (i *ImageRequest) ProcessRequest(details RequestDetails) error {
@@ -58,38 +70,94 @@ func (i *ImageRequest) ProcessRequest(details RequestDetails) error {
 
 	i.RequestDetails = details
 
+	gate, err := newAnalysis(i.Analysis, details.Analysis)
+	if err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+
 	deps := i.ClientSet.AppsV1().Deployments(details.Kube.Namespace)
 	deployment, err := deps.Get(i.Context, details.Kube.Name, metav1.GetOptions{})
 	if err != nil {
 		return logs.Errorf("failed to get deployment: %v", err)
 	}
 
-	if details.Image.Tag != "" {
-		deployment.Spec.Template.Spec.Containers[0].Image = fmt.Sprintf("%s:%s", details.Image.ContainerURL, details.Image.Tag)
-	}
-	if details.Image.Hash != "" {
-		deployment.Spec.Template.Spec.Containers[0].Image = fmt.Sprintf("%s:%s", details.Image.ContainerURL, details.Image.Hash)
+	if err := selectorSafe(deployment, details.Overrides); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
 	}
 
-	_, err = deps.Update(i.Context, deployment, metav1.UpdateOptions{})
+	_, err = conflict.Patch(i.Context, &i.Conflicts, deps, deployment, types.StrategicMergePatchType, func(dep *appsv1.Deployment) ([]byte, error) {
+		return overridePatch(dep, details.Image.Reference(), i.RequestID, details.Overrides)
+	})
 	if err != nil {
-		return logs.Errorf("failed to update deployment: %v", err)
+		return logs.Errorf("failed to patch deployment: %v", err)
 	}
 
 	i.UpdateStatus = true
+	if gate == nil {
+		return nil
+	}
+
+	err = gate.Run(i.Context, deploymentCheck(i.ClientSet, details.Kube.Namespace, details.Kube.Name), defaultTimeout)
+	i.Result = &gate.Result
+	if err == nil {
+		return nil
+	}
+
+	reason := rollout.Failure(i.Context, err)
+	if _, ok := operation.CancelledBy(i.Context); ok {
+		i.Cancelled = true
+		if !operation.RollbackRequested(i.Context) {
+			i.Reason = reason.Error()
+			return nil
+		}
+	}
+
+	return i.rollback(deployment, reason)
+}
+
+// rollback puts the previous image and any overridden fields back after the
+// analysis failed, the failed gate is reported in the response rather than
+// as an agent error
+func (i *ImageRequest) rollback(before *appsv1.Deployment, reason error) error {
+	ctx := context.WithoutCancel(i.Context)
+	i.Reason = reason.Error()
+
+	// the revert is worked out from before the deploy, whatever the
+	// deployment looks like now
+	_, err := patchDeployment(ctx, i.ClientSet, &i.Conflicts, i.RequestDetails.Kube.Namespace, i.RequestDetails.Kube.Name, func(*appsv1.Deployment) ([]byte, error) {
+		return revertPatch(before, i.RequestDetails.Overrides)
+	})
+	if err != nil {
+		return logs.Errorf("failed to roll back deployment: %v", err)
+	}
+
+	i.UpdateStatus = false
+	i.RolledBack = true
 
 	return nil
 }
 
 func (i *ImageRequest) GetResponse() (string, error) {
 	type Resp struct {
-		Updated    bool      `json:"updated"`
-		UpdateTime time.Time `json:"update_time"`
-		RequestID  string    `json:"request_id"`
+		Updated    bool             `json:"updated"`
+		Overrides  *Overrides       `json:"overrides,omitempty"`
+		RolledBack bool             `json:"rolled_back,omitempty"`
+		Cancelled  bool             `json:"cancelled,omitempty"`
+		Reason     string           `json:"reason,omitempty"`
+		Analysis   *analysis.Result `json:"analysis,omitempty"`
+		Conflicts  int32            `json:"conflicts"`
+		UpdateTime time.Time        `json:"update_time"`
+		RequestID  string           `json:"request_id"`
 	}
 
 	resp, err := json.Marshal(Resp{
 		Updated:    i.UpdateStatus,
+		Overrides:  i.RequestDetails.Overrides,
+		RolledBack: i.RolledBack,
+		Cancelled:  i.Cancelled,
+		Reason:     i.Reason,
+		Analysis:   i.Result,
+		Conflicts:  i.Conflicts.Count(),
 		UpdateTime: time.Now(),
 		RequestID:  i.RequestID,
 	})
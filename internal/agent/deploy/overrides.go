@@ -0,0 +1,311 @@
+package deploy
+
+import (
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Resources are cpu and memory quantities, anything not named keeps its
+// current value
+type Resources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+// Overrides tune a deployment along with its release, labels and annotations
+// go on the deployment and its pod template, tolerations replace the current
+// list
+type Overrides struct {
+	Replicas     *int32              `json:"replicas,omitempty"`
+	Resources    *Resources          `json:"resources,omitempty"`
+	Labels       map[string]string   `json:"labels,omitempty"`
+	Annotations  map[string]string   `json:"annotations,omitempty"`
+	NodeSelector map[string]string   `json:"node_selector,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+func validateResources(kind string, quantities map[string]string) error {
+	for name, value := range quantities {
+		if name != string(corev1.ResourceCPU) && name != string(corev1.ResourceMemory) {
+			return logs.Errorf("%s %s isn't cpu or memory", kind, name)
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return logs.Errorf("%s %s %q isn't a quantity", kind, name, value)
+		}
+	}
+
+	return nil
+}
+
+func validateOverrides(o *Overrides) error {
+	if o == nil {
+		return nil
+	}
+
+	if o.Replicas != nil && *o.Replicas < 0 {
+		return logs.Errorf("replicas %d can't be negative", *o.Replicas)
+	}
+	if o.Resources != nil {
+		if err := validateResources("requests", o.Resources.Requests); err != nil {
+			return err
+		}
+		if err := validateResources("limits", o.Resources.Limits); err != nil {
+			return err
+		}
+	}
+	for name, value := range o.Labels {
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return logs.Errorf("invalid label %s: %s", name, errs[0])
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return logs.Errorf("invalid label %s value: %s", name, errs[0])
+		}
+	}
+	for name := range o.Annotations {
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return logs.Errorf("invalid annotation %s: %s", name, errs[0])
+		}
+	}
+
+	return nil
+}
+
+// selectorSafe stops a label override from moving the pods out from under
+// the deployment's own selector
+func selectorSafe(dep *appsv1.Deployment, o *Overrides) error {
+	if o == nil || dep.Spec.Selector == nil {
+		return nil
+	}
+
+	for name, value := range o.Labels {
+		if current, ok := dep.Spec.Selector.MatchLabels[name]; ok && current != value {
+			return logs.Errorf("label %s is in the deployment selector and can't change", name)
+		}
+	}
+
+	return nil
+}
+
+// overridePatch is the strategic merge patch for an image deploy, only the
+// fields the request names are in it so other controllers keep theirs, the
+// request id goes on the deployment rather than the pod template, and only
+// when the template changes, see templateChanged
+func overridePatch(dep *appsv1.Deployment, image, requestID string, o *Overrides) ([]byte, error) {
+	container := map[string]interface{}{
+		"name":  dep.Spec.Template.Spec.Containers[0].Name,
+		"image": image,
+	}
+	podSpec := map[string]interface{}{
+		"containers": []interface{}{container},
+	}
+	template := map[string]interface{}{
+		"spec": podSpec,
+	}
+	spec := map[string]interface{}{
+		"template": template,
+	}
+	patch := map[string]interface{}{
+		"spec": spec,
+	}
+	var labels, annotations map[string]string
+
+	if o != nil {
+		if o.Replicas != nil {
+			spec["replicas"] = *o.Replicas
+		}
+		if o.Resources != nil {
+			container["resources"] = resourcesPatch(patchValues(o.Resources.Requests), patchValues(o.Resources.Limits))
+		}
+		labels = o.Labels
+		annotations = o.Annotations
+		if len(o.NodeSelector) > 0 {
+			podSpec["nodeSelector"] = o.NodeSelector
+		}
+		if o.Tolerations != nil {
+			podSpec["tolerations"] = o.Tolerations
+		}
+		if meta := metadataPatch(patchValues(o.Labels), patchValues(o.Annotations)); meta != nil {
+			template["metadata"] = meta
+		}
+	}
+	if meta := metadataPatch(patchValues(labels), patchValues(annotations)); meta != nil {
+		patch["metadata"] = meta
+	}
+
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return nil, logs.Errorf("failed to marshal patch: %v", err)
+	}
+	changed, err := templateChanged(dep, b)
+	if err != nil || !changed {
+		return b, err
+	}
+
+	patch["metadata"] = metadataPatch(patchValues(labels), patchValues(withRequestID(annotations, requestID)))
+	if b, err = json.Marshal(patch); err != nil {
+		return nil, logs.Errorf("failed to marshal patch: %v", err)
+	}
+
+	return b, nil
+}
+
+// templateChanged is whether patch changes the pod template of dep. The
+// controller copies the deployment's annotations onto the current replica set
+// on every sync, so a request id stamped by a deploy that leaves the template
+// alone would relabel the revision an earlier request made
+func templateChanged(dep *appsv1.Deployment, patch []byte) (bool, error) {
+	original, err := json.Marshal(dep)
+	if err != nil {
+		return false, logs.Errorf("failed to marshal deployment: %v", err)
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, appsv1.Deployment{})
+	if err != nil {
+		return false, logs.Errorf("failed to apply patch: %v", err)
+	}
+
+	var after appsv1.Deployment
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return false, logs.Errorf("failed to unmarshal patched deployment: %v", err)
+	}
+
+	return !equality.Semantic.DeepEqual(dep.Spec.Template, after.Spec.Template), nil
+}
+
+// revertPatch puts back the image, the request id and whatever the overrides
+// touched as they were before, keys that didn't exist are removed again
+func revertPatch(before *appsv1.Deployment, o *Overrides) ([]byte, error) {
+	previous := before.Spec.Template.Spec.Containers[0]
+	container := map[string]interface{}{
+		"name":  previous.Name,
+		"image": previous.Image,
+	}
+	podSpec := map[string]interface{}{
+		"containers": []interface{}{container},
+	}
+	template := map[string]interface{}{
+		"spec": podSpec,
+	}
+	spec := map[string]interface{}{
+		"template": template,
+	}
+	patch := map[string]interface{}{
+		"spec": spec,
+	}
+	templateMeta := before.Spec.Template.ObjectMeta
+	patch["metadata"] = metadataPatch(nil, previousValues(before.Annotations, withRequestID(nil, "")))
+
+	if o != nil {
+		if o.Replicas != nil {
+			spec["replicas"] = before.Spec.Replicas
+		}
+		if o.Resources != nil {
+			container["resources"] = resourcesPatch(
+				previousQuantities(previous.Resources.Requests, o.Resources.Requests),
+				previousQuantities(previous.Resources.Limits, o.Resources.Limits),
+			)
+		}
+		patch["metadata"] = metadataPatch(
+			previousValues(before.Labels, o.Labels),
+			previousValues(before.Annotations, withRequestID(o.Annotations, "")),
+		)
+		if meta := metadataPatch(previousValues(templateMeta.Labels, o.Labels), previousValues(templateMeta.Annotations, o.Annotations)); meta != nil {
+			template["metadata"] = meta
+		}
+		if len(o.NodeSelector) > 0 {
+			podSpec["nodeSelector"] = previousValues(before.Spec.Template.Spec.NodeSelector, o.NodeSelector)
+		}
+		if o.Tolerations != nil {
+			podSpec["tolerations"] = before.Spec.Template.Spec.Tolerations
+		}
+	}
+
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return nil, logs.Errorf("failed to marshal patch: %v", err)
+	}
+
+	return b, nil
+}
+
+func metadataPatch(labels, annotations map[string]interface{}) map[string]interface{} {
+	meta := map[string]interface{}{}
+	if len(labels) > 0 {
+		meta["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		meta["annotations"] = annotations
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+
+	return meta
+}
+
+// resourcesPatch leaves out an empty side, a null there would clear all of
+// the container's requests or limits
+func resourcesPatch(requests, limits map[string]interface{}) map[string]interface{} {
+	resources := map[string]interface{}{}
+	if len(requests) > 0 {
+		resources["requests"] = requests
+	}
+	if len(limits) > 0 {
+		resources["limits"] = limits
+	}
+
+	return resources
+}
+
+// withRequestID copies annotations with the request id added
+func withRequestID(annotations map[string]string, requestID string) map[string]string {
+	out := make(map[string]string, len(annotations)+1)
+	for k, v := range annotations {
+		out[k] = v
+	}
+	out[requestIDAnnotation] = requestID
+
+	return out
+}
+
+func patchValues(m map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+
+	return values
+}
+
+// previousValues is what the keys in changed were before, nil deletes a key
+// that was only added by the override
+func previousValues(before, changed map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(changed))
+	for name := range changed {
+		if value, ok := before[name]; ok {
+			values[name] = value
+			continue
+		}
+		values[name] = nil
+	}
+
+	return values
+}
+
+func previousQuantities(before corev1.ResourceList, changed map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(changed))
+	for name := range changed {
+		if value, ok := before[corev1.ResourceName(name)]; ok {
+			values[name] = value.String()
+			continue
+		}
+		values[name] = nil
+	}
+
+	return values
+}
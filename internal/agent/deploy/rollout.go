@@ -0,0 +1,249 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+// trackLabel keeps the pods of a parallel deployment apart from the ones it
+// was copied from, the labels the service selects on are left alone
+const trackLabel = "k8sdeploy.dev/track"
+
+// requestIDAnnotation records the request that made a revision. A deploy that
+// changes a deployment's pod template sets it on the deployment, the
+// controller copies it onto the new replica set without it restarting the
+// pods. Config deploys put it on the template too, statefulset and daemonset
+// controller revisions only keep the template
+const requestIDAnnotation = "k8sdeploy.dev/request-id"
+
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+const (
+	pollInterval   = 2 * time.Second
+	defaultTimeout = 5 * time.Minute
+)
+
+// Progress is published for every phase of a deploy that runs over several
+// steps
+type Progress struct {
+	RequestID string `json:"request_id"`
+	Type      string `json:"deployment_type"`
+	Phase     string `json:"phase"`
+	Step      int    `json:"step,omitempty"`
+	Steps     int    `json:"steps,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+func report(r Reporter, p Progress) {
+	if r == nil {
+		return
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		_ = logs.Errorf("failed to marshal progress: %v", err)
+		return
+	}
+	if err := r(string(b)); err != nil {
+		_ = logs.Errorf("failed to report progress: %v", err)
+	}
+}
+
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, logs.Errorf("failed to parse duration %q: %v", value, err)
+	}
+
+	return d, nil
+}
+
+func pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func replicas(dep *appsv1.Deployment) int32 {
+	if dep.Spec.Replicas == nil {
+		return 1
+	}
+
+	return *dep.Spec.Replicas
+}
+
+func waitReady(ctx context.Context, cs kubernetes.Interface, namespace, name string, timeout time.Duration) error {
+	err := wait.PollUntilContextTimeout(ctx, pollInterval, timeout, true, deploymentCheck(cs, namespace, name))
+	if err != nil {
+		return logs.Errorf("deployment %s not ready: %v", name, err)
+	}
+
+	return nil
+}
+
+// newAnalysis is nil when the request didn't ask for analysis, asking for it
+// without a provider configured is an error rather than an ungated rollout
+func newAnalysis(provider analysis.Provider, details *analysis.Details) (*analysis.Analysis, error) {
+	if details == nil {
+		return nil, nil
+	}
+
+	a, err := analysis.New(provider, *details)
+	if err != nil {
+		return nil, logs.Errorf("failed to set up analysis: %v", err)
+	}
+
+	return a, nil
+}
+
+// deploymentCheck is the ready check analysis runs alongside
+func deploymentCheck(cs kubernetes.Interface, namespace, name string) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		dep, err := cs.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		return rollout.DeploymentReady(dep)
+	}
+}
+
+// scale only patches the replicas, so a scale never undoes another write to
+// the deployment
+func scale(ctx context.Context, cs kubernetes.Interface, conflicts *conflict.Counter, namespace, name string, count int32) error {
+	_, err := patchDeployment(ctx, cs, conflicts, namespace, name, func(dep *appsv1.Deployment) ([]byte, error) {
+		if replicas(dep) == count {
+			return nil, nil
+		}
+		return conflict.ReplicasPatch(count), nil
+	})
+	if err != nil {
+		return logs.Errorf("failed to scale deployment: %v", err)
+	}
+
+	return nil
+}
+
+// patchDeployment reads the deployment and sends the strategic merge patch
+// build works out from it, guarded so a write in between is retried rather
+// than overwritten
+func patchDeployment(ctx context.Context, cs kubernetes.Interface, conflicts *conflict.Counter, namespace, name string, build func(*appsv1.Deployment) ([]byte, error)) (*appsv1.Deployment, error) {
+	deps := cs.AppsV1().Deployments(namespace)
+	dep, err := deps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to get deployment: %v", err)
+	}
+
+	return conflict.Patch(ctx, conflicts, deps, dep, types.StrategicMergePatchType, build)
+}
+
+// parallelDeployment copies dep under a new name with its own track label.
+// The copy's pods keep every label of the original's as well as the track, so
+// the service selects them and so does the original's selector, the two
+// selectors overlap. That's safe as a deployment only counts the pods of the
+// replica sets it owns, but anything listing pods by the original's selector
+// sees the copy's pods too
+func parallelDeployment(dep *appsv1.Deployment, name, track, image, requestID string) *appsv1.Deployment {
+	spec := dep.Spec.DeepCopy()
+	spec.Selector = dep.Spec.Selector.DeepCopy()
+	if spec.Selector == nil {
+		spec.Selector = &metav1.LabelSelector{}
+	}
+	spec.Selector.MatchLabels = withTrack(spec.Selector.MatchLabels, track)
+	spec.Template.Labels = withTrack(spec.Template.Labels, track)
+	if len(spec.Template.Spec.Containers) > 0 {
+		spec.Template.Spec.Containers[0].Image = image
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   dep.Namespace,
+			Labels:      withTrack(dep.Labels, track),
+			Annotations: withRequestID(nil, requestID),
+		},
+		Spec: *spec,
+	}
+}
+
+// updateParallel brings a parallel deployment an earlier deploy left behind
+// in line with want, the selector can't change on an existing deployment
+func updateParallel(ctx context.Context, counter *conflict.Counter, deps conflict.Client[*appsv1.Deployment], existing, want *appsv1.Deployment, requestID string) error {
+	_, err := conflict.Patch(ctx, counter, deps, existing, types.StrategicMergePatchType, func(dep *appsv1.Deployment) ([]byte, error) {
+		modified := dep.DeepCopy()
+		modified.Labels = want.Labels
+		modified.Spec = *want.Spec.DeepCopy()
+		modified.Spec.Selector = dep.Spec.Selector
+		if !equality.Semantic.DeepEqual(dep.Spec.Template, modified.Spec.Template) {
+			modified.Annotations = withRequestID(dep.Annotations, requestID)
+		}
+		return conflict.Diff(dep, modified, appsv1.Deployment{})
+	})
+	if err != nil {
+		return logs.Errorf("failed to update deployment: %v", err)
+	}
+
+	return nil
+}
+
+// parallelService copies svc under a new name that only selects the track
+func parallelService(svc *corev1.Service, name, track string) *corev1.Service {
+	spec := svc.Spec.DeepCopy()
+	spec.Selector = withTrack(spec.Selector, track)
+	spec.ClusterIP = ""
+	spec.ClusterIPs = nil
+	for i := range spec.Ports {
+		spec.Ports[i].NodePort = 0
+	}
+	if spec.Type == corev1.ServiceTypeNodePort || spec.Type == corev1.ServiceTypeLoadBalancer {
+		spec.Type = corev1.ServiceTypeClusterIP
+		spec.ExternalTrafficPolicy = ""
+		spec.HealthCheckNodePort = 0
+		spec.AllocateLoadBalancerNodePorts = nil
+		spec.LoadBalancerClass = nil
+		spec.LoadBalancerSourceRanges = nil
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: svc.Namespace,
+			Labels:    withTrack(svc.Labels, track),
+		},
+		Spec: *spec,
+	}
+}
+
+func withTrack(labels map[string]string, track string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[trackLabel] = track
+
+	return out
+}
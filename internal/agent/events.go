@@ -2,11 +2,18 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/k8sdeploy/agent/internal/agent/deploy"
 	"github.com/k8sdeploy/agent/internal/agent/info"
+	"github.com/k8sdeploy/agent/internal/agent/operation"
+	"github.com/k8sdeploy/agent/internal/agent/workload"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 )
 
@@ -16,20 +23,45 @@ const (
 	Deploy ActionType = "deploy"
 	Delete ActionType = "delete"
 
+	Scale   ActionType = "scale"
+	Restart ActionType = "restart"
+	Pause   ActionType = "pause"
+	Resume  ActionType = "resume"
+
+	Cancel     ActionType = "cancel"
+	Operations ActionType = "operations"
+
+	RotateKey ActionType = "rotate_key"
+	Reseal    ActionType = "reseal"
+
 	Information ActionType = "info"
 )
 
 type PayloadDetails struct {
 	Action        ActionType `json:"action"`
 	RequestID     string     `json:"request_id"`
+	Cluster       string     `json:"cluster"`
 	ActionDetails struct {
 		Type string `json:"type"`
 	} `json:"action_details"`
-	DeployDetails interface{} `json:"deploy_details"`
-	InfoDetails   interface{} `json:"info_details"`
+	DeployDetails   interface{}    `json:"deploy_details"`
+	InfoDetails     interface{}    `json:"info_details"`
+	WorkloadDetails interface{}    `json:"workload_details"`
+	ControlDetails  ControlDetails `json:"control_details"`
+	SealingDetails  SealingDetails `json:"sealing_details"`
+}
+
+type QueueMessage struct {
+	Payload string
+	Headers map[string]string
 }
 
-func (a *Agent) getMessage(queue string, requeue bool) (string, error) {
+func (a *Agent) getMessage(ctx context.Context, queue string, requeue bool) (qm QueueMessage, err error) {
+	ctx, span := telemetry.Start(ctx, "queue.get", trace.WithAttributes(attribute.String("queue", queue)))
+	defer func() {
+		telemetry.End(span, err)
+	}()
+
 	ackMode := "ack_requeue_false"
 	if requeue {
 		ackMode = "ack_requeue_true"
@@ -48,19 +80,24 @@ func (a *Agent) getMessage(queue string, requeue bool) (string, error) {
 		Truncate: 5000000,
 	})
 	if err != nil {
-		return "", logs.Errorf("failed to marshal %s payload: %v", queue, err)
+		return qm, logs.Errorf("failed to marshal %s payload: %v", queue, err)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/queues/%s/%s/get", a.Config.K8sDeploy.RabbitHost, queue, queue), bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/queues/%s/%s/get", a.Config.K8sDeploy.RabbitHost, queue, queue), bytes.NewBuffer(payload))
 	if err != nil {
-		return "", logs.Errorf("failed to create %s request: %v", queue, err)
+		return qm, logs.Errorf("failed to create %s request: %v", queue, err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(a.Config.K8sDeploy.Credentials.Queue.Key, a.Config.K8sDeploy.Credentials.Queue.Secret)
-	res, err := http.DefaultClient.Do(req)
+	req.SetBasicAuth(a.Config.K8sDeploy.QueueCredentials())
+	// a get that acks loses the message if it's sent again after the response
+	// was dropped, only a requeueing get can be repeated
+	if requeue {
+		req = httpclient.RetrySafe(req)
+	}
+	res, err := a.HTTPClient.Do(req)
 	if err != nil {
-		return "", logs.Errorf("failed to get %s events: %v", queue, err)
+		return qm, logs.Errorf("failed to get %s events: %v", queue, err)
 	}
 
 	defer func() {
@@ -69,81 +106,164 @@ func (a *Agent) getMessage(queue string, requeue bool) (string, error) {
 		}
 	}()
 	if res.StatusCode != http.StatusOK {
-		return "", logs.Errorf("failed get %s events: %s", queue, res.Status)
+		return qm, logs.Errorf("failed get %s events: %s", queue, res.Status)
 	}
 
 	type Message struct {
-		Exchange        string   `json:"exchange"`
-		MessageCount    int      `json:"message_count"`
-		Payload         string   `json:"payload"`
-		PayloadBytes    int      `json:"payload_bytes"`
-		PayloadEncoding string   `json:"payload_encoding"`
-		Properties      []string `json:"properties"`
-		Redelivered     bool     `json:"redelivered"`
-		RoutingKey      string   `json:"routing_key"`
+		Exchange        string          `json:"exchange"`
+		MessageCount    int             `json:"message_count"`
+		Payload         string          `json:"payload"`
+		PayloadBytes    int             `json:"payload_bytes"`
+		PayloadEncoding string          `json:"payload_encoding"`
+		Properties      json.RawMessage `json:"properties"`
+		Redelivered     bool            `json:"redelivered"`
+		RoutingKey      string          `json:"routing_key"`
 	}
 
 	var m []Message
 	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
-		return "", logs.Errorf("failed to decode %s events: %v", queue, err)
+		return qm, logs.Errorf("failed to decode %s events: %v", queue, err)
 	}
 
 	if len(m) == 0 {
-		return "", nil
+		return qm, nil
 	}
 
 	if m[0].PayloadBytes < 10 || m[0].Payload == "" {
-		return "", nil
+		return qm, nil
+	}
+
+	return QueueMessage{
+		Payload: m[0].Payload,
+		Headers: messageHeaders(m[0].Properties),
+	}, nil
+}
+
+// messageHeaders reads the string headers out of the message properties,
+// rabbit sends an empty list rather than an object when there are none
+func messageHeaders(properties json.RawMessage) map[string]string {
+	headers := map[string]string{}
+
+	var props struct {
+		Headers map[string]interface{} `json:"headers"`
+	}
+	if err := json.Unmarshal(properties, &props); err != nil {
+		return headers
 	}
 
-	return m[0].Payload, nil
+	for k, v := range props.Headers {
+		if sv, ok := v.(string); ok {
+			headers[k] = sv
+		}
+	}
+
+	return headers
 }
 
 func (a *Agent) listenForSelfUpdate(errChan chan error) {
-	updateMessage, err := a.getMessage(a.Config.K8sDeploy.Queues.Master, true)
+	updateMessage, err := a.getMessage(a.KubernetesClient.Context, a.Config.K8sDeploy.Queues.Master, true)
 	if err != nil {
 		errChan <- logs.Errorf("failed to get message: %v", err)
 		return
 	}
 
-	if updateMessage != "" {
-		fmt.Printf("updateMessage: %+v\n", updateMessage)
+	if updateMessage.Payload == "" {
+		return
+	}
+
+	if err := a.handleSelfUpdate(a.KubernetesClient.Context, updateMessage.Payload); err != nil {
+		errChan <- logs.Errorf("failed to self update: %v", err)
 	}
 }
 
 func (a *Agent) listenForEvents(errChan chan error) {
-	queueMessage, err := a.getMessage(a.Config.K8sDeploy.Queues.Agent, false)
+	queueMessage, err := a.getMessage(a.KubernetesClient.Context, a.Config.K8sDeploy.Queues.Agent, false)
 	if err != nil {
 		errChan <- logs.Errorf("failed to get message: %v", err)
 		return
 	}
+	a.Health.PollSucceeded()
 
-	if queueMessage == "" {
+	if queueMessage.Payload == "" {
 		errChan <- nil
 		return
 	}
 
+	ctx := telemetry.Extract(a.KubernetesClient.Context, queueMessage.Headers)
+	ctx, span := telemetry.Start(ctx, "agent.process", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
 	var payload PayloadDetails
-	if err := json.Unmarshal([]byte(queueMessage), &payload); err != nil {
+	if err := json.Unmarshal([]byte(queueMessage.Payload), &payload); err != nil {
+		span.RecordError(err)
 		errChan <- logs.Errorf("failed to unmarshal queueMessage: %v", err)
 		return
 	}
+	span.SetAttributes(
+		attribute.String("action", string(payload.Action)),
+		attribute.String("action.type", payload.ActionDetails.Type),
+		attribute.String("request_id", payload.RequestID),
+		attribute.String("cluster", payload.Cluster),
+	)
+
+	if handled, err := a.control(ctx, payload); handled {
+		errChan <- err
+		return
+	}
+
+	// everything past here is an operation the orchestrator can cancel
+	ctx, done := a.Operations.Start(ctx, operation.Operation{
+		RequestID: payload.RequestID,
+		Action:    string(payload.Action),
+		Type:      payload.ActionDetails.Type,
+		Cluster:   payload.Cluster,
+	})
+	defer done()
+
+	kc, err := a.Clusters.Get(payload.Cluster)
+	if err != nil {
+		span.RecordError(err)
+		errChan <- logs.Errorf("failed to get cluster: %v", err)
+		return
+	}
 
 	switch payload.Action {
 	case Deploy:
-		d := deploy.NewDeployment(a.KubernetesClient.ClientSet, a.KubernetesClient.Context)
+		d := deploy.NewDeployment(kc.ClientSet, ctx)
 		d.SetDeploymentType(deploy.TypeDeploy(payload.ActionDetails.Type))
 		d.SetRequestID(payload.RequestID)
+		d.SetNamespaces(kc.Namespaces)
+		d.SetCapabilities(kc.Capabilities)
+		d.SetDynamic(kc.Dynamic)
+		d.SetAnalysis(a.Analysis)
+		d.SetKeys(a.Keys)
+		d.SetReporter(func(response string) error {
+			return d.Publish(a.Config, a.HTTPClient, response)
+		})
 		errChan <- d.ParseRequest(payload.DeployDetails)
-		errChan <- d.SendResponse(a.Config)
+		errChan <- d.SendResponse(a.Config, a.HTTPClient)
 	case Information:
-		i := info.NewInfo(a.KubernetesClient.ClientSet, a.KubernetesClient.Context)
+		i := info.NewInfo(kc.ClientSet, ctx)
 		i.SetInfoType(info.TypeInfo(payload.ActionDetails.Type))
 		i.SetRequestID(payload.RequestID)
+		i.SetNamespaces(kc.Namespaces)
+		i.SetCapabilities(kc.Capabilities)
+		i.SetDynamic(kc.Dynamic)
+		i.SetMetadata(kc.Metadata)
 		errChan <- i.ParseRequest(payload.InfoDetails)
-		errChan <- i.SendResponse(a.Config)
+		errChan <- i.SendResponse(a.Config, a.HTTPClient)
+	case Scale, Restart, Pause, Resume:
+		w := workload.NewWorkload(kc.ClientSet, ctx)
+		w.SetAction(workload.Action(payload.Action))
+		w.SetKind(workload.Kind(payload.ActionDetails.Type))
+		w.SetRequestID(payload.RequestID)
+		w.SetNamespaces(kc.Namespaces)
+		w.SetCapabilities(kc.Capabilities)
+		errChan <- w.ParseRequest(payload.WorkloadDetails)
+		errChan <- w.SendResponse(a.Config, a.HTTPClient)
 	default:
-		logs.Info("unknown, %s", queueMessage)
+		// the payload can carry sealed values, so only say what it was
+		logs.Infof("unknown action %s for %s", payload.Action, payload.RequestID)
 		errChan <- logs.Errorf("unknown action: %s", payload.Action)
 	}
 }
@@ -0,0 +1,990 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testDeployment(name, namespace, image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: name, Image: image},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestListenForEventsDeployImage(t *testing.T) {
+	h := newHarness(t, testDeployment("api", "default", "registry.test/api:v1"))
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-1",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v2" {
+		t.Errorf("image = %s, want registry.test/api:v2", got)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	if responses[0].RoutingKey != responseQueue {
+		t.Errorf("routing key = %s, want %s", responses[0].RoutingKey, responseQueue)
+	}
+	if responses[0].Properties.RequestID != "req-1" {
+		t.Errorf("request id = %s, want req-1", responses[0].Properties.RequestID)
+	}
+
+	var resp struct {
+		Updated   bool   `json:"updated"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated {
+		t.Errorf("response not marked updated: %s", responses[0].Payload)
+	}
+}
+
+func TestListenForEventsInfoDeployments(t *testing.T) {
+	h := newHarness(t,
+		testDeployment("api", "default", "registry.test/api:v1"),
+		testDeployment("web", "default", "registry.test/web:v3"),
+		testDeployment("other", "other", "registry.test/other:v1"),
+	)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-2",
+		"action_details": map[string]string{
+			"type": "deployments",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		RequestID   string `json:"request_id"`
+		Deployments []struct {
+			Name      string `json:"name"`
+			Container string `json:"container"`
+		} `json:"deployments"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.RequestID != "req-2" {
+		t.Errorf("request id = %s, want req-2", resp.RequestID)
+	}
+
+	got := map[string]string{}
+	for _, d := range resp.Deployments {
+		got[d.Name] = d.Container
+	}
+	want := map[string]string{
+		"api": "registry.test/api:v1",
+		"web": "registry.test/web:v3",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("deployments = %v, want %v", got, want)
+	}
+	for name, image := range want {
+		if got[name] != image {
+			t.Errorf("deployment %s image = %s, want %s", name, got[name], image)
+		}
+	}
+}
+
+func TestListenForEventsUnknownAction(t *testing.T) {
+	h := newHarness(t)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "explode",
+		"request_id": "req-3",
+	})
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+	}
+	if n := len(h.Server.responses()); n != 0 {
+		t.Errorf("published %d responses, want 0", n)
+	}
+}
+
+func TestListenForEventsEmptyQueue(t *testing.T) {
+	h := newHarness(t)
+
+	if errs := h.process(t, nil); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if n := len(h.Server.responses()); n != 0 {
+		t.Errorf("published %d responses, want 0", n)
+	}
+}
+
+func TestListenForEventsRoutesToCluster(t *testing.T) {
+	h := newHarness(t, testDeployment("api", "default", "registry.test/api:v1"))
+	remote := h.addCluster("remote", testDeployment("api", "default", "registry.test/api:v1"))
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-4",
+		"cluster":    "remote",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for name, client := range map[string]*fake.Clientset{"local": h.Client, "remote": remote} {
+		dep, err := client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get %s deployment: %v", name, err)
+		}
+
+		want := "registry.test/api:v1"
+		if name == "remote" {
+			want = "registry.test/api:v2"
+		}
+		if got := dep.Spec.Template.Spec.Containers[0].Image; got != want {
+			t.Errorf("%s image = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestListenForEventsUnknownCluster(t *testing.T) {
+	h := newHarness(t)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-5",
+		"cluster":    "missing",
+		"action_details": map[string]string{
+			"type": "namespaces",
+		},
+	})
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+	}
+	if n := len(h.Server.responses()); n != 0 {
+		t.Errorf("published %d responses, want 0", n)
+	}
+}
+
+func TestListenForEventsNamespaceScoped(t *testing.T) {
+	h := newHarness(t, testDeployment("api", "other", "registry.test/api:v1"))
+	h.Agent.KubernetesClient.Namespaces = []string{"default"}
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-6",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "other",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+		},
+	})
+	if len(errs) == 0 {
+		t.Fatal("expected an error for a namespace outside the scope")
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("other").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want registry.test/api:v1", got)
+	}
+}
+
+func TestListenForEventsNotPermitted(t *testing.T) {
+	h := newHarness(t, testDeployment("api", "default", "registry.test/api:v1"))
+	h.Agent.KubernetesClient.Capabilities = scope.Capabilities{
+		{Permission: scope.Permission{Group: "apps", Resource: "deployments", Verb: "get"}, Allowed: true},
+		{Permission: scope.Permission{Group: "apps", Resource: "deployments", Verb: "patch"}, Allowed: false},
+	}
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-7",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+		},
+	})
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+	}
+	for _, a := range h.Client.Actions() {
+		if a.GetVerb() == "patch" {
+			t.Errorf("deployment patched without permission")
+		}
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		RequestID string `json:"request_id"`
+		Error     string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.RequestID != "req-7" || resp.Error != "not permitted: patch deployments.apps in default" {
+		t.Errorf("response = %+v, want not permitted for patch deployments", resp)
+	}
+}
+
+func TestListenForEventsCanaryTrafficNotPermitted(t *testing.T) {
+	h := newHarness(t, testDeployment("api", "default", "registry.test/api:v1"))
+	h.Agent.KubernetesClient.Capabilities = scope.Capabilities{
+		{Permission: scope.Permission{Group: "networking.k8s.io", Resource: "ingresses", Verb: "create"}, Allowed: false},
+	}
+
+	// replica traffic never touches an ingress
+	errs := h.process(t, canaryRequest("req-8", map[string]interface{}{
+		"steps":   []int{50},
+		"timeout": "10ms",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	errs = h.process(t, canaryRequest("req-9", map[string]interface{}{
+		"steps":   []int{50},
+		"traffic": "nginx",
+		"ingress": "api",
+		"service": "api",
+	}))
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+	}
+
+	responses := h.Server.responses()
+	var resp struct {
+		RequestID string `json:"request_id"`
+		Error     string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.RequestID != "req-9" || resp.Error != "not permitted: create ingresses.networking.k8s.io in default" {
+		t.Errorf("response = %+v, want not permitted for create ingresses", resp)
+	}
+}
+
+func TestListenForEventsInfoSecrets(t *testing.T) {
+	h := newHarness(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+	})
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-8",
+		"action_details": map[string]string{
+			"type": "secrets",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	payload := responses[0].Payload
+	if strings.Contains(payload, "hunter2") || strings.Contains(payload, "password") {
+		t.Fatalf("secret contents leaked into response: %s", payload)
+	}
+
+	var resp struct {
+		Secrets []map[string]interface{} `json:"secrets"`
+	}
+	if err := json.Unmarshal([]byte(payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Secrets) != 1 || len(resp.Secrets[0]) != 1 || resp.Secrets[0]["name"] != "db" {
+		t.Errorf("secrets = %+v, want just the name of db", resp.Secrets)
+	}
+	for _, action := range h.Client.Actions() {
+		if action.GetResource().Resource == "secrets" {
+			t.Errorf("secrets read through the clientset: %v", action)
+		}
+	}
+}
+
+func TestListenForEventsInfoCluster(t *testing.T) {
+	h := newHarness(t, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"node-role.kubernetes.io/control-plane": ""},
+		},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{
+				{Key: "node-role.kubernetes.io/control-plane", Effect: corev1.TaintEffectNoSchedule},
+			},
+		},
+		Status: corev1.NodeStatus{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("4"),
+			},
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+			},
+			NodeInfo: corev1.NodeSystemInfo{KubeletVersion: "v1.29.4"},
+		},
+	})
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-9",
+		"action_details": map[string]string{
+			"type": "cluster",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		Nodes []struct {
+			Name           string            `json:"name"`
+			Ready          bool              `json:"ready"`
+			Roles          []string          `json:"roles"`
+			KubeletVersion string            `json:"kubelet_version"`
+			Capacity       map[string]string `json:"capacity"`
+			Taints         []string          `json:"taints"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Nodes) != 1 {
+		t.Fatalf("nodes = %+v, want 1", resp.Nodes)
+	}
+
+	node := resp.Nodes[0]
+	if !node.Ready || node.KubeletVersion != "v1.29.4" || node.Capacity["cpu"] != "4" {
+		t.Errorf("node = %+v, want ready v1.29.4 with 4 cpu", node)
+	}
+	if len(node.Roles) != 1 || node.Roles[0] != "control-plane" {
+		t.Errorf("roles = %v, want [control-plane]", node.Roles)
+	}
+	if len(node.Taints) != 1 || node.Taints[0] != "node-role.kubernetes.io/control-plane:NoSchedule" {
+		t.Errorf("taints = %v, want the control-plane taint", node.Taints)
+	}
+}
+
+func TestListenForEventsInfoGraph(t *testing.T) {
+	owner := func(kind, name, uid string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, UID: types.UID(uid)}}
+	}
+	pathType := networkingv1.PathTypePrefix
+
+	h := newHarness(t,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "dep-uid"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "api-1", Namespace: "default", UID: "rs-uid", OwnerReferences: owner("Deployment", "api", "dep-uid")}},
+		// same owner name as the deployment but from an older object
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "api-old", Namespace: "default", UID: "old-uid", OwnerReferences: owner("Deployment", "api", "gone-uid")}},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-1-a", Namespace: "default", UID: "pod-uid", Labels: map[string]string{"app": "api"}, OwnerReferences: owner("ReplicaSet", "api-1", "rs-uid")},
+			Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{
+					{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "api-config"}}}},
+				},
+				Containers: []corev1.Container{{
+					Name:    "api",
+					EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "api-secret"}}}},
+				}},
+			},
+		},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "svc-uid"}, Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "api"}}},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "ing-uid"},
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{{
+					Host: "api.test",
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{{
+							Path:     "/",
+							PathType: &pathType,
+							Backend:  networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "api"}},
+						}},
+					}},
+				}},
+			},
+		},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "api-config", Namespace: "default", UID: "cm-uid"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "api-secret", Namespace: "default", UID: "secret-uid"}},
+	)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-10",
+		"action_details": map[string]string{
+			"type": "graph",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		Nodes []struct {
+			ID string `json:"id"`
+		} `json:"nodes"`
+		Edges []struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+			Type string `json:"type"`
+		} `json:"edges"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Nodes) != 8 {
+		t.Errorf("got %d nodes, want 8", len(resp.Nodes))
+	}
+
+	got := map[string]bool{}
+	for _, e := range resp.Edges {
+		got[e.From+" "+e.Type+" "+e.To] = true
+	}
+	want := []string{
+		"dep-uid owns rs-uid",
+		"rs-uid owns pod-uid",
+		"svc-uid selects pod-uid",
+		"ing-uid routes svc-uid",
+		"pod-uid mounts cm-uid",
+		"pod-uid references secret-uid",
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("missing edge %q", w)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("edges = %v, want %v", got, want)
+	}
+}
+
+func TestListenForEventsInfoServices(t *testing.T) {
+	ready, notReady := true, false
+	port := int32(8080)
+
+	h := newHarness(t,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Type:      corev1.ServiceTypeLoadBalancer,
+				ClusterIP: "10.0.0.10",
+				Ports: []corev1.ServicePort{
+					{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080)},
+				},
+			},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{Hostname: "lb.test"}},
+				},
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api-abc",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "api"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.1.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+				{Addresses: []string{"10.1.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			},
+			Ports: []discoveryv1.EndpointPort{{Port: &port}},
+		},
+	)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-11",
+		"action_details": map[string]string{
+			"type": "services",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		Services []struct {
+			InternalEndpoints []string `json:"internal_endpoints"`
+			ExternalEndpoints []string `json:"external_endpoints"`
+			ReadyEndpoints    []string `json:"ready_endpoints"`
+			NotReadyEndpoints []string `json:"not_ready_endpoints"`
+			Ports             []struct {
+				Port       int32  `json:"port"`
+				TargetPort string `json:"target_port"`
+			} `json:"ports"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Services) != 1 {
+		t.Fatalf("services = %+v, want 1", resp.Services)
+	}
+
+	svc := resp.Services[0]
+	if len(svc.InternalEndpoints) != 1 || svc.InternalEndpoints[0] != "api.default:80" {
+		t.Errorf("internal endpoints = %v, want [api.default:80]", svc.InternalEndpoints)
+	}
+	if len(svc.ExternalEndpoints) != 1 || svc.ExternalEndpoints[0] != "lb.test" {
+		t.Errorf("external endpoints = %v, want [lb.test]", svc.ExternalEndpoints)
+	}
+	if len(svc.ReadyEndpoints) != 1 || svc.ReadyEndpoints[0] != "10.1.0.1:8080" {
+		t.Errorf("ready endpoints = %v, want [10.1.0.1:8080]", svc.ReadyEndpoints)
+	}
+	if len(svc.NotReadyEndpoints) != 1 || svc.NotReadyEndpoints[0] != "10.1.0.2:8080" {
+		t.Errorf("not ready endpoints = %v, want [10.1.0.2:8080]", svc.NotReadyEndpoints)
+	}
+	if len(svc.Ports) != 1 || svc.Ports[0].Port != 80 || svc.Ports[0].TargetPort != "8080" {
+		t.Errorf("ports = %+v, want 80 -> 8080", svc.Ports)
+	}
+}
+
+func TestListenForEventsInfoIngresses(t *testing.T) {
+	class := "nginx"
+	pathType := networkingv1.PathTypePrefix
+
+	h := newHarness(t, &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: &class,
+			TLS: []networkingv1.IngressTLS{
+				{Hosts: []string{"api.test"}, SecretName: "api-tls"},
+			},
+			Rules: []networkingv1.IngressRule{{
+				Host: "api.test",
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path:     "/v1",
+						PathType: &pathType,
+						Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+							Name: "api",
+							Port: networkingv1.ServiceBackendPort{Name: "http"},
+						}},
+					}},
+				}},
+			}},
+		},
+	})
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-12",
+		"action_details": map[string]string{
+			"type": "ingresses",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		Ingresses []struct {
+			Class string `json:"class"`
+			Rules []struct {
+				Host  string `json:"host"`
+				Paths []struct {
+					Path     string `json:"path"`
+					PathType string `json:"path_type"`
+					Backend  struct {
+						Service string `json:"service"`
+						Port    string `json:"port"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"rules"`
+			TLS []struct {
+				Hosts      []string `json:"hosts"`
+				SecretName string   `json:"secret_name"`
+			} `json:"tls"`
+		} `json:"ingresses"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Ingresses) != 1 {
+		t.Fatalf("ingresses = %+v, want 1", resp.Ingresses)
+	}
+
+	ing := resp.Ingresses[0]
+	if ing.Class != "nginx" {
+		t.Errorf("class = %q, want nginx", ing.Class)
+	}
+	if len(ing.Rules) != 1 || len(ing.Rules[0].Paths) != 1 {
+		t.Fatalf("rules = %+v, want one rule with one path", ing.Rules)
+	}
+	path := ing.Rules[0].Paths[0]
+	if ing.Rules[0].Host != "api.test" || path.Path != "/v1" || path.PathType != "Prefix" {
+		t.Errorf("rule = %+v, want api.test /v1 Prefix", ing.Rules[0])
+	}
+	if path.Backend.Service != "api" || path.Backend.Port != "http" {
+		t.Errorf("backend = %+v, want api:http", path.Backend)
+	}
+	if len(ing.TLS) != 1 || ing.TLS[0].SecretName != "api-tls" {
+		t.Errorf("tls = %+v, want api-tls", ing.TLS)
+	}
+}
+
+func TestListenForEventsInfoHTTPRoutes(t *testing.T) {
+	h := newHarness(t)
+
+	gvr := schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]interface{}{"name": "api", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"hostnames":  []interface{}{"api.test"},
+			"parentRefs": []interface{}{map[string]interface{}{"name": "public"}},
+			"rules": []interface{}{map[string]interface{}{
+				"matches": []interface{}{map[string]interface{}{
+					"path": map[string]interface{}{"type": "PathPrefix", "value": "/v1"},
+				}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "api", "port": int64(80)}},
+			}},
+		},
+	}}
+
+	h.Client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: gvr.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: "httproutes", Kind: "HTTPRoute", Namespaced: true}},
+	}}
+	h.Agent.KubernetesClient.Dynamic = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "HTTPRouteList"},
+		route,
+	)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-13",
+		"action_details": map[string]string{
+			"type": "httproutes",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp struct {
+		HTTPRoutes []struct {
+			Name      string   `json:"name"`
+			Hostnames []string `json:"hostnames"`
+			Parents   []string `json:"parents"`
+			Rules     []struct {
+				Matches  []string `json:"matches"`
+				Backends []struct {
+					Name string `json:"name"`
+					Port int32  `json:"port"`
+				} `json:"backends"`
+			} `json:"rules"`
+		} `json:"httproutes"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.HTTPRoutes) != 1 {
+		t.Fatalf("httproutes = %+v, want 1", resp.HTTPRoutes)
+	}
+
+	hr := resp.HTTPRoutes[0]
+	if len(hr.Parents) != 1 || hr.Parents[0] != "Gateway/public" {
+		t.Errorf("parents = %v, want [Gateway/public]", hr.Parents)
+	}
+	if len(hr.Rules) != 1 || len(hr.Rules[0].Matches) != 1 || hr.Rules[0].Matches[0] != "PathPrefix /v1" {
+		t.Fatalf("rules = %+v, want one PathPrefix /v1 match", hr.Rules)
+	}
+	if be := hr.Rules[0].Backends; len(be) != 1 || be[0].Name != "api" || be[0].Port != 80 {
+		t.Errorf("backends = %+v, want api:80", be)
+	}
+}
+
+func TestListenForEventsInfoHTTPRoutesNotInstalled(t *testing.T) {
+	h := newHarness(t)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-14",
+		"action_details": map[string]string{
+			"type": "httproutes",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	if !strings.Contains(responses[0].Payload, `"httproutes":null`) {
+		t.Errorf("response = %s, want no httproutes", responses[0].Payload)
+	}
+}
+
+func TestListenForEventsInfoDeploymentPodStatus(t *testing.T) {
+	labels := map[string]string{"app": "api"}
+	owner := []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "api-1", UID: "rs-uid"}}
+
+	dep := testDeployment("api", "default", "registry.test/api:v1")
+	dep.UID = "dep-uid"
+	dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+
+	h := newHarness(t,
+		dep,
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "api-1",
+				Namespace:       "default",
+				UID:             "rs-uid",
+				Labels:          labels,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "api", UID: "dep-uid"}},
+			},
+			Spec: appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: labels}},
+		},
+		// scheduled but nothing reported by the kubelet yet
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-1-pending", Namespace: "default", Labels: labels, OwnerReferences: owner},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "api", Image: "registry.test/api:v1"}}},
+			Status:     corev1.PodStatus{Phase: corev1.PodPending},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-1-crashing", Namespace: "default", Labels: labels, OwnerReferences: owner},
+			Spec: corev1.PodSpec{
+				NodeName:   "node-1",
+				Containers: []corev1.Container{{Name: "api", Image: "registry.test/api:v1"}},
+			},
+			Status: corev1.PodStatus{
+				Phase:     corev1.PodRunning,
+				StartTime: &metav1.Time{},
+				QOSClass:  corev1.PodQOSBestEffort,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:         "api",
+					RestartCount: 4,
+					State: corev1.ContainerState{
+						Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+					},
+					LastTerminationState: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1},
+					},
+				}},
+			},
+		},
+	)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-15",
+		"action_details": map[string]string{
+			"type": "deployment",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+			"name":      "api",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	type state struct {
+		State    string `json:"state"`
+		Reason   string `json:"reason"`
+		ExitCode *int32 `json:"exit_code"`
+	}
+	var resp struct {
+		Pods []struct {
+			Name       string `json:"name"`
+			Status     string `json:"status"`
+			Phase      string `json:"phase"`
+			Restarts   int32  `json:"restarts"`
+			Node       string `json:"node"`
+			QOSClass   string `json:"qos_class"`
+			Containers []struct {
+				State     state  `json:"state"`
+				LastState *state `json:"last_state"`
+			} `json:"containers"`
+		} `json:"pods"`
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Pods) != 2 {
+		t.Fatalf("pods = %+v, want 2", resp.Pods)
+	}
+
+	for _, pod := range resp.Pods {
+		switch pod.Name {
+		case "api-1-pending":
+			if pod.Status != "Pending" || len(pod.Containers) != 0 {
+				t.Errorf("pending pod = %+v, want Pending with no containers", pod)
+			}
+		case "api-1-crashing":
+			if pod.Status != "CrashLoopBackOff" || pod.Phase != "Running" {
+				t.Errorf("crashing pod status = %s/%s, want CrashLoopBackOff/Running", pod.Status, pod.Phase)
+			}
+			if pod.Restarts != 4 || pod.Node != "node-1" || pod.QOSClass != "BestEffort" {
+				t.Errorf("crashing pod = %+v, want 4 restarts on node-1", pod)
+			}
+			if len(pod.Containers) != 1 {
+				t.Fatalf("containers = %+v, want 1", pod.Containers)
+			}
+			c := pod.Containers[0]
+			if c.State.State != "waiting" || c.LastState == nil || c.LastState.ExitCode == nil || *c.LastState.ExitCode != 1 {
+				t.Errorf("container = %+v, want waiting after exit code 1", c)
+			}
+		default:
+			t.Errorf("unexpected pod %s", pod.Name)
+		}
+	}
+}
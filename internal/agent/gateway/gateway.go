@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// gateway api versions in the order they're tried, v1beta1 is still what a
+// lot of clusters have installed
+var routeVersions = []schema.GroupVersionResource{
+	{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"},
+	{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "httproutes"},
+}
+
+// RouteResource is the httproute version the cluster serves, false when the
+// gateway api crds aren't installed
+func RouteResource(dc discovery.DiscoveryInterface) (schema.GroupVersionResource, bool) {
+	for _, gvr := range routeVersions {
+		resources, err := dc.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if err != nil {
+			continue
+		}
+
+		for _, r := range resources.APIResources {
+			if r.Name == gvr.Resource {
+				return gvr, true
+			}
+		}
+	}
+
+	return schema.GroupVersionResource{}, false
+}
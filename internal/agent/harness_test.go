@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+const (
+	agentQueue    = "agent-queue"
+	responseQueue = "response-queue"
+	masterQueue   = "master-queue"
+)
+
+type published struct {
+	RoutingKey string `json:"routing_key"`
+	Payload    string `json:"payload"`
+	Properties struct {
+		RequestID string            `json:"request_id"`
+		Headers   map[string]string `json:"headers"`
+	} `json:"properties"`
+}
+
+// queued is a message waiting on a stub queue, with the headers its
+// publisher set
+type queued struct {
+	payload string
+	headers map[string]string
+}
+
+// stubServer stands in for both the orchestrator api and the rabbit management api
+type stubServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	queues        map[string][]queued
+	published     []published
+	registrations []map[string]interface{}
+	heartbeats    []map[string]interface{}
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	t.Helper()
+
+	s := &stubServer{
+		queues: map[string][]queued{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /agent", s.register)
+	mux.HandleFunc("POST /agent/heartbeat", s.heartbeat)
+	mux.HandleFunc("POST /api/queues/{vhost}/{queue}/get", s.get)
+	mux.HandleFunc("POST /api/exchanges/{vhost}/amq.default/publish", s.publish)
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *stubServer) register(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+		s.mu.Lock()
+		s.registrations = append(s.registrations, body)
+		s.mu.Unlock()
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"credentials": map[string]string{
+			"key":    "queue-key",
+			"secret": "queue-secret",
+		},
+		"queues": []map[string]string{
+			{"name": "agent", "path": agentQueue},
+			{"name": "response", "path": responseQueue},
+			{"name": "master", "path": masterQueue},
+		},
+	})
+}
+
+func (s *stubServer) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.heartbeats = append(s.heartbeats, body)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *stubServer) get(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "queue-key" || pass != "queue-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := r.PathValue("queue")
+	if len(s.queues[queue]) == 0 {
+		writeJSON(w, []interface{}{})
+		return
+	}
+
+	msg := s.queues[queue][0]
+	s.queues[queue] = s.queues[queue][1:]
+	// rabbit sends an empty list rather than an object without properties
+	var properties interface{} = []interface{}{}
+	if len(msg.headers) > 0 {
+		properties = map[string]interface{}{"headers": msg.headers}
+	}
+	writeJSON(w, []map[string]interface{}{
+		{
+			"payload":          msg.payload,
+			"payload_bytes":    len(msg.payload),
+			"payload_encoding": "string",
+			"properties":       properties,
+		},
+	})
+}
+
+func (s *stubServer) publish(w http.ResponseWriter, r *http.Request) {
+	var p published
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.published = append(s.published, p)
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]bool{"routed": true})
+}
+
+func (s *stubServer) enqueue(t *testing.T, queue string, msg interface{}) {
+	t.Helper()
+
+	s.enqueueWithHeaders(t, queue, msg, nil)
+}
+
+func (s *stubServer) enqueueWithHeaders(t *testing.T, queue string, msg interface{}, headers map[string]string) {
+	t.Helper()
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[queue] = append(s.queues[queue], queued{payload: string(b), headers: headers})
+}
+
+func (s *stubServer) responses() []published {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]published{}, s.published...)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+type harness struct {
+	Agent  *Agent
+	Server *stubServer
+	Client *fake.Clientset
+}
+
+func newHarness(t *testing.T, objects ...runtime.Object) *harness {
+	t.Helper()
+
+	srv := newStubServer(t)
+
+	cfg := &config.Config{}
+	cfg.K8sDeploy.APIAddress = srv.URL
+	cfg.K8sDeploy.RabbitHost = srv.URL
+	cfg.K8sDeploy.Clusters.Default = "local"
+
+	client := fake.NewSimpleClientset(objects...)
+	a := NewAgent(cfg)
+	a.KubernetesClient = &KubernetesClient{
+		Context:   context.Background(),
+		ClientSet: client,
+		Metadata:  metadataClient(objects...),
+	}
+	a.Clusters.Add(a.Clusters.Default(), a.KubernetesClient)
+
+	if err := a.connectOrchestrator(); err != nil {
+		t.Fatalf("failed to connect to stub orchestrator: %v", err)
+	}
+
+	return &harness{
+		Agent:  a,
+		Server: srv,
+		Client: client,
+	}
+}
+
+func (h *harness) addCluster(name string, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	h.Agent.Clusters.Add(name, &KubernetesClient{
+		Context:   context.Background(),
+		ClientSet: client,
+		Metadata:  metadataClient(objects...),
+	})
+
+	return client
+}
+
+// metadataClient serves the secrets among objects, the only kind the agent
+// lists by metadata alone
+func metadataClient(objects ...runtime.Object) *metadatafake.FakeMetadataClient {
+	scheme := metadatafake.NewTestScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+
+	var partial []runtime.Object
+	for _, obj := range objects {
+		if secret, ok := obj.(*corev1.Secret); ok {
+			partial = append(partial, &metav1.PartialObjectMetadata{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: secret.ObjectMeta,
+			})
+		}
+	}
+
+	return metadatafake.NewSimpleMetadataClient(scheme, partial...)
+}
+
+// process feeds a single message through listenForEvents and returns every
+// error the loop reported
+func (h *harness) process(t *testing.T, msg interface{}) []error {
+	t.Helper()
+
+	if msg != nil {
+		h.Server.enqueue(t, agentQueue, msg)
+	}
+
+	errChan := make(chan error, 10)
+	h.Agent.listenForEvents(errChan)
+	close(errChan)
+
+	var errs []error
+	for err := range errChan {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/health"
+)
+
+// registerHealthChecks only covers the cluster registry, each cluster adds its
+// own api check once it is loaded
+func (a *Agent) registerHealthChecks() {
+	a.Health.AddCheck("clusters", health.Readiness, a.checkClusters)
+}
+
+func (a *Agent) checkClusters(_ context.Context) error {
+	if len(a.Clusters.Names()) == 0 {
+		return logs.Error("no kubernetes clusters loaded")
+	}
+
+	return nil
+}
+
+// checkAPI asks for the server version, a cheap call any client can make
+// whatever its rbac, and one the fake clientset answers too. The call doesn't
+// take a context, so the check stops waiting for it at the deadline
+func (kc *KubernetesClient) checkAPI(ctx context.Context) error {
+	if kc.ClientSet == nil {
+		return logs.Error("kubernetes client not created")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := kc.ClientSet.Discovery().ServerVersion()
+		done <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return logs.Errorf("kubernetes api unreachable: %v", ctx.Err())
+	case err := <-done:
+		if err != nil {
+			return logs.Errorf("kubernetes api unreachable: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/health"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func apiCheck(t *testing.T, h *harness) health.CheckResult {
+	t.Helper()
+
+	for _, c := range h.Agent.Health.Run(context.Background(), health.Readiness).Checks {
+		if c.Name == "kubernetes_api/local" {
+			return c
+		}
+	}
+	t.Fatal("no kubernetes api check for the local cluster")
+
+	return health.CheckResult{}
+}
+
+func TestStartClustersAPICheck(t *testing.T) {
+	h := newHarness(t)
+	h.Agent.startClusters()
+
+	if check := apiCheck(t, h); check.Status != health.StatusPass {
+		t.Errorf("api check = %+v, want passing against the fake clientset", check)
+	}
+
+	h.Client.PrependReactor("get", "version", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	if check := apiCheck(t, h); check.Status != health.StatusFail {
+		t.Errorf("api check = %+v, want failed once the api is unreachable", check)
+	}
+}
+
+func TestCheckAPIWithoutClient(t *testing.T) {
+	kc := &KubernetesClient{}
+	if err := kc.checkAPI(context.Background()); err == nil {
+		t.Error("api check passed without a client")
+	}
+}
@@ -0,0 +1,298 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type historyResponse struct {
+	Kind      string `json:"kind"`
+	Revisions []struct {
+		Revision int64  `json:"revision"`
+		Name     string `json:"name"`
+		Current  bool   `json:"current"`
+		Images   []struct {
+			Name  string `json:"name"`
+			Image string `json:"image"`
+		} `json:"images"`
+		ChangeCause   string `json:"change_cause"`
+		DeployRequest string `json:"deploy_request_id"`
+		Replicas      int32  `json:"replicas"`
+		ReadyReplicas int32  `json:"ready_replicas"`
+	} `json:"revisions"`
+}
+
+func historyRequest(requestID, kind string) map[string]interface{} {
+	return map[string]interface{}{
+		"action":     "info",
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": "history",
+		},
+		"info_details": map[string]string{
+			"name":      "api",
+			"namespace": "default",
+			"kind":      kind,
+		},
+	}
+}
+
+func (h *harness) historyResponse(t *testing.T) historyResponse {
+	t.Helper()
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp historyResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	return resp
+}
+
+func ownerRefs(uid types.UID) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{UID: uid, Name: "api"}}
+}
+
+func historyReplicaSet(name, revision, image, requestID string, owner types.UID, age time.Duration, replicas int32) *appsv1.ReplicaSet {
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            map[string]string{"app": "api"},
+			Annotations:       map[string]string{"deployment.kubernetes.io/revision": revision},
+			OwnerReferences:   ownerRefs(owner),
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "api", Image: image},
+						{Name: "proxy", Image: "registry.test/proxy:v1"},
+					},
+				},
+			},
+		},
+		Status: appsv1.ReplicaSetStatus{Replicas: replicas, ReadyReplicas: replicas},
+	}
+	if requestID != "" {
+		rs.Annotations["k8sdeploy.dev/request-id"] = requestID
+	}
+
+	return rs
+}
+
+func TestListenForEventsInfoHistory(t *testing.T) {
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v3", 2)
+	dep.UID = "dep-uid"
+	dep.Annotations = map[string]string{"deployment.kubernetes.io/revision": "3"}
+
+	changed := historyReplicaSet("api-2", "2", "registry.test/api:v2", "req-2", dep.UID, 2*time.Hour, 0)
+	changed.Annotations["kubernetes.io/change-cause"] = "kubectl set image"
+	// made before the request id moved off the pod template
+	delete(changed.Annotations, "k8sdeploy.dev/request-id")
+	changed.Spec.Template.Annotations = map[string]string{"k8sdeploy.dev/request-id": "req-2"}
+
+	h := newHarness(t,
+		dep,
+		historyReplicaSet("api-1", "1", "registry.test/api:v1", "", dep.UID, 3*time.Hour, 0),
+		changed,
+		historyReplicaSet("api-3", "3", "registry.test/api:v3", "req-3", dep.UID, time.Hour, 2),
+		// same labels, but from a deployment that was deleted and recreated
+		historyReplicaSet("api-old", "7", "registry.test/api:v0", "", "old-uid", 4*time.Hour, 0),
+	)
+
+	if errs := h.process(t, historyRequest("req-90", "")); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	resp := h.historyResponse(t)
+	if resp.Kind != "deployment" || len(resp.Revisions) != 3 {
+		t.Fatalf("history = %+v, want 3 deployment revisions", resp)
+	}
+	for i, want := range []int64{3, 2, 1} {
+		if resp.Revisions[i].Revision != want {
+			t.Errorf("revision %d = %d, want %d", i, resp.Revisions[i].Revision, want)
+		}
+	}
+
+	current := resp.Revisions[0]
+	if !current.Current || current.DeployRequest != "req-3" || current.Replicas != 2 || current.ReadyReplicas != 2 {
+		t.Errorf("current = %+v, want req-3 running 2 replicas", current)
+	}
+	if len(current.Images) != 2 || current.Images[0].Image != "registry.test/api:v3" || current.Images[1].Name != "proxy" {
+		t.Errorf("images = %+v, want api and proxy", current.Images)
+	}
+	if prev := resp.Revisions[1]; prev.Current || prev.ChangeCause != "kubectl set image" || prev.DeployRequest != "req-2" {
+		t.Errorf("previous = %+v, want the change cause and req-2", prev)
+	}
+	if first := resp.Revisions[2]; first.DeployRequest != "" || first.Replicas != 0 {
+		t.Errorf("first = %+v, want no request id and scaled down", first)
+	}
+}
+
+func TestListenForEventsInfoHistoryUnchangedTemplate(t *testing.T) {
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v3", 2)
+	dep.UID = "dep-uid"
+	dep.Annotations = map[string]string{
+		"deployment.kubernetes.io/revision": "3",
+		"k8sdeploy.dev/request-id":          "req-3",
+	}
+	h := newHarness(t, dep, historyReplicaSet("api-3", "3", "registry.test/api:v3", "req-3", dep.UID, time.Hour, 2))
+
+	// only scales, so the pods and their replica set stay as req-3 made them
+	errs := h.process(t, withOverrides(map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-92",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v3",
+			},
+		},
+	}, map[string]interface{}{"replicas": 4}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors deploying: %v", errs)
+	}
+
+	// what the controller does on its next sync
+	ctx := context.Background()
+	current, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if *current.Spec.Replicas != 4 {
+		t.Fatalf("replicas = %d, want 4", *current.Spec.Replicas)
+	}
+	rs, err := h.Client.AppsV1().ReplicaSets("default").Get(ctx, "api-3", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get replica set: %v", err)
+	}
+	for k, v := range current.Annotations {
+		rs.Annotations[k] = v
+	}
+	if _, err := h.Client.AppsV1().ReplicaSets("default").Update(ctx, rs, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update replica set: %v", err)
+	}
+
+	if errs := h.process(t, historyRequest("req-93", "")); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	var resp historyResponse
+	h.responseFor(t, "req-93", &resp)
+	if len(resp.Revisions) != 1 || resp.Revisions[0].DeployRequest != "req-3" {
+		t.Errorf("history = %+v, want the revision still made by req-3", resp)
+	}
+}
+
+func historyRevision(t *testing.T, name, hash, image string, revision int64, owner types.UID) *appsv1.ControllerRevision {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{"k8sdeploy.dev/request-id": name},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "api", Image: image}},
+				},
+			},
+			"$patch": "replace",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal revision: %v", err)
+	}
+
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			Labels:          map[string]string{"app": "api", appsv1.ControllerRevisionHashLabelKey: hash},
+			OwnerReferences: ownerRefs(owner),
+		},
+		Data:     runtime.RawExtension{Raw: data},
+		Revision: revision,
+	}
+}
+
+func historyPod(name, revision string, ready bool, owner types.UID) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			Labels:          map[string]string{"app": "api", appsv1.ControllerRevisionHashLabelKey: revision},
+			OwnerReferences: ownerRefs(owner),
+		},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestListenForEventsInfoHistoryStatefulSet(t *testing.T) {
+	replicas := int32(3)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "sts-uid"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+		},
+		Status: appsv1.StatefulSetStatus{CurrentRevision: "api-aaa", UpdateRevision: "api-bbb"},
+	}
+
+	h := newHarness(t,
+		sts,
+		historyRevision(t, "api-aaa", "aaa", "registry.test/api:v1", 1, sts.UID),
+		historyRevision(t, "api-bbb", "bbb", "registry.test/api:v2", 2, sts.UID),
+		// a rolling update part way through
+		historyPod("api-0", "api-bbb", false, sts.UID),
+		historyPod("api-1", "api-aaa", true, sts.UID),
+		historyPod("api-2", "api-aaa", true, sts.UID),
+	)
+
+	if errs := h.process(t, historyRequest("req-91", "statefulset")); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	resp := h.historyResponse(t)
+	if resp.Kind != "statefulset" || len(resp.Revisions) != 2 {
+		t.Fatalf("history = %+v, want 2 statefulset revisions", resp)
+	}
+
+	updating, previous := resp.Revisions[0], resp.Revisions[1]
+	if updating.Revision != 2 || !updating.Current || updating.Replicas != 1 || updating.ReadyReplicas != 0 {
+		t.Errorf("updating = %+v, want revision 2 with 1 pod not ready", updating)
+	}
+	if len(updating.Images) != 1 || updating.Images[0].Image != "registry.test/api:v2" || updating.DeployRequest != "api-bbb" {
+		t.Errorf("updating = %+v, want the v2 template read back", updating)
+	}
+	if previous.Revision != 1 || previous.Current || previous.Replicas != 2 || previous.ReadyReplicas != 2 {
+		t.Errorf("previous = %+v, want revision 1 with 2 ready pods", previous)
+	}
+}
@@ -3,13 +3,17 @@ package info
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"strconv"
 )
 
 type IngressRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	Response  *IngressResponse
@@ -23,12 +27,39 @@ type IngressResponse struct {
 }
 
 type IngressInfo struct {
-	Name      string   `json:"name"`
-	Hosts     []string `json:"hosts"`
-	Endpoints []string `json:"endpoints"`
+	Name           string          `json:"name"`
+	Class          string          `json:"class"`
+	Hosts          []string        `json:"hosts"`
+	Endpoints      []string        `json:"endpoints"`
+	Rules          []IngressRule   `json:"rules"`
+	DefaultBackend *IngressBackend `json:"default_backend,omitempty"`
+	TLS            []IngressTLS    `json:"tls"`
 }
 
-func NewIngress(cs *kubernetes.Clientset, ctx context.Context) *IngressRequest {
+type IngressRule struct {
+	Host  string        `json:"host"`
+	Paths []IngressPath `json:"paths"`
+}
+
+type IngressPath struct {
+	Path     string         `json:"path"`
+	PathType string         `json:"path_type"`
+	Backend  IngressBackend `json:"backend"`
+}
+
+// IngressBackend is either a service and port or a resource reference
+type IngressBackend struct {
+	Service  string `json:"service,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Resource string `json:"resource,omitempty"`
+}
+
+type IngressTLS struct {
+	Hosts      []string `json:"hosts"`
+	SecretName string   `json:"secret_name"`
+}
+
+func NewIngress(cs kubernetes.Interface, ctx context.Context) *IngressRequest {
 	return &IngressRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -65,27 +96,96 @@ func (i *IngressRequest) GetResponse() (string, error) {
 }
 
 func (i *IngressRequest) GetIngress(namespace string) ([]IngressInfo, error) {
-	ing, err := i.ClientSet.NetworkingV1().Ingresses(namespace).List(i.Context, metav1.ListOptions{})
+	var ingresses []IngressInfo
+	err := eachItem(i.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return i.ClientSet.NetworkingV1().Ingresses(namespace).List(i.Context, opts)
+	}, func(i *networkingv1.Ingress) {
+		ingresses = append(ingresses, ingressInfo(i))
+	})
 	if err != nil {
 		return nil, logs.Errorf("failed to get ingress: %v", err)
 	}
 
-	var ingresses []IngressInfo
-	for _, i := range ing.Items {
-		var hosts []string
-		var endpoints []string
-		for _, h := range i.Spec.Rules {
-			hosts = append(hosts, h.Host)
+	return ingresses, nil
+}
+
+func ingressInfo(ing *networkingv1.Ingress) IngressInfo {
+	info := IngressInfo{
+		Name:           ing.Name,
+		DefaultBackend: ingressBackend(ing.Spec.DefaultBackend),
+	}
+
+	// the annotation predates ingressClassName and is still set by a lot of
+	// charts
+	if ing.Spec.IngressClassName != nil {
+		info.Class = *ing.Spec.IngressClassName
+	} else {
+		info.Class = ing.Annotations["kubernetes.io/ingress.class"]
+	}
+
+	for _, rule := range ing.Spec.Rules {
+		info.Hosts = append(info.Hosts, rule.Host)
+
+		ir := IngressRule{
+			Host: rule.Host,
 		}
-		for _, e := range i.Status.LoadBalancer.Ingress {
-			endpoints = append(endpoints, e.IP)
+		if rule.HTTP != nil {
+			for _, path := range rule.HTTP.Paths {
+				ip := IngressPath{
+					Path: path.Path,
+				}
+				if path.PathType != nil {
+					ip.PathType = string(*path.PathType)
+				}
+				if be := ingressBackend(&path.Backend); be != nil {
+					ip.Backend = *be
+				}
+				ir.Paths = append(ir.Paths, ip)
+			}
 		}
-		ingresses = append(ingresses, IngressInfo{
-			Name:      i.Name,
-			Hosts:     hosts,
-			Endpoints: endpoints,
+		info.Rules = append(info.Rules, ir)
+	}
+
+	for _, tls := range ing.Spec.TLS {
+		info.TLS = append(info.TLS, IngressTLS{
+			Hosts:      tls.Hosts,
+			SecretName: tls.SecretName,
 		})
 	}
 
-	return ingresses, nil
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			info.Endpoints = append(info.Endpoints, lb.IP)
+		}
+		if lb.Hostname != "" {
+			info.Endpoints = append(info.Endpoints, lb.Hostname)
+		}
+	}
+
+	return info
+}
+
+func ingressBackend(be *networkingv1.IngressBackend) *IngressBackend {
+	if be == nil {
+		return nil
+	}
+
+	if be.Resource != nil {
+		return &IngressBackend{
+			Resource: fmt.Sprintf("%s/%s", be.Resource.Kind, be.Resource.Name),
+		}
+	}
+	if be.Service == nil {
+		return nil
+	}
+
+	port := be.Service.Port.Name
+	if port == "" {
+		port = strconv.Itoa(int(be.Service.Port.Number))
+	}
+
+	return &IngressBackend{
+		Service: be.Service.Name,
+		Port:    port,
+	}
 }
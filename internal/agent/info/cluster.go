@@ -0,0 +1,150 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+)
+
+const nodeRolePrefix = "node-role.kubernetes.io/"
+
+type ClusterRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *ClusterResponse
+}
+
+type NodeInfo struct {
+	Name             string            `json:"name"`
+	Ready            bool              `json:"ready"`
+	Unschedulable    bool              `json:"unschedulable"`
+	Roles            []string          `json:"roles"`
+	KubeletVersion   string            `json:"kubelet_version"`
+	OSImage          string            `json:"os_image"`
+	KernelVersion    string            `json:"kernel_version"`
+	ContainerRuntime string            `json:"container_runtime"`
+	Architecture     string            `json:"architecture"`
+	Capacity         map[string]string `json:"capacity"`
+	Allocatable      map[string]string `json:"allocatable"`
+	Taints           []string          `json:"taints"`
+}
+
+type ClusterInfo struct {
+	Version  string     `json:"version"`
+	Platform string     `json:"platform"`
+	Nodes    []NodeInfo `json:"nodes"`
+}
+
+type ClusterResponse struct {
+	RequestID string `json:"request_id"`
+	ClusterInfo
+}
+
+func NewCluster(cs kubernetes.Interface, ctx context.Context) *ClusterRequest {
+	return &ClusterRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (c *ClusterRequest) SetRequestID(rid string) {
+	c.RequestID = rid
+}
+
+func (c *ClusterRequest) ProcessRequest(_ *RequestDetails) error {
+	ci, err := c.GetCluster()
+	if err != nil {
+		return logs.Errorf("failed to get cluster: %v", err)
+	}
+
+	c.Response = &ClusterResponse{
+		ClusterInfo: ci,
+	}
+
+	return nil
+}
+
+func (c *ClusterRequest) GetResponse() (string, error) {
+	c.Response.RequestID = c.RequestID
+	r, err := json.Marshal(c.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (c *ClusterRequest) GetCluster() (ClusterInfo, error) {
+	var ci ClusterInfo
+
+	sv, err := c.ClientSet.Discovery().ServerVersion()
+	if err != nil {
+		return ci, logs.Errorf("failed to get server version: %v", err)
+	}
+	ci.Version = sv.GitVersion
+	ci.Platform = sv.Platform
+
+	err = eachItem(c.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return c.ClientSet.CoreV1().Nodes().List(c.Context, opts)
+	}, func(node *corev1.Node) {
+		ci.Nodes = append(ci.Nodes, nodeInfo(node))
+	})
+	if err != nil {
+		return ci, logs.Errorf("failed to get nodes: %v", err)
+	}
+
+	return ci, nil
+}
+
+func nodeInfo(node *corev1.Node) NodeInfo {
+	ni := NodeInfo{
+		Name:             node.Name,
+		Unschedulable:    node.Spec.Unschedulable,
+		KubeletVersion:   node.Status.NodeInfo.KubeletVersion,
+		OSImage:          node.Status.NodeInfo.OSImage,
+		KernelVersion:    node.Status.NodeInfo.KernelVersion,
+		ContainerRuntime: node.Status.NodeInfo.ContainerRuntimeVersion,
+		Architecture:     node.Status.NodeInfo.Architecture,
+		Capacity:         resourceStrings(node.Status.Capacity),
+		Allocatable:      resourceStrings(node.Status.Allocatable),
+	}
+
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			ni.Ready = cond.Status == corev1.ConditionTrue
+		}
+	}
+	for label := range node.Labels {
+		if role, ok := strings.CutPrefix(label, nodeRolePrefix); ok && role != "" {
+			ni.Roles = append(ni.Roles, role)
+		}
+	}
+	sort.Strings(ni.Roles)
+
+	for _, taint := range node.Spec.Taints {
+		if taint.Value == "" {
+			ni.Taints = append(ni.Taints, fmt.Sprintf("%s:%s", taint.Key, taint.Effect))
+			continue
+		}
+		ni.Taints = append(ni.Taints, fmt.Sprintf("%s=%s:%s", taint.Key, taint.Value, taint.Effect))
+	}
+
+	return ni
+}
+
+func resourceStrings(rl corev1.ResourceList) map[string]string {
+	ret := make(map[string]string, len(rl))
+	for name, quantity := range rl {
+		ret[string(name)] = quantity.String()
+	}
+
+	return ret
+}
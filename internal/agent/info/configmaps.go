@@ -0,0 +1,94 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+)
+
+type ConfigMapsRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *ConfigMapsResponse
+}
+
+// ConfigMapInfo only carries the keys, values can be large and aren't needed
+// to show what a workload mounts
+type ConfigMapInfo struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+}
+
+type ConfigMapsResponse struct {
+	RequestID  string          `json:"request_id"`
+	Namespace  string          `json:"namespace"`
+	ConfigMaps []ConfigMapInfo `json:"configmaps"`
+}
+
+func NewConfigMaps(cs kubernetes.Interface, ctx context.Context) *ConfigMapsRequest {
+	return &ConfigMapsRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *ConfigMapsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *ConfigMapsRequest) ProcessRequest(details *RequestDetails) error {
+	cms, err := d.GetConfigMaps(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get configmaps: %v", err)
+	}
+
+	d.Response = &ConfigMapsResponse{
+		Namespace:  details.Namespace,
+		ConfigMaps: cms,
+	}
+
+	return nil
+}
+
+func (d *ConfigMapsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *ConfigMapsRequest) GetConfigMaps(namespace string) ([]ConfigMapInfo, error) {
+	var configMaps []ConfigMapInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.CoreV1().ConfigMaps(namespace).List(d.Context, opts)
+	}, func(cm *corev1.ConfigMap) {
+		keys := make([]string, 0, len(cm.Data)+len(cm.BinaryData))
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		for k := range cm.BinaryData {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		configMaps = append(configMaps, ConfigMapInfo{
+			Name: cm.Name,
+			Keys: keys,
+		})
+	})
+	if err != nil {
+		return configMaps, logs.Errorf("failed to get configmaps: %v", err)
+	}
+
+	return configMaps, nil
+}
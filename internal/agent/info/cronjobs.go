@@ -0,0 +1,93 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+type CronJobsRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *CronJobsResponse
+}
+
+type CronJobInfo struct {
+	Name               string     `json:"name"`
+	Image              string     `json:"image"`
+	Schedule           string     `json:"schedule"`
+	Suspended          bool       `json:"suspended"`
+	Active             int        `json:"active"`
+	LastScheduleTime   *time.Time `json:"last_schedule_time,omitempty"`
+	LastSuccessfulTime *time.Time `json:"last_successful_time,omitempty"`
+}
+
+type CronJobsResponse struct {
+	RequestID string        `json:"request_id"`
+	Namespace string        `json:"namespace"`
+	CronJobs  []CronJobInfo `json:"cronjobs"`
+}
+
+func NewCronJobs(cs kubernetes.Interface, ctx context.Context) *CronJobsRequest {
+	return &CronJobsRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *CronJobsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *CronJobsRequest) ProcessRequest(details *RequestDetails) error {
+	cj, err := d.GetCronJobs(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get cronjobs: %v", err)
+	}
+
+	d.Response = &CronJobsResponse{
+		Namespace: details.Namespace,
+		CronJobs:  cj,
+	}
+
+	return nil
+}
+
+func (d *CronJobsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *CronJobsRequest) GetCronJobs(namespace string) ([]CronJobInfo, error) {
+	var cronJobs []CronJobInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.BatchV1().CronJobs(namespace).List(d.Context, opts)
+	}, func(cj *batchv1.CronJob) {
+		cronJobs = append(cronJobs, CronJobInfo{
+			Name:               cj.Name,
+			Image:              firstImage(cj.Spec.JobTemplate.Spec.Template.Spec.Containers),
+			Schedule:           cj.Spec.Schedule,
+			Suspended:          cj.Spec.Suspend != nil && *cj.Spec.Suspend,
+			Active:             len(cj.Status.Active),
+			LastScheduleTime:   timePtr(cj.Status.LastScheduleTime),
+			LastSuccessfulTime: timePtr(cj.Status.LastSuccessfulTime),
+		})
+	})
+	if err != nil {
+		return cronJobs, logs.Errorf("failed to get cronjobs: %v", err)
+	}
+
+	return cronJobs, nil
+}
@@ -0,0 +1,92 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+type DaemonSetsRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *DaemonSetsResponse
+}
+
+type DaemonSetInfo struct {
+	Name      string `json:"name"`
+	Image     string `json:"image"`
+	Desired   int32  `json:"desired"`
+	Current   int32  `json:"current"`
+	Ready     int32  `json:"ready"`
+	Updated   int32  `json:"updated"`
+	Available int32  `json:"available"`
+}
+
+type DaemonSetsResponse struct {
+	RequestID  string          `json:"request_id"`
+	Namespace  string          `json:"namespace"`
+	DaemonSets []DaemonSetInfo `json:"daemonsets"`
+}
+
+func NewDaemonSets(cs kubernetes.Interface, ctx context.Context) *DaemonSetsRequest {
+	return &DaemonSetsRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *DaemonSetsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *DaemonSetsRequest) ProcessRequest(details *RequestDetails) error {
+	ds, err := d.GetDaemonSets(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get daemonsets: %v", err)
+	}
+
+	d.Response = &DaemonSetsResponse{
+		Namespace:  details.Namespace,
+		DaemonSets: ds,
+	}
+
+	return nil
+}
+
+func (d *DaemonSetsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *DaemonSetsRequest) GetDaemonSets(namespace string) ([]DaemonSetInfo, error) {
+	var daemonSets []DaemonSetInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.AppsV1().DaemonSets(namespace).List(d.Context, opts)
+	}, func(ds *appsv1.DaemonSet) {
+		daemonSets = append(daemonSets, DaemonSetInfo{
+			Name:      ds.Name,
+			Image:     firstImage(ds.Spec.Template.Spec.Containers),
+			Desired:   ds.Status.DesiredNumberScheduled,
+			Current:   ds.Status.CurrentNumberScheduled,
+			Ready:     ds.Status.NumberReady,
+			Updated:   ds.Status.UpdatedNumberScheduled,
+			Available: ds.Status.NumberAvailable,
+		})
+	})
+	if err != nil {
+		return daemonSets, logs.Errorf("failed to get daemonsets: %v", err)
+	}
+
+	return daemonSets, nil
+}
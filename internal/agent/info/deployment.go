@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"strings"
 )
 
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
 type DeploymentRequest struct {
 	Namespace string `json:"namespace"`
 	Name      string `json:"name"`
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	Response  *DeploymentResponse
@@ -38,7 +42,7 @@ type DeploymentResponse struct {
 	Pods      []PodInfo `json:"pods"`
 }
 
-func NewDeployment(cs *kubernetes.Clientset, ctx context.Context) *DeploymentRequest {
+func NewDeployment(cs kubernetes.Interface, ctx context.Context) *DeploymentRequest {
 	return &DeploymentRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -87,12 +91,16 @@ func (v *DeploymentRequest) getDeployment(name, namespace string) (*DeploymentRe
 	i := dep.Spec.Template.Spec.Containers[0].Image
 	version := strings.Split(i, ":")[1]
 
-	repName, err := v.getReplicaSet(name, namespace)
+	rep, err := v.getReplicaSet(dep)
 	if err != nil {
 		return nil, logs.Errorf("failed to get replica set: %v", err)
 	}
+	repName := ""
+	if rep != nil {
+		repName = rep.Name
+	}
 
-	pods, err := v.getPods(namespace, repName)
+	pods, err := v.getPods(rep)
 	if err != nil {
 		return nil, logs.Errorf("failed to get pods: %v", err)
 	}
@@ -113,65 +121,74 @@ func (v *DeploymentRequest) getDeployment(name, namespace string) (*DeploymentRe
 	}, nil
 }
 
-func (v *DeploymentRequest) getReplicaSet(name, ns string) (string, error) {
-	reps, err := v.ClientSet.AppsV1().ReplicaSets(ns).List(v.Context, metav1.ListOptions{})
+// getReplicaSet finds the replica set running the deployment's current
+// revision, ownership is matched on uid so a same named object from an older
+// deployment can't be picked up
+func (v *DeploymentRequest) getReplicaSet(dep *appsv1.Deployment) (*appsv1.ReplicaSet, error) {
+	selector, err := metav1.LabelSelectorAsSelector(dep.Spec.Selector)
+	if err != nil {
+		return nil, logs.Errorf("failed to parse deployment selector: %v", err)
+	}
+
+	reps, err := v.ClientSet.AppsV1().ReplicaSets(dep.Namespace).List(v.Context, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
 	if err != nil {
-		return "nil", logs.Errorf("failed to get replica set: %v", err)
+		return nil, logs.Errorf("failed to get replica set: %v", err)
 	}
-	var repName string
-	for _, rep := range reps.Items {
-		repName := v.findInNameOwners(name, rep.OwnerReferences)
-		if repName != "" {
-			return repName, nil
+
+	var current *appsv1.ReplicaSet
+	for idx := range reps.Items {
+		rep := &reps.Items[idx]
+		if !ownedBy(dep.UID, rep.OwnerReferences) {
+			continue
+		}
+		if rep.Annotations[revisionAnnotation] == dep.Annotations[revisionAnnotation] {
+			return rep, nil
+		}
+		if current == nil || rep.CreationTimestamp.After(current.CreationTimestamp.Time) {
+			current = rep
 		}
 	}
 
-	return repName, nil
+	return current, nil
 }
 
-func (v *DeploymentRequest) getPods(ns, replicaSetName string) ([]PodInfo, error) {
-	allPods, err := v.ClientSet.CoreV1().Pods(ns).List(v.Context, metav1.ListOptions{})
+func (v *DeploymentRequest) getPods(rep *appsv1.ReplicaSet) ([]PodInfo, error) {
+	pods := make([]PodInfo, 0)
+	if rep == nil {
+		return pods, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(rep.Spec.Selector)
 	if err != nil {
-		return nil, logs.Errorf("failed to get pods: %v", err)
+		return nil, logs.Errorf("failed to parse replica set selector: %v", err)
 	}
 
-	pods := make([]PodInfo, 0)
-	for _, pod := range allPods.Items {
-		podName := v.findInNameOwners(replicaSetName, pod.OwnerReferences)
-		if podName != "" {
-			pod, err := v.ClientSet.CoreV1().Pods(ns).Get(v.Context, pod.Name, metav1.GetOptions{})
-			if err != nil {
-				return nil, logs.Errorf("failed to get pod: %v", err)
-			}
-			podInfo := PodInfo{
-				Name:      pod.Name,
-				Restarts:  pod.Status.ContainerStatuses[0].RestartCount,
-				StartedAt: pod.Status.StartTime.Time,
-			}
-			pods = append(pods, podInfo)
-		}
+	allPods, err := v.ClientSet.CoreV1().Pods(rep.Namespace).List(v.Context, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get pods: %v", err)
 	}
 
-	for _, pod := range pods {
-		metric, err := v.getMetrics(pod)
-		if err != nil {
-			return nil, logs.Errorf("failed to get metrics: %v", err)
+	for i := range allPods.Items {
+		pod := &allPods.Items[i]
+		if !ownedBy(rep.UID, pod.OwnerReferences) {
+			continue
 		}
-		pod.Metrics = metric
+
+		pods = append(pods, podInfo(pod))
 	}
 
 	return pods, nil
 }
 
-func (v *DeploymentRequest) getMetrics(info PodInfo) (interface{}, error) {
-	return nil, nil
-}
-
-func (v *DeploymentRequest) findInNameOwners(name string, owners []metav1.OwnerReference) string {
+func ownedBy(uid types.UID, owners []metav1.OwnerReference) bool {
 	for _, owner := range owners {
-		if owner.Name == name {
-			return owner.Name
+		if owner.UID == uid {
+			return true
 		}
 	}
-	return ""
+	return false
 }
@@ -4,13 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 
 	"k8s.io/client-go/kubernetes"
 )
 
 type DeploymentsRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	RequestID string
@@ -30,7 +32,7 @@ type DeploymentsSendResponse struct {
 	Deployments []DeploymentInfo `json:"deployments"`
 }
 
-func NewDeployments(cs *kubernetes.Clientset, ctx context.Context) *DeploymentsRequest {
+func NewDeployments(cs kubernetes.Interface, ctx context.Context) *DeploymentsRequest {
 	return &DeploymentsRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -67,17 +69,17 @@ func (d *DeploymentsRequest) GetResponse() (string, error) {
 }
 
 func (d *DeploymentsRequest) GetDeployments(namespace string) ([]DeploymentInfo, error) {
-	dep, err := d.ClientSet.AppsV1().Deployments(namespace).List(d.Context, metav1.ListOptions{})
-	if err != nil {
-		return nil, logs.Errorf("failed to get deployments: %v", err)
-	}
-
 	var deployments []DeploymentInfo
-	for _, dd := range dep.Items {
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.AppsV1().Deployments(namespace).List(d.Context, opts)
+	}, func(dd *appsv1.Deployment) {
 		deployments = append(deployments, DeploymentInfo{
 			Name:      dd.Name,
 			Container: dd.Spec.Template.Spec.Containers[0].Image,
 		})
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get deployments: %v", err)
 	}
 
 	return deployments, nil
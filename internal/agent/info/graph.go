@@ -0,0 +1,339 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"sort"
+)
+
+const (
+	edgeOwns       = "owns"
+	edgeSelects    = "selects"
+	edgeRoutes     = "routes"
+	edgeMounts     = "mounts"
+	edgeReferences = "references"
+)
+
+type GraphRequest struct {
+	ClientSet kubernetes.Interface
+	Metadata  metadata.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *GraphResponse
+}
+
+// GraphNode ids are object uids, so names can be reused without edges
+// crossing between old and new objects
+type GraphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphResponse struct {
+	RequestID string `json:"request_id"`
+	Namespace string `json:"namespace"`
+	Graph
+}
+
+func NewGraph(cs kubernetes.Interface, md metadata.Interface, ctx context.Context) *GraphRequest {
+	return &GraphRequest{
+		ClientSet: cs,
+		Metadata:  md,
+		Context:   ctx,
+	}
+}
+
+func (g *GraphRequest) SetRequestID(rid string) {
+	g.RequestID = rid
+}
+
+func (g *GraphRequest) ProcessRequest(details *RequestDetails) error {
+	if details.Namespace == "" {
+		return logs.Error("namespace is required")
+	}
+
+	graph, err := g.GetGraph(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get graph: %v", err)
+	}
+
+	g.Response = &GraphResponse{
+		Namespace: details.Namespace,
+		Graph:     *graph,
+	}
+
+	return nil
+}
+
+func (g *GraphRequest) GetResponse() (string, error) {
+	g.Response.RequestID = g.RequestID
+	r, err := json.Marshal(g.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+// GetGraph links the namespace together: owner references for workloads,
+// selectors for services, backends for ingresses and volumes and env for the
+// config a pod uses. Secrets only need a name to link to, so they're listed
+// through the metadata api and their values stay in the cluster
+func (g *GraphRequest) GetGraph(namespace string) (*Graph, error) {
+	if g.Metadata == nil {
+		return nil, logs.Error("metadata client not available")
+	}
+
+	ctx := g.Context
+	cs := g.ClientSet
+	b := newGraphBuilder()
+
+	var pods []*corev1.Pod
+	var services []*corev1.Service
+	var ingresses []*networkingv1.Ingress
+
+	lists := map[string]error{
+		"deployments": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.AppsV1().Deployments(namespace).List(ctx, opts)
+		}, func(d *appsv1.Deployment) { b.add("Deployment", d) }),
+		"replicasets": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.AppsV1().ReplicaSets(namespace).List(ctx, opts)
+		}, func(r *appsv1.ReplicaSet) { b.add("ReplicaSet", r) }),
+		"statefulsets": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.AppsV1().StatefulSets(namespace).List(ctx, opts)
+		}, func(s *appsv1.StatefulSet) { b.add("StatefulSet", s) }),
+		"daemonsets": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.AppsV1().DaemonSets(namespace).List(ctx, opts)
+		}, func(d *appsv1.DaemonSet) { b.add("DaemonSet", d) }),
+		"cronjobs": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.BatchV1().CronJobs(namespace).List(ctx, opts)
+		}, func(c *batchv1.CronJob) { b.add("CronJob", c) }),
+		"jobs": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.BatchV1().Jobs(namespace).List(ctx, opts)
+		}, func(j *batchv1.Job) { b.add("Job", j) }),
+		"pods": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.CoreV1().Pods(namespace).List(ctx, opts)
+		}, func(p *corev1.Pod) {
+			b.add("Pod", p)
+			pods = append(pods, p)
+		}),
+		"services": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.CoreV1().Services(namespace).List(ctx, opts)
+		}, func(s *corev1.Service) {
+			b.add("Service", s)
+			services = append(services, s)
+		}),
+		"ingresses": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.NetworkingV1().Ingresses(namespace).List(ctx, opts)
+		}, func(i *networkingv1.Ingress) {
+			b.add("Ingress", i)
+			ingresses = append(ingresses, i)
+		}),
+		"configmaps": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.CoreV1().ConfigMaps(namespace).List(ctx, opts)
+		}, func(c *corev1.ConfigMap) { b.add("ConfigMap", c) }),
+		"secrets": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return g.Metadata.Resource(secretsResource).Namespace(namespace).List(ctx, opts)
+		}, func(s *metav1.PartialObjectMetadata) { b.add("Secret", s) }),
+		"pvcs": eachItem(ctx, func(opts metav1.ListOptions) (runtime.Object, error) {
+			return cs.CoreV1().PersistentVolumeClaims(namespace).List(ctx, opts)
+		}, func(p *corev1.PersistentVolumeClaim) { b.add("PersistentVolumeClaim", p) }),
+	}
+	for resource, err := range lists {
+		if err != nil {
+			return nil, logs.Errorf("failed to list %s: %v", resource, err)
+		}
+	}
+
+	b.linkOwners()
+	for _, svc := range services {
+		b.linkSelected(svc, pods)
+	}
+	for _, ing := range ingresses {
+		b.linkBackends(ing)
+	}
+	for _, pod := range pods {
+		b.linkConfig(pod)
+	}
+
+	return b.build(), nil
+}
+
+type graphBuilder struct {
+	nodes   []GraphNode
+	objects []metav1.Object
+	byName  map[string]string
+	edges   map[GraphEdge]bool
+}
+
+func newGraphBuilder() *graphBuilder {
+	return &graphBuilder{
+		byName: map[string]string{},
+		edges:  map[GraphEdge]bool{},
+	}
+}
+
+func (b *graphBuilder) add(kind string, obj metav1.Object) {
+	b.nodes = append(b.nodes, GraphNode{
+		ID:   string(obj.GetUID()),
+		Kind: kind,
+		Name: obj.GetName(),
+	})
+	b.objects = append(b.objects, obj)
+	b.byName[kind+"/"+obj.GetName()] = string(obj.GetUID())
+}
+
+func (b *graphBuilder) link(from, to, edgeType string) {
+	if from == "" || to == "" {
+		return
+	}
+
+	b.edges[GraphEdge{From: from, To: to, Type: edgeType}] = true
+}
+
+func (b *graphBuilder) linkOwners() {
+	known := make(map[string]bool, len(b.nodes))
+	for _, n := range b.nodes {
+		known[n.ID] = true
+	}
+
+	for _, obj := range b.objects {
+		for _, owner := range obj.GetOwnerReferences() {
+			if known[string(owner.UID)] {
+				b.link(string(owner.UID), string(obj.GetUID()), edgeOwns)
+			}
+		}
+	}
+}
+
+// linkSelected matches on the service selector, a service without one has
+// its endpoints managed by hand and doesn't select anything
+func (b *graphBuilder) linkSelected(svc *corev1.Service, pods []*corev1.Pod) {
+	if len(svc.Spec.Selector) == 0 {
+		return
+	}
+
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			b.link(string(svc.UID), string(pod.UID), edgeSelects)
+		}
+	}
+}
+
+func (b *graphBuilder) linkBackends(ing *networkingv1.Ingress) {
+	backend := func(be *networkingv1.IngressBackend) {
+		if be != nil && be.Service != nil {
+			b.link(string(ing.UID), b.byName["Service/"+be.Service.Name], edgeRoutes)
+		}
+	}
+
+	backend(ing.Spec.DefaultBackend)
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			backend(&path.Backend)
+		}
+	}
+}
+
+func (b *graphBuilder) linkConfig(pod *corev1.Pod) {
+	from := string(pod.UID)
+
+	for _, v := range pod.Spec.Volumes {
+		switch {
+		case v.ConfigMap != nil:
+			b.link(from, b.byName["ConfigMap/"+v.ConfigMap.Name], edgeMounts)
+		case v.Secret != nil:
+			b.link(from, b.byName["Secret/"+v.Secret.SecretName], edgeMounts)
+		case v.PersistentVolumeClaim != nil:
+			b.link(from, b.byName["PersistentVolumeClaim/"+v.PersistentVolumeClaim.ClaimName], edgeMounts)
+		case v.Projected != nil:
+			for _, src := range v.Projected.Sources {
+				if src.ConfigMap != nil {
+					b.link(from, b.byName["ConfigMap/"+src.ConfigMap.Name], edgeMounts)
+				}
+				if src.Secret != nil {
+					b.link(from, b.byName["Secret/"+src.Secret.Name], edgeMounts)
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		for _, ef := range c.EnvFrom {
+			if ef.ConfigMapRef != nil {
+				b.link(from, b.byName["ConfigMap/"+ef.ConfigMapRef.Name], edgeReferences)
+			}
+			if ef.SecretRef != nil {
+				b.link(from, b.byName["Secret/"+ef.SecretRef.Name], edgeReferences)
+			}
+		}
+		for _, e := range c.Env {
+			if e.ValueFrom == nil {
+				continue
+			}
+			if e.ValueFrom.ConfigMapKeyRef != nil {
+				b.link(from, b.byName["ConfigMap/"+e.ValueFrom.ConfigMapKeyRef.Name], edgeReferences)
+			}
+			if e.ValueFrom.SecretKeyRef != nil {
+				b.link(from, b.byName["Secret/"+e.ValueFrom.SecretKeyRef.Name], edgeReferences)
+			}
+		}
+	}
+}
+
+// build sorts everything so the same cluster state always gives the same
+// graph, boot syncs hash it to spot changes
+func (b *graphBuilder) build() *Graph {
+	g := &Graph{
+		Nodes: b.nodes,
+		Edges: make([]GraphEdge, 0, len(b.edges)),
+	}
+	for e := range b.edges {
+		g.Edges = append(g.Edges, e)
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Kind != g.Nodes[j].Kind {
+			return g.Nodes[i].Kind < g.Nodes[j].Kind
+		}
+		return g.Nodes[i].Name < g.Nodes[j].Name
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		if g.Edges[i].To != g.Edges[j].To {
+			return g.Edges[i].To < g.Edges[j].To
+		}
+		return g.Edges[i].Type < g.Edges[j].Type
+	})
+
+	return g
+}
@@ -0,0 +1,332 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	changeCauseAnnotation = "kubernetes.io/change-cause"
+	requestIDAnnotation   = "k8sdeploy.dev/request-id"
+
+	deploymentKind  = "deployment"
+	statefulSetKind = "statefulset"
+	daemonSetKind   = "daemonset"
+)
+
+// historyPermissions is what history needs for each kind, deployments keep
+// their revisions in replica sets and the others in controller revisions
+var historyPermissions = map[string][]scope.Permission{
+	deploymentKind: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "replicasets", Verb: "list"},
+	},
+	statefulSetKind: {
+		{Group: "apps", Resource: "statefulsets", Verb: "get"},
+		{Group: "apps", Resource: "controllerrevisions", Verb: "list"},
+		{Group: "", Resource: "pods", Verb: "list"},
+	},
+	daemonSetKind: {
+		{Group: "apps", Resource: "daemonsets", Verb: "get"},
+		{Group: "apps", Resource: "controllerrevisions", Verb: "list"},
+		{Group: "", Resource: "pods", Verb: "list"},
+	},
+}
+
+type HistoryRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *HistoryResponse
+}
+
+type ContainerImage struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// Revision is one version of a workload, request id is only there for
+// revisions the agent deployed
+type Revision struct {
+	Revision      int64            `json:"revision"`
+	Name          string           `json:"name"`
+	Current       bool             `json:"current"`
+	Images        []ContainerImage `json:"images"`
+	CreatedAt     time.Time        `json:"created_at"`
+	ChangeCause   string           `json:"change_cause,omitempty"`
+	DeployRequest string           `json:"deploy_request_id,omitempty"`
+	Replicas      int32            `json:"replicas"`
+	ReadyReplicas int32            `json:"ready_replicas"`
+}
+
+type HistoryResponse struct {
+	RequestID string     `json:"request_id"`
+	Kind      string     `json:"kind"`
+	Name      string     `json:"name"`
+	Namespace string     `json:"namespace"`
+	Revisions []Revision `json:"revisions"`
+}
+
+func NewHistory(cs kubernetes.Interface, ctx context.Context) *HistoryRequest {
+	return &HistoryRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (h *HistoryRequest) SetRequestID(rid string) {
+	h.RequestID = rid
+}
+
+// historyKind defaults to deployment when the request doesn't say
+func historyKind(kind string) string {
+	if kind == "" {
+		return deploymentKind
+	}
+
+	return kind
+}
+
+func (h *HistoryRequest) ProcessRequest(details *RequestDetails) error {
+	if details.Namespace == "" {
+		return logs.Error("namespace is required")
+	}
+	if details.Name == "" {
+		return logs.Error("name is required")
+	}
+
+	var revisions []Revision
+	var err error
+	kind := historyKind(details.Kind)
+	switch kind {
+	case deploymentKind:
+		revisions, err = h.deploymentRevisions(details.Namespace, details.Name)
+	case statefulSetKind:
+		revisions, err = h.statefulSetRevisions(details.Namespace, details.Name)
+	case daemonSetKind:
+		revisions, err = h.daemonSetRevisions(details.Namespace, details.Name)
+	default:
+		return logs.Errorf("unknown history kind: %s", kind)
+	}
+	if err != nil {
+		return logs.Errorf("failed to get history: %v", err)
+	}
+
+	sort.SliceStable(revisions, func(a, b int) bool {
+		if revisions[a].Revision != revisions[b].Revision {
+			return revisions[a].Revision > revisions[b].Revision
+		}
+		return revisions[a].CreatedAt.After(revisions[b].CreatedAt)
+	})
+
+	h.Response = &HistoryResponse{
+		Kind:      kind,
+		Name:      details.Name,
+		Namespace: details.Namespace,
+		Revisions: revisions,
+	}
+
+	return nil
+}
+
+func (h *HistoryRequest) GetResponse() (string, error) {
+	h.Response.RequestID = h.RequestID
+	r, err := json.Marshal(h.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal history response: %v", err)
+	}
+
+	return string(r), nil
+}
+
+// revision fills in what every kind keeps the same way, from the pod
+// template the revision was made from. Replica sets carry the request id the
+// deployment controller copied onto them, controller revisions and replica
+// sets from before that only have it on the template
+func revision(meta metav1.ObjectMeta, number int64, template *corev1.PodTemplateSpec) Revision {
+	images := make([]ContainerImage, 0, len(template.Spec.Containers))
+	for _, c := range template.Spec.Containers {
+		images = append(images, ContainerImage{Name: c.Name, Image: c.Image})
+	}
+
+	return Revision{
+		Revision:      number,
+		Name:          meta.Name,
+		Images:        images,
+		CreatedAt:     meta.CreationTimestamp.Time,
+		ChangeCause:   meta.Annotations[changeCauseAnnotation],
+		DeployRequest: requestID(meta, template),
+	}
+}
+
+func requestID(meta metav1.ObjectMeta, template *corev1.PodTemplateSpec) string {
+	if id := meta.Annotations[requestIDAnnotation]; id != "" {
+		return id
+	}
+
+	return template.Annotations[requestIDAnnotation]
+}
+
+func (h *HistoryRequest) deploymentRevisions(namespace, name string) ([]Revision, error) {
+	dep, err := h.ClientSet.AppsV1().Deployments(namespace).Get(h.Context, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to get deployment: %v", err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(dep.Spec.Selector)
+	if err != nil {
+		return nil, logs.Errorf("failed to parse deployment selector: %v", err)
+	}
+
+	revisions := make([]Revision, 0)
+	err = eachItem(h.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		opts.LabelSelector = selector.String()
+		return h.ClientSet.AppsV1().ReplicaSets(namespace).List(h.Context, opts)
+	}, func(rs *appsv1.ReplicaSet) {
+		if !ownedBy(dep.UID, rs.OwnerReferences) {
+			return
+		}
+
+		number, _ := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+		rev := revision(rs.ObjectMeta, number, &rs.Spec.Template)
+		rev.Current = rs.Annotations[revisionAnnotation] == dep.Annotations[revisionAnnotation]
+		rev.Replicas = rs.Status.Replicas
+		rev.ReadyReplicas = rs.Status.ReadyReplicas
+		revisions = append(revisions, rev)
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get replica sets: %v", err)
+	}
+
+	return revisions, nil
+}
+
+func (h *HistoryRequest) statefulSetRevisions(namespace, name string) ([]Revision, error) {
+	sts, err := h.ClientSet.AppsV1().StatefulSets(namespace).Get(h.Context, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to get statefulset: %v", err)
+	}
+
+	// statefulset pods are labelled with the revision name
+	revisions, err := h.controllerRevisions(namespace, sts.UID, sts.Spec.Selector, func(cr *appsv1.ControllerRevision) string {
+		return cr.Name
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		revisions[i].Current = revisions[i].Name == sts.Status.UpdateRevision
+	}
+
+	return revisions, nil
+}
+
+func (h *HistoryRequest) daemonSetRevisions(namespace, name string) ([]Revision, error) {
+	ds, err := h.ClientSet.AppsV1().DaemonSets(namespace).Get(h.Context, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to get daemonset: %v", err)
+	}
+
+	// daemonset pods are labelled with the hash the revision is labelled with
+	revisions, err := h.controllerRevisions(namespace, ds.UID, ds.Spec.Selector, func(cr *appsv1.ControllerRevision) string {
+		return cr.Labels[appsv1.ControllerRevisionHashLabelKey]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a daemonset always runs its highest revision
+	var newest int64
+	for _, rev := range revisions {
+		if rev.Revision > newest {
+			newest = rev.Revision
+		}
+	}
+	for i := range revisions {
+		revisions[i].Current = revisions[i].Revision == newest
+	}
+
+	return revisions, nil
+}
+
+// controllerRevisions reads the pod template back out of each revision the
+// workload owns, replicas are counted from the pods carrying its hash
+func (h *HistoryRequest) controllerRevisions(namespace string, owner types.UID, sel *metav1.LabelSelector, hash func(*appsv1.ControllerRevision) string) ([]Revision, error) {
+	selector, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return nil, logs.Errorf("failed to parse selector: %v", err)
+	}
+
+	type counts struct {
+		replicas, ready int32
+	}
+	pods := map[string]*counts{}
+	err = eachItem(h.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		opts.LabelSelector = selector.String()
+		return h.ClientSet.CoreV1().Pods(namespace).List(h.Context, opts)
+	}, func(pod *corev1.Pod) {
+		if !ownedBy(owner, pod.OwnerReferences) {
+			return
+		}
+
+		label := pod.Labels[appsv1.ControllerRevisionHashLabelKey]
+		if pods[label] == nil {
+			pods[label] = &counts{}
+		}
+		pods[label].replicas++
+		if podReady(pod.Status.Conditions) {
+			pods[label].ready++
+		}
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get pods: %v", err)
+	}
+
+	revisions := make([]Revision, 0)
+	var decodeErr error
+	err = eachItem(h.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		opts.LabelSelector = selector.String()
+		return h.ClientSet.AppsV1().ControllerRevisions(namespace).List(h.Context, opts)
+	}, func(cr *appsv1.ControllerRevision) {
+		if !ownedBy(owner, cr.OwnerReferences) {
+			return
+		}
+
+		// the data is a patch that replaces the whole template
+		var data struct {
+			Spec struct {
+				Template corev1.PodTemplateSpec `json:"template"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(cr.Data.Raw, &data); err != nil {
+			decodeErr = logs.Errorf("failed to decode revision %s: %v", cr.Name, err)
+			return
+		}
+
+		rev := revision(cr.ObjectMeta, cr.Revision, &data.Spec.Template)
+		if c, ok := pods[hash(cr)]; ok {
+			rev.Replicas = c.replicas
+			rev.ReadyReplicas = c.ready
+		}
+		revisions = append(revisions, rev)
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get controller revisions: %v", err)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return revisions, nil
+}
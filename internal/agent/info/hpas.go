@@ -0,0 +1,135 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+type HPAsRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *HPAsResponse
+}
+
+type HPAInfo struct {
+	Name            string   `json:"name"`
+	Target          string   `json:"target"`
+	MinReplicas     int32    `json:"min_replicas"`
+	MaxReplicas     int32    `json:"max_replicas"`
+	CurrentReplicas int32    `json:"current_replicas"`
+	DesiredReplicas int32    `json:"desired_replicas"`
+	Metrics         []string `json:"metrics"`
+}
+
+type HPAsResponse struct {
+	RequestID string    `json:"request_id"`
+	Namespace string    `json:"namespace"`
+	HPAs      []HPAInfo `json:"hpas"`
+}
+
+func NewHPAs(cs kubernetes.Interface, ctx context.Context) *HPAsRequest {
+	return &HPAsRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *HPAsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *HPAsRequest) ProcessRequest(details *RequestDetails) error {
+	hpas, err := d.GetHPAs(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get hpas: %v", err)
+	}
+
+	d.Response = &HPAsResponse{
+		Namespace: details.Namespace,
+		HPAs:      hpas,
+	}
+
+	return nil
+}
+
+func (d *HPAsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *HPAsRequest) GetHPAs(namespace string) ([]HPAInfo, error) {
+	var hpas []HPAInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.AutoscalingV2().HorizontalPodAutoscalers(namespace).List(d.Context, opts)
+	}, func(hpa *autoscalingv2.HorizontalPodAutoscaler) {
+		minReplicas := int32(1)
+		if hpa.Spec.MinReplicas != nil {
+			minReplicas = *hpa.Spec.MinReplicas
+		}
+
+		var metrics []string
+		for _, m := range hpa.Spec.Metrics {
+			metrics = append(metrics, describeMetric(m))
+		}
+
+		hpas = append(hpas, HPAInfo{
+			Name:            hpa.Name,
+			Target:          fmt.Sprintf("%s/%s", hpa.Spec.ScaleTargetRef.Kind, hpa.Spec.ScaleTargetRef.Name),
+			MinReplicas:     minReplicas,
+			MaxReplicas:     hpa.Spec.MaxReplicas,
+			CurrentReplicas: hpa.Status.CurrentReplicas,
+			DesiredReplicas: hpa.Status.DesiredReplicas,
+			Metrics:         metrics,
+		})
+	})
+	if err != nil {
+		return hpas, logs.Errorf("failed to get hpas: %v", err)
+	}
+
+	return hpas, nil
+}
+
+// describeMetric gives a short human form of an hpa metric, e.g. "cpu 80%"
+func describeMetric(m autoscalingv2.MetricSpec) string {
+	var name string
+	var target autoscalingv2.MetricTarget
+
+	switch m.Type {
+	case autoscalingv2.ResourceMetricSourceType:
+		name, target = string(m.Resource.Name), m.Resource.Target
+	case autoscalingv2.ContainerResourceMetricSourceType:
+		name, target = fmt.Sprintf("%s/%s", m.ContainerResource.Container, m.ContainerResource.Name), m.ContainerResource.Target
+	case autoscalingv2.PodsMetricSourceType:
+		name, target = m.Pods.Metric.Name, m.Pods.Target
+	case autoscalingv2.ObjectMetricSourceType:
+		name, target = m.Object.Metric.Name, m.Object.Target
+	case autoscalingv2.ExternalMetricSourceType:
+		name, target = m.External.Metric.Name, m.External.Target
+	default:
+		return string(m.Type)
+	}
+
+	switch {
+	case target.AverageUtilization != nil:
+		return fmt.Sprintf("%s %d%%", name, *target.AverageUtilization)
+	case target.AverageValue != nil:
+		return fmt.Sprintf("%s %s", name, target.AverageValue.String())
+	case target.Value != nil:
+		return fmt.Sprintf("%s %s", name, target.Value.String())
+	}
+
+	return name
+}
@@ -0,0 +1,197 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/gateway"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+type HTTPRoutesRequest struct {
+	ClientSet kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *HTTPRoutesResponse
+}
+
+type HTTPRouteInfo struct {
+	Name      string          `json:"name"`
+	Hostnames []string        `json:"hostnames"`
+	Parents   []string        `json:"parents"`
+	Rules     []HTTPRouteRule `json:"rules"`
+}
+
+type HTTPRouteRule struct {
+	Matches  []string           `json:"matches"`
+	Backends []HTTPRouteBackend `json:"backends"`
+}
+
+type HTTPRouteBackend struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Port   int32  `json:"port,omitempty"`
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+type HTTPRoutesResponse struct {
+	RequestID  string          `json:"request_id"`
+	Namespace  string          `json:"namespace"`
+	HTTPRoutes []HTTPRouteInfo `json:"httproutes"`
+}
+
+// httpRoute is the part of the gateway api type the agent reports on, it's
+// decoded from unstructured so the agent doesn't depend on the gateway api
+type httpRoute struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Hostnames  []string `json:"hostnames"`
+		ParentRefs []struct {
+			Kind        *string `json:"kind"`
+			Name        string  `json:"name"`
+			SectionName *string `json:"sectionName"`
+		} `json:"parentRefs"`
+		Rules []struct {
+			Matches []struct {
+				Path *struct {
+					Type  *string `json:"type"`
+					Value *string `json:"value"`
+				} `json:"path"`
+			} `json:"matches"`
+			BackendRefs []struct {
+				Kind   *string `json:"kind"`
+				Name   string  `json:"name"`
+				Port   *int32  `json:"port"`
+				Weight *int32  `json:"weight"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+func NewHTTPRoutes(cs kubernetes.Interface, dyn dynamic.Interface, ctx context.Context) *HTTPRoutesRequest {
+	return &HTTPRoutesRequest{
+		ClientSet: cs,
+		Dynamic:   dyn,
+		Context:   ctx,
+	}
+}
+
+func (h *HTTPRoutesRequest) SetRequestID(rid string) {
+	h.RequestID = rid
+}
+
+func (h *HTTPRoutesRequest) ProcessRequest(details *RequestDetails) error {
+	routes, err := h.GetHTTPRoutes(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get httproutes: %v", err)
+	}
+
+	h.Response = &HTTPRoutesResponse{
+		Namespace:  details.Namespace,
+		HTTPRoutes: routes,
+	}
+
+	return nil
+}
+
+func (h *HTTPRoutesRequest) GetResponse() (string, error) {
+	h.Response.RequestID = h.RequestID
+	r, err := json.Marshal(h.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+// GetHTTPRoutes gives nothing back when the gateway api crds aren't installed
+func (h *HTTPRoutesRequest) GetHTTPRoutes(namespace string) ([]HTTPRouteInfo, error) {
+	gvr, ok := gateway.RouteResource(h.ClientSet.Discovery())
+	if !ok {
+		return nil, nil
+	}
+	if h.Dynamic == nil {
+		return nil, logs.Error("dynamic client not available")
+	}
+
+	var routes []HTTPRouteInfo
+	var decodeErr error
+	err := eachItem(h.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return h.Dynamic.Resource(gvr).Namespace(namespace).List(h.Context, opts)
+	}, func(u *unstructured.Unstructured) {
+		var route httpRoute
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &route); err != nil {
+			decodeErr = logs.Errorf("failed to decode httproute %s: %v", u.GetName(), err)
+			return
+		}
+		routes = append(routes, httpRouteInfo(route))
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get httproutes: %v", err)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return routes, nil
+}
+
+func httpRouteInfo(route httpRoute) HTTPRouteInfo {
+	info := HTTPRouteInfo{
+		Name:      route.Metadata.Name,
+		Hostnames: route.Spec.Hostnames,
+	}
+
+	for _, parent := range route.Spec.ParentRefs {
+		kind := "Gateway"
+		if parent.Kind != nil {
+			kind = *parent.Kind
+		}
+
+		ref := fmt.Sprintf("%s/%s", kind, parent.Name)
+		if parent.SectionName != nil {
+			ref = fmt.Sprintf("%s/%s", ref, *parent.SectionName)
+		}
+		info.Parents = append(info.Parents, ref)
+	}
+
+	for _, rule := range route.Spec.Rules {
+		var hr HTTPRouteRule
+		for _, match := range rule.Matches {
+			if match.Path == nil || match.Path.Value == nil {
+				continue
+			}
+
+			matchType := "PathPrefix"
+			if match.Path.Type != nil {
+				matchType = *match.Path.Type
+			}
+			hr.Matches = append(hr.Matches, fmt.Sprintf("%s %s", matchType, *match.Path.Value))
+		}
+
+		for _, be := range rule.BackendRefs {
+			backend := HTTPRouteBackend{
+				Kind:   "Service",
+				Name:   be.Name,
+				Weight: be.Weight,
+			}
+			if be.Kind != nil {
+				backend.Kind = *be.Kind
+			}
+			if be.Port != nil {
+				backend.Port = *be.Port
+			}
+			hr.Backends = append(hr.Backends, backend)
+		}
+
+		info.Rules = append(info.Rules, hr)
+	}
+
+	return info
+}
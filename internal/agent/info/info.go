@@ -1,23 +1,35 @@
 package info
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/queue"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
 	"github.com/k8sdeploy/agent/internal/config"
-	"net/http"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 )
 
 type Info struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Metadata  metadata.Interface
 	Context   context.Context
 
-	Type      TypeInfo
-	RequestID string
+	Type         TypeInfo
+	RequestID    string
+	Namespaces   scope.Namespaces
+	Capabilities scope.Capabilities
 
 	Response string
 }
@@ -28,9 +40,107 @@ const (
 	namespaceRequestType   TypeInfo = "namespaces"
 	deploymentsRequestType TypeInfo = "deployments"
 	deploymentRequestType  TypeInfo = "deployment"
+
+	daemonSetsRequestType      TypeInfo = "daemonsets"
+	cronJobsRequestType        TypeInfo = "cronjobs"
+	hpasRequestType            TypeInfo = "hpas"
+	pvcsRequestType            TypeInfo = "pvcs"
+	configMapsRequestType      TypeInfo = "configmaps"
+	secretsRequestType         TypeInfo = "secrets"
+	networkPoliciesRequestType TypeInfo = "networkpolicies"
+	clusterRequestType         TypeInfo = "cluster"
+	graphRequestType           TypeInfo = "graph"
+	ingressesRequestType       TypeInfo = "ingresses"
+	servicesRequestType        TypeInfo = "services"
+	httpRoutesRequestType      TypeInfo = "httproutes"
+	historyRequestType         TypeInfo = "history"
 )
 
-func NewInfo(cs *kubernetes.Clientset, ctx context.Context) *Info {
+// permissions is what each info type needs, namespaces and cluster are the
+// only ones that aren't namespaced, history depends on the kind so it's in
+// historyPermissions
+var permissions = map[TypeInfo][]scope.Permission{
+	namespaceRequestType: {
+		{Group: "", Resource: "namespaces", Verb: "list"},
+	},
+	clusterRequestType: {
+		{Group: "", Resource: "nodes", Verb: "list"},
+	},
+	deploymentsRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "list"},
+	},
+	deploymentRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "get"},
+		{Group: "apps", Resource: "replicasets", Verb: "list"},
+		{Group: "", Resource: "pods", Verb: "list"},
+		{Group: "", Resource: "pods", Verb: "get"},
+	},
+	daemonSetsRequestType: {
+		{Group: "apps", Resource: "daemonsets", Verb: "list"},
+	},
+	cronJobsRequestType: {
+		{Group: "batch", Resource: "cronjobs", Verb: "list"},
+	},
+	hpasRequestType: {
+		{Group: "autoscaling", Resource: "horizontalpodautoscalers", Verb: "list"},
+	},
+	pvcsRequestType: {
+		{Group: "", Resource: "persistentvolumeclaims", Verb: "list"},
+	},
+	configMapsRequestType: {
+		{Group: "", Resource: "configmaps", Verb: "list"},
+	},
+	secretsRequestType: {
+		{Group: "", Resource: "secrets", Verb: "list"},
+	},
+	networkPoliciesRequestType: {
+		{Group: "networking.k8s.io", Resource: "networkpolicies", Verb: "list"},
+	},
+	ingressesRequestType: {
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "list"},
+	},
+	servicesRequestType: {
+		{Group: "", Resource: "services", Verb: "list"},
+		{Group: "discovery.k8s.io", Resource: "endpointslices", Verb: "list"},
+	},
+	httpRoutesRequestType: {
+		{Group: "gateway.networking.k8s.io", Resource: "httproutes", Verb: "list"},
+	},
+	graphRequestType: {
+		{Group: "apps", Resource: "deployments", Verb: "list"},
+		{Group: "apps", Resource: "replicasets", Verb: "list"},
+		{Group: "apps", Resource: "statefulsets", Verb: "list"},
+		{Group: "apps", Resource: "daemonsets", Verb: "list"},
+		{Group: "batch", Resource: "cronjobs", Verb: "list"},
+		{Group: "batch", Resource: "jobs", Verb: "list"},
+		{Group: "", Resource: "pods", Verb: "list"},
+		{Group: "", Resource: "services", Verb: "list"},
+		{Group: "networking.k8s.io", Resource: "ingresses", Verb: "list"},
+		{Group: "", Resource: "configmaps", Verb: "list"},
+		{Group: "", Resource: "secrets", Verb: "list"},
+		{Group: "", Resource: "persistentvolumeclaims", Verb: "list"},
+	},
+}
+
+// Permissions is everything the info types check, split into what's checked
+// in a namespace and what's only checked cluster wide
+func Permissions() (namespaced, clusterWide []scope.Permission) {
+	for t, perms := range permissions {
+		switch t {
+		case namespaceRequestType, clusterRequestType:
+			clusterWide = append(clusterWide, perms...)
+		default:
+			namespaced = append(namespaced, perms...)
+		}
+	}
+	for _, perms := range historyPermissions {
+		namespaced = append(namespaced, perms...)
+	}
+
+	return namespaced, clusterWide
+}
+
+func NewInfo(cs kubernetes.Interface, ctx context.Context) *Info {
 	return &Info{
 		ClientSet: cs,
 		Context:   ctx,
@@ -45,9 +155,28 @@ func (i *Info) SetRequestID(rid string) {
 	i.RequestID = rid
 }
 
+func (i *Info) SetNamespaces(ns scope.Namespaces) {
+	i.Namespaces = ns
+}
+
+func (i *Info) SetCapabilities(caps scope.Capabilities) {
+	i.Capabilities = caps
+}
+
+// SetDynamic is only needed for types backed by crds, like httproutes
+func (i *Info) SetDynamic(dyn dynamic.Interface) {
+	i.Dynamic = dyn
+}
+
+// SetMetadata is for types that only need names, like secrets
+func (i *Info) SetMetadata(md metadata.Interface) {
+	i.Metadata = md
+}
+
 type RequestDetails struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
+	Kind      string `json:"kind,omitempty"`
 }
 
 type System interface {
@@ -70,15 +199,43 @@ func requestToInfo(infoRequest interface{}) (*RequestDetails, error) {
 	return jd, nil
 }
 
-func (i *Info) createSystem(clientSet *kubernetes.Clientset, context context.Context, infoType TypeInfo) (System, error) {
+func (i *Info) createSystem(clientSet kubernetes.Interface, context context.Context, infoType TypeInfo) (System, error) {
 	var is System
 	switch infoType {
 	case namespaceRequestType:
-		is = NewNamespaces(clientSet, context)
+		ns := NewNamespaces(clientSet, context)
+		ns.Scope = i.Namespaces
+		is = ns
 	case deploymentsRequestType:
 		is = NewDeployments(clientSet, context)
 	case deploymentRequestType:
 		is = NewDeployment(clientSet, context)
+	case daemonSetsRequestType:
+		is = NewDaemonSets(clientSet, context)
+	case cronJobsRequestType:
+		is = NewCronJobs(clientSet, context)
+	case hpasRequestType:
+		is = NewHPAs(clientSet, context)
+	case pvcsRequestType:
+		is = NewPVCs(clientSet, context)
+	case configMapsRequestType:
+		is = NewConfigMaps(clientSet, context)
+	case secretsRequestType:
+		is = NewSecrets(clientSet, i.Metadata, context)
+	case networkPoliciesRequestType:
+		is = NewNetworkPolicies(clientSet, context)
+	case clusterRequestType:
+		is = NewCluster(clientSet, context)
+	case graphRequestType:
+		is = NewGraph(clientSet, i.Metadata, context)
+	case ingressesRequestType:
+		is = NewIngress(clientSet, context)
+	case servicesRequestType:
+		is = NewService(clientSet, context)
+	case httpRoutesRequestType:
+		is = NewHTTPRoutes(clientSet, i.Dynamic, context)
+	case historyRequestType:
+		is = NewHistory(clientSet, context)
 	default:
 		return nil, logs.Errorf("unknown info type: %s", infoType)
 	}
@@ -88,13 +245,62 @@ func (i *Info) createSystem(clientSet *kubernetes.Clientset, context context.Con
 	return is, nil
 }
 
-func (i *Info) ParseRequest(infoRequest interface{}) error {
+// permitted checks the request against the agent scope, a scoped agent
+// answers namespace requests without touching the cluster
+func (i *Info) permitted(details *RequestDetails) error {
+	namespace := details.Namespace
+
+	switch i.Type {
+	case namespaceRequestType:
+		if i.Namespaces.Scoped() {
+			return nil
+		}
+
+		return i.Capabilities.Check(permissions[i.Type]...)
+	case clusterRequestType:
+		if i.Namespaces.Scoped() {
+			return logs.Error("cluster info isn't available to a namespace scoped agent")
+		}
+
+		return i.Capabilities.Check(permissions[i.Type]...)
+	}
+
+	if err := i.Namespaces.Check(namespace); err != nil {
+		return err
+	}
+
+	perms := permissions[i.Type]
+	if i.Type == historyRequestType {
+		perms = historyPermissions[historyKind(details.Kind)]
+	}
+
+	return i.Capabilities.Check(scope.In(namespace, perms...)...)
+}
+
+func (i *Info) ParseRequest(infoRequest interface{}) (err error) {
+	ctx, span := telemetry.Start(i.Context, "info.ParseRequest", trace.WithAttributes(
+		attribute.String("info.type", string(i.Type)),
+		attribute.String("request_id", i.RequestID),
+	))
+	defer func() {
+		telemetry.End(span, err)
+	}()
+
 	infoDetails, err := requestToInfo(infoRequest)
 	if err != nil {
 		return logs.Errorf("failed to marshal deployment request: %v", err)
 	}
+	span.SetAttributes(
+		attribute.String("k8s.namespace", infoDetails.Namespace),
+		attribute.String("k8s.name", infoDetails.Name),
+	)
+
+	if err := i.permitted(infoDetails); err != nil {
+		i.Response = scope.DeniedResponse(i.RequestID, err)
+		return logs.Errorf("failed to check permissions: %v", err)
+	}
 
-	is, err := i.createSystem(i.ClientSet, i.Context, i.Type)
+	is, err := i.createSystem(i.ClientSet, ctx, i.Type)
 	if err != nil {
 		return logs.Errorf("failed to create system: %v", err)
 	}
@@ -112,49 +318,29 @@ func (i *Info) ParseRequest(infoRequest interface{}) error {
 	return nil
 }
 
-func (i *Info) SendResponse(cfg *config.Config) error {
-	type Props struct {
-		RequestID string `json:"request_id"`
-	}
+func (i *Info) SendResponse(cfg *config.Config, client *httpclient.Client) (err error) {
+	ctx, span := telemetry.Start(context.WithoutCancel(i.Context), "info.SendResponse", trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() {
+		telemetry.End(span, err)
+	}()
 
-	type Payload struct {
-		Props           Props  `json:"properties"`
-		PayloadEncoding string `json:"payload_encoding"`
-		RoutingKey      string `json:"routing_key"`
-		Payload         string `json:"payload"`
-	}
+	return queue.Publish(ctx, cfg, client, i.RequestID, i.Response)
+}
 
-	payload, err := json.Marshal(Payload{
-		Props: Props{
-			RequestID: i.RequestID,
-		},
-		PayloadEncoding: "string",
-		RoutingKey:      cfg.K8sDeploy.Queues.Response,
-		Payload:         i.Response,
-	})
-	if err != nil {
-		return logs.Errorf("failed to marshal payload: %v", err)
+// firstImage is the image of the first container, or empty for a template
+// without any
+func firstImage(containers []corev1.Container) string {
+	if len(containers) == 0 {
+		return ""
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/exchanges/%s/amq.default/publish", cfg.K8sDeploy.RabbitHost, cfg.K8sDeploy.Queues.Agent), bytes.NewBuffer(payload))
-	if err != nil {
-		return logs.Errorf("failed to create request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(cfg.K8sDeploy.Credentials.Queue.Key, cfg.K8sDeploy.Credentials.Queue.Secret)
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return logs.Errorf("failed to get events: %v", err)
-	}
-	defer func() {
-		if err := res.Body.Close(); err != nil {
-			_ = logs.Errorf("failed to close queue body: %v", err)
-		}
-	}()
-	if res.StatusCode != http.StatusOK {
-		return logs.Errorf("failed get events: %s", res.Status)
+	return containers[0].Image
+}
+
+func timePtr(t *metav1.Time) *time.Time {
+	if t == nil {
+		return nil
 	}
 
-	return nil
+	return &t.Time
 }
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 )
 
 type JobsRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	RequestID string
@@ -33,7 +35,7 @@ type JobsResponse struct {
 	Jobs      []JobInfo `json:"jobs"`
 }
 
-func NewJobs(cs *kubernetes.Clientset, ctx context.Context) *JobsRequest {
+func NewJobs(cs kubernetes.Interface, ctx context.Context) *JobsRequest {
 	return &JobsRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -70,12 +72,9 @@ func (d *JobsRequest) GetResponse() (string, error) {
 func (d *JobsRequest) GetJobs(namespace string) ([]JobInfo, error) {
 	var jobs []JobInfo
 
-	jobList, err := d.ClientSet.BatchV1().Jobs(namespace).List(d.Context, metav1.ListOptions{})
-	if err != nil {
-		return jobs, logs.Errorf("failed to get jobs: %v", err)
-	}
-
-	for _, job := range jobList.Items {
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.BatchV1().Jobs(namespace).List(d.Context, opts)
+	}, func(job *batchv1.Job) {
 		jobs = append(jobs, JobInfo{
 			Name:        job.Name,
 			Image:       job.Spec.Template.Spec.Containers[0].Image,
@@ -86,6 +85,9 @@ func (d *JobsRequest) GetJobs(namespace string) ([]JobInfo, error) {
 			Failed:      job.Status.Failed,
 			Age:         job.CreationTimestamp.String(),
 		})
+	})
+	if err != nil {
+		return jobs, logs.Errorf("failed to get jobs: %v", err)
 	}
 
 	return jobs, nil
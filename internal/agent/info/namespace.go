@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -14,13 +17,14 @@ type NamespaceSendResponse struct {
 }
 
 type NamespaceRequest struct {
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
 	Context   context.Context
 	RequestID string
+	Scope     scope.Namespaces
 	Response  *NamespaceSendResponse
 }
 
-func NewNamespaces(cs *kubernetes.Clientset, ctx context.Context) *NamespaceRequest {
+func NewNamespaces(cs kubernetes.Interface, ctx context.Context) *NamespaceRequest {
 	return &NamespaceRequest{
 		Clientset: cs,
 		Context:   ctx,
@@ -31,16 +35,23 @@ func (n *NamespaceRequest) SetRequestID(rid string) {
 	n.RequestID = rid
 }
 
+// FetchAllNamespaces needs cluster wide list access, a scoped agent just
+// reports the namespaces it has been given
 func (n *NamespaceRequest) FetchAllNamespaces() ([]string, error) {
-	namespaces, err := n.Clientset.CoreV1().Namespaces().List(n.Context, metav1.ListOptions{})
-	if err != nil {
-		return nil, logs.Errorf("failed to get namespaces: %v", err)
+	if n.Scope.Scoped() {
+		return append([]string{}, n.Scope...), nil
 	}
 
 	ret := make([]string, 0)
-	for _, namespace := range namespaces.Items {
+	err := eachItem(n.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return n.Clientset.CoreV1().Namespaces().List(n.Context, opts)
+	}, func(namespace *corev1.Namespace) {
 		ret = append(ret, namespace.Name)
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get namespaces: %v", err)
 	}
+
 	return ret, nil
 }
 
@@ -0,0 +1,93 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+type NetworkPoliciesRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *NetworkPoliciesResponse
+}
+
+type NetworkPolicyInfo struct {
+	Name         string   `json:"name"`
+	PodSelector  string   `json:"pod_selector"`
+	PolicyTypes  []string `json:"policy_types"`
+	IngressRules int      `json:"ingress_rules"`
+	EgressRules  int      `json:"egress_rules"`
+}
+
+type NetworkPoliciesResponse struct {
+	RequestID       string              `json:"request_id"`
+	Namespace       string              `json:"namespace"`
+	NetworkPolicies []NetworkPolicyInfo `json:"network_policies"`
+}
+
+func NewNetworkPolicies(cs kubernetes.Interface, ctx context.Context) *NetworkPoliciesRequest {
+	return &NetworkPoliciesRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *NetworkPoliciesRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *NetworkPoliciesRequest) ProcessRequest(details *RequestDetails) error {
+	nps, err := d.GetNetworkPolicies(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get network policies: %v", err)
+	}
+
+	d.Response = &NetworkPoliciesResponse{
+		Namespace:       details.Namespace,
+		NetworkPolicies: nps,
+	}
+
+	return nil
+}
+
+func (d *NetworkPoliciesRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *NetworkPoliciesRequest) GetNetworkPolicies(namespace string) ([]NetworkPolicyInfo, error) {
+	var policies []NetworkPolicyInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.NetworkingV1().NetworkPolicies(namespace).List(d.Context, opts)
+	}, func(np *networkingv1.NetworkPolicy) {
+		var types []string
+		for _, t := range np.Spec.PolicyTypes {
+			types = append(types, string(t))
+		}
+
+		policies = append(policies, NetworkPolicyInfo{
+			Name:         np.Name,
+			PodSelector:  metav1.FormatLabelSelector(&np.Spec.PodSelector),
+			PolicyTypes:  types,
+			IngressRules: len(np.Spec.Ingress),
+			EgressRules:  len(np.Spec.Egress),
+		})
+	})
+	if err != nil {
+		return policies, logs.Errorf("failed to get network policies: %v", err)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,31 @@
+package info
+
+import (
+	"context"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/pager"
+)
+
+// pageSize keeps each list call small on big clusters, the pager follows the
+// continue tokens and falls back to a full list if a token expires
+const pageSize = 250
+
+type listFunc func(opts metav1.ListOptions) (runtime.Object, error)
+
+func eachItem[T runtime.Object](ctx context.Context, list listFunc, fn func(item T)) error {
+	p := pager.New(pager.SimplePageFunc(list))
+	p.PageSize = pageSize
+
+	return p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		item, ok := obj.(T)
+		if !ok {
+			return logs.Errorf("unexpected list item: %T", obj)
+		}
+		fn(item)
+
+		return nil
+	})
+}
@@ -4,27 +4,43 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"time"
 )
 
 type PodsRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	RequestID string
 	Response  *PodsResponse
 }
 
+// PodInfo Status is the kubectl style status, Phase is the raw pod phase
 type PodInfo struct {
 	Name     string `json:"name"`
 	Status   string `json:"status"`
+	Phase    string `json:"phase"`
 	Image    string `json:"image"`
 	Restarts int32  `json:"restarts"`
 
-	StartedAt time.Time   `json:"started_at"`
-	Metrics   interface{} `json:"metrics"`
+	Ready           bool     `json:"ready"`
+	ReadyContainers int      `json:"ready_containers"`
+	TotalContainers int      `json:"total_containers"`
+	Node            string   `json:"node"`
+	HostIP          string   `json:"host_ip"`
+	PodIP           string   `json:"pod_ip"`
+	PodIPs          []string `json:"pod_ips"`
+	QOSClass        string   `json:"qos_class"`
+
+	Conditions     []PodCondition    `json:"conditions"`
+	InitContainers []ContainerStatus `json:"init_containers,omitempty"`
+	Containers     []ContainerStatus `json:"containers"`
+
+	StartedAt *time.Time `json:"started_at"`
 }
 
 type PodsResponse struct {
@@ -33,7 +49,7 @@ type PodsResponse struct {
 	Pods      []PodInfo `json:"pods"`
 }
 
-func NewPods(cs *kubernetes.Clientset, ctx context.Context) *PodsRequest {
+func NewPods(cs kubernetes.Interface, ctx context.Context) *PodsRequest {
 	return &PodsRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -71,20 +87,14 @@ func (d *PodsRequest) GetResponse() (string, error) {
 func (d *PodsRequest) GetPods(namespace string) ([]PodInfo, error) {
 	var pods []PodInfo
 
-	podList, err := d.ClientSet.CoreV1().Pods(namespace).List(d.Context, metav1.ListOptions{})
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.CoreV1().Pods(namespace).List(d.Context, opts)
+	}, func(pod *corev1.Pod) {
+		pods = append(pods, podInfo(pod))
+	})
 	if err != nil {
 		return nil, logs.Errorf("failed to get pods: %v", err)
 	}
 
-	for _, pod := range podList.Items {
-		pods = append(pods, PodInfo{
-			Name:      pod.Name,
-			Status:    string(pod.Status.Phase),
-			Image:     pod.Spec.Containers[0].Image,
-			Restarts:  pod.Status.ContainerStatuses[0].RestartCount,
-			StartedAt: pod.Status.StartTime.Time,
-		})
-	}
-
 	return pods, nil
 }
@@ -0,0 +1,214 @@
+package info
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"time"
+)
+
+const (
+	containerWaiting    = "waiting"
+	containerRunning    = "running"
+	containerTerminated = "terminated"
+)
+
+// ContainerState is whichever of the kubelet states is set, an empty State
+// means the kubelet hasn't reported the container yet
+type ContainerState struct {
+	State      string     `json:"state"`
+	Reason     string     `json:"reason,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	ExitCode   *int32     `json:"exit_code,omitempty"`
+	Signal     int32      `json:"signal,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type ContainerStatus struct {
+	Name         string          `json:"name"`
+	Image        string          `json:"image"`
+	Ready        bool            `json:"ready"`
+	Started      bool            `json:"started"`
+	RestartCount int32           `json:"restart_count"`
+	State        ContainerState  `json:"state"`
+	LastState    *ContainerState `json:"last_state,omitempty"`
+}
+
+type PodCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// podInfo builds the pod status from whatever the kubelet has reported so
+// far, pending pods have no container statuses or start time
+func podInfo(pod *corev1.Pod) PodInfo {
+	info := PodInfo{
+		Name:            pod.Name,
+		Status:          podStatus(pod),
+		Phase:           string(pod.Status.Phase),
+		Image:           firstImage(pod.Spec.Containers),
+		Ready:           podReady(pod.Status.Conditions),
+		TotalContainers: len(pod.Spec.Containers),
+		Node:            pod.Spec.NodeName,
+		HostIP:          pod.Status.HostIP,
+		PodIP:           pod.Status.PodIP,
+		QOSClass:        string(pod.Status.QOSClass),
+		StartedAt:       timePtr(pod.Status.StartTime),
+	}
+
+	for _, ip := range pod.Status.PodIPs {
+		info.PodIPs = append(info.PodIPs, ip.IP)
+	}
+
+	for _, c := range pod.Status.Conditions {
+		info.Conditions = append(info.Conditions, PodCondition{
+			Type:    string(c.Type),
+			Status:  string(c.Status),
+			Reason:  c.Reason,
+			Message: c.Message,
+		})
+	}
+
+	for _, cs := range pod.Status.InitContainerStatuses {
+		info.InitContainers = append(info.InitContainers, containerStatus(cs))
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		info.Containers = append(info.Containers, containerStatus(cs))
+		info.Restarts += cs.RestartCount
+		if cs.Ready {
+			info.ReadyContainers++
+		}
+	}
+
+	return info
+}
+
+func containerStatus(cs corev1.ContainerStatus) ContainerStatus {
+	status := ContainerStatus{
+		Name:         cs.Name,
+		Image:        cs.Image,
+		Ready:        cs.Ready,
+		RestartCount: cs.RestartCount,
+		State:        containerState(cs.State),
+	}
+	if cs.Started != nil {
+		status.Started = *cs.Started
+	}
+
+	if last := containerState(cs.LastTerminationState); last.State != "" {
+		status.LastState = &last
+	}
+
+	return status
+}
+
+func containerState(state corev1.ContainerState) ContainerState {
+	switch {
+	case state.Waiting != nil:
+		return ContainerState{
+			State:   containerWaiting,
+			Reason:  state.Waiting.Reason,
+			Message: state.Waiting.Message,
+		}
+	case state.Running != nil:
+		return ContainerState{
+			State:     containerRunning,
+			StartedAt: timePtr(&state.Running.StartedAt),
+		}
+	case state.Terminated != nil:
+		exitCode := state.Terminated.ExitCode
+		return ContainerState{
+			State:      containerTerminated,
+			Reason:     state.Terminated.Reason,
+			Message:    state.Terminated.Message,
+			ExitCode:   &exitCode,
+			Signal:     state.Terminated.Signal,
+			StartedAt:  timePtr(&state.Terminated.StartedAt),
+			FinishedAt: timePtr(&state.Terminated.FinishedAt),
+		}
+	}
+
+	return ContainerState{}
+}
+
+func podReady(conditions []corev1.PodCondition) bool {
+	for _, c := range conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// podStatus is the status kubectl get pods shows, so a pod stuck restarting
+// reads CrashLoopBackOff rather than Running
+func podStatus(pod *corev1.Pod) string {
+	reason := string(pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		reason = pod.Status.Reason
+	}
+
+	initializing := false
+	for i, cs := range pod.Status.InitContainerStatuses {
+		if cs.State.Terminated != nil && cs.State.Terminated.ExitCode == 0 {
+			continue
+		}
+
+		initializing = true
+		switch {
+		case cs.State.Terminated != nil:
+			reason = "Init:" + terminatedReason(cs.State.Terminated)
+		case cs.State.Waiting != nil && cs.State.Waiting.Reason != "" && cs.State.Waiting.Reason != "PodInitializing":
+			reason = "Init:" + cs.State.Waiting.Reason
+		default:
+			reason = fmt.Sprintf("Init:%d/%d", i, len(pod.Spec.InitContainers))
+		}
+		break
+	}
+
+	if !initializing {
+		hasRunning := false
+		for i := len(pod.Status.ContainerStatuses) - 1; i >= 0; i-- {
+			cs := pod.Status.ContainerStatuses[i]
+			switch {
+			case cs.State.Waiting != nil && cs.State.Waiting.Reason != "":
+				reason = cs.State.Waiting.Reason
+			case cs.State.Terminated != nil:
+				reason = terminatedReason(cs.State.Terminated)
+			case cs.Ready && cs.State.Running != nil:
+				hasRunning = true
+			}
+		}
+
+		// a completed container alongside a running one is still serving
+		if reason == "Completed" && hasRunning {
+			reason = "NotReady"
+			if podReady(pod.Status.Conditions) {
+				reason = "Running"
+			}
+		}
+	}
+
+	if pod.DeletionTimestamp != nil {
+		if pod.Status.Reason == "NodeLost" {
+			return "Unknown"
+		}
+		return "Terminating"
+	}
+
+	return reason
+}
+
+func terminatedReason(t *corev1.ContainerStateTerminated) string {
+	switch {
+	case t.Reason != "":
+		return t.Reason
+	case t.Signal != 0:
+		return fmt.Sprintf("Signal:%d", t.Signal)
+	}
+
+	return fmt.Sprintf("ExitCode:%d", t.ExitCode)
+}
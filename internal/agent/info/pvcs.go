@@ -0,0 +1,98 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+type PVCsRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *PVCsResponse
+}
+
+type PVCInfo struct {
+	Name         string   `json:"name"`
+	Status       string   `json:"status"`
+	StorageClass string   `json:"storage_class"`
+	Volume       string   `json:"volume"`
+	Capacity     string   `json:"capacity"`
+	AccessModes  []string `json:"access_modes"`
+}
+
+type PVCsResponse struct {
+	RequestID string    `json:"request_id"`
+	Namespace string    `json:"namespace"`
+	PVCs      []PVCInfo `json:"pvcs"`
+}
+
+func NewPVCs(cs kubernetes.Interface, ctx context.Context) *PVCsRequest {
+	return &PVCsRequest{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (d *PVCsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *PVCsRequest) ProcessRequest(details *RequestDetails) error {
+	pvcs, err := d.GetPVCs(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get pvcs: %v", err)
+	}
+
+	d.Response = &PVCsResponse{
+		Namespace: details.Namespace,
+		PVCs:      pvcs,
+	}
+
+	return nil
+}
+
+func (d *PVCsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *PVCsRequest) GetPVCs(namespace string) ([]PVCInfo, error) {
+	var pvcs []PVCInfo
+
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.CoreV1().PersistentVolumeClaims(namespace).List(d.Context, opts)
+	}, func(pvc *corev1.PersistentVolumeClaim) {
+		info := PVCInfo{
+			Name:   pvc.Name,
+			Status: string(pvc.Status.Phase),
+			Volume: pvc.Spec.VolumeName,
+		}
+		if pvc.Spec.StorageClassName != nil {
+			info.StorageClass = *pvc.Spec.StorageClassName
+		}
+		if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+			info.Capacity = capacity.String()
+		}
+		for _, mode := range pvc.Spec.AccessModes {
+			info.AccessModes = append(info.AccessModes, string(mode))
+		}
+
+		pvcs = append(pvcs, info)
+	})
+	if err != nil {
+		return pvcs, logs.Errorf("failed to get pvcs: %v", err)
+	}
+
+	return pvcs, nil
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 )
 
 type ReplicaSetRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	RequestID string
@@ -29,7 +31,7 @@ type ReplicaSetResponse struct {
 	ReplicaSets []ReplicaSetInfo `json:"replicasets"`
 }
 
-func NewReplicaSets(cs *kubernetes.Clientset, ctx context.Context) *ReplicaSetRequest {
+func NewReplicaSets(cs kubernetes.Interface, ctx context.Context) *ReplicaSetRequest {
 	return &ReplicaSetRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -67,14 +69,11 @@ func (d *ReplicaSetRequest) GetResponse() (string, error) {
 func (d *ReplicaSetRequest) GetReplicaSets(namespace string) ([]ReplicaSetInfo, error) {
 	var replicaSets []ReplicaSetInfo
 
-	rs, err := d.ClientSet.AppsV1().ReplicaSets(namespace).List(d.Context, metav1.ListOptions{})
-	if err != nil {
-		return nil, logs.Errorf("failed to get replicasets: %v", err)
-	}
-
-	for _, r := range rs.Items {
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.AppsV1().ReplicaSets(namespace).List(d.Context, opts)
+	}, func(r *appsv1.ReplicaSet) {
 		if r.Status.Replicas == 0 {
-			continue
+			return
 		}
 
 		replicaSets = append(replicaSets, ReplicaSetInfo{
@@ -83,6 +82,9 @@ func (d *ReplicaSetRequest) GetReplicaSets(namespace string) ([]ReplicaSetInfo,
 			Replicas:      r.Status.Replicas,
 			Image:         r.Spec.Template.Spec.Containers[0].Image,
 		})
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get replicasets: %v", err)
 	}
 
 	return replicaSets, nil
@@ -0,0 +1,90 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+var secretsResource = corev1.SchemeGroupVersion.WithResource("secrets")
+
+type SecretsRequest struct {
+	ClientSet kubernetes.Interface
+	Metadata  metadata.Interface
+	Context   context.Context
+
+	RequestID string
+	Response  *SecretsResponse
+}
+
+// SecretInfo is deliberately just the name, secrets are listed through the
+// metadata api so their values and keys never even reach the agent
+type SecretInfo struct {
+	Name string `json:"name"`
+}
+
+type SecretsResponse struct {
+	RequestID string       `json:"request_id"`
+	Namespace string       `json:"namespace"`
+	Secrets   []SecretInfo `json:"secrets"`
+}
+
+func NewSecrets(cs kubernetes.Interface, md metadata.Interface, ctx context.Context) *SecretsRequest {
+	return &SecretsRequest{
+		ClientSet: cs,
+		Metadata:  md,
+		Context:   ctx,
+	}
+}
+
+func (d *SecretsRequest) SetRequestID(rid string) {
+	d.RequestID = rid
+}
+
+func (d *SecretsRequest) ProcessRequest(details *RequestDetails) error {
+	secrets, err := d.GetSecrets(details.Namespace)
+	if err != nil {
+		return logs.Errorf("failed to get secrets: %v", err)
+	}
+
+	d.Response = &SecretsResponse{
+		Namespace: details.Namespace,
+		Secrets:   secrets,
+	}
+
+	return nil
+}
+
+func (d *SecretsRequest) GetResponse() (string, error) {
+	d.Response.RequestID = d.RequestID
+	r, err := json.Marshal(d.Response)
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+	return string(r), nil
+}
+
+func (d *SecretsRequest) GetSecrets(namespace string) ([]SecretInfo, error) {
+	if d.Metadata == nil {
+		return nil, logs.Error("metadata client not available")
+	}
+
+	var secrets []SecretInfo
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.Metadata.Resource(secretsResource).Namespace(namespace).List(d.Context, opts)
+	}, func(s *metav1.PartialObjectMetadata) {
+		secrets = append(secrets, SecretInfo{
+			Name: s.Name,
+		})
+	})
+	if err != nil {
+		return secrets, logs.Errorf("failed to get secrets: %v", err)
+	}
+
+	return secrets, nil
+}
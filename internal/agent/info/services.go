@@ -5,12 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"net"
+	"sort"
+	"strconv"
 )
 
 type ServiceRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	Response  *ServiceResponse
@@ -24,14 +30,25 @@ type ServiceResponse struct {
 }
 
 type ServiceInfo struct {
-	Name              string   `json:"name"`
-	Type              string   `json:"type"`
-	ClusterIP         string   `json:"cluster_ip"`
-	InternalEndpoints []string `json:"internal_endpoints"`
-	ExternalEndpoints []string `json:"external_endpoints"`
+	Name              string        `json:"name"`
+	Type              string        `json:"type"`
+	ClusterIP         string        `json:"cluster_ip"`
+	Ports             []ServicePort `json:"ports"`
+	InternalEndpoints []string      `json:"internal_endpoints"`
+	ExternalEndpoints []string      `json:"external_endpoints"`
+	ReadyEndpoints    []string      `json:"ready_endpoints"`
+	NotReadyEndpoints []string      `json:"not_ready_endpoints"`
 }
 
-func NewService(cs *kubernetes.Clientset, ctx context.Context) *ServiceRequest {
+type ServicePort struct {
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	Port       int32  `json:"port"`
+	TargetPort string `json:"target_port"`
+	NodePort   int32  `json:"node_port,omitempty"`
+}
+
+func NewService(cs kubernetes.Interface, ctx context.Context) *ServiceRequest {
 	return &ServiceRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -68,27 +85,110 @@ func (s *ServiceRequest) GetResponse() (string, error) {
 }
 
 func (s *ServiceRequest) GetServices(namespace string) ([]ServiceInfo, error) {
-	svc, err := s.ClientSet.CoreV1().Services(namespace).List(s.Context, metav1.ListOptions{})
+	ready, notReady, err := s.getEndpoints(namespace)
 	if err != nil {
-		return nil, logs.Errorf("failed to get services: %v", err)
+		return nil, logs.Errorf("failed to get endpoints: %v", err)
 	}
 
 	var services []ServiceInfo
-	for _, s := range svc.Items {
-		ies := []string{}
-		for _, ie := range s.Spec.Ports {
-			ies = append(ies, fmt.Sprintf("%s.%s:%d", s.ObjectMeta.Name, s.ObjectMeta.Namespace, ie.Port))
-		}
-		ies = append(ies, fmt.Sprintf("%s.%s:0", s.ObjectMeta.Name, s.ObjectMeta.Namespace))
-
-		services = append(services, ServiceInfo{
+	err = eachItem(s.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return s.ClientSet.CoreV1().Services(namespace).List(s.Context, opts)
+	}, func(s *corev1.Service) {
+		info := ServiceInfo{
 			Name:              s.Name,
 			Type:              string(s.Spec.Type),
 			ClusterIP:         s.Spec.ClusterIP,
-			InternalEndpoints: ies,
 			ExternalEndpoints: s.Spec.ExternalIPs,
-		})
+			ReadyEndpoints:    ready[s.Name],
+			NotReadyEndpoints: notReady[s.Name],
+		}
+
+		for _, p := range s.Spec.Ports {
+			info.Ports = append(info.Ports, ServicePort{
+				Name:       p.Name,
+				Protocol:   string(p.Protocol),
+				Port:       p.Port,
+				TargetPort: p.TargetPort.String(),
+				NodePort:   p.NodePort,
+			})
+			info.InternalEndpoints = append(info.InternalEndpoints, fmt.Sprintf("%s.%s:%d", s.Name, s.Namespace, p.Port))
+		}
+
+		for _, lb := range s.Status.LoadBalancer.Ingress {
+			if lb.IP != "" {
+				info.ExternalEndpoints = append(info.ExternalEndpoints, lb.IP)
+			}
+			if lb.Hostname != "" {
+				info.ExternalEndpoints = append(info.ExternalEndpoints, lb.Hostname)
+			}
+		}
+
+		services = append(services, info)
+	})
+	if err != nil {
+		return nil, logs.Errorf("failed to get services: %v", err)
 	}
 
 	return services, nil
 }
+
+// getEndpoints reads every endpoint slice in the namespace once and groups
+// the addresses by service, split on the ready condition
+func (s *ServiceRequest) getEndpoints(namespace string) (map[string][]string, map[string][]string, error) {
+	ready := map[string][]string{}
+	notReady := map[string][]string{}
+
+	err := eachItem(s.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return s.ClientSet.DiscoveryV1().EndpointSlices(namespace).List(s.Context, opts)
+	}, func(slice *discoveryv1.EndpointSlice) {
+		service := slice.Labels[discoveryv1.LabelServiceName]
+		if service == "" {
+			return
+		}
+
+		for _, ep := range slice.Endpoints {
+			// a nil ready condition means unknown, which the api says to treat
+			// as ready
+			isReady := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+
+			for _, addr := range endpointAddresses(ep, slice.Ports) {
+				if isReady {
+					ready[service] = append(ready[service], addr)
+				} else {
+					notReady[service] = append(notReady[service], addr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, eps := range []map[string][]string{ready, notReady} {
+		for name := range eps {
+			sort.Strings(eps[name])
+		}
+	}
+
+	return ready, notReady, nil
+}
+
+func endpointAddresses(ep discoveryv1.Endpoint, ports []discoveryv1.EndpointPort) []string {
+	var addrs []string
+	for _, addr := range ep.Addresses {
+		if len(ports) == 0 {
+			addrs = append(addrs, addr)
+			continue
+		}
+
+		for _, p := range ports {
+			if p.Port == nil {
+				addrs = append(addrs, addr)
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(int(*p.Port))))
+		}
+	}
+
+	return addrs
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 )
 
 type StatefulSetsRequest struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
 	Context   context.Context
 
 	RequestID string
@@ -29,7 +31,7 @@ type StatefulSetsResponse struct {
 	StatefulSets []StatefulSetInfo `json:"statefulsets"`
 }
 
-func NewStatefulSets(cs *kubernetes.Clientset, ctx context.Context) *StatefulSetsRequest {
+func NewStatefulSets(cs kubernetes.Interface, ctx context.Context) *StatefulSetsRequest {
 	return &StatefulSetsRequest{
 		ClientSet: cs,
 		Context:   ctx,
@@ -66,18 +68,18 @@ func (d *StatefulSetsRequest) GetResponse() (string, error) {
 
 func (d *StatefulSetsRequest) GetStatefulSets(namespace string) ([]StatefulSetInfo, error) {
 	var statefulSets []StatefulSetInfo
-	sts, err := d.ClientSet.AppsV1().StatefulSets(namespace).List(d.Context, metav1.ListOptions{})
-	if err != nil {
-		return statefulSets, logs.Errorf("failed to get statefulsets: %v", err)
-	}
-
-	for _, s := range sts.Items {
+	err := eachItem(d.Context, func(opts metav1.ListOptions) (runtime.Object, error) {
+		return d.ClientSet.AppsV1().StatefulSets(namespace).List(d.Context, opts)
+	}, func(s *appsv1.StatefulSet) {
 		statefulSets = append(statefulSets, StatefulSetInfo{
 			Name:            s.ObjectMeta.Name,
 			ReadyReplicas:   s.Status.ReadyReplicas,
 			CurrentReplicas: s.Status.CurrentReplicas,
 			Image:           s.Spec.Template.Spec.Containers[0].Image,
 		})
+	})
+	if err != nil {
+		return statefulSets, logs.Errorf("failed to get statefulsets: %v", err)
 	}
 
 	return statefulSets, nil
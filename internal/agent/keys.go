@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sort"
+	"strings"
+)
+
+const (
+	currentKeyField  = "current"
+	previousKeyField = "previous"
+)
+
+// PublicKey is what the orchestrator seals secret values to
+type PublicKey struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	Algorithm string `json:"algorithm"`
+}
+
+// SealingDetails are the values a reseal moves onto the current key, keyed by
+// whatever name the orchestrator stores them under
+type SealingDetails struct {
+	Values map[string]string `json:"values"`
+}
+
+func (a *Agent) publicKey() *PublicKey {
+	if a.Keyring == nil {
+		return nil
+	}
+
+	box := a.Keyring.Current()
+	return &PublicKey{
+		ID:        box.ID(),
+		Key:       box.PublicKey(),
+		Algorithm: sealed.Algorithm,
+	}
+}
+
+// loadKeyring reads the agent's key pairs out of its secret, the first
+// replica to start creates it
+func (a *Agent) loadKeyring(ctx context.Context) error {
+	boxes, err := a.readKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	if boxes == nil {
+		box, err := sealed.GenerateBox()
+		if err != nil {
+			return err
+		}
+		boxes = []*sealed.Box{box}
+
+		if err := a.createKeys(ctx, boxes); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return logs.Errorf("failed to create key secret: %v", err)
+			}
+
+			// another replica got there first, use its keys
+			if boxes, err = a.readKeys(ctx); err != nil {
+				return err
+			}
+			if boxes == nil {
+				return logs.Error("key secret disappeared while it was being created")
+			}
+		}
+	}
+
+	ring, err := sealed.NewKeyring(boxes, a.Config.K8sDeploy.Sealing.KeepKeys)
+	if err != nil {
+		return err
+	}
+	ring.SetReload(func() ([]*sealed.Box, error) {
+		return a.readKeys(context.WithoutCancel(ctx))
+	}, a.Config.K8sDeploy.Sealing.ReloadInterval)
+	if a.Keys != nil {
+		ring.SetShared(a.Keys)
+	}
+
+	a.Keyring = ring
+	a.Keys = ring
+
+	return nil
+}
+
+func (a *Agent) keySecret() (string, string, error) {
+	sealing := a.Config.K8sDeploy.Sealing
+	if sealing.SealingSecret == "" || a.Config.K8sDeploy.Self.Namespace == "" {
+		return "", "", logs.Error("no secret to keep the sealing keys in")
+	}
+
+	return a.Config.K8sDeploy.Self.Namespace, sealing.SealingSecret, nil
+}
+
+// readKeys is nil without an error when the secret hasn't been created yet
+func (a *Agent) readKeys(ctx context.Context) ([]*sealed.Box, error) {
+	namespace, name, err := a.keySecret()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := a.KubernetesClient.ClientSet.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, logs.Errorf("failed to get key secret: %v", err)
+	}
+
+	return parseKeys(secret)
+}
+
+func parseKeys(secret *corev1.Secret) ([]*sealed.Box, error) {
+	current, err := sealed.NewBox(string(secret.Data[currentKeyField]))
+	if err != nil {
+		return nil, logs.Errorf("failed to load current key: %v", err)
+	}
+	boxes := []*sealed.Box{current}
+	for _, encoded := range strings.Fields(string(secret.Data[previousKeyField])) {
+		box, err := sealed.NewBox(encoded)
+		if err != nil {
+			return nil, logs.Errorf("failed to load previous key: %v", err)
+		}
+		boxes = append(boxes, box)
+	}
+
+	return boxes, nil
+}
+
+func keyData(boxes []*sealed.Box) map[string][]byte {
+	previous := make([]string, 0, len(boxes)-1)
+	for _, box := range boxes[1:] {
+		previous = append(previous, box.Private())
+	}
+
+	return map[string][]byte{
+		currentKeyField:  []byte(boxes[0].Private()),
+		previousKeyField: []byte(strings.Join(previous, "\n")),
+	}
+}
+
+func (a *Agent) createKeys(ctx context.Context, boxes []*sealed.Box) error {
+	namespace, name, err := a.keySecret()
+	if err != nil {
+		return err
+	}
+
+	_, err = a.KubernetesClient.ClientSet.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: keyData(boxes),
+	}, metav1.CreateOptions{})
+
+	return err
+}
+
+// storeKeys applies rotate to the keys in the secret as they are now, another
+// replica may have rotated since this one last read them
+func (a *Agent) storeKeys(ctx context.Context, rotate func(saved []*sealed.Box) []*sealed.Box) error {
+	namespace, name, err := a.keySecret()
+	if err != nil {
+		return err
+	}
+
+	secrets := a.KubernetesClient.ClientSet.CoreV1().Secrets(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return a.createKeys(ctx, rotate(nil))
+		}
+		if err != nil {
+			return err
+		}
+
+		saved, err := parseKeys(secret)
+		if err != nil {
+			return err
+		}
+		secret.Data = keyData(rotate(saved))
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return logs.Errorf("failed to store keys: %v", err)
+	}
+
+	return nil
+}
+
+func boxIDs(boxes []*sealed.Box) []string {
+	ids := make([]string, 0, len(boxes))
+	for _, box := range boxes {
+		ids = append(ids, box.ID())
+	}
+
+	return ids
+}
+
+// rotateKey moves the agent onto a new key pair, the old one keeps opening
+// values until enough rotations have retired it
+func (a *Agent) rotateKey(ctx context.Context, payload PayloadDetails) error {
+	type Resp struct {
+		RequestID string     `json:"request_id"`
+		Key       *PublicKey `json:"key,omitempty"`
+		Keys      []string   `json:"keys,omitempty"`
+		Retired   []string   `json:"retired,omitempty"`
+		Error     string     `json:"error,omitempty"`
+	}
+
+	resp := Resp{
+		RequestID: payload.RequestID,
+	}
+
+	rotateErr := a.rotate(ctx, func(retired []*sealed.Box) {
+		resp.Key = a.publicKey()
+		resp.Keys = boxIDs(a.Keyring.Boxes())
+		resp.Retired = boxIDs(retired)
+	})
+	if rotateErr != nil {
+		resp.Error = rotateErr.Error()
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return logs.Errorf("failed to marshal rotate response: %v", err)
+	}
+	if err := a.publishResponse(ctx, payload.RequestID, string(b)); err != nil {
+		return logs.Errorf("failed to publish rotate response: %v", err)
+	}
+
+	return rotateErr
+}
+
+func (a *Agent) rotate(ctx context.Context, rotated func(retired []*sealed.Box)) error {
+	if a.Keyring == nil {
+		return logs.Error("agent has no key pair to rotate")
+	}
+
+	next, err := sealed.GenerateBox()
+	if err != nil {
+		return err
+	}
+	retired, err := a.Keyring.Rotate(next, func(rotate func([]*sealed.Box) []*sealed.Box) error {
+		return a.storeKeys(context.WithoutCancel(ctx), rotate)
+	})
+	if err != nil {
+		return logs.Errorf("failed to rotate key: %v", err)
+	}
+	rotated(retired)
+
+	// the rotate response carries the new key as well, so a failed
+	// registration only delays the orchestrator's record of it
+	if err := a.connectOrchestrator(); err != nil {
+		_ = logs.Errorf("failed to publish rotated key: %v", err)
+	}
+
+	return nil
+}
+
+// reseal re-encrypts values to the current key so the orchestrator can drop
+// anything sealed to a key that is about to be retired, failures are only
+// reported by name
+func (a *Agent) reseal(ctx context.Context, payload PayloadDetails) error {
+	type Resp struct {
+		RequestID string            `json:"request_id"`
+		KeyID     string            `json:"key_id,omitempty"`
+		Values    map[string]string `json:"values"`
+		Failed    []string          `json:"failed,omitempty"`
+		Error     string            `json:"error,omitempty"`
+	}
+
+	resp := Resp{
+		RequestID: payload.RequestID,
+		Values:    map[string]string{},
+	}
+
+	var resealErr error
+	if a.Keyring == nil {
+		resealErr = logs.Error("agent has no key pair to reseal to")
+	} else {
+		resp.KeyID = a.Keyring.Current().ID()
+		for name, value := range payload.SealingDetails.Values {
+			resealed, err := a.Keyring.Reseal(value)
+			if err != nil {
+				resp.Failed = append(resp.Failed, name)
+				continue
+			}
+			resp.Values[name] = resealed
+		}
+		sort.Strings(resp.Failed)
+		if len(resp.Failed) > 0 {
+			resealErr = logs.Errorf("failed to reseal %s", strings.Join(resp.Failed, ", "))
+		}
+	}
+	if resealErr != nil {
+		resp.Error = resealErr.Error()
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return logs.Errorf("failed to marshal reseal response: %v", err)
+	}
+	if err := a.publishResponse(ctx, payload.RequestID, string(b)); err != nil {
+		return logs.Errorf("failed to publish reseal response: %v", err)
+	}
+
+	return resealErr
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k8sdeploy/agent/internal/agent/sealed"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (h *harness) withKeyring(t *testing.T, keep int) {
+	t.Helper()
+
+	h.Agent.Config.K8sDeploy.Self.Namespace = "k8sdeploy"
+	h.Agent.Config.K8sDeploy.Sealing.SealingSecret = "k8sdeploy-agent-keys"
+	h.Agent.Config.K8sDeploy.Sealing.KeepKeys = keep
+	if err := h.Agent.loadKeyring(context.Background()); err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+}
+
+func (h *harness) lastRegistration(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	h.Server.mu.Lock()
+	defer h.Server.mu.Unlock()
+	if len(h.Server.registrations) == 0 {
+		t.Fatal("agent never registered")
+	}
+
+	return h.Server.registrations[len(h.Server.registrations)-1]
+}
+
+func sealTo(t *testing.T, box *sealed.Box, value string) string {
+	t.Helper()
+
+	s, err := sealed.SealTo(box.PublicKey(), []byte(value))
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	return s
+}
+
+func TestLoadKeyringPublishesPublicKey(t *testing.T) {
+	h := newHarness(t)
+	if _, ok := h.lastRegistration(t)["public_key"]; ok {
+		t.Error("public key published before the agent had one")
+	}
+
+	h.withKeyring(t, 1)
+	if err := h.Agent.connectOrchestrator(); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	published, ok := h.lastRegistration(t)["public_key"].(map[string]interface{})
+	if !ok {
+		t.Fatal("registration has no public key")
+	}
+	current := h.Agent.Keyring.Current()
+	if published["id"] != current.ID() || published["key"] != current.PublicKey() || published["algorithm"] != sealed.Algorithm {
+		t.Errorf("published key = %v, want %s", published, current.ID())
+	}
+	if published["key"] == current.Private() {
+		t.Error("private key published")
+	}
+
+	secret, err := h.Client.CoreV1().Secrets("k8sdeploy").Get(context.Background(), "k8sdeploy-agent-keys", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get key secret: %v", err)
+	}
+	if string(secret.Data[currentKeyField]) != current.Private() {
+		t.Error("key secret doesn't hold the current key")
+	}
+
+	// a restart, or a second replica, picks up the same key
+	h.Agent.Keyring = nil
+	h.withKeyring(t, 1)
+	if h.Agent.Keyring.Current().ID() != current.ID() {
+		t.Errorf("key id = %s after reload, want %s", h.Agent.Keyring.Current().ID(), current.ID())
+	}
+}
+
+func TestListenForEventsDeployConfigSealedToPublicKey(t *testing.T) {
+	h := newHarness(t, consumer("api", true))
+	shared := testSealingKey(t)
+	h.Agent.Keys = shared
+	h.withKeyring(t, 1)
+
+	errs := h.process(t, configRequest("req-70", map[string]interface{}{
+		"secrets": []map[string]interface{}{{
+			"name": "api-secret",
+			"data": map[string]string{
+				"password": sealTo(t, h.Agent.Keyring.Current(), "hunter2"),
+				"token":    seal(t, shared, "legacy-token"),
+			},
+		}},
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	secret, err := h.Client.CoreV1().Secrets("default").Get(context.Background(), "api-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get secret: %v", err)
+	}
+	if string(secret.Data["password"]) != "hunter2" || string(secret.Data["token"]) != "legacy-token" {
+		t.Errorf("secret data = %q, want both values opened", secret.Data)
+	}
+}
+
+func TestListenForEventsRotateKey(t *testing.T) {
+	h := newHarness(t)
+	h.withKeyring(t, 1)
+
+	first := h.Agent.Keyring.Current()
+	old := sealTo(t, first, "hunter2")
+
+	if errs := h.process(t, controlRequest("rotate_key", "req-71", nil)); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	var rotated struct {
+		Key     PublicKey `json:"key"`
+		Keys    []string  `json:"keys"`
+		Retired []string  `json:"retired"`
+	}
+	h.responseFor(t, "req-71", &rotated)
+
+	second := h.Agent.Keyring.Current()
+	if rotated.Key.ID != second.ID() || second.ID() == first.ID() {
+		t.Errorf("rotated key = %s, want a new key", rotated.Key.ID)
+	}
+	if strings.Join(rotated.Keys, ",") != second.ID()+","+first.ID() || len(rotated.Retired) != 0 {
+		t.Errorf("keys = %v retired = %v, want the old key kept", rotated.Keys, rotated.Retired)
+	}
+	if published := h.lastRegistration(t)["public_key"].(map[string]interface{}); published["id"] != second.ID() {
+		t.Errorf("registered key = %v, want %s", published["id"], second.ID())
+	}
+
+	// values sealed before the rotation still open and can be moved across
+	if plain, err := h.Agent.Keys.Open(old); err != nil || string(plain) != "hunter2" {
+		t.Fatalf("old value didn't open after rotation: %v", err)
+	}
+	errs := h.process(t, map[string]interface{}{
+		"action":     "reseal",
+		"request_id": "req-72",
+		"sealing_details": map[string]interface{}{
+			"values": map[string]string{
+				"db-password": old,
+				"broken":      first.ID() + ":bm90IHNlYWxlZA==",
+			},
+		},
+	})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "broken") {
+		t.Fatalf("errors = %v, want only the broken value to fail", errs)
+	}
+	var resealed struct {
+		KeyID  string            `json:"key_id"`
+		Values map[string]string `json:"values"`
+		Failed []string          `json:"failed"`
+	}
+	h.responseFor(t, "req-72", &resealed)
+	if resealed.KeyID != second.ID() || strings.Join(resealed.Failed, ",") != "broken" {
+		t.Errorf("reseal = %+v, want db-password on %s", resealed, second.ID())
+	}
+	moved := resealed.Values["db-password"]
+	if !strings.HasPrefix(moved, second.ID()+":") {
+		t.Fatalf("resealed value %q isn't on the new key", moved)
+	}
+	for _, r := range h.Server.responses() {
+		if strings.Contains(r.Payload, "hunter2") {
+			t.Fatal("plaintext published in a response")
+		}
+	}
+
+	// a second rotation retires the first key
+	if errs := h.process(t, controlRequest("rotate_key", "req-73", nil)); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	h.responseFor(t, "req-73", &rotated)
+	if strings.Join(rotated.Retired, ",") != first.ID() {
+		t.Errorf("retired = %v, want %s", rotated.Retired, first.ID())
+	}
+	if _, err := h.Agent.Keys.Open(old); err == nil {
+		t.Error("value sealed to a retired key still opens")
+	}
+	if plain, err := h.Agent.Keys.Open(moved); err != nil || string(plain) != "hunter2" {
+		t.Errorf("resealed value didn't open: %v", err)
+	}
+}
+
+func (h *harness) otherReplica(t *testing.T) *Agent {
+	t.Helper()
+
+	other := &Agent{Config: h.Agent.Config, KubernetesClient: h.Agent.KubernetesClient, HTTPClient: h.Agent.HTTPClient}
+	if err := other.loadKeyring(context.Background()); err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	return other
+}
+
+func TestKeyringReloadsRotationFromAnotherReplica(t *testing.T) {
+	h := newHarness(t)
+	h.withKeyring(t, 2)
+	other := h.otherReplica(t)
+
+	// a value for a key nobody has mustn't stop later rotations being seen
+	stranger, err := sealed.GenerateBox()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if _, err := other.Keys.Open(sealTo(t, stranger, "hunter2")); err == nil {
+		t.Fatal("value for an unknown key opened")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.Agent.rotate(context.Background(), func([]*sealed.Box) {}); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+
+		plain, err := other.Keys.Open(sealTo(t, h.Agent.Keyring.Current(), "hunter2"))
+		if err != nil || string(plain) != "hunter2" {
+			t.Fatalf("other replica didn't pick up rotation %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestKeyringReloadIsRateLimited(t *testing.T) {
+	h := newHarness(t)
+	h.withKeyring(t, 2)
+	h.Agent.Config.K8sDeploy.Sealing.ReloadInterval = time.Hour
+	other := h.otherReplica(t)
+
+	if err := h.Agent.rotate(context.Background(), func([]*sealed.Box) {}); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if _, err := other.Keys.Open(sealTo(t, h.Agent.Keyring.Current(), "hunter2")); err != nil {
+		t.Fatalf("first reload didn't happen: %v", err)
+	}
+
+	if err := h.Agent.rotate(context.Background(), func([]*sealed.Box) {}); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if _, err := other.Keys.Open(sealTo(t, h.Agent.Keyring.Current(), "hunter2")); err == nil {
+		t.Error("keys reloaded again within the interval")
+	}
+}
+
+func TestRotateKeepsAnotherReplicasRotation(t *testing.T) {
+	h := newHarness(t)
+	h.withKeyring(t, 2)
+	h.Agent.Config.K8sDeploy.Sealing.ReloadInterval = time.Hour
+	other := h.otherReplica(t)
+	first := h.Agent.Keyring.Current()
+
+	if err := h.Agent.rotate(context.Background(), func([]*sealed.Box) {}); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	second := h.Agent.Keyring.Current()
+
+	// the other replica hasn't seen the first rotation when it makes its own
+	if err := other.rotate(context.Background(), func([]*sealed.Box) {}); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	third := other.Keyring.Current()
+
+	want := strings.Join([]string{third.ID(), second.ID(), first.ID()}, ",")
+	if got := strings.Join(boxIDs(other.Keyring.Boxes()), ","); got != want {
+		t.Errorf("keys = %s, want %s", got, want)
+	}
+	stored, err := h.Agent.readKeys(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read keys: %v", err)
+	}
+	if got := strings.Join(boxIDs(stored), ","); got != want {
+		t.Errorf("stored keys = %s, want %s", got, want)
+	}
+	if plain, err := other.Keys.Open(sealTo(t, second, "hunter2")); err != nil || string(plain) != "hunter2" {
+		t.Errorf("value sealed to the first replica's key didn't open: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StateRunning    = "running"
+	StateCancelling = "cancelling"
+)
+
+// Operation is a request the agent is working on
+type Operation struct {
+	RequestID string    `json:"request_id"`
+	Action    string    `json:"action"`
+	Type      string    `json:"type,omitempty"`
+	Cluster   string    `json:"cluster,omitempty"`
+	State     string    `json:"state"`
+	Rollback  bool      `json:"rollback,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+
+	cancel context.CancelCauseFunc
+}
+
+// Cancelled is the cause given to an operation's context when the
+// orchestrator cancels it
+type Cancelled struct {
+	Rollback bool
+}
+
+func (c *Cancelled) Error() string {
+	if c.Rollback {
+		return "cancelled with rollback"
+	}
+
+	return "cancelled"
+}
+
+// Tracker keeps every running operation so it can be listed and cancelled,
+// it only knows the operations of its own replica, with more than one agent
+// replica a cancel or a listing only covers whichever replica took the message
+type Tracker struct {
+	Replica string
+
+	mu      sync.Mutex
+	running map[string]*Operation
+}
+
+func NewTracker(replica string) *Tracker {
+	return &Tracker{
+		Replica: replica,
+		running: map[string]*Operation{},
+	}
+}
+
+// Start registers op and gives it a context that Cancel ends, done has to be
+// called once the operation has finished
+func (t *Tracker) Start(ctx context.Context, op Operation) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	op.State = StateRunning
+	op.StartedAt = time.Now()
+	op.cancel = cancel
+
+	t.mu.Lock()
+	t.running[op.RequestID] = &op
+	t.mu.Unlock()
+
+	return ctx, func() {
+		t.mu.Lock()
+		if t.running[op.RequestID] == &op {
+			delete(t.running, op.RequestID)
+		}
+		t.mu.Unlock()
+
+		cancel(nil)
+	}
+}
+
+// Cancel stops the wait loops of a running operation, rollback asks it to
+// put back what it changed, false means this replica isn't running it, which
+// doesn't say whether another replica is
+func (t *Tracker) Cancel(requestID string, rollback bool) (Operation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	op, ok := t.running[requestID]
+	if !ok {
+		return Operation{}, false
+	}
+
+	op.State = StateCancelling
+	op.Rollback = rollback
+	op.cancel(&Cancelled{Rollback: rollback})
+
+	return *op, true
+}
+
+// Running lists the operations in the order they started
+func (t *Tracker) Running() []Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ops := make([]Operation, 0, len(t.running))
+	for _, op := range t.running {
+		ops = append(ops, *op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].StartedAt.Before(ops[j].StartedAt)
+	})
+
+	return ops
+}
+
+// CancelledBy is how a handler finds out its context ended because of a
+// cancel rather than a timeout
+func CancelledBy(ctx context.Context) (*Cancelled, bool) {
+	var c *Cancelled
+	if errors.As(context.Cause(ctx), &c) {
+		return c, true
+	}
+
+	return nil, false
+}
+
+// RollbackRequested is true once the operation was cancelled with rollback
+func RollbackRequested(ctx context.Context) bool {
+	c, ok := CancelledBy(ctx)
+	return ok && c.Rollback
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/operation"
+	"time"
+)
+
+// ControlDetails names the operation a cancel is for, rollback asks it to
+// put back what it already changed
+type ControlDetails struct {
+	RequestID string `json:"request_id"`
+	Rollback  bool   `json:"rollback"`
+}
+
+// control handles the actions that are about the agent itself rather than a
+// cluster, it reports whether the action was one of them
+func (a *Agent) control(ctx context.Context, payload PayloadDetails) (bool, error) {
+	switch payload.Action {
+	case Cancel:
+		return true, a.cancelOperation(ctx, payload)
+	case Operations:
+		return true, a.listOperations(ctx, payload)
+	case RotateKey:
+		return true, a.rotateKey(ctx, payload)
+	case Reseal:
+		return true, a.reseal(ctx, payload)
+	}
+
+	return false, nil
+}
+
+// cancelOperation only signals the operation, its own response says how it
+// ended once its wait loops have stopped, operations are tracked per replica
+// so unknown only means the replica that took the cancel isn't running it
+func (a *Agent) cancelOperation(ctx context.Context, payload PayloadDetails) error {
+	type Resp struct {
+		RequestID string               `json:"request_id"`
+		Cancelled string               `json:"cancelled"`
+		Rollback  bool                 `json:"rollback"`
+		Replica   string               `json:"replica,omitempty"`
+		Unknown   bool                 `json:"unknown,omitempty"`
+		Operation *operation.Operation `json:"operation,omitempty"`
+		Error     string               `json:"error,omitempty"`
+	}
+
+	details := payload.ControlDetails
+	resp := Resp{
+		RequestID: payload.RequestID,
+		Cancelled: details.RequestID,
+		Rollback:  details.Rollback,
+		Replica:   a.Operations.Replica,
+	}
+
+	var cancelErr error
+	if details.RequestID == "" {
+		cancelErr = logs.Error("request_id of the operation to cancel is required")
+	} else if op, ok := a.Operations.Cancel(details.RequestID, details.Rollback); !ok {
+		resp.Unknown = true
+		cancelErr = logs.Errorf("operation %s is unknown to this replica, it may be running on another", details.RequestID)
+	} else {
+		resp.Operation = &op
+	}
+	if cancelErr != nil {
+		resp.Error = cancelErr.Error()
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return logs.Errorf("failed to marshal cancel response: %v", err)
+	}
+	if err := a.publishResponse(ctx, payload.RequestID, string(b)); err != nil {
+		return logs.Errorf("failed to publish cancel response: %v", err)
+	}
+
+	return cancelErr
+}
+
+// listOperations lists what the replica that took the message is running,
+// not the other replicas
+func (a *Agent) listOperations(ctx context.Context, payload PayloadDetails) error {
+	type Resp struct {
+		RequestID  string                `json:"request_id"`
+		Replica    string                `json:"replica,omitempty"`
+		Operations []operation.Operation `json:"operations"`
+		Time       time.Time             `json:"time"`
+	}
+
+	b, err := json.Marshal(Resp{
+		RequestID:  payload.RequestID,
+		Replica:    a.Operations.Replica,
+		Operations: a.Operations.Running(),
+		Time:       time.Now(),
+	})
+	if err != nil {
+		return logs.Errorf("failed to marshal operations response: %v", err)
+	}
+	if err := a.publishResponse(ctx, payload.RequestID, string(b)); err != nil {
+		return logs.Errorf("failed to publish operations response: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// start feeds msg through listenForEvents in the background, for operations
+// that have to be running before the test can act on them
+func (h *harness) start(t *testing.T, msg interface{}) <-chan []error {
+	t.Helper()
+
+	h.Server.enqueue(t, agentQueue, msg)
+	done := make(chan []error, 1)
+	go func() {
+		errChan := make(chan error, 10)
+		h.Agent.listenForEvents(errChan)
+		close(errChan)
+
+		var errs []error
+		for err := range errChan {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		done <- errs
+	}()
+
+	return done
+}
+
+func (h *harness) waitForOperation(t *testing.T, requestID string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, op := range h.Agent.Operations.Running() {
+			if op.RequestID == requestID {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("operation %s never started", requestID)
+}
+
+func (h *harness) finished(t *testing.T, done <-chan []error) []error {
+	t.Helper()
+
+	select {
+	case errs := <-done:
+		return errs
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation didn't stop after cancel")
+	}
+
+	return nil
+}
+
+func controlRequest(action, requestID string, details map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"action":          action,
+		"request_id":      requestID,
+		"control_details": details,
+	}
+}
+
+// responseFor is the last response published for requestID
+func (h *harness) responseFor(t *testing.T, requestID string, v interface{}) {
+	t.Helper()
+
+	responses := h.Server.responses()
+	for i := len(responses) - 1; i >= 0; i-- {
+		if responses[i].Properties.RequestID != requestID {
+			continue
+		}
+		if err := json.Unmarshal([]byte(responses[i].Payload), v); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return
+	}
+	t.Fatalf("no response published for %s", requestID)
+}
+
+func TestListenForEventsCancelWithRollback(t *testing.T) {
+	prom := prometheusStub(t, "0.01")
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	h.Agent.Analysis = newTestPrometheus(h, prom.URL)
+
+	// nothing marks the deployment ready so the analysis keeps waiting
+	done := h.start(t, analysedImageRequest("req-50"))
+	h.waitForOperation(t, "req-50")
+
+	if errs := h.process(t, controlRequest("operations", "req-51", map[string]interface{}{})); len(errs) != 0 {
+		t.Fatalf("unexpected errors listing operations: %v", errs)
+	}
+	var running struct {
+		Operations []struct {
+			RequestID string `json:"request_id"`
+			Action    string `json:"action"`
+			Type      string `json:"type"`
+			State     string `json:"state"`
+		} `json:"operations"`
+	}
+	h.responseFor(t, "req-51", &running)
+	if len(running.Operations) != 1 {
+		t.Fatalf("running = %+v, want the deploy", running)
+	}
+	if op := running.Operations[0]; op.RequestID != "req-50" || op.Action != "deploy" || op.Type != "image" || op.State != "running" {
+		t.Errorf("operation = %+v, want running image deploy req-50", op)
+	}
+
+	if errs := h.process(t, controlRequest("cancel", "req-52", map[string]interface{}{
+		"request_id": "req-50",
+		"rollback":   true,
+	})); len(errs) != 0 {
+		t.Fatalf("unexpected errors cancelling: %v", errs)
+	}
+	if errs := h.finished(t, done); len(errs) != 0 {
+		t.Fatalf("unexpected errors from cancelled deploy: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want rolled back to registry.test/api:v1", got)
+	}
+
+	var resp struct {
+		Updated    bool   `json:"updated"`
+		Cancelled  bool   `json:"cancelled"`
+		RolledBack bool   `json:"rolled_back"`
+		Reason     string `json:"reason"`
+	}
+	h.responseFor(t, "req-50", &resp)
+	if resp.Updated || !resp.Cancelled || !resp.RolledBack || resp.Reason != "cancelled with rollback" {
+		t.Errorf("response = %+v, want cancelled and rolled back", resp)
+	}
+	if ops := h.Agent.Operations.Running(); len(ops) != 0 {
+		t.Errorf("operations still running: %+v", ops)
+	}
+}
+
+func TestListenForEventsCancelWithoutRollback(t *testing.T) {
+	prom := prometheusStub(t, "0.01")
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	h.Agent.Analysis = newTestPrometheus(h, prom.URL)
+
+	done := h.start(t, analysedImageRequest("req-53"))
+	h.waitForOperation(t, "req-53")
+
+	if errs := h.process(t, controlRequest("cancel", "req-54", map[string]interface{}{
+		"request_id": "req-53",
+	})); len(errs) != 0 {
+		t.Fatalf("unexpected errors cancelling: %v", errs)
+	}
+	if errs := h.finished(t, done); len(errs) != 0 {
+		t.Fatalf("unexpected errors from cancelled deploy: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v2" {
+		t.Errorf("image = %s, want registry.test/api:v2 left in place", got)
+	}
+
+	var resp struct {
+		Updated    bool `json:"updated"`
+		Cancelled  bool `json:"cancelled"`
+		RolledBack bool `json:"rolled_back"`
+	}
+	h.responseFor(t, "req-53", &resp)
+	if !resp.Updated || !resp.Cancelled || resp.RolledBack {
+		t.Errorf("response = %+v, want cancelled without rollback", resp)
+	}
+}
+
+func TestListenForEventsCancelUnknown(t *testing.T) {
+	h := newHarness(t)
+	h.Agent.Operations.Replica = "agent-0"
+
+	errs := h.process(t, controlRequest("cancel", "req-55", map[string]interface{}{
+		"request_id": "req-missing",
+	}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error cancelling an operation that isn't running")
+	}
+
+	// another replica may be running it, so this one can't say it isn't
+	var resp struct {
+		Cancelled string `json:"cancelled"`
+		Replica   string `json:"replica"`
+		Unknown   bool   `json:"unknown"`
+		Error     string `json:"error"`
+	}
+	h.responseFor(t, "req-55", &resp)
+	if resp.Cancelled != "req-missing" || resp.Replica != "agent-0" || !resp.Unknown || !strings.Contains(resp.Error, "unknown to this replica") {
+		t.Errorf("response = %+v, want req-missing unknown to agent-0", resp)
+	}
+}
+
+func TestListenForEventsPauseResume(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	rollOut(h.Client)
+
+	if errs := h.process(t, workloadRequest("pause", "deployment", "req-56", map[string]interface{}{})); len(errs) != 0 {
+		t.Fatalf("unexpected errors pausing: %v", errs)
+	}
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if !dep.Spec.Paused {
+		t.Fatal("deployment not paused")
+	}
+
+	if errs := h.process(t, workloadRequest("resume", "deployment", "req-57", map[string]interface{}{
+		"wait": true,
+	})); len(errs) != 0 {
+		t.Fatalf("unexpected errors resuming: %v", errs)
+	}
+
+	var resp struct {
+		Action string `json:"action"`
+		Before struct {
+			Paused bool `json:"paused"`
+		} `json:"before"`
+		After struct {
+			Paused bool `json:"paused"`
+		} `json:"after"`
+		Ready *bool `json:"ready"`
+	}
+	h.responseFor(t, "req-57", &resp)
+	if resp.Action != "resume" || !resp.Before.Paused || resp.After.Paused {
+		t.Errorf("response = %+v, want resumed from paused", resp)
+	}
+	if resp.Ready == nil || !*resp.Ready {
+		t.Errorf("ready = %v, want true", resp.Ready)
+	}
+
+	errs := h.process(t, workloadRequest("pause", "statefulset", "req-58", map[string]interface{}{}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error pausing a statefulset")
+	}
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"net/http"
+)
+
+// Publish puts a response on the orchestrator's response queue, tagged with
+// the request it answers and the trace it was made in
+func Publish(ctx context.Context, cfg *config.Config, client *httpclient.Client, requestID, response string) error {
+	type Props struct {
+		RequestID string            `json:"request_id"`
+		Headers   map[string]string `json:"headers,omitempty"`
+	}
+
+	type Payload struct {
+		Props           Props  `json:"properties"`
+		PayloadEncoding string `json:"payload_encoding"`
+		RoutingKey      string `json:"routing_key"`
+		Payload         string `json:"payload"`
+	}
+
+	payload, err := json.Marshal(Payload{
+		Props: Props{
+			RequestID: requestID,
+			Headers:   telemetry.Inject(ctx),
+		},
+		PayloadEncoding: "string",
+		RoutingKey:      cfg.K8sDeploy.Queues.Response,
+		Payload:         response,
+	})
+	if err != nil {
+		return logs.Errorf("failed to marshal payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/exchanges/%s/amq.default/publish", cfg.K8sDeploy.RabbitHost, cfg.K8sDeploy.Queues.Agent), bytes.NewBuffer(payload))
+	if err != nil {
+		return logs.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(cfg.K8sDeploy.QueueCredentials())
+	res, err := client.Do(req)
+	if err != nil {
+		return logs.Errorf("failed to publish response: %v", err)
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			_ = logs.Errorf("failed to close queue body: %v", err)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return logs.Errorf("failed to publish response: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k8sdeploy/agent/internal/agent/info"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// infoResponse runs an info request for the default namespace against objects
+// and decodes what was published into resp
+func infoResponse(t *testing.T, infoType string, resp interface{}, objects ...runtime.Object) {
+	t.Helper()
+
+	h := newHarness(t, objects...)
+	errs := h.process(t, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-" + infoType,
+		"action_details": map[string]string{
+			"type": infoType,
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	if err := json.Unmarshal([]byte(responses[0].Payload), resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+}
+
+func TestListenForEventsInfoDaemonSets(t *testing.T) {
+	var resp info.DaemonSetsResponse
+	infoResponse(t, "daemonsets", &resp, &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "agent", Image: "registry.test/agent:v1"}},
+			}},
+		},
+		Status: appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: 3,
+			CurrentNumberScheduled: 3,
+			NumberReady:            2,
+			UpdatedNumberScheduled: 1,
+			NumberAvailable:        2,
+		},
+	})
+
+	want := []info.DaemonSetInfo{{
+		Name: "agent", Image: "registry.test/agent:v1",
+		Desired: 3, Current: 3, Ready: 2, Updated: 1, Available: 2,
+	}}
+	if resp.RequestID != "req-daemonsets" || !reflect.DeepEqual(resp.DaemonSets, want) {
+		t.Errorf("response = %+v, want %+v", resp, want)
+	}
+}
+
+func TestListenForEventsInfoCronJobs(t *testing.T) {
+	suspended := true
+	lastRun := metav1.NewTime(time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC))
+
+	var resp info.CronJobsResponse
+	infoResponse(t, "cronjobs", &resp, &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "default"},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "0 3 * * *",
+			Suspend:  &suspended,
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "report", Image: "registry.test/report:v2"}},
+				}},
+			}},
+		},
+		Status: batchv1.CronJobStatus{
+			Active:           []corev1.ObjectReference{{Name: "report-1"}},
+			LastScheduleTime: &lastRun,
+		},
+	})
+
+	if len(resp.CronJobs) != 1 {
+		t.Fatalf("cronjobs = %+v, want 1", resp.CronJobs)
+	}
+	cj := resp.CronJobs[0]
+	if cj.Name != "report" || cj.Image != "registry.test/report:v2" || cj.Schedule != "0 3 * * *" || !cj.Suspended || cj.Active != 1 {
+		t.Errorf("cronjob = %+v, want suspended report with one active job", cj)
+	}
+	if cj.LastScheduleTime == nil || !cj.LastScheduleTime.Equal(lastRun.Time) || cj.LastSuccessfulTime != nil {
+		t.Errorf("times = %v %v, want only the last schedule", cj.LastScheduleTime, cj.LastSuccessfulTime)
+	}
+}
+
+func TestListenForEventsInfoHPAs(t *testing.T) {
+	utilization := int32(80)
+	value := resource.MustParse("100")
+
+	var resp info.HPAsResponse
+	infoResponse(t, "hpas", &resp, &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "api"},
+			MaxReplicas:    10,
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name:   corev1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{AverageUtilization: &utilization},
+					},
+				},
+				{
+					Type: autoscalingv2.PodsMetricSourceType,
+					Pods: &autoscalingv2.PodsMetricSource{
+						Metric: autoscalingv2.MetricIdentifier{Name: "requests"},
+						Target: autoscalingv2.MetricTarget{AverageValue: &value},
+					},
+				},
+			},
+		},
+		Status: autoscalingv2.HorizontalPodAutoscalerStatus{CurrentReplicas: 2, DesiredReplicas: 3},
+	})
+
+	want := []info.HPAInfo{{
+		Name: "api", Target: "Deployment/api",
+		MinReplicas: 1, MaxReplicas: 10, CurrentReplicas: 2, DesiredReplicas: 3,
+		Metrics: []string{"cpu 80%", "requests 100"},
+	}}
+	if !reflect.DeepEqual(resp.HPAs, want) {
+		t.Errorf("hpas = %+v, want %+v", resp.HPAs, want)
+	}
+}
+
+func TestListenForEventsInfoPVCs(t *testing.T) {
+	class := "fast"
+
+	var resp info.PVCsResponse
+	infoResponse(t, "pvcs", &resp, &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			VolumeName:       "pv-1",
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase:    corev1.ClaimBound,
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+		},
+	}, &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pending", Namespace: "default"},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	})
+
+	want := []info.PVCInfo{
+		{Name: "data", Status: "Bound", StorageClass: "fast", Volume: "pv-1", Capacity: "10Gi", AccessModes: []string{"ReadWriteOnce"}},
+		{Name: "pending", Status: "Pending"},
+	}
+	if !reflect.DeepEqual(resp.PVCs, want) {
+		t.Errorf("pvcs = %+v, want %+v", resp.PVCs, want)
+	}
+}
+
+func TestListenForEventsInfoConfigMaps(t *testing.T) {
+	var resp info.ConfigMapsResponse
+	infoResponse(t, "configmaps", &resp, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-config", Namespace: "default"},
+		Data:       map[string]string{"log_level": "debug", "app.yaml": "port: 8080"},
+		BinaryData: map[string][]byte{"cert.der": {0x30}},
+	})
+
+	want := []info.ConfigMapInfo{{Name: "api-config", Keys: []string{"app.yaml", "cert.der", "log_level"}}}
+	if !reflect.DeepEqual(resp.ConfigMaps, want) {
+		t.Errorf("configmaps = %+v, want %+v", resp.ConfigMaps, want)
+	}
+}
+
+func TestListenForEventsInfoNetworkPolicies(t *testing.T) {
+	var resp info.NetworkPoliciesResponse
+	infoResponse(t, "networkpolicies", &resp, &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-ingress", Namespace: "default"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{{}, {}},
+			Egress:      []networkingv1.NetworkPolicyEgressRule{{}},
+		},
+	})
+
+	want := []info.NetworkPolicyInfo{{
+		Name: "api-ingress", PodSelector: "app=api",
+		PolicyTypes: []string{"Ingress", "Egress"}, IngressRules: 2, EgressRules: 1,
+	}}
+	if !reflect.DeepEqual(resp.NetworkPolicies, want) {
+		t.Errorf("network policies = %+v, want %+v", resp.NetworkPolicies, want)
+	}
+}
@@ -0,0 +1,40 @@
+package rollout
+
+import (
+	"context"
+	"github.com/bugfixes/go-bugfixes/logs"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+const progressDeadline = "ProgressDeadlineExceeded"
+
+// DeploymentReady is the same check kubectl rollout status makes, the old
+// replicas have to be gone as well as the new ones ready
+func DeploymentReady(dep *appsv1.Deployment) (bool, error) {
+	for _, c := range dep.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == progressDeadline {
+			return false, logs.Errorf("deployment %s exceeded its progress deadline", dep.Name)
+		}
+	}
+
+	want := int32(1)
+	if dep.Spec.Replicas != nil {
+		want = *dep.Spec.Replicas
+	}
+
+	return dep.Status.ObservedGeneration >= dep.Generation &&
+		dep.Status.UpdatedReplicas >= want &&
+		dep.Status.ReadyReplicas >= want &&
+		dep.Status.Replicas == want, nil
+}
+
+// Failure is why a rollout or a wait stopped, a cancelled request says so
+// rather than just context canceled. Failures are reported in the response,
+// the request itself still succeeded
+func Failure(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	return err
+}
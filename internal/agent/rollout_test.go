@@ -0,0 +1,1379 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/agent/analysis"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const trackLabel = "k8sdeploy.dev/track"
+
+func testRolloutDeployment(name, namespace, image string, replicas int32) *appsv1.Deployment {
+	labels := map[string]string{"app": name}
+
+	dep := testDeployment(name, namespace, image)
+	dep.Labels = labels
+	dep.Spec.Replicas = &replicas
+	dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	dep.Spec.Template.Labels = labels
+
+	return dep
+}
+
+// rollOut stands in for the deployment controller, every deployment reports
+// its replicas ready as soon as it's written unless it's listed as stuck
+func rollOut(client *fake.Clientset, stuck ...string) {
+	client.PrependReactor("*", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			return applyPatch(client, patch, &appsv1.Deployment{}, func(obj runtime.Object) {
+				markRolledOut(obj.(*appsv1.Deployment), stuck)
+			})
+		}
+
+		write, ok := action.(interface{ GetObject() runtime.Object })
+		if !ok {
+			return false, nil, nil
+		}
+		dep, ok := write.GetObject().(*appsv1.Deployment)
+		if !ok {
+			return false, nil, nil
+		}
+		markRolledOut(dep, stuck)
+
+		return false, nil, nil
+	})
+}
+
+// applyPatch applies a strategic merge patch itself, a patch action has no
+// object for a reactor to set the status on before the tracker stores it
+func applyPatch(client *fake.Clientset, action k8stesting.PatchAction, into runtime.Object, mark func(runtime.Object)) (bool, runtime.Object, error) {
+	if action.GetPatchType() != types.StrategicMergePatchType {
+		return false, nil, nil
+	}
+
+	obj, err := client.Tracker().Get(action.GetResource(), action.GetNamespace(), action.GetName())
+	if err != nil {
+		return true, nil, err
+	}
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return true, nil, err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, action.GetPatch(), into)
+	if err != nil {
+		return true, nil, err
+	}
+
+	if err := json.Unmarshal(patched, into); err != nil {
+		return true, nil, err
+	}
+	mark(into)
+	if err := client.Tracker().Update(action.GetResource(), into, action.GetNamespace()); err != nil {
+		return true, nil, err
+	}
+
+	return true, into, nil
+}
+
+func markRolledOut(dep *appsv1.Deployment, stuck []string) {
+	for _, name := range stuck {
+		if dep.Name == name {
+			dep.Status.Conditions = []appsv1.DeploymentCondition{{
+				Type:   appsv1.DeploymentProgressing,
+				Status: corev1.ConditionFalse,
+				Reason: "ProgressDeadlineExceeded",
+			}}
+			return
+		}
+	}
+
+	count := int32(1)
+	if dep.Spec.Replicas != nil {
+		count = *dep.Spec.Replicas
+	}
+	dep.Status.Replicas = count
+	dep.Status.UpdatedReplicas = count
+	dep.Status.ReadyReplicas = count
+	dep.Status.AvailableReplicas = count
+}
+
+// scaledTo lists the replica counts name was written with, in order
+func scaledTo(client *fake.Clientset, name string) []int32 {
+	var counts []int32
+	for _, action := range client.Actions() {
+		switch write := action.(type) {
+		case k8stesting.PatchAction:
+			var patch struct {
+				Spec struct {
+					Replicas *int32 `json:"replicas"`
+				} `json:"spec"`
+			}
+			if write.GetResource().Resource != "deployments" || write.GetName() != name {
+				continue
+			}
+			if err := json.Unmarshal(write.GetPatch(), &patch); err == nil && patch.Spec.Replicas != nil {
+				counts = append(counts, *patch.Spec.Replicas)
+			}
+		case k8stesting.UpdateAction:
+			if action.GetVerb() != "update" {
+				continue
+			}
+			if dep, ok := write.GetObject().(*appsv1.Deployment); ok && dep.Name == name {
+				counts = append(counts, *dep.Spec.Replicas)
+			}
+		}
+	}
+
+	return counts
+}
+
+type rolloutProgress struct {
+	Type    string `json:"deployment_type"`
+	Phase   string `json:"phase"`
+	Step    int    `json:"step"`
+	Weight  int    `json:"weight"`
+	Message string `json:"message"`
+}
+
+func canaryRequest(requestID string, canary map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"action":     "deploy",
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": "canary",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+			"canary": canary,
+		},
+	}
+}
+
+func TestListenForEventsDeployCanary(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 4))
+	rollOut(h.Client)
+
+	errs := h.process(t, canaryRequest("req-20", map[string]interface{}{
+		"steps": []int{25, 50},
+		"pause": "0s",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v2" {
+		t.Errorf("image = %s, want registry.test/api:v2", got)
+	}
+	if _, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary deployment still there after promotion: %v", err)
+	}
+
+	// stable gives up a replica per step then comes back at full size
+	want := []int32{3, 2, 4}
+	got := scaledTo(h.Client, "api")
+	if len(got) != len(want) {
+		t.Fatalf("stable scaled to %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("stable scaled to %v, want %v", got, want)
+		}
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 6 {
+		t.Fatalf("published %d responses, want 6", len(responses))
+	}
+
+	wantPhases := []string{"progressing", "healthy", "progressing", "healthy", "promoted"}
+	for i, phase := range wantPhases {
+		var p rolloutProgress
+		if err := json.Unmarshal([]byte(responses[i].Payload), &p); err != nil {
+			t.Fatalf("failed to unmarshal progress: %v", err)
+		}
+		if p.Type != "canary" || p.Phase != phase {
+			t.Errorf("progress %d = %+v, want canary %s", i, p, phase)
+		}
+	}
+
+	var resp struct {
+		Updated  bool `json:"updated"`
+		Promoted bool `json:"promoted"`
+		Aborted  bool `json:"aborted"`
+	}
+	if err := json.Unmarshal([]byte(responses[5].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || !resp.Promoted || resp.Aborted {
+		t.Errorf("response = %+v, want promoted", resp)
+	}
+}
+
+func TestListenForEventsDeployCanaryAborted(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 4))
+	rollOut(h.Client, "api-canary")
+
+	errs := h.process(t, canaryRequest("req-21", map[string]interface{}{
+		"steps": []int{25, 50},
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want registry.test/api:v1", got)
+	}
+	if *dep.Spec.Replicas != 4 {
+		t.Errorf("replicas = %d, want 4", *dep.Spec.Replicas)
+	}
+	if _, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary deployment still there after abort: %v", err)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 3 {
+		t.Fatalf("published %d responses, want 3", len(responses))
+	}
+
+	var p rolloutProgress
+	if err := json.Unmarshal([]byte(responses[1].Payload), &p); err != nil {
+		t.Fatalf("failed to unmarshal progress: %v", err)
+	}
+	if p.Phase != "aborted" || p.Step != 1 || p.Message == "" {
+		t.Errorf("progress = %+v, want aborted at step 1 with a reason", p)
+	}
+
+	var resp struct {
+		Updated bool `json:"updated"`
+		Aborted bool `json:"aborted"`
+	}
+	if err := json.Unmarshal([]byte(responses[2].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Updated || !resp.Aborted {
+		t.Errorf("response = %+v, want aborted", resp)
+	}
+}
+
+func TestListenForEventsDeployCanaryLeftover(t *testing.T) {
+	// left by a run that stopped before it could clean up
+	leftover := testRolloutDeployment("api-canary", "default", "registry.test/api:v0", 3)
+	leftover.Labels = map[string]string{"app": "api", "k8sdeploy.dev/track": "canary"}
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 4), leftover)
+	rollOut(h.Client)
+
+	errs := h.process(t, canaryRequest("req-28", map[string]interface{}{
+		"steps": []int{50},
+		"pause": "0s",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var images []string
+	for _, action := range h.Client.Actions() {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok || patch.GetName() != "api-canary" || !strings.Contains(string(patch.GetPatch()), "image") {
+			continue
+		}
+		images = append(images, string(patch.GetPatch()))
+	}
+	if len(images) != 1 || !strings.Contains(images[0], "registry.test/api:v2") {
+		t.Errorf("canary patches = %v, want the leftover moved onto v2", images)
+	}
+
+	var resp struct {
+		Promoted bool `json:"promoted"`
+		Aborted  bool `json:"aborted"`
+	}
+	h.responseFor(t, "req-28", &resp)
+	if !resp.Promoted || resp.Aborted {
+		t.Errorf("response = %+v, want promoted", resp)
+	}
+	if _, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary deployment still there after promotion: %v", err)
+	}
+}
+
+func TestListenForEventsDeployCanaryNameTaken(t *testing.T) {
+	// someone else's deployment that happens to have the canary's name
+	foreign := testRolloutDeployment("api-canary", "default", "registry.test/other:v1", 1)
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 4), foreign)
+	rollOut(h.Client)
+
+	errs := h.process(t, canaryRequest("req-29", map[string]interface{}{
+		"steps": []int{50},
+		"pause": "0s",
+	}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error with the canary name taken")
+	}
+
+	ctx := context.Background()
+	dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api-canary", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("deployment with the canary name removed: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/other:v1" {
+		t.Errorf("image = %s, want it left alone", got)
+	}
+	stable, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := stable.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("stable image = %s, want registry.test/api:v1", got)
+	}
+}
+
+func TestListenForEventsDeployCanaryPromoteFailed(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 4))
+	// the canary is healthy but stable never rolls out onto its image
+	rollOut(h.Client, "api")
+
+	errs := h.process(t, canaryRequest("req-24", map[string]interface{}{
+		"steps":   []int{50},
+		"timeout": "10ms",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	ctx := context.Background()
+	dep, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want stable put back on registry.test/api:v1", got)
+	}
+	if *dep.Spec.Replicas != 4 {
+		t.Errorf("replicas = %d, want 4", *dep.Spec.Replicas)
+	}
+	if _, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary deployment still there after a failed promotion: %v", err)
+	}
+
+	responses := h.Server.responses()
+	var p rolloutProgress
+	if err := json.Unmarshal([]byte(responses[len(responses)-2].Payload), &p); err != nil {
+		t.Fatalf("failed to unmarshal progress: %v", err)
+	}
+	if p.Phase != "aborted" || p.Message == "" {
+		t.Errorf("progress = %+v, want aborted with a reason", p)
+	}
+
+	var resp struct {
+		Promoted bool `json:"promoted"`
+		Aborted  bool `json:"aborted"`
+	}
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Promoted || !resp.Aborted {
+		t.Errorf("response = %+v, want aborted", resp)
+	}
+}
+
+func TestListenForEventsDeployCanaryNginx(t *testing.T) {
+	pathType := networkingv1.PathTypePrefix
+	h := newHarness(t,
+		testRolloutDeployment("api", "default", "registry.test/api:v1", 2),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "10.0.0.10",
+				Selector:  map[string]string{"app": "api"},
+				Ports:     []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: networkingv1.IngressSpec{
+				TLS: []networkingv1.IngressTLS{{Hosts: []string{"api.test"}, SecretName: "api-tls"}},
+				Rules: []networkingv1.IngressRule{{
+					Host: "api.test",
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{{
+							Path:     "/",
+							PathType: &pathType,
+							Backend:  networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "api"}},
+						}},
+					}},
+				}},
+			},
+		},
+	)
+	rollOut(h.Client)
+
+	var weights []string
+	var canary *networkingv1.Ingress
+	h.Client.PrependReactor("*", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			var weight struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal(patch.GetPatch(), &weight); err == nil {
+				weights = append(weights, weight.Metadata.Annotations["nginx.ingress.kubernetes.io/canary-weight"])
+			}
+			return false, nil, nil
+		}
+
+		write, ok := action.(interface{ GetObject() runtime.Object })
+		if !ok {
+			return false, nil, nil
+		}
+		ing := write.GetObject().(*networkingv1.Ingress)
+		weights = append(weights, ing.Annotations["nginx.ingress.kubernetes.io/canary-weight"])
+		canary = ing.DeepCopy()
+		return false, nil, nil
+	})
+
+	var canarySvc *corev1.Service
+	h.Client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		canarySvc = action.(k8stesting.CreateAction).GetObject().(*corev1.Service).DeepCopy()
+		return false, nil, nil
+	})
+
+	errs := h.process(t, canaryRequest("req-22", map[string]interface{}{
+		"steps":   []int{10, 50},
+		"traffic": "nginx",
+		"ingress": "api",
+		"service": "api",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(weights) != 2 || weights[0] != "10" || weights[1] != "50" {
+		t.Errorf("canary weights = %v, want [10 50]", weights)
+	}
+	if canary == nil || canary.Name != "api-canary" || len(canary.Spec.TLS) != 0 {
+		t.Fatalf("canary ingress = %+v, want api-canary without tls", canary)
+	}
+	if be := canary.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name; be != "api-canary" {
+		t.Errorf("canary ingress backend = %s, want api-canary", be)
+	}
+	if canarySvc == nil || canarySvc.Spec.Selector[trackLabel] != "canary" || canarySvc.Spec.ClusterIP != "" {
+		t.Errorf("canary service = %+v, want a fresh service selecting the canary track", canarySvc)
+	}
+
+	ctx := context.Background()
+	if _, err := h.Client.NetworkingV1().Ingresses("default").Get(ctx, "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary ingress still there after promotion: %v", err)
+	}
+	if _, err := h.Client.CoreV1().Services("default").Get(ctx, "api-canary", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("canary service still there after promotion: %v", err)
+	}
+	// nginx canaries leave the stable replica count alone
+	if got := scaledTo(h.Client, "api"); len(got) != 1 || got[0] != 2 {
+		t.Errorf("stable scaled to %v, want only the promotion at 2", got)
+	}
+}
+
+func TestListenForEventsDeployCanaryHTTPRoute(t *testing.T) {
+	h := newHarness(t,
+		testRolloutDeployment("api", "default", "registry.test/api:v1", 2),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "api"},
+				Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+	)
+	rollOut(h.Client)
+
+	// only the older gateway api is installed
+	gvr := schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "httproutes"}
+	h.Client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: gvr.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: "httproutes", Kind: "HTTPRoute", Namespaced: true}},
+	}}
+	rules := []interface{}{map[string]interface{}{
+		"backendRefs": []interface{}{map[string]interface{}{"name": "api", "port": int64(80)}},
+	}}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "HTTPRouteList"},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "gateway.networking.k8s.io/v1beta1",
+			"kind":       "HTTPRoute",
+			"metadata":   map[string]interface{}{"name": "api", "namespace": "default", "resourceVersion": "5"},
+			"spec":       map[string]interface{}{"rules": runtime.DeepCopyJSONValue(rules)},
+		}},
+	)
+	h.Agent.KubernetesClient.Dynamic = dyn
+	staleOnce(dyn, "httproutes")
+
+	errs := h.process(t, canaryRequest("req-23", map[string]interface{}{
+		"steps":     []int{30},
+		"traffic":   "httproute",
+		"httproute": "api",
+		"service":   "api",
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var weights [][]interface{}
+	for _, action := range dyn.Actions() {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok {
+			continue
+		}
+		if patch.GetPatchType() != types.JSONPatchType {
+			t.Fatalf("route patched with %s, want a json patch", patch.GetPatchType())
+		}
+		var ops []struct {
+			Op    string          `json:"op"`
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		var rules []map[string]interface{}
+		if err := json.Unmarshal(patch.GetPatch(), &ops); err != nil || len(ops) != 2 || ops[0].Op != "test" || ops[1].Path != "/spec/rules" {
+			t.Fatalf("route patch = %s, want a test then the rules", patch.GetPatch())
+		}
+		if err := json.Unmarshal(ops[1].Value, &rules); err != nil || len(rules) != 1 {
+			t.Fatalf("route patch = %s, want one rule", patch.GetPatch())
+		}
+		refs := rules[0]["backendRefs"].([]interface{})
+		weights = append(weights, refs)
+	}
+	// refused once for the other write, then the weights and the reset
+	if len(weights) != 3 || len(weights[1]) != 2 || len(weights[2]) != 1 {
+		t.Fatalf("route backends = %v, want split then put back", weights)
+	}
+	if canary := weights[1][1].(map[string]interface{}); canary["name"] != "api-canary" || canary["weight"] != float64(30) {
+		t.Errorf("canary backend = %v, want api-canary at 30", canary)
+	}
+
+	route, err := dyn.Resource(gvr).Namespace("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get route: %v", err)
+	}
+	got, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	if !reflect.DeepEqual(got, rules) {
+		t.Errorf("route rules = %v, want %v back", got, rules)
+	}
+
+	var resp struct {
+		Promoted  bool  `json:"promoted"`
+		Conflicts int32 `json:"conflicts"`
+	}
+	responses := h.Server.responses()
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Promoted || resp.Conflicts != 1 {
+		t.Errorf("response = %+v, want promoted after 1 conflict", resp)
+	}
+}
+
+func blueGreenRequest(requestID, grace string) map[string]interface{} {
+	return map[string]interface{}{
+		"action":     "deploy",
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": "bluegreen",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+			"bluegreen": map[string]string{
+				"service": "api",
+				"grace":   grace,
+			},
+		},
+	}
+}
+
+func testSelectorService(selector map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector: selector,
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+}
+
+// patchedSelector is the selector a json patch to a service sets
+func patchedSelector(action k8stesting.Action) (map[string]string, bool) {
+	patch, ok := action.(k8stesting.PatchAction)
+	if !ok || patch.GetResource().Resource != "services" {
+		return nil, false
+	}
+
+	var ops []struct {
+		Path  string            `json:"path"`
+		Value map[string]string `json:"value"`
+	}
+	if err := json.Unmarshal(patch.GetPatch(), &ops); err != nil {
+		return nil, false
+	}
+	for _, op := range ops {
+		if op.Path == "/spec/selector" {
+			return op.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// selectors lists every selector the service was written with, in order
+func selectors(client *fake.Clientset) []map[string]string {
+	var out []map[string]string
+	for _, action := range client.Actions() {
+		if selector, ok := patchedSelector(action); ok {
+			out = append(out, selector)
+		}
+	}
+
+	return out
+}
+
+func TestListenForEventsDeployBlueGreen(t *testing.T) {
+	isController := true
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v1", 2)
+	dep.UID = "dep-uid"
+	dep.Annotations = map[string]string{"deployment.kubernetes.io/revision": "3"}
+
+	h := newHarness(t,
+		dep,
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "api-abc",
+				Namespace:       "default",
+				Labels:          map[string]string{"app": "api", "pod-template-hash": "abc"},
+				Annotations:     map[string]string{"deployment.kubernetes.io/revision": "3"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "api", UID: "dep-uid", Controller: &isController}},
+			},
+		},
+		testSelectorService(map[string]string{"app": "api"}),
+	)
+	rollOut(h.Client)
+
+	errs := h.process(t, blueGreenRequest("req-23", "0s"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got := selectors(h.Client)
+	if len(got) != 2 {
+		t.Fatalf("service selectors = %v, want pinned then switched", got)
+	}
+	if got[0]["pod-template-hash"] != "abc" || got[0]["app"] != "api" {
+		t.Errorf("pinned selector = %v, want app=api pinned to abc", got[0])
+	}
+	if got[1][trackLabel] != "blue" || got[1]["app"] != "api" || got[1]["pod-template-hash"] != "" {
+		t.Errorf("switched selector = %v, want app=api on the blue track", got[1])
+	}
+
+	ctx := context.Background()
+	blue, err := h.Client.AppsV1().Deployments("default").Get(ctx, "api-blue", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blue deployment: %v", err)
+	}
+	if img := blue.Spec.Template.Spec.Containers[0].Image; img != "registry.test/api:v2" || *blue.Spec.Replicas != 2 {
+		t.Errorf("blue = %s with %d replicas, want registry.test/api:v2 with 2", img, *blue.Spec.Replicas)
+	}
+	if blue.Spec.Template.Labels[trackLabel] != "blue" {
+		t.Errorf("blue pod labels = %v, want the blue track", blue.Spec.Template.Labels)
+	}
+	if got := scaledTo(h.Client, "api"); len(got) != 1 || got[0] != 0 {
+		t.Errorf("original scaled to %v, want [0]", got)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 5 {
+		t.Fatalf("published %d responses, want 5", len(responses))
+	}
+	for i, phase := range []string{"deploying", "ready", "switched", "scaled_down"} {
+		var p rolloutProgress
+		if err := json.Unmarshal([]byte(responses[i].Payload), &p); err != nil {
+			t.Fatalf("failed to unmarshal progress: %v", err)
+		}
+		if p.Type != "bluegreen" || p.Phase != phase {
+			t.Errorf("progress %d = %+v, want bluegreen %s", i, p, phase)
+		}
+	}
+
+	var resp struct {
+		Updated  bool   `json:"updated"`
+		Colour   string `json:"colour"`
+		Previous string `json:"previous"`
+	}
+	if err := json.Unmarshal([]byte(responses[4].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.Colour != "blue" || resp.Previous != "api" {
+		t.Errorf("response = %+v, want updated to blue from api", resp)
+	}
+}
+
+func TestListenForEventsDeployBlueGreenColourFailed(t *testing.T) {
+	isController := true
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v1", 2)
+	dep.UID = "dep-uid"
+	dep.Annotations = map[string]string{"deployment.kubernetes.io/revision": "3"}
+
+	h := newHarness(t,
+		dep,
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "api-abc",
+				Namespace:       "default",
+				Labels:          map[string]string{"app": "api", "pod-template-hash": "abc"},
+				Annotations:     map[string]string{"deployment.kubernetes.io/revision": "3"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "api", UID: "dep-uid", Controller: &isController}},
+			},
+		},
+		testSelectorService(map[string]string{"app": "api"}),
+	)
+	h.Client.PrependReactor("create", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("quota exceeded")
+	})
+
+	if errs := h.process(t, blueGreenRequest("req-25", "0s")); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got := selectors(h.Client)
+	if len(got) != 2 || got[0]["pod-template-hash"] != "abc" {
+		t.Fatalf("service selectors = %v, want pinned then restored", got)
+	}
+	svc, err := h.Client.CoreV1().Services("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if !reflect.DeepEqual(svc.Spec.Selector, map[string]string{"app": "api"}) {
+		t.Errorf("service selector = %v, want the original app=api", svc.Spec.Selector)
+	}
+	if scaled := scaledTo(h.Client, "api"); len(scaled) != 0 {
+		t.Errorf("original scaled to %v, want it left running", scaled)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) == 0 {
+		t.Fatal("published no responses")
+	}
+	var resp struct {
+		Updated bool   `json:"updated"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Updated || !strings.Contains(resp.Reason, "quota exceeded") {
+		t.Errorf("response = %+v, want not updated with the create failure", resp)
+	}
+}
+
+func TestListenForEventsDeployBlueGreenReverted(t *testing.T) {
+	blue := testRolloutDeployment("api-blue", "default", "registry.test/api:v1", 2)
+	blue.Labels = map[string]string{"app": "api", trackLabel: "blue"}
+	blue.Spec.Selector = &metav1.LabelSelector{MatchLabels: blue.Labels}
+	blue.Spec.Template.Labels = blue.Labels
+
+	h := newHarness(t,
+		blue,
+		testSelectorService(map[string]string{"app": "api", trackLabel: "blue"}),
+	)
+	rollOut(h.Client)
+
+	// green comes up ready then loses its pods once it has the traffic
+	switched := false
+	h.Client.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector, _ := patchedSelector(action)
+		switched = selector[trackLabel] == "green"
+		return false, nil, nil
+	})
+	h.Client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		if !switched || get.GetName() != "api-green" {
+			return false, nil, nil
+		}
+
+		obj, err := h.Client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), "default", "api-green")
+		if err != nil {
+			return true, nil, err
+		}
+		dep := obj.(*appsv1.Deployment).DeepCopy()
+		dep.Status.ReadyReplicas = 0
+		return true, dep, nil
+	})
+
+	errs := h.process(t, blueGreenRequest("req-24", "1m"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got := selectors(h.Client)
+	if len(got) != 2 || got[0][trackLabel] != "green" || got[1][trackLabel] != "blue" {
+		t.Fatalf("service selectors = %v, want green then back to blue", got)
+	}
+	if scaled := scaledTo(h.Client, "api-green"); len(scaled) != 1 || scaled[0] != 0 {
+		t.Errorf("green scaled to %v, want [0]", scaled)
+	}
+	if scaled := scaledTo(h.Client, "api-blue"); len(scaled) != 0 {
+		t.Errorf("blue scaled to %v, want it left running", scaled)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) == 0 {
+		t.Fatal("published no responses")
+	}
+
+	var resp struct {
+		Updated  bool   `json:"updated"`
+		Reverted bool   `json:"reverted"`
+		Reason   string `json:"reason"`
+		Colour   string `json:"colour"`
+	}
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Updated || !resp.Reverted || resp.Reason == "" || resp.Colour != "green" {
+		t.Errorf("response = %+v, want green reverted with a reason", resp)
+	}
+}
+
+// prometheusStub answers every instant query with value, an empty value
+// answers with no series
+func prometheusStub(t *testing.T, value string) *httptest.Server {
+	t.Helper()
+
+	if value == "" {
+		return prometheusSeries(t)
+	}
+
+	return prometheusSeries(t, value)
+}
+
+// prometheusSeries answers every instant query with a series per value
+func prometheusSeries(t *testing.T, values ...string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" || r.URL.Query().Get("query") == "" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer prom-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		result := []interface{}{}
+		for i, value := range values {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]string{"pod": fmt.Sprintf("api-%d", i)},
+				"value":  []interface{}{1700000000.0, value},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     result,
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func newTestPrometheus(h *harness, address string) *analysis.Prometheus {
+	return analysis.NewPrometheus(address, "prom-token", h.Agent.HTTPClient)
+}
+
+func TestPrometheusQuery(t *testing.T) {
+	h := newHarness(t)
+
+	for _, c := range []struct {
+		name    string
+		values  []string
+		value   float64
+		ok      bool
+		wantErr bool
+	}{
+		{name: "single series", values: []string{"0.25"}, value: 0.25, ok: true},
+		{name: "no series"},
+		{name: "no traffic", values: []string{"NaN"}},
+		{name: "several series", values: []string{"0.1", "0.2"}, wantErr: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			prom := prometheusSeries(t, c.values...)
+			value, ok, err := newTestPrometheus(h, prom.URL).Query(context.Background(), "rate(errors[1m])")
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, want error %t", err, c.wantErr)
+			}
+			if value != c.value || ok != c.ok {
+				t.Errorf("query = %v %t, want %v %t", value, ok, c.value, c.ok)
+			}
+		})
+	}
+}
+
+func analysedImageRequest(requestID string) map[string]interface{} {
+	return map[string]interface{}{
+		"action":     "deploy",
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+			"analysis": map[string]interface{}{
+				"interval": "10ms",
+				"checks": []map[string]interface{}{{
+					"name":  "error-rate",
+					"query": `sum(rate(http_requests_total{code=~"5.."}[1m])) / sum(rate(http_requests_total[1m]))`,
+					"max":   0.05,
+				}},
+			},
+		},
+	}
+}
+
+type analysedResponse struct {
+	Updated    bool   `json:"updated"`
+	RolledBack bool   `json:"rolled_back"`
+	Reason     string `json:"reason"`
+	Analysis   struct {
+		Passed       bool `json:"passed"`
+		Failures     int  `json:"failures"`
+		Measurements []struct {
+			Check  string   `json:"check"`
+			Value  *float64 `json:"value"`
+			Passed bool     `json:"passed"`
+		} `json:"measurements"`
+	} `json:"analysis"`
+}
+
+func TestListenForEventsDeployImageAnalysis(t *testing.T) {
+	prom := prometheusStub(t, "0.01")
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	h.Agent.Analysis = newTestPrometheus(h, prom.URL)
+	rollOut(h.Client)
+
+	errs := h.process(t, analysedImageRequest("req-30"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v2" {
+		t.Errorf("image = %s, want registry.test/api:v2", got)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	var resp analysedResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.RolledBack || !resp.Analysis.Passed {
+		t.Errorf("response = %+v, want updated with analysis passed", resp)
+	}
+	if len(resp.Analysis.Measurements) == 0 {
+		t.Fatal("no measurements in response")
+	}
+	m := resp.Analysis.Measurements[0]
+	if m.Check != "error-rate" || m.Value == nil || *m.Value != 0.01 || !m.Passed {
+		t.Errorf("measurement = %+v, want error-rate 0.01 passed", m)
+	}
+}
+
+func TestListenForEventsDeployImageAnalysisRollback(t *testing.T) {
+	prom := prometheusStub(t, "0.25")
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	h.Agent.Analysis = newTestPrometheus(h, prom.URL)
+	rollOut(h.Client)
+
+	errs := h.process(t, analysedImageRequest("req-31"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want rolled back to registry.test/api:v1", got)
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	var resp analysedResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Updated || !resp.RolledBack || resp.Reason == "" {
+		t.Errorf("response = %+v, want rolled back with a reason", resp)
+	}
+	if resp.Analysis.Passed || resp.Analysis.Failures != 1 {
+		t.Errorf("analysis = %+v, want one failure", resp.Analysis)
+	}
+}
+
+func TestListenForEventsDeployImageAnalysisNotConfigured(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+
+	errs := h.process(t, analysedImageRequest("req-32"))
+	if len(errs) == 0 {
+		t.Fatal("expected an error without an analysis provider")
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if got := dep.Spec.Template.Spec.Containers[0].Image; got != "registry.test/api:v1" {
+		t.Errorf("image = %s, want registry.test/api:v1 untouched", got)
+	}
+}
+
+// overriddenDeployment has the capacity and labels an overrides request
+// changes, plus a label another controller owns
+func overriddenDeployment() *appsv1.Deployment {
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v1", 2)
+	dep.Labels = map[string]string{"app": "api", "owner": "platform"}
+	dep.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("64Mi"),
+		},
+	}
+
+	return dep
+}
+
+func withOverrides(request map[string]interface{}, overrides map[string]interface{}) map[string]interface{} {
+	request["deploy_details"].(map[string]interface{})["overrides"] = overrides
+	return request
+}
+
+func testOverrides() map[string]interface{} {
+	return map[string]interface{}{
+		"replicas": 4,
+		"resources": map[string]interface{}{
+			"requests": map[string]string{"cpu": "250m"},
+			"limits":   map[string]string{"memory": "256Mi"},
+		},
+		"labels":        map[string]string{"tier": "web"},
+		"annotations":   map[string]string{"k8sdeploy.dev/release": "v2"},
+		"node_selector": map[string]string{"pool": "compute"},
+		"tolerations": []map[string]string{{
+			"key": "dedicated", "operator": "Equal", "value": "compute", "effect": "NoSchedule",
+		}},
+	}
+}
+
+func TestListenForEventsDeployImageOverrides(t *testing.T) {
+	h := newHarness(t, overriddenDeployment())
+
+	request := analysedImageRequest("req-80")
+	delete(request["deploy_details"].(map[string]interface{}), "analysis")
+	if errs := h.process(t, withOverrides(request, testOverrides())); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for _, action := range h.Client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("deployment written with a full update")
+		}
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	container := dep.Spec.Template.Spec.Containers[0]
+	if container.Image != "registry.test/api:v2" || *dep.Spec.Replicas != 4 {
+		t.Errorf("image = %s replicas = %d, want v2 on 4 replicas", container.Image, *dep.Spec.Replicas)
+	}
+	requests, limits := container.Resources.Requests, container.Resources.Limits
+	if requests.Cpu().String() != "250m" || requests.Memory().String() != "64Mi" || limits.Memory().String() != "256Mi" {
+		t.Errorf("resources = %+v, want cpu raised and memory request kept", container.Resources)
+	}
+	if dep.Labels["tier"] != "web" || dep.Labels["owner"] != "platform" || dep.Spec.Template.Labels["tier"] != "web" {
+		t.Errorf("labels = %v template = %v, want tier added everywhere", dep.Labels, dep.Spec.Template.Labels)
+	}
+	if dep.Spec.Template.Annotations["k8sdeploy.dev/release"] != "v2" || dep.Spec.Template.Spec.NodeSelector["pool"] != "compute" {
+		t.Errorf("template = %+v, want annotation and node selector", dep.Spec.Template)
+	}
+	if id := dep.Annotations["k8sdeploy.dev/request-id"]; id != "req-80" {
+		t.Errorf("request id = %q, want req-80", id)
+	}
+	if _, ok := dep.Spec.Template.Annotations["k8sdeploy.dev/request-id"]; ok {
+		t.Errorf("template annotations = %v, want the request id left off the pods", dep.Spec.Template.Annotations)
+	}
+	if tol := dep.Spec.Template.Spec.Tolerations; len(tol) != 1 || tol[0].Key != "dedicated" {
+		t.Errorf("tolerations = %+v, want dedicated", tol)
+	}
+
+	var resp struct {
+		Updated   bool `json:"updated"`
+		Overrides struct {
+			Replicas int32 `json:"replicas"`
+		} `json:"overrides"`
+	}
+	if err := json.Unmarshal([]byte(h.Server.responses()[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.Overrides.Replicas != 4 {
+		t.Errorf("response = %+v, want updated with overrides", resp)
+	}
+}
+
+type fakeClient interface {
+	PrependReactor(verb, resource string, reaction k8stesting.ReactionFunc)
+	Tracker() k8stesting.ObjectTracker
+}
+
+// staleOnce has another writer change the object just before the first patch
+// to resource, then refuses any patch that isn't guarded by the version the
+// object has now the way the api server does
+func staleOnce(client fakeClient, resource string) {
+	written := false
+	client.PrependReactor("patch", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		obj, err := client.Tracker().Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return false, nil, nil
+		}
+		meta, err := apimeta.Accessor(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		if !written {
+			written = true
+			meta.SetResourceVersion(meta.GetResourceVersion() + "1")
+			if err := client.Tracker().Update(patch.GetResource(), obj, patch.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+		}
+
+		gr := patch.GetResource().GroupResource()
+		if patch.GetPatchType() == types.JSONPatchType {
+			var ops []struct {
+				Op    string `json:"op"`
+				Path  string `json:"path"`
+				Value string `json:"value"`
+			}
+			_ = json.Unmarshal(patch.GetPatch(), &ops)
+			if len(ops) == 0 || ops[0].Op != "test" || ops[0].Path != "/metadata/resourceVersion" || ops[0].Value != meta.GetResourceVersion() {
+				return true, nil, k8serrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "patch", gr, patch.GetName(), "testing value /metadata/resourceVersion failed: test failed", 0, false)
+			}
+			return false, nil, nil
+		}
+
+		var guard struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		_ = json.Unmarshal(patch.GetPatch(), &guard)
+		if guard.Metadata.ResourceVersion != meta.GetResourceVersion() {
+			return true, nil, k8serrors.NewConflict(gr, patch.GetName(), errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+}
+
+func TestListenForEventsDeployImageConflict(t *testing.T) {
+	h := newHarness(t, overriddenDeployment())
+	staleOnce(h.Client, "deployments")
+
+	request := analysedImageRequest("req-83")
+	delete(request["deploy_details"].(map[string]interface{}), "analysis")
+	if errs := h.process(t, request); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "registry.test/api:v2" {
+		t.Errorf("image = %s, want v2 after the retry", image)
+	}
+
+	var resp struct {
+		Updated   bool  `json:"updated"`
+		Conflicts int32 `json:"conflicts"`
+	}
+	if err := json.Unmarshal([]byte(h.Server.responses()[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.Conflicts != 1 {
+		t.Errorf("response = %+v, want updated after 1 conflict", resp)
+	}
+}
+
+func TestListenForEventsDeployImageOverridesRollback(t *testing.T) {
+	prom := prometheusStub(t, "0.25")
+	h := newHarness(t, overriddenDeployment())
+	h.Agent.Analysis = newTestPrometheus(h, prom.URL)
+	rollOut(h.Client)
+
+	if errs := h.process(t, withOverrides(analysedImageRequest("req-81"), testOverrides())); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	container := dep.Spec.Template.Spec.Containers[0]
+	if container.Image != "registry.test/api:v1" || *dep.Spec.Replicas != 2 {
+		t.Errorf("image = %s replicas = %d, want v1 on 2 replicas", container.Image, *dep.Spec.Replicas)
+	}
+	if container.Resources.Requests.Cpu().String() != "100m" || len(container.Resources.Limits) != 0 {
+		t.Errorf("resources = %+v, want the original requests only", container.Resources)
+	}
+	if _, ok := dep.Labels["tier"]; ok || dep.Labels["owner"] != "platform" {
+		t.Errorf("labels = %v, want tier removed and owner kept", dep.Labels)
+	}
+	if len(dep.Annotations) != 0 {
+		t.Errorf("annotations = %v, want the request id and release removed", dep.Annotations)
+	}
+	if _, ok := dep.Spec.Template.Labels["tier"]; ok || dep.Spec.Template.Labels["app"] != "api" {
+		t.Errorf("template labels = %v, want the original", dep.Spec.Template.Labels)
+	}
+	if len(dep.Spec.Template.Annotations) != 0 {
+		t.Errorf("template annotations = %v, want the release removed", dep.Spec.Template.Annotations)
+	}
+	if len(dep.Spec.Template.Spec.NodeSelector) != 0 || len(dep.Spec.Template.Spec.Tolerations) != 0 {
+		t.Errorf("pod spec = %+v, want node selector and tolerations removed", dep.Spec.Template.Spec)
+	}
+}
+
+func TestListenForEventsDeploySameImage(t *testing.T) {
+	before := testRolloutDeployment("api", "default", "registry.test/api:v2", 2)
+	before.Annotations = map[string]string{"k8sdeploy.dev/request-id": "req-82"}
+	h := newHarness(t, before)
+
+	errs := h.process(t, map[string]interface{}{
+		"action":     "deploy",
+		"request_id": "req-83",
+		"action_details": map[string]string{
+			"type": "image",
+		},
+		"deploy_details": map[string]interface{}{
+			"k8s": map[string]string{
+				"name":      "api",
+				"namespace": "default",
+			},
+			"image": map[string]string{
+				"container_url": "registry.test/api",
+				"tag":           "v2",
+			},
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if !reflect.DeepEqual(dep.Spec.Template, before.Spec.Template) {
+		t.Errorf("template = %+v, want it untouched so the pods aren't restarted", dep.Spec.Template)
+	}
+	// the controller would copy a new id onto the replica set req-82 made
+	if id := dep.Annotations["k8sdeploy.dev/request-id"]; id != "req-82" {
+		t.Errorf("request id = %q, want req-82 kept", id)
+	}
+}
+
+func TestListenForEventsDeployOverridesRejected(t *testing.T) {
+	h := newHarness(t, overriddenDeployment())
+
+	request := analysedImageRequest("req-82")
+	delete(request["deploy_details"].(map[string]interface{}), "analysis")
+	errs := h.process(t, withOverrides(request, map[string]interface{}{
+		"labels": map[string]string{"app": "web"},
+	}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error for a label in the selector")
+	}
+
+	canary := canaryRequest("req-83", map[string]interface{}{"steps": []map[string]interface{}{{"weight": 50}}})
+	if errs := h.process(t, withOverrides(canary, map[string]interface{}{"replicas": 3})); len(errs) == 0 {
+		t.Fatal("expected an error for overrides on a canary deploy")
+	}
+
+	for _, action := range h.Client.Actions() {
+		if action.GetVerb() == "patch" || action.GetVerb() == "update" {
+			t.Errorf("deployment written by a rejected request")
+		}
+	}
+}
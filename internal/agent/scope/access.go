@@ -0,0 +1,105 @@
+package scope
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Permission is a single verb on a resource, an empty namespace means cluster
+// wide and an empty name means any object
+type Permission struct {
+	Group     string `json:"group"`
+	Resource  string `json:"resource"`
+	Verb      string `json:"verb"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource = fmt.Sprintf("%s.%s", p.Resource, p.Group)
+	}
+	if p.Name != "" {
+		resource = fmt.Sprintf("%s/%s", resource, p.Name)
+	}
+	if p.Namespace == "" {
+		return fmt.Sprintf("%s %s", p.Verb, resource)
+	}
+
+	return fmt.Sprintf("%s %s in %s", p.Verb, resource, p.Namespace)
+}
+
+// Required lists the permissions the agent needs for the given scope, from
+// what the handlers check in a namespace and the ones only checked cluster
+// wide, which a scoped agent never asks for
+func Required(namespaces Namespaces, namespaced, clusterWide []Permission) []Permission {
+	namespaced = unique(namespaced)
+	if !namespaces.Scoped() {
+		return append(unique(clusterWide), namespaced...)
+	}
+
+	var perms []Permission
+	for _, ns := range namespaces {
+		for _, p := range namespaced {
+			p.Namespace = ns
+			perms = append(perms, p)
+		}
+	}
+
+	return perms
+}
+
+// unique drops repeats and sorts what's left, the handlers share most of
+// their permissions and keep them in maps
+func unique(perms []Permission) []Permission {
+	seen := map[Permission]bool{}
+	out := make([]Permission, 0, len(perms))
+	for _, p := range perms {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		out = append(out, p)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].String() < out[b].String()
+	})
+
+	return out
+}
+
+// Review asks the api server which of the permissions the agent holds
+func Review(ctx context.Context, cs kubernetes.Interface, perms []Permission) (Capabilities, error) {
+	caps := make(Capabilities, 0, len(perms))
+
+	for _, p := range perms {
+		review, err := cs.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: p.Namespace,
+					Verb:      p.Verb,
+					Group:     p.Group,
+					Resource:  p.Resource,
+					Name:      p.Name,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, logs.Errorf("failed to review %s: %v", p, err)
+		}
+
+		caps = append(caps, Capability{
+			Permission: p,
+			Allowed:    review.Status.Allowed,
+		})
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,83 @@
+package scope
+
+import (
+	"encoding/json"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+type Capability struct {
+	Permission
+	Allowed bool `json:"allowed"`
+}
+
+// Capabilities is the matrix of reviewed permissions for a cluster
+type Capabilities []Capability
+
+// Permitted reports whether p was allowed, a cluster wide grant covers every
+// namespace and anything that was never reviewed is left to the api server
+func (c Capabilities) Permitted(p Permission) bool {
+	for _, capability := range c {
+		if capability.Group != p.Group || capability.Resource != p.Resource || capability.Verb != p.Verb || capability.Name != p.Name {
+			continue
+		}
+		if capability.Namespace == p.Namespace || capability.Namespace == "" {
+			return capability.Allowed
+		}
+	}
+
+	return true
+}
+
+// Check returns a not permitted error for the first permission the agent is
+// missing
+func (c Capabilities) Check(perms ...Permission) error {
+	for _, p := range perms {
+		if !c.Permitted(p) {
+			return logs.Errorf("not permitted: %s", p)
+		}
+	}
+
+	return nil
+}
+
+func (c Capabilities) Missing() []Permission {
+	var missing []Permission
+	for _, capability := range c {
+		if !capability.Allowed {
+			missing = append(missing, capability.Permission)
+		}
+	}
+
+	return missing
+}
+
+// In sets the namespace on each permission
+func In(namespace string, perms ...Permission) []Permission {
+	ret := make([]Permission, 0, len(perms))
+	for _, p := range perms {
+		p.Namespace = namespace
+		ret = append(ret, p)
+	}
+
+	return ret
+}
+
+// DeniedResponse is sent back to the orchestrator in place of the handler's
+// response when a request is refused before it reaches the cluster
+func DeniedResponse(requestID string, err error) string {
+	type Resp struct {
+		RequestID string `json:"request_id"`
+		Error     string `json:"error"`
+	}
+
+	r, merr := json.Marshal(Resp{
+		RequestID: requestID,
+		Error:     err.Error(),
+	})
+	if merr != nil {
+		return ""
+	}
+
+	return string(r)
+}
@@ -0,0 +1,36 @@
+package scope
+
+import (
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+// Namespaces is the set of namespaces the agent may touch, empty means the
+// whole cluster
+type Namespaces []string
+
+func (n Namespaces) Scoped() bool {
+	return len(n) > 0
+}
+
+func (n Namespaces) Allows(namespace string) bool {
+	if !n.Scoped() {
+		return true
+	}
+
+	for _, ns := range n {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check is Allows with an error that can go straight back to the orchestrator
+func (n Namespaces) Check(namespace string) error {
+	if n.Allows(namespace) {
+		return nil
+	}
+
+	return logs.Errorf("namespace %q is outside the agent scope %v", namespace, []string(n))
+}
@@ -0,0 +1,168 @@
+package sealed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"strings"
+)
+
+// Algorithm is published alongside the public key so the orchestrator knows
+// how to seal values to it
+const Algorithm = "x25519-sha256-aes256gcm"
+
+// Box is an x25519 key pair, a value sealed to it is the key id, a colon,
+// then base64 of the ephemeral public key, the gcm nonce and the ciphertext
+type Box struct {
+	id      string
+	private *ecdh.PrivateKey
+}
+
+func GenerateBox() (*Box, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, logs.Errorf("failed to generate key: %v", err)
+	}
+
+	return newBox(private), nil
+}
+
+// NewBox loads a private key stored by Private
+func NewBox(encoded string) (*Box, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, logs.Errorf("failed to decode private key: %v", err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, logs.Errorf("failed to load private key: %v", err)
+	}
+
+	return newBox(private), nil
+}
+
+func newBox(private *ecdh.PrivateKey) *Box {
+	return &Box{
+		id:      keyID(private.PublicKey().Bytes()),
+		private: private,
+	}
+}
+
+func keyID(public []byte) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (b *Box) ID() string {
+	return b.id
+}
+
+func (b *Box) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(b.private.PublicKey().Bytes())
+}
+
+// Private is only for storing the key, it must never be logged or sent
+func (b *Box) Private() string {
+	return base64.StdEncoding.EncodeToString(b.private.Bytes())
+}
+
+func (b *Box) Open(value string) ([]byte, error) {
+	id, body, ok := strings.Cut(value, ":")
+	if !ok || id != b.id {
+		return nil, logs.Errorf("value isn't sealed to key %s", b.id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, logs.Errorf("failed to decode sealed value: %v", err)
+	}
+
+	curve := ecdh.X25519()
+	if len(raw) < 32 {
+		return nil, logs.Error("sealed value is too short")
+	}
+	ephemeral, err := curve.NewPublicKey(raw[:32])
+	if err != nil {
+		return nil, logs.Errorf("failed to load ephemeral key: %v", err)
+	}
+	shared, err := b.private.ECDH(ephemeral)
+	if err != nil {
+		return nil, logs.Errorf("failed to agree key: %v", err)
+	}
+
+	aead, err := boxCipher(shared, raw[:32], b.private.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	rest := raw[32:]
+	if len(rest) < aead.NonceSize() {
+		return nil, logs.Error("sealed value is too short")
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(b.id))
+	if err != nil {
+		return nil, logs.Error("failed to open sealed value")
+	}
+
+	return plain, nil
+}
+
+// SealTo seals plain to a published public key, it is what the orchestrator
+// does and what re-encryption uses to move a value onto the current key
+func SealTo(publicKey string, plain []byte) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", logs.Errorf("failed to decode public key: %v", err)
+	}
+
+	curve := ecdh.X25519()
+	recipient, err := curve.NewPublicKey(raw)
+	if err != nil {
+		return "", logs.Errorf("failed to load public key: %v", err)
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", logs.Errorf("failed to generate ephemeral key: %v", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", logs.Errorf("failed to agree key: %v", err)
+	}
+
+	aead, err := boxCipher(shared, ephemeral.PublicKey().Bytes(), raw)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", logs.Errorf("failed to create nonce: %v", err)
+	}
+
+	id := keyID(raw)
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = aead.Seal(out, nonce, plain, []byte(id))
+
+	return id + ":" + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// boxCipher derives the aes key from the shared secret and both public keys
+func boxCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, logs.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, logs.Errorf("failed to create gcm: %v", err)
+	}
+
+	return aead, nil
+}
@@ -0,0 +1,175 @@
+package sealed
+
+import (
+	"github.com/bugfixes/go-bugfixes/logs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keyring opens values sealed to the current box or to any of the boxes it
+// was rotated away from, values without a key id go to the shared key
+type Keyring struct {
+	mu         sync.RWMutex
+	boxes      []*Box
+	keep       int
+	shared     Opener
+	reload     func() ([]*Box, error)
+	interval   time.Duration
+	lastReload time.Time
+}
+
+// NewKeyring takes the current box first, keep is how many old boxes are
+// kept around after a rotation so values sealed before it still open
+func NewKeyring(boxes []*Box, keep int) (*Keyring, error) {
+	if len(boxes) == 0 {
+		return nil, logs.Error("keyring needs at least one key")
+	}
+	if keep < 0 {
+		keep = 0
+	}
+
+	return &Keyring{
+		boxes: boxes,
+		keep:  keep,
+	}, nil
+}
+
+// SetShared keeps the aes key working for values sealed before the agent had
+// a public key
+func (k *Keyring) SetShared(shared Opener) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.shared = shared
+}
+
+// SetReload is how the keyring picks up a rotation another replica made, it
+// is tried when a value turns up for a key id it doesn't know, at most once
+// every interval
+func (k *Keyring) SetReload(reload func() ([]*Box, error), interval time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.reload = reload
+	k.interval = interval
+}
+
+func (k *Keyring) Current() *Box {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.boxes[0]
+}
+
+// Boxes is the current box followed by the retired ones, newest first
+func (k *Keyring) Boxes() []*Box {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return append([]*Box{}, k.boxes...)
+}
+
+func (k *Keyring) Open(value string) ([]byte, error) {
+	id, _, ok := strings.Cut(value, ":")
+	if !ok {
+		k.mu.RLock()
+		shared := k.shared
+		k.mu.RUnlock()
+		if shared == nil {
+			return nil, logs.Error("value has no key id and there is no shared key")
+		}
+		return shared.Open(value)
+	}
+
+	box := k.find(id)
+	if box == nil && k.refresh() {
+		box = k.find(id)
+	}
+	if box == nil {
+		return nil, logs.Errorf("no key %s, it may have been retired", id)
+	}
+
+	return box.Open(value)
+}
+
+func (k *Keyring) find(id string) *Box {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, b := range k.boxes {
+		if b.ID() == id {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// refresh reloads the boxes unless that was done within the interval, a
+// value for a key nobody has shouldn't cause a read for every secret in the
+// request
+func (k *Keyring) refresh() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.reload == nil || (!k.lastReload.IsZero() && time.Since(k.lastReload) < k.interval) {
+		return false
+	}
+	k.lastReload = time.Now()
+
+	boxes, err := k.reload()
+	if err != nil || len(boxes) == 0 {
+		_ = logs.Errorf("failed to reload keys: %v", err)
+		return false
+	}
+	k.boxes = boxes
+
+	return true
+}
+
+// Rotate makes next the current box and drops anything past keep, store
+// reads the saved set, passes it through rotate and saves the result, so a
+// rotation another replica made is built on rather than overwritten, rotate
+// can be called again if the save has to be retried
+func (k *Keyring) Rotate(next *Box, store func(rotate func(saved []*Box) []*Box) error) ([]*Box, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var boxes, retired []*Box
+	err := store(func(saved []*Box) []*Box {
+		if len(saved) == 0 {
+			saved = k.boxes
+		}
+		boxes = append([]*Box{next}, saved...)
+		retired = nil
+		if len(boxes) > k.keep+1 {
+			retired = boxes[k.keep+1:]
+			boxes = boxes[:k.keep+1]
+		}
+		return boxes
+	})
+	if err != nil {
+		return nil, err
+	}
+	k.boxes = boxes
+
+	return retired, nil
+}
+
+// Reseal moves a value onto the current key without the plaintext leaving
+// the agent, values already on it come back as they are
+func (k *Keyring) Reseal(value string) (string, error) {
+	current := k.Current()
+	if id, _, ok := strings.Cut(value, ":"); ok && id == current.ID() {
+		return value, nil
+	}
+
+	plain, err := k.Open(value)
+	if err != nil {
+		return "", err
+	}
+	defer clear(plain)
+
+	return SealTo(current.PublicKey(), plain)
+}
@@ -0,0 +1,72 @@
+package sealed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+// Opener decrypts a value sealed for this agent, the plaintext only ever
+// lives in memory on its way into a secret
+type Opener interface {
+	Open(value string) ([]byte, error)
+}
+
+// Key is a shared aes-256 key, values are base64 of the gcm nonce followed by
+// the ciphertext
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKey takes the key base64 encoded, as it comes out of the environment
+func NewKey(encoded string) (*Key, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, logs.Errorf("failed to decode sealing key: %v", err)
+	}
+	if len(raw) != 32 {
+		return nil, logs.Errorf("sealing key is %d bytes, want 32", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, logs.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, logs.Errorf("failed to create gcm: %v", err)
+	}
+
+	return &Key{aead: aead}, nil
+}
+
+func (k *Key) Open(value string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, logs.Errorf("failed to decode sealed value: %v", err)
+	}
+	if len(raw) < k.aead.NonceSize() {
+		return nil, logs.Error("sealed value is too short")
+	}
+
+	nonce, ciphertext := raw[:k.aead.NonceSize()], raw[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		// the gcm error never includes the plaintext, but say as little as possible
+		return nil, logs.Error("failed to open sealed value")
+	}
+
+	return plain, nil
+}
+
+// Seal is the other half of Open, the orchestrator does the same
+func (k *Key) Seal(plain []byte) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", logs.Errorf("failed to create nonce: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(k.aead.Seal(nonce, nonce, plain, nil)), nil
+}
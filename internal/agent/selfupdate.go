@@ -0,0 +1,402 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/queue"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	versionAnnotation = "k8sdeploy.dev/version"
+	updateAnnotation  = "k8sdeploy.dev/update-request-id"
+)
+
+// an update is reported twice under its request id, once the deployment is
+// patched and again when the rollout has finished or failed
+const (
+	updatePatched       = "patched"
+	updateRolledOut     = "rolled_out"
+	updateRolloutFailed = "rollout_failed"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+type UpdateRequest struct {
+	RequestID string `json:"request_id"`
+	Version   string `json:"version"`
+	Image     string `json:"image"`
+	Digest    string `json:"digest"`
+	Signature string `json:"signature"`
+}
+
+type UpdateResponse struct {
+	RequestID   string    `json:"request_id"`
+	Updated     bool      `json:"updated"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Image       string    `json:"image"`
+	Phase       string    `json:"phase"`
+	Error       string    `json:"error,omitempty"`
+	UpdateTime  time.Time `json:"update_time"`
+}
+
+// signaturePayload is what the orchestrator signs with the agent secret
+func (u UpdateRequest) signaturePayload() string {
+	return strings.Join([]string{u.RequestID, u.Version, u.Image, u.Digest}, "\n")
+}
+
+func (a *Agent) verifyUpdate(u UpdateRequest, currentImage string) error {
+	if u.RequestID == "" {
+		return logs.Error("request_id is required")
+	}
+	if u.Version == "" {
+		return logs.Error("version is required")
+	}
+	if !digestPattern.MatchString(u.Digest) {
+		return logs.Errorf("invalid digest: %s", u.Digest)
+	}
+	if repository(u.Image) != repository(currentImage) {
+		return logs.Errorf("image %s does not match current repository %s", u.Image, repository(currentImage))
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.Config.K8sDeploy.Credentials.Agent.Secret))
+	mac.Write([]byte(u.signaturePayload()))
+	sig, err := hex.DecodeString(u.Signature)
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return logs.Error("signature does not match")
+	}
+
+	// a version that can't be compared, like a dev build, could be a downgrade
+	// so it needs the same opt in
+	if a.Config.K8sDeploy.Self.AllowDowngrade {
+		return nil
+	}
+	newer, known := compareVersions(u.Version, a.Config.K8sDeploy.BuildVersion)
+	if !known {
+		return logs.Errorf("refusing update from %q to %q, versions can't be compared", a.Config.K8sDeploy.BuildVersion, u.Version)
+	}
+	if newer < 0 {
+		return logs.Errorf("refusing downgrade from %s to %s", a.Config.K8sDeploy.BuildVersion, u.Version)
+	}
+
+	return nil
+}
+
+func (a *Agent) handleSelfUpdate(ctx context.Context, message string) error {
+	var u UpdateRequest
+	if err := json.Unmarshal([]byte(message), &u); err != nil {
+		return logs.Errorf("failed to unmarshal update: %v", err)
+	}
+
+	// the master queue is read with requeue, so the same instruction keeps
+	// arriving until the orchestrator removes it
+	if u.Version == a.Config.K8sDeploy.BuildVersion || !a.claimUpdate(u.RequestID) {
+		return nil
+	}
+	defer a.finishUpdate()
+
+	resp := UpdateResponse{
+		RequestID:   u.RequestID,
+		FromVersion: a.Config.K8sDeploy.BuildVersion,
+		ToVersion:   u.Version,
+		Image:       fmt.Sprintf("%s@%s", repository(u.Image), u.Digest),
+		Phase:       updatePatched,
+	}
+	generation, updateErr := a.selfUpdate(ctx, u)
+	if updateErr != nil {
+		resp.Error = updateErr.Error()
+	} else {
+		resp.Updated = true
+	}
+	resp.UpdateTime = time.Now()
+
+	r, err := json.Marshal(resp)
+	if err != nil {
+		return logs.Errorf("failed to marshal update response: %v", err)
+	}
+
+	// this pod is likely replaced by the rollout it started, so the patch is
+	// reported straight away and the rollout separately
+	if err := a.publishResponse(ctx, u.RequestID, string(r)); err != nil {
+		return err
+	}
+	if updateErr != nil {
+		return nil
+	}
+
+	return a.reportRollout(ctx, resp, generation)
+}
+
+// reportUpdate finishes reporting the self update that started this pod, the
+// pod that patched the deployment is usually stopped before the rollout is
+// done so it can't say so itself
+func (a *Agent) reportUpdate(ctx context.Context) {
+	if !a.Config.SelfUpdate {
+		return
+	}
+
+	self := a.Config.K8sDeploy.Self
+	dep, err := a.KubernetesClient.ClientSet.AppsV1().Deployments(self.Namespace).Get(ctx, self.Deployment, metav1.GetOptions{})
+	if err != nil {
+		_ = logs.Errorf("failed to get agent deployment: %v", err)
+		return
+	}
+	requestID := dep.Annotations[updateAnnotation]
+	if requestID == "" || dep.Annotations[versionAnnotation] != a.Config.K8sDeploy.BuildVersion {
+		return
+	}
+
+	resp := UpdateResponse{
+		RequestID: requestID,
+		ToVersion: a.Config.K8sDeploy.BuildVersion,
+	}
+	for _, c := range dep.Spec.Template.Spec.Containers {
+		if c.Name == self.Container {
+			resp.Image = c.Image
+		}
+	}
+	if err := a.reportRollout(ctx, resp, dep.Generation); err != nil {
+		_ = logs.Errorf("failed to report agent update: %v", err)
+	}
+}
+
+// reportRollout waits for the rollout and publishes how it went, the old pod
+// and the new ones all wait on it and whichever claims the report first sends it
+func (a *Agent) reportRollout(ctx context.Context, resp UpdateResponse, generation int64) error {
+	rolloutErr := a.waitForRollout(ctx, generation)
+	if !a.claimRolloutReport(ctx, resp.RequestID) {
+		return rolloutErr
+	}
+
+	resp.Updated = true
+	resp.Phase = updateRolledOut
+	if rolloutErr != nil {
+		resp.Phase = updateRolloutFailed
+		resp.Error = rolloutErr.Error()
+	}
+	resp.UpdateTime = time.Now()
+
+	r, err := json.Marshal(resp)
+	if err != nil {
+		return logs.Errorf("failed to marshal update response: %v", err)
+	}
+	if err := a.publishResponse(ctx, resp.RequestID, string(r)); err != nil {
+		return err
+	}
+	if rolloutErr != nil {
+		return logs.Errorf("agent update to %s didn't roll out: %v", resp.ToVersion, rolloutErr)
+	}
+
+	return nil
+}
+
+// claimRolloutReport takes the update request id off the deployment, the
+// json patch tests for it first so only one pod gets to
+func (a *Agent) claimRolloutReport(ctx context.Context, requestID string) bool {
+	self := a.Config.K8sDeploy.Self
+	path := "/metadata/annotations/" + strings.ReplaceAll(updateAnnotation, "/", "~1")
+	patch, err := json.Marshal([]map[string]string{
+		{"op": "test", "path": path, "value": requestID},
+		{"op": "remove", "path": path},
+	})
+	if err != nil {
+		_ = logs.Errorf("failed to marshal patch: %v", err)
+		return false
+	}
+
+	deps := a.KubernetesClient.ClientSet.AppsV1().Deployments(self.Namespace)
+	if _, err := deps.Patch(ctx, self.Deployment, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		logs.Infof("update %s already reported: %v", requestID, err)
+		return false
+	}
+
+	return true
+}
+
+// selfUpdate patches the agent deployment, the generation it returns is the
+// one the rollout has to reach
+func (a *Agent) selfUpdate(ctx context.Context, u UpdateRequest) (int64, error) {
+	self := a.Config.K8sDeploy.Self
+	deps := a.KubernetesClient.ClientSet.AppsV1().Deployments(self.Namespace)
+
+	dep, err := deps.Get(ctx, self.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return 0, logs.Errorf("failed to get agent deployment: %v", err)
+	}
+
+	currentImage := ""
+	for _, c := range dep.Spec.Template.Spec.Containers {
+		if c.Name == self.Container {
+			currentImage = c.Image
+		}
+	}
+	if currentImage == "" {
+		return 0, logs.Errorf("container %s not found in %s", self.Container, self.Deployment)
+	}
+
+	if err := a.verifyUpdate(u, currentImage); err != nil {
+		return 0, logs.Errorf("failed to verify update: %v", err)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				versionAnnotation: u.Version,
+				updateAnnotation:  u.RequestID,
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						versionAnnotation: u.Version,
+					},
+				},
+				"spec": map[string]interface{}{
+					"containers": []map[string]string{
+						{
+							"name":  self.Container,
+							"image": fmt.Sprintf("%s@%s", repository(u.Image), u.Digest),
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return 0, logs.Errorf("failed to marshal patch: %v", err)
+	}
+
+	updated, err := deps.Patch(ctx, self.Deployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return 0, logs.Errorf("failed to patch agent deployment: %v", err)
+	}
+
+	return updated.Generation, nil
+}
+
+// waitForRollout polls until every replica is running the new template, the
+// pod that patched the deployment is often stopped while it waits, so the new
+// pods wait on it too from reportUpdate
+func (a *Agent) waitForRollout(ctx context.Context, generation int64) error {
+	self := a.Config.K8sDeploy.Self
+	deps := a.KubernetesClient.ClientSet.AppsV1().Deployments(self.Namespace)
+
+	return wait.PollUntilContextTimeout(ctx, 5*time.Second, self.UpdateTimeout, true, func(ctx context.Context) (bool, error) {
+		dep, err := deps.Get(ctx, self.Deployment, metav1.GetOptions{})
+		if err != nil {
+			return false, logs.Errorf("failed to get agent deployment: %v", err)
+		}
+
+		return rolledOut(dep, generation), nil
+	})
+}
+
+func rolledOut(dep *appsv1.Deployment, generation int64) bool {
+	if dep.Status.ObservedGeneration < generation {
+		return false
+	}
+
+	replicas := int32(1)
+	if dep.Spec.Replicas != nil {
+		replicas = *dep.Spec.Replicas
+	}
+
+	return dep.Status.UpdatedReplicas == replicas &&
+		dep.Status.AvailableReplicas == replicas &&
+		dep.Status.Replicas == replicas
+}
+
+func (a *Agent) claimUpdate(requestID string) bool {
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+
+	if a.updating || a.handledUpdates[requestID] {
+		return false
+	}
+	a.updating = true
+	a.handledUpdates[requestID] = true
+
+	return true
+}
+
+func (a *Agent) finishUpdate() {
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+
+	a.updating = false
+}
+
+func (a *Agent) publishResponse(ctx context.Context, requestID, response string) error {
+	return queue.Publish(ctx, a.Config, a.HTTPClient, requestID, response)
+}
+
+// repository strips the tag or digest from an image reference
+func repository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	return image
+}
+
+// compareVersions returns -1, 0 or 1 comparing a to b, known is false when
+// either isn't a semantic version (e.g. dev builds)
+func compareVersions(a, b string) (int, bool) {
+	av, aok := parseVersion(a)
+	bv, bok := parseVersion(b)
+	if !aok || !bok {
+		return 0, false
+	}
+
+	for i := range av {
+		switch {
+		case av[i] < bv[i]:
+			return -1, true
+		case av[i] > bv[i]:
+			return 1, true
+		}
+	}
+
+	return 0, true
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return parsed, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+
+	return parsed, true
+}
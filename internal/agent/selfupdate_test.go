@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k8sdeploy/agent/internal/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testUpdateSecret = "agent-secret"
+	testDigest       = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+func signedUpdate(version string) UpdateRequest {
+	u := UpdateRequest{
+		RequestID: "req-upd",
+		Version:   version,
+		Image:     "registry.test/agent:" + version,
+		Digest:    testDigest,
+	}
+
+	mac := hmac.New(sha256.New, []byte(testUpdateSecret))
+	mac.Write([]byte(u.signaturePayload()))
+	u.Signature = hex.EncodeToString(mac.Sum(nil))
+
+	return u
+}
+
+func updateAgent(buildVersion string, allowDowngrade bool) *Agent {
+	a := &Agent{Config: &config.Config{}}
+	a.Config.K8sDeploy.Credentials.Agent.Secret = testUpdateSecret
+	a.Config.K8sDeploy.BuildVersion = buildVersion
+	a.Config.K8sDeploy.Self.AllowDowngrade = allowDowngrade
+
+	return a
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		want  int
+		known bool
+	}{
+		{"v1.2.3", "1.2.3", 0, true},
+		{"1.10.0", "1.9.9", 1, true},
+		{"1.2", "1.2.1", -1, true},
+		{"2.0.0-rc.1", "1.9.0", 1, true},
+		{"1.2.3", "", 0, false},
+		{"dev", "1.2.3", 0, false},
+		{"1.2.3.4", "1.2.3", 0, false},
+	} {
+		got, known := compareVersions(c.a, c.b)
+		if got != c.want || known != c.known {
+			t.Errorf("compareVersions(%q, %q) = %d, %t, want %d, %t", c.a, c.b, got, known, c.want, c.known)
+		}
+	}
+}
+
+func TestRepository(t *testing.T) {
+	for image, want := range map[string]string{
+		"registry.test/agent:v1":               "registry.test/agent",
+		"registry.test/agent@" + testDigest:    "registry.test/agent",
+		"registry.test/agent:v1@" + testDigest: "registry.test/agent",
+		"registry.test:5000/agent":             "registry.test:5000/agent",
+		"registry.test:5000/team/agent:v1":     "registry.test:5000/team/agent",
+		"agent":                                "agent",
+	} {
+		if got := repository(image); got != want {
+			t.Errorf("repository(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestVerifyUpdate(t *testing.T) {
+	current := "registry.test/agent:1.2.0"
+
+	if err := updateAgent("1.2.0", false).verifyUpdate(signedUpdate("1.3.0"), current); err != nil {
+		t.Errorf("upgrade refused: %v", err)
+	}
+
+	tampered := signedUpdate("1.3.0")
+	tampered.Digest = "sha256:" + strings.Repeat("f", 64)
+	if err := updateAgent("1.2.0", false).verifyUpdate(tampered, current); err == nil {
+		t.Error("tampered digest accepted")
+	}
+
+	other := signedUpdate("1.3.0")
+	if err := updateAgent("1.2.0", false).verifyUpdate(other, "registry.test/other:1.2.0"); err == nil {
+		t.Error("image from another repository accepted")
+	}
+
+	if err := updateAgent("1.2.0", false).verifyUpdate(signedUpdate("1.1.0"), current); err == nil {
+		t.Error("downgrade accepted")
+	}
+	if err := updateAgent("1.2.0", true).verifyUpdate(signedUpdate("1.1.0"), current); err != nil {
+		t.Errorf("allowed downgrade refused: %v", err)
+	}
+
+	// a build without a version can't tell whether it's being downgraded
+	for _, build := range []string{"", "dev"} {
+		if err := updateAgent(build, false).verifyUpdate(signedUpdate("1.3.0"), current); err == nil {
+			t.Errorf("update from %q accepted without allowing downgrades", build)
+		}
+	}
+	if err := updateAgent("1.2.0", false).verifyUpdate(signedUpdate("nightly"), current); err == nil {
+		t.Error("update to a version that can't be compared accepted")
+	}
+	if err := updateAgent("", true).verifyUpdate(signedUpdate("1.3.0"), current); err != nil {
+		t.Errorf("update from an unversioned build refused with downgrades allowed: %v", err)
+	}
+}
+
+func TestHandleSelfUpdatePublishesBeforeRollout(t *testing.T) {
+	replicas := int32(1)
+	h := newHarness(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "k8sdeploy"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "agent", Image: "registry.test/agent:1.2.0"}},
+				},
+			},
+		},
+	})
+	self := &h.Agent.Config.K8sDeploy.Self
+	self.Namespace, self.Deployment, self.Container = "k8sdeploy", "agent", "agent"
+	self.UpdateTimeout = 50 * time.Millisecond
+	h.Agent.Config.K8sDeploy.Credentials.Agent.Secret = testUpdateSecret
+	h.Agent.Config.K8sDeploy.BuildVersion = "1.2.0"
+
+	msg, err := json.Marshal(signedUpdate("1.3.0"))
+	if err != nil {
+		t.Fatalf("failed to marshal update: %v", err)
+	}
+
+	// the fake deployment never rolls out, which is what this pod sees when
+	// it's replaced part way through
+	if err := h.Agent.handleSelfUpdate(context.Background(), string(msg)); err == nil {
+		t.Error("rollout that never finished wasn't reported")
+	}
+
+	responses := h.Server.responses()
+	if len(responses) != 2 {
+		t.Fatalf("published %d responses, want the patch and the rollout", len(responses))
+	}
+	var resp UpdateResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Updated || resp.Phase != updatePatched || resp.ToVersion != "1.3.0" || resp.Image != "registry.test/agent@"+testDigest {
+		t.Errorf("response = %+v, want patched to 1.3.0 by digest", resp)
+	}
+	resp = UpdateResponse{}
+	if err := json.Unmarshal([]byte(responses[1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if responses[1].Properties.RequestID != "req-upd" || resp.Phase != updateRolloutFailed || resp.Error == "" {
+		t.Errorf("response = %+v, want the failed rollout for req-upd", resp)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("k8sdeploy").Get(context.Background(), "agent", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "registry.test/agent@"+testDigest {
+		t.Errorf("image = %s, want the digest", image)
+	}
+	if id, ok := dep.Annotations[updateAnnotation]; ok {
+		t.Errorf("update request id %s left on the deployment after it was reported", id)
+	}
+}
+
+func TestReportUpdateFromNewPod(t *testing.T) {
+	replicas := int32(2)
+	h := newHarness(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "agent",
+			Namespace:  "k8sdeploy",
+			Generation: 3,
+			Annotations: map[string]string{
+				versionAnnotation: "1.3.0",
+				updateAnnotation:  "req-upd",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "agent", Image: "registry.test/agent@" + testDigest}},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 3,
+			Replicas:           2,
+			UpdatedReplicas:    2,
+			AvailableReplicas:  2,
+		},
+	})
+	h.Agent.Config.SelfUpdate = true
+	self := &h.Agent.Config.K8sDeploy.Self
+	self.Namespace, self.Deployment, self.Container = "k8sdeploy", "agent", "agent"
+	self.UpdateTimeout = 50 * time.Millisecond
+	h.Agent.Config.K8sDeploy.BuildVersion = "1.3.0"
+
+	// both new replicas start up and try to report, only one gets to
+	h.Agent.reportUpdate(context.Background())
+	h.Agent.reportUpdate(context.Background())
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	var resp UpdateResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if responses[0].Properties.RequestID != "req-upd" || !resp.Updated || resp.Phase != updateRolledOut || resp.ToVersion != "1.3.0" {
+		t.Errorf("response = %+v, want req-upd rolled out to 1.3.0", resp)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// recordSpans swaps in a tracer provider that keeps every span, put back
+// when the test ends
+func recordSpans(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	cfg := &config.Config{}
+	cfg.K8sDeploy.Tracing.SampleRatio = 1
+
+	exp := tracetest.NewInMemoryExporter()
+	shutdown, err := telemetry.SetupWithExporter(cfg, exp)
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = shutdown(context.Background())
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	return func() tracetest.SpanStubs {
+		// spans are batched, shutting the exporter down would clear them
+		if err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background()); err != nil {
+			t.Fatalf("failed to flush spans: %v", err)
+		}
+		return exp.GetSpans()
+	}
+}
+
+// tracedClientSet talks to a stub api server through the traced transport,
+// the fake clientset never makes a request to trace
+func tracedClientSet(t *testing.T) kubernetes.Interface {
+	t.Helper()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/configmaps" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"kind":       "ConfigMapList",
+			"apiVersion": "v1",
+			"metadata":   map[string]interface{}{},
+			"items":      []interface{}{},
+		})
+	}))
+	t.Cleanup(api.Close)
+
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: api.URL, WrapTransport: telemetry.WrapTransport})
+	if err != nil {
+		t.Fatalf("failed to create clientset: %v", err)
+	}
+
+	return cs
+}
+
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no %s span in %d spans", name, len(spans))
+
+	return tracetest.SpanStub{}
+}
+
+func TestListenForEventsTraced(t *testing.T) {
+	spans := recordSpans(t)
+	h := newHarness(t)
+	h.Agent.KubernetesClient.ClientSet = tracedClientSet(t)
+
+	// the orchestrator's publish is the parent the agent carries on from
+	ctx, producer := otel.Tracer("orchestrator").Start(context.Background(), "orchestrator.publish")
+	h.Server.enqueueWithHeaders(t, agentQueue, map[string]interface{}{
+		"action":     "info",
+		"request_id": "req-tr",
+		"action_details": map[string]string{
+			"type": "configmaps",
+		},
+		"info_details": map[string]string{
+			"namespace": "default",
+		},
+	}, telemetry.Inject(ctx))
+	producer.End()
+
+	if errs := h.process(t, nil); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	recorded := spans()
+	get := spanNamed(t, recorded, "queue.get")
+	process := spanNamed(t, recorded, "agent.process")
+	parse := spanNamed(t, recorded, "info.ParseRequest")
+	k8s := spanNamed(t, recorded, "k8s GET")
+	send := spanNamed(t, recorded, "info.SendResponse")
+
+	// the get happens before there's a message to take a trace from
+	if get.SpanContext.TraceID() == producer.SpanContext().TraceID() {
+		t.Error("queue.get joined the message's trace")
+	}
+	for _, c := range []struct {
+		child, parent tracetest.SpanStub
+	}{
+		{parse, process},
+		{k8s, parse},
+		{send, process},
+	} {
+		if c.child.Parent.SpanID() != c.parent.SpanContext.SpanID() {
+			t.Errorf("%s parent = %s, want %s", c.child.Name, c.child.Parent.SpanID(), c.parent.Name)
+		}
+	}
+	if process.Parent.SpanID() != producer.SpanContext().SpanID() || !process.Parent.IsRemote() {
+		t.Errorf("agent.process parent = %s, want the remote producer span", process.Parent.SpanID())
+	}
+	if process.SpanKind != trace.SpanKindConsumer || send.SpanKind != trace.SpanKindProducer {
+		t.Errorf("kinds = %s and %s, want consumer and producer", process.SpanKind, send.SpanKind)
+	}
+
+	var path string
+	for _, attr := range k8s.Attributes {
+		if attr.Key == "url.path" {
+			path = attr.Value.AsString()
+		}
+	}
+	if path != "/api/v1/namespaces/default/configmaps" {
+		t.Errorf("k8s span path = %q, want the configmaps path", path)
+	}
+
+	// the response carries the trace on for whoever reads it
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+	carried := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(responses[0].Properties.Headers))
+	if sc := trace.SpanContextFromContext(carried); sc.TraceID() != producer.SpanContext().TraceID() || sc.SpanID() != send.SpanContext.SpanID() {
+		t.Errorf("response trace = %s/%s, want the SendResponse span in the producer's trace", sc.TraceID(), sc.SpanID())
+	}
+}
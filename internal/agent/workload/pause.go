@@ -0,0 +1,122 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+// PauseRequest pauses or resumes a deployment rollout the way kubectl rollout
+// pause and resume do, changes made while paused roll out on resume
+type PauseRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+	Kind      Kind
+	Paused    bool
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	Before State
+	After  State
+	Ready  *bool
+	Reason string
+
+	Conflicts conflict.Counter
+}
+
+func NewPause(cs kubernetes.Interface, ctx context.Context, kind Kind, paused bool) *PauseRequest {
+	return &PauseRequest{
+		ClientSet: cs,
+		Context:   ctx,
+		Kind:      kind,
+		Paused:    paused,
+	}
+}
+
+func (p *PauseRequest) SetRequestID(rid string) {
+	p.RequestID = rid
+}
+
+func (p *PauseRequest) action() Action {
+	if p.Paused {
+		return pauseAction
+	}
+
+	return resumeAction
+}
+
+func (p *PauseRequest) validate(details RequestDetails) error {
+	if err := validateKube(details.Kube); err != nil {
+		return err
+	}
+	if p.Kind != deploymentKind {
+		return logs.Errorf("only deployments can be paused, not %s", p.Kind)
+	}
+	if details.Replicas != nil || details.HPA != nil {
+		return logs.Errorf("%s doesn't take replicas or hpa", p.action())
+	}
+	// a paused rollout never gets ready
+	if p.Paused && details.Wait {
+		return logs.Error("wait only applies to resume")
+	}
+
+	_, err := timeout(details.Timeout)
+	return err
+}
+
+func (p *PauseRequest) ProcessRequest(details RequestDetails) error {
+	if err := p.validate(details); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	p.RequestDetails = details
+
+	t, err := getTarget(p.Context, p.ClientSet, p.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	p.Before = t.state()
+
+	dep := t.(*deploymentTarget)
+	if dep.Deployment.Spec.Paused != p.Paused {
+		patch := []byte(fmt.Sprintf(`{"spec":{"paused":%t}}`, p.Paused))
+		if err := dep.patch(p.Context, &p.Conflicts, patch); err != nil {
+			return err
+		}
+	}
+
+	p.Ready, p.Reason = awaitReady(p.Context, p.ClientSet, p.Kind, details)
+
+	after, err := getTarget(p.Context, p.ClientSet, p.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	p.After = after.state()
+
+	return nil
+}
+
+func (p *PauseRequest) GetResponse() (string, error) {
+	resp, err := json.Marshal(response{
+		Action:     string(p.action()),
+		Kind:       string(p.Kind),
+		Name:       p.RequestDetails.Kube.Name,
+		Namespace:  p.RequestDetails.Kube.Namespace,
+		Before:     p.Before,
+		After:      p.After,
+		Ready:      p.Ready,
+		Reason:     p.Reason,
+		Conflicts:  p.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  p.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
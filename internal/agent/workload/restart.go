@@ -0,0 +1,123 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+type RestartRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+	Kind      Kind
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	Before State
+	After  State
+	Ready  *bool
+	Reason string
+
+	Conflicts conflict.Counter
+}
+
+func NewRestart(cs kubernetes.Interface, ctx context.Context, kind Kind) *RestartRequest {
+	return &RestartRequest{
+		ClientSet: cs,
+		Context:   ctx,
+		Kind:      kind,
+	}
+}
+
+func (r *RestartRequest) SetRequestID(rid string) {
+	r.RequestID = rid
+}
+
+func validateRestartRequest(details RequestDetails) error {
+	if err := validateKube(details.Kube); err != nil {
+		return err
+	}
+	if details.Replicas != nil || details.HPA != nil {
+		return logs.Error("restart doesn't take replicas or hpa")
+	}
+
+	_, err := timeout(details.Timeout)
+	return err
+}
+
+// ProcessRequest does what kubectl rollout restart does, a new annotation on
+// the pod template rolls every pod
+func (r *RestartRequest) ProcessRequest(details RequestDetails) error {
+	if err := validateRestartRequest(details); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	r.RequestDetails = details
+
+	t, err := getTarget(r.Context, r.ClientSet, r.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	if err := restartable(t); err != nil {
+		return logs.Errorf("failed to restart %s: %v", details.Kube.Name, err)
+	}
+	r.Before = t.state()
+
+	// the same patch kubectl rollout restart sends
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, restartedAtAnnotation, time.Now().Format(time.RFC3339)))
+	if err := t.patch(r.Context, &r.Conflicts, patch); err != nil {
+		return err
+	}
+
+	r.Ready, r.Reason = awaitReady(r.Context, r.ClientSet, r.Kind, details)
+
+	after, err := getTarget(r.Context, r.ClientSet, r.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	r.After = after.state()
+
+	return nil
+}
+
+// restartable refuses the cases where the annotation wouldn't roll anything
+func restartable(t target) error {
+	switch w := t.(type) {
+	case *deploymentTarget:
+		if w.Deployment.Spec.Paused {
+			return logs.Error("deployment is paused")
+		}
+	case *statefulSetTarget:
+		if w.StatefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			return logs.Error("statefulset uses the OnDelete update strategy")
+		}
+	}
+
+	return nil
+}
+
+func (r *RestartRequest) GetResponse() (string, error) {
+	resp, err := json.Marshal(response{
+		Action:     string(restartAction),
+		Kind:       string(r.Kind),
+		Name:       r.RequestDetails.Kube.Name,
+		Namespace:  r.RequestDetails.Kube.Namespace,
+		Before:     r.Before,
+		After:      r.After,
+		Ready:      r.Ready,
+		Reason:     r.Reason,
+		Conflicts:  r.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  r.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
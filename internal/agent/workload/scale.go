@@ -0,0 +1,193 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+type ScaleRequest struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+	Kind      Kind
+
+	RequestDetails RequestDetails
+	RequestID      string
+
+	Before State
+	After  State
+	Ready  *bool
+	Reason string
+
+	Conflicts conflict.Counter
+}
+
+func NewScale(cs kubernetes.Interface, ctx context.Context, kind Kind) *ScaleRequest {
+	return &ScaleRequest{
+		ClientSet: cs,
+		Context:   ctx,
+		Kind:      kind,
+	}
+}
+
+func (s *ScaleRequest) SetRequestID(rid string) {
+	s.RequestID = rid
+}
+
+func validateScaleRequest(details RequestDetails) error {
+	if err := validateKube(details.Kube); err != nil {
+		return err
+	}
+
+	switch {
+	case details.Replicas == nil && details.HPA == nil:
+		return logs.Error("replicas or hpa is required")
+	case details.Replicas != nil && details.HPA != nil:
+		return logs.Error("only one of replicas or hpa can be set")
+	case details.Replicas != nil && *details.Replicas < 0:
+		return logs.Errorf("replicas %d can't be negative", *details.Replicas)
+	}
+
+	if hpa := details.HPA; hpa != nil {
+		if hpa.Max < 1 {
+			return logs.Error("hpa max must be at least 1")
+		}
+		if hpa.Min != nil && (*hpa.Min < 1 || *hpa.Min > hpa.Max) {
+			return logs.Errorf("hpa min %d must be between 1 and max %d", *hpa.Min, hpa.Max)
+		}
+	}
+
+	_, err := timeout(details.Timeout)
+	return err
+}
+
+func (s *ScaleRequest) ProcessRequest(details RequestDetails) error {
+	if err := validateScaleRequest(details); err != nil {
+		return logs.Errorf("failed to validate request: %v", err)
+	}
+	s.RequestDetails = details
+
+	t, err := getTarget(s.Context, s.ClientSet, s.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	hpa, err := s.findHPA(t.kind())
+	if err != nil {
+		return err
+	}
+	s.Before = withHPA(t.state(), hpa)
+
+	if details.HPA != nil {
+		if hpa, err = s.scaleHPA(hpa); err != nil {
+			return err
+		}
+	} else {
+		// the hpa would put the replicas straight back
+		if hpa != nil {
+			return logs.Errorf("%s is managed by hpa %s, scale the hpa instead", details.Kube.Name, hpa.Name)
+		}
+		if err := t.patch(s.Context, &s.Conflicts, conflict.ReplicasPatch(*details.Replicas)); err != nil {
+			return err
+		}
+	}
+
+	s.Ready, s.Reason = awaitReady(s.Context, s.ClientSet, s.Kind, details)
+
+	after, err := getTarget(s.Context, s.ClientSet, s.Kind, details.Kube.Namespace, details.Kube.Name)
+	if err != nil {
+		return err
+	}
+	s.After = withHPA(after.state(), hpa)
+
+	return nil
+}
+
+// findHPA is the hpa whose scale target is the workload, if there is one
+func (s *ScaleRequest) findHPA(kind string) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	hpas, err := s.ClientSet.AutoscalingV2().HorizontalPodAutoscalers(s.RequestDetails.Kube.Namespace).List(s.Context, metav1.ListOptions{})
+	if err != nil {
+		return nil, logs.Errorf("failed to list hpas: %v", err)
+	}
+
+	for i := range hpas.Items {
+		ref := hpas.Items[i].Spec.ScaleTargetRef
+		if ref.Kind == kind && ref.Name == s.RequestDetails.Kube.Name {
+			return &hpas.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *ScaleRequest) scaleHPA(hpa *autoscalingv2.HorizontalPodAutoscaler) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	if hpa == nil {
+		return nil, logs.Errorf("no hpa targets %s", s.RequestDetails.Kube.Name)
+	}
+
+	// the new max is checked against the min the hpa has when it's written
+	var minErr error
+	hpas := s.ClientSet.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace)
+	updated, err := conflict.Patch(s.Context, &s.Conflicts, hpas, hpa, types.MergePatchType, func(hpa *autoscalingv2.HorizontalPodAutoscaler) ([]byte, error) {
+		minReplicas := hpa.Spec.MinReplicas
+		if s.RequestDetails.HPA.Min != nil {
+			minReplicas = s.RequestDetails.HPA.Min
+		}
+		if minReplicas != nil && *minReplicas > s.RequestDetails.HPA.Max {
+			minErr = logs.Errorf("hpa min %d is above the new max %d", *minReplicas, s.RequestDetails.HPA.Max)
+			return nil, minErr
+		}
+
+		spec := map[string]interface{}{"maxReplicas": s.RequestDetails.HPA.Max}
+		if s.RequestDetails.HPA.Min != nil {
+			spec["minReplicas"] = *s.RequestDetails.HPA.Min
+		}
+		return json.Marshal(map[string]interface{}{"spec": spec})
+	})
+	if minErr != nil {
+		return nil, minErr
+	}
+	if err != nil {
+		return nil, logs.Errorf("failed to patch hpa: %v", err)
+	}
+
+	return updated, nil
+}
+
+func withHPA(st State, hpa *autoscalingv2.HorizontalPodAutoscaler) State {
+	if hpa == nil {
+		return st
+	}
+
+	st.HPA = hpa.Name
+	st.MinReplicas = hpa.Spec.MinReplicas
+	st.MaxReplicas = hpa.Spec.MaxReplicas
+
+	return st
+}
+
+func (s *ScaleRequest) GetResponse() (string, error) {
+	resp, err := json.Marshal(response{
+		Action:     string(scaleAction),
+		Kind:       string(s.Kind),
+		Name:       s.RequestDetails.Kube.Name,
+		Namespace:  s.RequestDetails.Kube.Namespace,
+		Before:     s.Before,
+		After:      s.After,
+		Ready:      s.Ready,
+		Reason:     s.Reason,
+		Conflicts:  s.Conflicts.Count(),
+		UpdateTime: time.Now(),
+		RequestID:  s.RequestID,
+	})
+	if err != nil {
+		return "", logs.Errorf("failed to marshal response: %v", err)
+	}
+
+	return string(resp), nil
+}
@@ -0,0 +1,165 @@
+package workload
+
+import (
+	"context"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/conflict"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const (
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	pollInterval          = 2 * time.Second
+)
+
+// target is the part of a deployment or statefulset the workload actions
+// work on
+type target interface {
+	kind() string
+	replicas() int32
+	ready() (bool, error)
+	state() State
+	patch(ctx context.Context, conflicts *conflict.Counter, patch []byte) error
+}
+
+func getTarget(ctx context.Context, cs kubernetes.Interface, kind Kind, namespace, name string) (target, error) {
+	switch kind {
+	case deploymentKind:
+		dep, err := cs.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, logs.Errorf("failed to get deployment: %v", err)
+		}
+		return &deploymentTarget{ClientSet: cs, Deployment: dep}, nil
+	case statefulSetKind:
+		sts, err := cs.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, logs.Errorf("failed to get statefulset: %v", err)
+		}
+		return &statefulSetTarget{ClientSet: cs, StatefulSet: sts}, nil
+	}
+
+	return nil, logs.Errorf("unknown workload kind: %s", kind)
+}
+
+// waitReady polls until the workload has rolled out
+func waitReady(ctx context.Context, cs kubernetes.Interface, kind Kind, namespace, name string, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(ctx, pollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		t, err := getTarget(ctx, cs, kind, namespace, name)
+		if err != nil {
+			return false, err
+		}
+
+		return t.ready()
+	})
+}
+
+func int32Value(p *int32) int32 {
+	if p == nil {
+		return 1
+	}
+
+	return *p
+}
+
+type deploymentTarget struct {
+	ClientSet  kubernetes.Interface
+	Deployment *appsv1.Deployment
+}
+
+func (d *deploymentTarget) kind() string {
+	return "Deployment"
+}
+
+func (d *deploymentTarget) replicas() int32 {
+	return int32Value(d.Deployment.Spec.Replicas)
+}
+
+func (d *deploymentTarget) ready() (bool, error) {
+	return rollout.DeploymentReady(d.Deployment)
+}
+
+func (d *deploymentTarget) state() State {
+	return State{
+		Replicas:        d.replicas(),
+		ReadyReplicas:   d.Deployment.Status.ReadyReplicas,
+		UpdatedReplicas: d.Deployment.Status.UpdatedReplicas,
+		Generation:      d.Deployment.Generation,
+		RestartedAt:     d.Deployment.Spec.Template.Annotations[restartedAtAnnotation],
+		Paused:          d.Deployment.Spec.Paused,
+	}
+}
+
+// patch sends a strategic merge patch, only the fields in it change so a
+// controller writing the rest of the deployment isn't overwritten. It's
+// guarded by the version the request was checked against
+func (d *deploymentTarget) patch(ctx context.Context, conflicts *conflict.Counter, patch []byte) error {
+	deps := d.ClientSet.AppsV1().Deployments(d.Deployment.Namespace)
+	dep, err := conflict.Patch(ctx, conflicts, deps, d.Deployment, types.StrategicMergePatchType, func(*appsv1.Deployment) ([]byte, error) {
+		return patch, nil
+	})
+	if err != nil {
+		return logs.Errorf("failed to patch deployment: %v", err)
+	}
+	d.Deployment = dep
+
+	return nil
+}
+
+type statefulSetTarget struct {
+	ClientSet   kubernetes.Interface
+	StatefulSet *appsv1.StatefulSet
+}
+
+func (s *statefulSetTarget) kind() string {
+	return "StatefulSet"
+}
+
+func (s *statefulSetTarget) replicas() int32 {
+	return int32Value(s.StatefulSet.Spec.Replicas)
+}
+
+// ready waits for every pod to be on the update revision, a partitioned
+// rollout is done once the pods above the partition are
+func (s *statefulSetTarget) ready() (bool, error) {
+	sts := s.StatefulSet
+	want := s.replicas()
+	if sts.Status.ObservedGeneration < sts.Generation || sts.Status.ReadyReplicas < want || sts.Status.Replicas != want {
+		return false, nil
+	}
+
+	updated := want
+	if ru := sts.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition < want {
+		updated = want - *ru.Partition
+	}
+
+	return sts.Status.UpdatedReplicas >= updated, nil
+}
+
+func (s *statefulSetTarget) state() State {
+	return State{
+		Replicas:        s.replicas(),
+		ReadyReplicas:   s.StatefulSet.Status.ReadyReplicas,
+		UpdatedReplicas: s.StatefulSet.Status.UpdatedReplicas,
+		Generation:      s.StatefulSet.Generation,
+		RestartedAt:     s.StatefulSet.Spec.Template.Annotations[restartedAtAnnotation],
+	}
+}
+
+func (s *statefulSetTarget) patch(ctx context.Context, conflicts *conflict.Counter, patch []byte) error {
+	stss := s.ClientSet.AppsV1().StatefulSets(s.StatefulSet.Namespace)
+	sts, err := conflict.Patch(ctx, conflicts, stss, s.StatefulSet, types.StrategicMergePatchType, func(*appsv1.StatefulSet) ([]byte, error) {
+		return patch, nil
+	})
+	if err != nil {
+		return logs.Errorf("failed to patch statefulset: %v", err)
+	}
+	s.StatefulSet = sts
+
+	return nil
+}
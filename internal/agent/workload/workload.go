@@ -0,0 +1,319 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/agent/queue"
+	"github.com/k8sdeploy/agent/internal/agent/rollout"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"github.com/k8sdeploy/agent/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+type Action string
+
+const (
+	scaleAction   Action = "scale"
+	restartAction Action = "restart"
+	pauseAction   Action = "pause"
+	resumeAction  Action = "resume"
+)
+
+type Kind string
+
+const (
+	deploymentKind  Kind = "deployment"
+	statefulSetKind Kind = "statefulset"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+// permissions is what each action needs on the workload, scale also reads the
+// hpas so it doesn't fight one
+var permissions = map[Action][]scope.Permission{
+	scaleAction: {
+		{Group: "autoscaling", Resource: "horizontalpodautoscalers", Verb: "list"},
+	},
+	restartAction: {},
+	pauseAction:   {},
+	resumeAction:  {},
+}
+
+var resources = map[Kind]string{
+	deploymentKind:  "deployments",
+	statefulSetKind: "statefulsets",
+}
+
+// hpaPatch is only needed when scale is given hpa bounds
+var hpaPatch = scope.Permission{Group: "autoscaling", Resource: "horizontalpodautoscalers", Verb: "patch"}
+
+func targetPermissions(resource string) []scope.Permission {
+	return []scope.Permission{
+		{Group: "apps", Resource: resource, Verb: "get"},
+		{Group: "apps", Resource: resource, Verb: "patch"},
+	}
+}
+
+// Permissions is everything the workload actions check, for the agent to
+// review up front
+func Permissions() []scope.Permission {
+	perms := []scope.Permission{hpaPatch}
+	for _, resource := range resources {
+		perms = append(perms, targetPermissions(resource)...)
+	}
+	for _, p := range permissions {
+		perms = append(perms, p...)
+	}
+
+	return perms
+}
+
+type Workload struct {
+	ClientSet kubernetes.Interface
+	Context   context.Context
+
+	Action       Action
+	Kind         Kind
+	RequestID    string
+	Namespaces   scope.Namespaces
+	Capabilities scope.Capabilities
+
+	Response string
+}
+
+type Kube struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// HPA min and max replace the ones on the hpa targeting the workload, a nil
+// min leaves it alone
+type HPA struct {
+	Min *int32 `json:"min"`
+	Max int32  `json:"max"`
+}
+
+type RequestDetails struct {
+	Kube     Kube   `json:"k8s"`
+	Replicas *int32 `json:"replicas,omitempty"`
+	HPA      *HPA   `json:"hpa,omitempty"`
+	Wait     bool   `json:"wait"`
+	Timeout  string `json:"timeout"`
+}
+
+func NewWorkload(cs kubernetes.Interface, ctx context.Context) *Workload {
+	return &Workload{
+		ClientSet: cs,
+		Context:   ctx,
+	}
+}
+
+func (w *Workload) SetAction(a Action) {
+	w.Action = a
+}
+
+// SetKind defaults to deployment when the request doesn't say
+func (w *Workload) SetKind(k Kind) {
+	if k == "" {
+		k = deploymentKind
+	}
+	w.Kind = k
+}
+
+func (w *Workload) SetRequestID(rid string) {
+	w.RequestID = rid
+}
+
+func (w *Workload) SetNamespaces(ns scope.Namespaces) {
+	w.Namespaces = ns
+}
+
+func (w *Workload) SetCapabilities(caps scope.Capabilities) {
+	w.Capabilities = caps
+}
+
+type System interface {
+	SetRequestID(rid string)
+	ProcessRequest(details RequestDetails) error
+	GetResponse() (string, error)
+}
+
+func requestToDetails(workloadRequest interface{}) (RequestDetails, error) {
+	jd, err := json.Marshal(workloadRequest)
+	if err != nil {
+		return RequestDetails{}, logs.Errorf("failed to marshal workload request: %v", err)
+	}
+
+	var details RequestDetails
+	if err := json.Unmarshal(jd, &details); err != nil {
+		return RequestDetails{}, logs.Errorf("failed to unmarshal workload request: %v", err)
+	}
+
+	return details, nil
+}
+
+func (w *Workload) getSystem(ctx context.Context) (System, error) {
+	var sys System
+
+	switch w.Action {
+	case scaleAction:
+		sys = NewScale(w.ClientSet, ctx, w.Kind)
+	case restartAction:
+		sys = NewRestart(w.ClientSet, ctx, w.Kind)
+	case pauseAction:
+		sys = NewPause(w.ClientSet, ctx, w.Kind, true)
+	case resumeAction:
+		sys = NewPause(w.ClientSet, ctx, w.Kind, false)
+	default:
+		return nil, logs.Errorf("unknown workload action: %s", w.Action)
+	}
+
+	sys.SetRequestID(w.RequestID)
+	return sys, nil
+}
+
+func (w *Workload) permitted(details RequestDetails) error {
+	namespace := details.Kube.Namespace
+	if err := w.Namespaces.Check(namespace); err != nil {
+		return err
+	}
+
+	resource, ok := resources[w.Kind]
+	if !ok {
+		return logs.Errorf("unknown workload kind: %s", w.Kind)
+	}
+	perms := append(targetPermissions(resource), permissions[w.Action]...)
+	if w.Action == scaleAction && details.HPA != nil {
+		perms = append(perms, hpaPatch)
+	}
+
+	return w.Capabilities.Check(scope.In(namespace, perms...)...)
+}
+
+func (w *Workload) ParseRequest(workloadRequest interface{}) (err error) {
+	ctx, span := telemetry.Start(w.Context, "workload.ParseRequest", trace.WithAttributes(
+		attribute.String("workload.action", string(w.Action)),
+		attribute.String("workload.kind", string(w.Kind)),
+		attribute.String("request_id", w.RequestID),
+	))
+	defer func() {
+		telemetry.End(span, err)
+	}()
+
+	details, err := requestToDetails(workloadRequest)
+	if err != nil {
+		return logs.Errorf("failed to parse request: %v", err)
+	}
+	span.SetAttributes(
+		attribute.String("k8s.namespace", details.Kube.Namespace),
+		attribute.String("k8s.name", details.Kube.Name),
+	)
+
+	if err := w.permitted(details); err != nil {
+		w.Response = scope.DeniedResponse(w.RequestID, err)
+		return logs.Errorf("failed to check permissions: %v", err)
+	}
+
+	sys, err := w.getSystem(ctx)
+	if err != nil {
+		return logs.Errorf("failed to get system: %v", err)
+	}
+
+	if err := sys.ProcessRequest(details); err != nil {
+		return logs.Errorf("failed to process request: %v", err)
+	}
+
+	resp, err := sys.GetResponse()
+	if err != nil {
+		return logs.Errorf("failed to get response: %v", err)
+	}
+	w.Response = resp
+
+	return nil
+}
+
+func (w *Workload) SendResponse(cfg *config.Config, client *httpclient.Client) (err error) {
+	ctx, span := telemetry.Start(context.WithoutCancel(w.Context), "workload.SendResponse", trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() {
+		telemetry.End(span, err)
+	}()
+
+	return queue.Publish(ctx, cfg, client, w.RequestID, w.Response)
+}
+
+// State is the workload before and after the action, the hpa fields are
+// only set when an hpa was changed
+type State struct {
+	Replicas        int32  `json:"replicas"`
+	ReadyReplicas   int32  `json:"ready_replicas"`
+	UpdatedReplicas int32  `json:"updated_replicas"`
+	Generation      int64  `json:"generation"`
+	RestartedAt     string `json:"restarted_at,omitempty"`
+	Paused          bool   `json:"paused"`
+	HPA             string `json:"hpa,omitempty"`
+	MinReplicas     *int32 `json:"min_replicas,omitempty"`
+	MaxReplicas     int32  `json:"max_replicas,omitempty"`
+}
+
+func validateKube(kube Kube) error {
+	if kube.Name == "" {
+		return logs.Error("name is required")
+	}
+	if kube.Namespace == "" {
+		return logs.Error("namespace is required")
+	}
+
+	return nil
+}
+
+func timeout(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultTimeout, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, logs.Errorf("failed to parse timeout %q: %v", value, err)
+	}
+
+	return d, nil
+}
+
+// awaitReady only waits when the request asks to, not being ready in time is
+// reported in the response
+func awaitReady(ctx context.Context, cs kubernetes.Interface, kind Kind, details RequestDetails) (*bool, string) {
+	if !details.Wait {
+		return nil, ""
+	}
+
+	d, err := timeout(details.Timeout)
+	if err == nil {
+		err = waitReady(ctx, cs, kind, details.Kube.Namespace, details.Kube.Name, d)
+	}
+	ready := err == nil
+	if err != nil {
+		return &ready, rollout.Failure(ctx, err).Error()
+	}
+
+	return &ready, ""
+}
+
+type response struct {
+	Action     string    `json:"action"`
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	Namespace  string    `json:"namespace"`
+	Before     State     `json:"before"`
+	After      State     `json:"after"`
+	Ready      *bool     `json:"ready,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Conflicts  int32     `json:"conflicts"`
+	UpdateTime time.Time `json:"update_time"`
+	RequestID  string    `json:"request_id"`
+}
@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func workloadRequest(action, kind, requestID string, details map[string]interface{}) map[string]interface{} {
+	details["k8s"] = map[string]string{
+		"name":      "api",
+		"namespace": "default",
+	}
+
+	return map[string]interface{}{
+		"action":     action,
+		"request_id": requestID,
+		"action_details": map[string]string{
+			"type": kind,
+		},
+		"workload_details": details,
+	}
+}
+
+func testStatefulSet(name, namespace string, replicas int32) *appsv1.StatefulSet {
+	labels := map[string]string{"app": name}
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: name, Image: "registry.test/db:v1"}},
+				},
+			},
+		},
+	}
+}
+
+// rollOutStatefulSets marks every statefulset written as fully rolled out
+func rollOutStatefulSets(client *fake.Clientset) {
+	mark := func(obj runtime.Object) {
+		sts := obj.(*appsv1.StatefulSet)
+		count := *sts.Spec.Replicas
+		sts.Status.Replicas = count
+		sts.Status.UpdatedReplicas = count
+		sts.Status.ReadyReplicas = count
+	}
+
+	client.PrependReactor("*", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			return applyPatch(client, patch, &appsv1.StatefulSet{}, mark)
+		}
+
+		write, ok := action.(interface{ GetObject() runtime.Object })
+		if !ok {
+			return false, nil, nil
+		}
+		if sts, ok := write.GetObject().(*appsv1.StatefulSet); ok {
+			mark(sts)
+		}
+
+		return false, nil, nil
+	})
+}
+
+type workloadResponse struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Before struct {
+		Replicas    int32  `json:"replicas"`
+		RestartedAt string `json:"restarted_at"`
+		HPA         string `json:"hpa"`
+		MinReplicas *int32 `json:"min_replicas"`
+		MaxReplicas int32  `json:"max_replicas"`
+	} `json:"before"`
+	After struct {
+		Replicas      int32  `json:"replicas"`
+		ReadyReplicas int32  `json:"ready_replicas"`
+		RestartedAt   string `json:"restarted_at"`
+		HPA           string `json:"hpa"`
+		MinReplicas   *int32 `json:"min_replicas"`
+		MaxReplicas   int32  `json:"max_replicas"`
+	} `json:"after"`
+	Ready     *bool  `json:"ready"`
+	Reason    string `json:"reason"`
+	Conflicts int32  `json:"conflicts"`
+}
+
+func (h *harness) workloadResponse(t *testing.T) workloadResponse {
+	t.Helper()
+
+	responses := h.Server.responses()
+	if len(responses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(responses))
+	}
+
+	var resp workloadResponse
+	if err := json.Unmarshal([]byte(responses[0].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	return resp
+}
+
+func TestListenForEventsScaleDeployment(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	rollOut(h.Client)
+
+	errs := h.process(t, workloadRequest("scale", "deployment", "req-40", map[string]interface{}{
+		"replicas": 5,
+		"wait":     true,
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dep, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if *dep.Spec.Replicas != 5 {
+		t.Errorf("replicas = %d, want 5", *dep.Spec.Replicas)
+	}
+
+	resp := h.workloadResponse(t)
+	if resp.Action != "scale" || resp.Kind != "deployment" {
+		t.Errorf("response = %+v, want scale deployment", resp)
+	}
+	if resp.Before.Replicas != 2 || resp.After.Replicas != 5 || resp.After.ReadyReplicas != 5 {
+		t.Errorf("before %+v after %+v, want 2 then 5 ready", resp.Before, resp.After)
+	}
+	if resp.Ready == nil || !*resp.Ready {
+		t.Errorf("ready = %v, want true", resp.Ready)
+	}
+}
+
+func TestListenForEventsScaleConflict(t *testing.T) {
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2))
+	rollOut(h.Client)
+	staleOnce(h.Client, "deployments")
+
+	errs := h.process(t, workloadRequest("scale", "deployment", "req-45", map[string]interface{}{
+		"replicas": 3,
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if got := scaledTo(h.Client, "api"); len(got) != 2 || got[1] != 3 {
+		t.Errorf("scaled to %v, want 3 written twice", got)
+	}
+	if resp := h.workloadResponse(t); resp.Conflicts != 1 || resp.After.Replicas != 3 {
+		t.Errorf("response = %+v, want 3 replicas after 1 conflict", resp)
+	}
+}
+
+func TestListenForEventsScaleManagedByHPA(t *testing.T) {
+	minReplicas := int32(2)
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "api", APIVersion: "apps/v1"},
+			MinReplicas:    &minReplicas,
+			MaxReplicas:    4,
+		},
+	}
+	h := newHarness(t, testRolloutDeployment("api", "default", "registry.test/api:v1", 2), hpa)
+
+	errs := h.process(t, workloadRequest("scale", "", "req-41", map[string]interface{}{
+		"replicas": 5,
+	}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error scaling replicas under an hpa")
+	}
+
+	errs = h.process(t, workloadRequest("scale", "", "req-42", map[string]interface{}{
+		"hpa": map[string]interface{}{"min": 3, "max": 10},
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got, err := h.Client.AutoscalingV2().HorizontalPodAutoscalers("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get hpa: %v", err)
+	}
+	if *got.Spec.MinReplicas != 3 || got.Spec.MaxReplicas != 10 {
+		t.Errorf("hpa = %d-%d, want 3-10", *got.Spec.MinReplicas, got.Spec.MaxReplicas)
+	}
+
+	responses := h.Server.responses()
+	var resp workloadResponse
+	if err := json.Unmarshal([]byte(responses[len(responses)-1].Payload), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Before.HPA != "api" || *resp.Before.MinReplicas != 2 || resp.Before.MaxReplicas != 4 {
+		t.Errorf("before = %+v, want hpa api 2-4", resp.Before)
+	}
+	if *resp.After.MinReplicas != 3 || resp.After.MaxReplicas != 10 {
+		t.Errorf("after = %+v, want 3-10", resp.After)
+	}
+	if resp.Ready != nil {
+		t.Errorf("ready = %v, want unset without wait", *resp.Ready)
+	}
+}
+
+func TestListenForEventsRestartStatefulSet(t *testing.T) {
+	h := newHarness(t, testStatefulSet("api", "default", 3))
+	rollOutStatefulSets(h.Client)
+
+	errs := h.process(t, workloadRequest("restart", "statefulset", "req-43", map[string]interface{}{
+		"wait": true,
+	}))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	sts, err := h.Client.AppsV1().StatefulSets("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get statefulset: %v", err)
+	}
+	restartedAt := sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+	if restartedAt == "" {
+		t.Fatal("pod template not annotated with restartedAt")
+	}
+
+	resp := h.workloadResponse(t)
+	if resp.Action != "restart" || resp.Kind != "statefulset" {
+		t.Errorf("response = %+v, want restart statefulset", resp)
+	}
+	if resp.Before.RestartedAt != "" || resp.After.RestartedAt != restartedAt {
+		t.Errorf("restarted_at before %q after %q, want empty then %q", resp.Before.RestartedAt, resp.After.RestartedAt, restartedAt)
+	}
+	if resp.Ready == nil || !*resp.Ready {
+		t.Errorf("ready = %v, want true", resp.Ready)
+	}
+}
+
+func TestListenForEventsRestartPausedDeployment(t *testing.T) {
+	dep := testRolloutDeployment("api", "default", "registry.test/api:v1", 2)
+	dep.Spec.Paused = true
+	h := newHarness(t, dep)
+
+	errs := h.process(t, workloadRequest("restart", "deployment", "req-44", map[string]interface{}{}))
+	if len(errs) == 0 {
+		t.Fatal("expected an error restarting a paused deployment")
+	}
+
+	got, err := h.Client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if _, ok := got.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]; ok {
+		t.Error("paused deployment was annotated")
+	}
+}
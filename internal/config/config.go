@@ -16,6 +16,9 @@ func Build(buildVersion string) (*Config, error) {
 	if err := BuildK8sDeploy(cfg); err != nil {
 		return nil, logs.Errorf("k8sdeploy: %v", err)
 	}
+	if cfg.K8sDeploy.BuildVersion == "" {
+		cfg.K8sDeploy.BuildVersion = buildVersion
+	}
 
 	c, err := ConfigBuilder.Build(ConfigBuilder.Local)
 	if err != nil {
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"sync"
+	"time"
+
 	"github.com/caarlos0/env/v6"
 )
 
@@ -10,10 +13,16 @@ type Credentials struct {
 		Secret    string `env:"K8SDEPLOY_SECRET" envDefault:""`
 		CompanyID string `env:"K8SDEPLOY_COMPANY_ID" envDefault:""`
 	}
-	Queue struct {
-		Key    string `env:"K8SDEPLOY_QUEUE_KEY" envDefault:""`
-		Secret string `env:"K8SDEPLOY_QUEUE_SECRET" envDefault:""`
-	}
+	Queue QueueCredentials
+}
+
+// QueueCredentials get swapped out when the agent re-registers while the
+// event loop is still reading them
+type QueueCredentials struct {
+	Key    string `env:"K8SDEPLOY_QUEUE_KEY" envDefault:""`
+	Secret string `env:"K8SDEPLOY_QUEUE_SECRET" envDefault:""`
+
+	mu sync.RWMutex
 }
 
 //type AgentCredentials struct {
@@ -33,6 +42,74 @@ type Queues struct {
 	Response string `env:"K8SDEPLOY_RESPONSE_QUEUE" envDefault:""`
 }
 
+type Tracing struct {
+	Enabled     bool    `env:"K8SDEPLOY_TRACING_ENABLED" envDefault:"false"`
+	Endpoint    string  `env:"K8SDEPLOY_TRACING_ENDPOINT" envDefault:"http://localhost:4318"`
+	Insecure    bool    `env:"K8SDEPLOY_TRACING_INSECURE" envDefault:"false"`
+	ServiceName string  `env:"K8SDEPLOY_TRACING_SERVICE_NAME" envDefault:"k8sdeploy-agent"`
+	SampleRatio float64 `env:"K8SDEPLOY_TRACING_SAMPLE_RATIO" envDefault:"1"`
+}
+
+type HTTP struct {
+	Timeout         time.Duration `env:"K8SDEPLOY_HTTP_TIMEOUT" envDefault:"30s"`
+	MaxRetries      int           `env:"K8SDEPLOY_HTTP_MAX_RETRIES" envDefault:"5"`
+	BaseDelay       time.Duration `env:"K8SDEPLOY_HTTP_BASE_DELAY" envDefault:"250ms"`
+	MaxDelay        time.Duration `env:"K8SDEPLOY_HTTP_MAX_DELAY" envDefault:"30s"`
+	BreakerFailures int           `env:"K8SDEPLOY_HTTP_BREAKER_FAILURES" envDefault:"10"`
+	BreakerCooldown time.Duration `env:"K8SDEPLOY_HTTP_BREAKER_COOLDOWN" envDefault:"30s"`
+}
+
+type Self struct {
+	Namespace      string        `env:"POD_NAMESPACE" envDefault:"k8sdeploy"`
+	Pod            string        `env:"POD_NAME"`
+	Deployment     string        `env:"K8SDEPLOY_SELF_DEPLOYMENT" envDefault:"agent"`
+	Container      string        `env:"K8SDEPLOY_SELF_CONTAINER" envDefault:"agent"`
+	AllowDowngrade bool          `env:"K8SDEPLOY_ALLOW_DOWNGRADE" envDefault:"false"`
+	UpdateTimeout  time.Duration `env:"K8SDEPLOY_SELF_UPDATE_TIMEOUT" envDefault:"10m"`
+}
+
+type Clusters struct {
+	Default    string   `env:"K8SDEPLOY_CLUSTER_NAME" envDefault:"local"`
+	Contexts   []string `env:"K8SDEPLOY_CLUSTER_CONTEXTS" envSeparator:","`
+	SecretsDir string   `env:"K8SDEPLOY_CLUSTER_SECRETS_DIR" envDefault:""`
+}
+
+// Kube shapes how kubeconfig files are read in development and for extra
+// cluster contexts, KUBECONFIG path lists are merged unless Kubeconfig points
+// at a specific file
+type Kube struct {
+	Kubeconfig        string   `env:"K8SDEPLOY_KUBECONFIG" envDefault:""`
+	Context           string   `env:"K8SDEPLOY_KUBE_CONTEXT" envDefault:""`
+	ImpersonateUser   string   `env:"K8SDEPLOY_IMPERSONATE_USER" envDefault:""`
+	ImpersonateGroups []string `env:"K8SDEPLOY_IMPERSONATE_GROUPS" envSeparator:","`
+	NamespaceScoped   bool     `env:"K8SDEPLOY_NAMESPACE_SCOPED" envDefault:"false"`
+}
+
+type Boot struct {
+	Concurrency  int           `env:"K8SDEPLOY_BOOT_CONCURRENCY" envDefault:"4"`
+	ChunkSize    int           `env:"K8SDEPLOY_BOOT_CHUNK_SIZE" envDefault:"1048576"`
+	SyncInterval time.Duration `env:"K8SDEPLOY_BOOT_SYNC_INTERVAL" envDefault:"5m"`
+}
+
+// Analysis points at a prometheus compatible api for the checks deploys can
+// gate on, the token is sent as a bearer token when set
+type Analysis struct {
+	PrometheusAddress string `env:"K8SDEPLOY_PROMETHEUS_ADDRESS" envDefault:""`
+	PrometheusToken   string `env:"K8SDEPLOY_PROMETHEUS_TOKEN" envDefault:""`
+}
+
+// Sealing is how secret values arrive encrypted, the agent publishes the
+// public half of the key pair kept in SealingSecret and still takes values
+// sealed with the older shared aes-256 SealingKey when one is set
+type Sealing struct {
+	SealingKey    string `env:"K8SDEPLOY_SEALING_KEY" envDefault:""`
+	SealingSecret string `env:"K8SDEPLOY_SEALING_SECRET" envDefault:"k8sdeploy-agent-keys"`
+	KeepKeys      int    `env:"K8SDEPLOY_SEALING_KEEP_KEYS" envDefault:"2"`
+	// ReloadInterval is the least time between reads of the key secret for a
+	// key id the agent doesn't know
+	ReloadInterval time.Duration `env:"K8SDEPLOY_SEALING_RELOAD_INTERVAL" envDefault:"10s"`
+}
+
 type K8sDeploy struct {
 	APIAddress string `env:"API_ADDRESS" envDefault:"https://api.k8sdeploy.dev/v1"`
 
@@ -40,17 +117,48 @@ type K8sDeploy struct {
 	BuildVersion string `env:"BUILD_VERSION" envDefault:""`
 	RabbitHost   string `env:"RABBIT_HOSTNAME" envDefault:"https://queue-api.k8sdeploy.dev"`
 
+	PollInterval   time.Duration `env:"K8SDEPLOY_POLL_INTERVAL" envDefault:"5s"`
+	MaxMissedPolls int           `env:"K8SDEPLOY_MAX_MISSED_POLLS" envDefault:"6"`
+
+	HeartbeatInterval  time.Duration `env:"K8SDEPLOY_HEARTBEAT_INTERVAL" envDefault:"60s"`
+	CredentialsRefresh time.Duration `env:"K8SDEPLOY_CREDENTIALS_REFRESH" envDefault:"1h"`
+	CredentialsLeeway  time.Duration `env:"K8SDEPLOY_CREDENTIALS_LEEWAY" envDefault:"5m"`
+
+	// Namespaces restricts the agent to these namespaces so it only needs Roles,
+	// leave empty for cluster wide access
+	Namespaces []string `env:"K8SDEPLOY_NAMESPACES" envSeparator:","`
+
 	Queues
 	Credentials
+	Tracing
+	HTTP
+	Self
+	Clusters
+	Kube
+	Boot
+	Analysis
+	Sealing
 }
 
-func BuildK8sDeploy(c *Config) error {
-	cfg := &K8sDeploy{}
+func (k *K8sDeploy) QueueCredentials() (string, string) {
+	q := &k.Credentials.Queue
+	q.mu.RLock()
+	defer q.mu.RUnlock()
 
-	if err := env.Parse(cfg); err != nil {
-		return err
-	}
-	c.K8sDeploy = *cfg
+	return q.Key, q.Secret
+}
+
+func (k *K8sDeploy) SetQueueCredentials(key, secret string) {
+	q := &k.Credentials.Queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	return nil
+	q.Key = key
+	q.Secret = secret
+}
+
+// BuildK8sDeploy parses straight into the config, the queue credentials hold
+// their lock so aren't copied
+func BuildK8sDeploy(c *Config) error {
+	return env.Parse(&c.K8sDeploy)
 }
@@ -0,0 +1,208 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+type CheckType string
+
+const (
+	Readiness CheckType = "readiness"
+	Liveness  CheckType = "liveness"
+)
+
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	kind CheckType
+	fn   CheckFunc
+}
+
+type CheckResult struct {
+	Name    string    `json:"name"`
+	Type    CheckType `json:"type"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+type Report struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type Health struct {
+	mu     sync.RWMutex
+	checks []check
+
+	registered   bool
+	lastPoll     time.Time
+	pollInterval time.Duration
+	maxMissed    int
+	timeout      time.Duration
+}
+
+func NewHealth(pollInterval time.Duration, maxMissed int) *Health {
+	h := &Health{
+		pollInterval: pollInterval,
+		maxMissed:    maxMissed,
+		timeout:      2 * time.Second,
+	}
+
+	h.AddCheck("orchestrator", Readiness, h.checkRegistered)
+	h.AddCheck("event_loop", Liveness, h.checkEventLoop)
+
+	return h
+}
+
+func (h *Health) AddCheck(name string, kind CheckType, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, check{
+		name: name,
+		kind: kind,
+		fn:   fn,
+	})
+}
+
+func (h *Health) SetRegistered(registered bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.registered = registered
+}
+
+// StartPolling starts the event loop clock, until then the loop is still
+// waiting on registration and the clusters, which can take as long as the
+// orchestrator is down, and restarting the agent wouldn't help it
+func (h *Health) StartPolling() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastPoll = time.Now()
+}
+
+func (h *Health) PollSucceeded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastPoll = time.Now()
+}
+
+func (h *Health) checkRegistered(_ context.Context) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.registered {
+		return logs.Error("agent is not registered with the orchestrator")
+	}
+
+	return nil
+}
+
+func (h *Health) checkEventLoop(_ context.Context) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.lastPoll.IsZero() {
+		return nil
+	}
+	allowed := h.pollInterval * time.Duration(h.maxMissed)
+	if since := time.Since(h.lastPoll); since > allowed {
+		return fmt.Errorf("no successful poll for %s, allowed %s", since.Round(time.Second), allowed)
+	}
+
+	return nil
+}
+
+// Run executes the checks of the given types, no types means every check
+func (h *Health) Run(ctx context.Context, kinds ...CheckType) Report {
+	h.mu.RLock()
+	checks := make([]check, len(h.checks))
+	copy(checks, h.checks)
+	h.mu.RUnlock()
+
+	report := Report{
+		Status: StatusPass,
+		Checks: []CheckResult{},
+	}
+	for _, c := range checks {
+		if !wanted(c.kind, kinds) {
+			continue
+		}
+
+		cctx, cancel := context.WithTimeout(ctx, h.timeout)
+		err := c.fn(cctx)
+		cancel()
+
+		res := CheckResult{
+			Name:    c.name,
+			Type:    c.kind,
+			Status:  StatusPass,
+			Checked: time.Now(),
+		}
+		if err != nil {
+			res.Status = StatusFail
+			res.Message = err.Error()
+			report.Status = StatusFail
+		}
+		report.Checks = append(report.Checks, res)
+	}
+
+	return report
+}
+
+func wanted(kind CheckType, kinds []CheckType) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Health) ReadinessHTTP(w http.ResponseWriter, r *http.Request) {
+	h.writeReport(w, h.Run(r.Context(), Readiness))
+}
+
+func (h *Health) LivenessHTTP(w http.ResponseWriter, r *http.Request) {
+	h.writeReport(w, h.Run(r.Context(), Liveness))
+}
+
+func (h *Health) StatusHTTP(w http.ResponseWriter, r *http.Request) {
+	h.writeReport(w, h.Run(r.Context()))
+}
+
+func (h *Health) writeReport(w http.ResponseWriter, report Report) {
+	j, err := json.Marshal(report)
+	if err != nil {
+		_ = logs.Errorf("failed to marshal health report: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/health+json")
+	if report.Status != StatusPass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(j); err != nil {
+		_ = logs.Errorf("failed to write health report: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func result(t *testing.T, report Report, name string) CheckResult {
+	t.Helper()
+
+	for _, c := range report.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s check in %+v", name, report.Checks)
+
+	return CheckResult{}
+}
+
+func TestRunKinds(t *testing.T) {
+	h := NewHealth(time.Second, 3)
+	h.SetRegistered(true)
+	h.AddCheck("broken", Liveness, func(context.Context) error {
+		return errors.New("broken")
+	})
+
+	if report := h.Run(context.Background(), Readiness); report.Status != StatusPass || len(report.Checks) != 1 {
+		t.Errorf("readiness = %+v, want only the orchestrator check passing", report)
+	}
+
+	report := h.Run(context.Background(), Liveness)
+	if report.Status != StatusFail || len(report.Checks) != 2 {
+		t.Fatalf("liveness = %+v, want the event loop and broken checks failing overall", report)
+	}
+	if broken := result(t, report, "broken"); broken.Status != StatusFail || broken.Message != "broken" {
+		t.Errorf("broken = %+v, want failed with its error", broken)
+	}
+	if loop := result(t, report, "event_loop"); loop.Status != StatusPass {
+		t.Errorf("event loop = %+v, want passing straight after start", loop)
+	}
+
+	if report := h.Run(context.Background()); len(report.Checks) != 3 {
+		t.Errorf("all checks = %+v, want 3", report.Checks)
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	h := NewHealth(time.Second, 3)
+
+	if check := result(t, h.Run(context.Background(), Readiness), "orchestrator"); check.Status != StatusFail {
+		t.Errorf("orchestrator = %+v before registering, want failed", check)
+	}
+	h.SetRegistered(true)
+	if check := result(t, h.Run(context.Background(), Readiness), "orchestrator"); check.Status != StatusPass {
+		t.Errorf("orchestrator = %+v after registering, want passing", check)
+	}
+}
+
+func TestEventLoop(t *testing.T) {
+	h := NewHealth(10*time.Millisecond, 2)
+
+	time.Sleep(30 * time.Millisecond)
+	if check := result(t, h.Run(context.Background(), Liveness), "event_loop"); check.Status != StatusPass {
+		t.Errorf("event loop = %+v before polling started, want passing", check)
+	}
+
+	h.StartPolling()
+	time.Sleep(30 * time.Millisecond)
+	if check := result(t, h.Run(context.Background(), Liveness), "event_loop"); check.Status != StatusFail {
+		t.Errorf("event loop = %+v after missed polls, want failed", check)
+	}
+
+	h.PollSucceeded()
+	if check := result(t, h.Run(context.Background(), Liveness), "event_loop"); check.Status != StatusPass {
+		t.Errorf("event loop = %+v after a poll, want passing", check)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	h := NewHealth(time.Second, 3)
+	h.timeout = 10 * time.Millisecond
+	h.AddCheck("slow", Readiness, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	if check := result(t, h.Run(context.Background(), Readiness), "slow"); check.Status != StatusFail {
+		t.Errorf("slow = %+v, want failed at the timeout", check)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("run took %s, want the check cut off", elapsed)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	h := NewHealth(time.Second, 3)
+
+	for _, c := range []struct {
+		handler http.HandlerFunc
+		status  int
+	}{
+		// not registered yet
+		{h.ReadinessHTTP, http.StatusServiceUnavailable},
+		{h.LivenessHTTP, http.StatusOK},
+		{h.StatusHTTP, http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		c.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rec.Code != c.status {
+			t.Errorf("status = %d, want %d", rec.Code, c.status)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/health+json" {
+			t.Errorf("content type = %s, want application/health+json", ct)
+		}
+		var report Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("failed to unmarshal report: %v", err)
+		}
+		if (report.Status == StatusPass) != (c.status == http.StatusOK) {
+			t.Errorf("report status = %s with code %d", report.Status, rec.Code)
+		}
+	}
+}
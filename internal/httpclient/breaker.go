@@ -0,0 +1,110 @@
+package httpclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker opens after a run of consecutive failures, once the cooldown has
+// passed a single trial request is let through to decide whether to close again
+type Breaker struct {
+	mu sync.Mutex
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+
+	threshold int
+	cooldown  time.Duration
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = stateHalfOpen
+		b.trial = true
+		return nil
+	case stateHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = stateClosed
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == stateHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = stateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+type Breakers struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+
+	threshold int
+	cooldown  time.Duration
+}
+
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	return &Breakers{
+		breakers:  map[string]*Breaker{},
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *Breakers) For(host string) *Breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.breakers[host]
+	if !ok {
+		br = NewBreaker(b.threshold, b.cooldown)
+		b.breakers[host] = br
+	}
+
+	return br
+}
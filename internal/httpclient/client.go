@@ -0,0 +1,182 @@
+package httpclient
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/config"
+)
+
+type Client struct {
+	HTTPClient *http.Client
+
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+
+	// AuthFailed is told about any 401/403 so stale credentials can be replaced
+	AuthFailed func(host string)
+
+	breakers *Breakers
+}
+
+func NewClient(cfg *config.Config) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Timeout: cfg.K8sDeploy.HTTP.Timeout,
+		},
+		MaxRetries: cfg.K8sDeploy.HTTP.MaxRetries,
+		BaseDelay:  cfg.K8sDeploy.HTTP.BaseDelay,
+		MaxDelay:   cfg.K8sDeploy.HTTP.MaxDelay,
+		breakers:   NewBreakers(cfg.K8sDeploy.HTTP.BreakerFailures, cfg.K8sDeploy.HTTP.BreakerCooldown),
+	}
+}
+
+type retrySafeKey struct{}
+
+// RetrySafe marks a request whose method isn't idempotent as safe to send
+// again, only use it when a duplicate does no harm on the server
+func RetrySafe(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), retrySafeKey{}, true))
+}
+
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	safe, _ := req.Context().Value(retrySafeKey{}).(bool)
+
+	return safe
+}
+
+// Do sends the request, retrying connection errors, 5xx and 429 responses with
+// backoff when the request is idempotent or marked RetrySafe, the body is
+// replayed through req.GetBody so build requests with http.NewRequest and a
+// bytes buffer/reader
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	breaker := c.breakers.For(req.URL.Host)
+
+	for attempt := 0; ; attempt++ {
+		if err := breaker.Allow(); err != nil {
+			return nil, logs.Errorf("%s: %v", req.URL.Host, err)
+		}
+
+		r, err := cloneRequest(req, attempt)
+		if err != nil {
+			return nil, logs.Errorf("failed to clone request: %v", err)
+		}
+
+		res, err := c.HTTPClient.Do(r)
+		if res != nil && c.AuthFailed != nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+			c.AuthFailed(req.URL.Host)
+		}
+
+		// the caller giving up says nothing about the host
+		if req.Context().Err() != nil {
+			return res, err
+		}
+
+		retry, wait := c.classify(res, err, attempt)
+		if !retry {
+			breaker.Success()
+			return res, err
+		}
+		breaker.Failure()
+
+		if !retryable(req) || attempt >= c.MaxRetries {
+			return res, err
+		}
+		drain(res)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// cloneRequest copies req for another attempt, the first attempt can use the
+// body as it is but a retry needs GetBody to get it back
+func cloneRequest(req *http.Request, attempt int) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody || attempt == 0 {
+		return r, nil
+	}
+	if req.GetBody == nil {
+		return nil, logs.Error("request body can't be replayed without GetBody")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+
+	return r, nil
+}
+
+func drain(res *http.Response) {
+	if res == nil || res.Body == nil {
+		return
+	}
+	if err := res.Body.Close(); err != nil {
+		_ = logs.Errorf("failed to close retried body: %v", err)
+	}
+}
+
+func (c *Client) classify(res *http.Response, err error, attempt int) (bool, time.Duration) {
+	if err != nil {
+		return true, c.Backoff(attempt)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		if wait, ok := retryAfter(res); ok {
+			return true, min(wait, c.MaxDelay)
+		}
+		return true, c.Backoff(attempt)
+	case res.StatusCode == http.StatusNotImplemented:
+		return false, 0
+	case res.StatusCode >= http.StatusInternalServerError:
+		return true, c.Backoff(attempt)
+	}
+
+	return false, 0
+}
+
+// Backoff is exponential with full jitter, capped at MaxDelay
+func (c *Client) Backoff(attempt int) time.Duration {
+	ceiling := float64(c.BaseDelay) * math.Pow(2, float64(attempt))
+	if ceiling > float64(c.MaxDelay) {
+		ceiling = float64(c.MaxDelay)
+	}
+	if ceiling < 1 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	ra := res.Header.Get("Retry-After")
+	if ra == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(ra); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(ra); err == nil {
+		return time.Until(t), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,232 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClient(retries int) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: time.Second},
+		MaxRetries: retries,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   5 * time.Millisecond,
+		breakers:   NewBreakers(0, time.Minute),
+	}
+}
+
+// failing answers with status until it has been called fail times
+func failing(t *testing.T, status, fail int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(body) != "payload" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if int(n) <= fail {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &calls
+}
+
+func send(t *testing.T, c *Client, req *http.Request) int {
+	t.Helper()
+
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	return res.StatusCode
+}
+
+func post(t *testing.T, url string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString("payload"))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	return req
+}
+
+func TestDoRetriesIdempotent(t *testing.T) {
+	srv, calls := failing(t, http.StatusBadGateway, 2, nil)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if status := send(t, testClient(3), req); status != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("status = %d after %d calls, want 200 after 3", status, calls.Load())
+	}
+}
+
+func TestDoDoesNotRetryPost(t *testing.T) {
+	srv, calls := failing(t, http.StatusBadGateway, 1, nil)
+
+	if status := send(t, testClient(3), post(t, srv.URL)); status != http.StatusBadGateway || calls.Load() != 1 {
+		t.Errorf("status = %d after %d calls, want the 502 after 1", status, calls.Load())
+	}
+}
+
+func TestDoRetriesRetrySafePost(t *testing.T) {
+	srv, calls := failing(t, http.StatusServiceUnavailable, 1, nil)
+
+	// the handler rejects an empty body, so the replay has to resend it
+	if status := send(t, testClient(3), RetrySafe(post(t, srv.URL))); status != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("status = %d after %d calls, want 200 after 2", status, calls.Load())
+	}
+}
+
+func TestDoRefusesReplayWithoutGetBody(t *testing.T) {
+	srv, _ := failing(t, http.StatusServiceUnavailable, 1, nil)
+
+	req := RetrySafe(post(t, srv.URL))
+	req.GetBody = nil
+	if _, err := testClient(3).Do(req); err == nil {
+		t.Error("retry without GetBody didn't fail")
+	}
+}
+
+func TestDoRetryAfter(t *testing.T) {
+	srv, calls := failing(t, http.StatusTooManyRequests, 1, http.Header{"Retry-After": {"1"}})
+
+	c := testClient(1)
+	c.MaxDelay = 20 * time.Millisecond
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	start := time.Now()
+	if status := send(t, c, req); status != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("status = %d after %d calls, want 200 after 2", status, calls.Load())
+	}
+	// a second of Retry-After is capped at MaxDelay
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("waited %s, want MaxDelay", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for header, want := range map[string]time.Duration{
+		"3":     3 * time.Second,
+		"":      0,
+		"later": 0,
+	} {
+		res := &http.Response{Header: http.Header{}}
+		res.Header.Set("Retry-After", header)
+		if got, _ := retryAfter(res); got != want {
+			t.Errorf("retryAfter(%q) = %s, want %s", header, got, want)
+		}
+	}
+
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got, ok := retryAfter(res); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(date) = %s, %t, want about a minute", got, ok)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := testClient(0)
+	c.BaseDelay = 10 * time.Millisecond
+	c.MaxDelay = 50 * time.Millisecond
+
+	for attempt, ceiling := range []time.Duration{10, 20, 40, 50, 50} {
+		ceiling *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if wait := c.Backoff(attempt); wait < 0 || wait >= ceiling {
+				t.Fatalf("backoff(%d) = %s, want under %s", attempt, wait, ceiling)
+			}
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, 20*time.Millisecond)
+
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("opened after 1 failure: %v", err)
+	}
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allowed = %v after 2 failures, want open", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("trial refused after cooldown: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second request allowed during the trial")
+	}
+
+	// a failed trial opens it again straight away
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allowed = %v after a failed trial, want open", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("trial refused after cooldown: %v", err)
+	}
+	b.Success()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("still open after a successful trial: %v", err)
+	}
+}
+
+func TestDoCancelledLeavesBreaker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	c := testClient(0)
+	c.breakers = NewBreakers(2, time.Minute)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	c.breakers.For(host).Failure()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+
+	// counted as a success the earlier failure would be forgotten
+	c.breakers.For(host).Failure()
+	if err := c.breakers.For(host).Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("breaker = %v, want open after the failures either side of a cancelled request", err)
+	}
+}
@@ -1,30 +1,53 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/k8sdeploy/agent/internal/agent"
 	"github.com/k8sdeploy/agent/internal/agent/info"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
 	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"net/http"
+	"k8s.io/client-go/metadata"
+	"sync"
 )
 
 type Boot struct {
-	Config    *config.Config
-	Context   context.Context
-	ClientSet *kubernetes.Clientset
-	ErrChan   chan error
+	Config       *config.Config
+	Context      context.Context
+	Cluster      string
+	ClientSet    kubernetes.Interface
+	Dynamic      dynamic.Interface
+	Metadata     metadata.Interface
+	Namespaces   scope.Namespaces
+	Capabilities scope.Capabilities
+	HTTPClient   *httpclient.Client
+	ErrChan      chan error
 
 	BootInfo *BootInfo
+
+	// hashes is what each namespace looked like at the last sync the
+	// orchestrator accepted, nil until the first full sync
+	hashes map[string]string
+
+	// failed is the namespaces this sync couldn't read completely
+	failedMu sync.Mutex
+	failed   map[string]bool
 }
 
 type BootInfo struct {
+	Cluster       string
 	Namespaces    []string
 	NamespaceInfo []NamespaceInfo
+	Capabilities  scope.Capabilities
+	ClusterInfo   *info.ClusterInfo
+
+	// Incremental syncs only carry the namespaces that changed, along with
+	// any that have gone since the last sync
+	Incremental bool
+	Removed     []string
 }
 
 type NamespaceInfo struct {
@@ -36,12 +59,29 @@ type NamespaceInfo struct {
 	Ingresses    []IngressInfo
 	StatefulSets []StatefulSetInfo
 	Jobs         []JobInfo
+
+	DaemonSets      []info.DaemonSetInfo
+	CronJobs        []info.CronJobInfo
+	HPAs            []info.HPAInfo
+	PVCs            []info.PVCInfo
+	ConfigMaps      []info.ConfigMapInfo
+	Secrets         []info.SecretInfo
+	NetworkPolicies []info.NetworkPolicyInfo
+	HTTPRoutes      []info.HTTPRouteInfo
+
+	Graph *info.Graph
 }
 
 type PodInfo struct {
-	Name   string
-	Status string
-	Image  string
+	Name     string
+	Status   string
+	Phase    string
+	Image    string
+	Ready    bool
+	Restarts int32
+	Node     string
+
+	Containers []info.ContainerStatus
 }
 
 type DeploymentInfo struct {
@@ -62,14 +102,21 @@ type ServiceInfo struct {
 	Name              string
 	Type              string
 	ClusterIP         string
+	Ports             []info.ServicePort
 	InternalEndpoints []string
 	ExternalEndpoints []string
+	ReadyEndpoints    []string
+	NotReadyEndpoints []string
 }
 
 type IngressInfo struct {
-	Name      string
-	Hosts     []string
-	Endpoints []string
+	Name           string
+	Class          string
+	Hosts          []string
+	Endpoints      []string
+	Rules          []info.IngressRule
+	DefaultBackend *info.IngressBackend
+	TLS            []info.IngressTLS
 }
 
 type StatefulSetInfo struct {
@@ -85,54 +132,136 @@ type JobInfo struct {
 	ReadyPods int
 }
 
-func NewBoot(cfg *config.Config, errChan chan error) *Boot {
+// NewBoots gives a boot for each cluster the agent serves, the clients and the
+// capabilities its access review found are shared rather than made again
+func NewBoots(cfg *config.Config, clusters *agent.Clusters, client *httpclient.Client, errChan chan error) []*Boot {
 	ctx := context.Background()
 
-	a := agent.NewAgent(cfg)
-	if err := a.GetKubernetesClient(); err != nil {
-		errChan <- logs.Errorf("failed to get kubernetes client: %v", err)
-		return nil
-	}
+	var boots []*Boot
+	for _, name := range clusters.Names() {
+		kc, err := clusters.Get(name)
+		if err != nil {
+			errChan <- logs.Errorf("failed to get cluster: %v", err)
+			continue
+		}
 
-	return &Boot{
-		Config:    cfg,
-		Context:   ctx,
-		ClientSet: a.KubernetesClient.ClientSet,
-		ErrChan:   errChan,
+		boots = append(boots, &Boot{
+			Config:       cfg,
+			Context:      ctx,
+			Cluster:      name,
+			ClientSet:    kc.ClientSet,
+			Dynamic:      kc.Dynamic,
+			Metadata:     kc.Metadata,
+			Namespaces:   kc.Namespaces,
+			Capabilities: kc.Capabilities,
+			HTTPClient:   client,
+			ErrChan:      errChan,
+		})
 	}
+
+	return boots
 }
 
-func (b *Boot) GetInfo() *Boot {
-	bi := &BootInfo{}
+// GetInfo reads the inventory, it fails outright when the namespaces can't be
+// listed, a namespace that only partly listed is recorded in failed
+func (b *Boot) GetInfo() error {
+	bi := &BootInfo{
+		Cluster:      b.Cluster,
+		Capabilities: b.Capabilities,
+	}
+	b.failed = map[string]bool{}
 
-	b.GetNamespaces(bi)
+	if err := b.GetNamespaces(bi); err != nil {
+		return err
+	}
+	b.GetCluster(bi)
 
-	for _, namespace := range bi.Namespaces {
-		ni := NamespaceInfo{
-			Name:         namespace,
-			Ingresses:    b.GetIngresses(namespace),
-			Deployments:  b.GetDeployments(namespace),
-			ReplicaSets:  b.GetReplicaSets(namespace),
-			Pods:         b.GetPods(namespace),
-			Services:     b.GetServices(namespace),
-			StatefulSets: b.GetStatefulSets(namespace),
-			Jobs:         b.GetJobs(namespace),
-		}
-		bi.NamespaceInfo = append(bi.NamespaceInfo, ni)
+	concurrency := b.Config.K8sDeploy.Boot.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	bi.NamespaceInfo = make([]NamespaceInfo, len(bi.Namespaces))
+	for idx, namespace := range bi.Namespaces {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, namespace string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			bi.NamespaceInfo[idx] = b.GetNamespaceInfo(namespace)
+		}(idx, namespace)
 	}
+	wg.Wait()
 
 	b.BootInfo = bi
-	return b
+	return nil
+}
+
+// namespaceFailed reports err and marks the namespace so the sync leaves it
+// out rather than sending the kinds that failed as empty
+func (b *Boot) namespaceFailed(namespace string, err error) {
+	b.failedMu.Lock()
+	b.failed[namespace] = true
+	b.failedMu.Unlock()
+
+	b.ErrChan <- err
+}
+
+func (b *Boot) GetNamespaceInfo(namespace string) NamespaceInfo {
+	return NamespaceInfo{
+		Name:         namespace,
+		Ingresses:    b.GetIngresses(namespace),
+		Deployments:  b.GetDeployments(namespace),
+		ReplicaSets:  b.GetReplicaSets(namespace),
+		Pods:         b.GetPods(namespace),
+		Services:     b.GetServices(namespace),
+		StatefulSets: b.GetStatefulSets(namespace),
+		Jobs:         b.GetJobs(namespace),
+
+		DaemonSets:      b.GetDaemonSets(namespace),
+		CronJobs:        b.GetCronJobs(namespace),
+		HPAs:            b.GetHPAs(namespace),
+		PVCs:            b.GetPVCs(namespace),
+		ConfigMaps:      b.GetConfigMaps(namespace),
+		Secrets:         b.GetSecrets(namespace),
+		NetworkPolicies: b.GetNetworkPolicies(namespace),
+		HTTPRoutes:      b.GetHTTPRoutes(namespace),
+
+		Graph: b.GetGraph(namespace),
+	}
+}
+
+// GetCluster needs cluster wide node access, so a namespace scoped agent
+// leaves the cluster section out
+func (b *Boot) GetCluster(bi *BootInfo) {
+	if b.Namespaces.Scoped() || !b.Capabilities.Permitted(scope.Permission{Resource: "nodes", Verb: "list"}) {
+		return
+	}
+
+	ci, err := info.NewCluster(b.ClientSet, b.Context).GetCluster()
+	if err != nil {
+		b.ErrChan <- logs.Errorf("failed to get cluster: %v", err)
+		return
+	}
+
+	bi.ClusterInfo = &ci
 }
 
-func (b *Boot) GetNamespaces(bi *BootInfo) {
+func (b *Boot) GetNamespaces(bi *BootInfo) error {
 	namespaces := info.NewNamespaces(b.ClientSet, b.Context)
+	namespaces.Scope = b.Namespaces
 	names, err := namespaces.FetchAllNamespaces()
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to fetch namespaces: %v", err)
+		return logs.Errorf("failed to fetch namespaces: %v", err)
 	}
 
 	bi.Namespaces = names
+	return nil
 }
 
 func (b *Boot) GetJobs(namespace string) []JobInfo {
@@ -141,7 +270,7 @@ func (b *Boot) GetJobs(namespace string) []JobInfo {
 	j := info.NewJobs(b.ClientSet, b.Context)
 	jobs, err := j.GetJobs(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get jobs: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get jobs: %v", err))
 	}
 
 	for _, j := range jobs {
@@ -161,14 +290,18 @@ func (b *Boot) GetIngresses(namespace string) []IngressInfo {
 	i := info.NewIngress(b.ClientSet, b.Context)
 	ingress, err := i.GetIngress(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get ingress: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get ingress: %v", err))
 	}
 
 	for _, i := range ingress {
 		ingressInfo = append(ingressInfo, IngressInfo{
-			Name:      i.Name,
-			Hosts:     i.Hosts,
-			Endpoints: i.Endpoints,
+			Name:           i.Name,
+			Class:          i.Class,
+			Hosts:          i.Hosts,
+			Endpoints:      i.Endpoints,
+			Rules:          i.Rules,
+			DefaultBackend: i.DefaultBackend,
+			TLS:            i.TLS,
 		})
 	}
 	return ingressInfo
@@ -180,7 +313,7 @@ func (b *Boot) GetDeployments(namespace string) []DeploymentInfo {
 	d := info.NewDeployments(b.ClientSet, b.Context)
 	deployments, err := d.GetDeployments(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get deployments: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get deployments: %v", err))
 	}
 
 	for _, d := range deployments {
@@ -201,7 +334,7 @@ func (b *Boot) GetReplicaSets(namespace string) []ReplicaSetInfo {
 	r := info.NewReplicaSets(b.ClientSet, b.Context)
 	replicaSets, err := r.GetReplicaSets(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get replicasets: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get replicasets: %v", err))
 	}
 
 	for _, r := range replicaSets {
@@ -222,14 +355,19 @@ func (b *Boot) GetPods(namespace string) []PodInfo {
 	p := info.NewPods(b.ClientSet, b.Context)
 	podList, err := p.GetPods(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get pods: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get pods: %v", err))
 	}
 
 	for _, pod := range podList {
 		podInfo = append(podInfo, PodInfo{
-			Name:   pod.Name,
-			Status: pod.Status,
-			Image:  pod.Image,
+			Name:       pod.Name,
+			Status:     pod.Status,
+			Phase:      pod.Phase,
+			Image:      pod.Image,
+			Ready:      pod.Ready,
+			Restarts:   pod.Restarts,
+			Node:       pod.Node,
+			Containers: pod.Containers,
 		})
 	}
 
@@ -242,7 +380,7 @@ func (b *Boot) GetStatefulSets(namespace string) []StatefulSetInfo {
 	s := info.NewStatefulSets(b.ClientSet, b.Context)
 	statefulSets, err := s.GetStatefulSets(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get statefulsets: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get statefulsets: %v", err))
 	}
 
 	for _, s := range statefulSets {
@@ -262,7 +400,7 @@ func (b *Boot) GetServices(namespace string) []ServiceInfo {
 	s := info.NewService(b.ClientSet, b.Context)
 	services, err := s.GetServices(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to get services: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get services: %v", err))
 	}
 
 	for _, s := range services {
@@ -270,34 +408,94 @@ func (b *Boot) GetServices(namespace string) []ServiceInfo {
 			Name:              s.Name,
 			Type:              string(s.Type),
 			ClusterIP:         s.ClusterIP,
+			Ports:             s.Ports,
 			InternalEndpoints: s.InternalEndpoints,
 			ExternalEndpoints: s.ExternalEndpoints,
+			ReadyEndpoints:    s.ReadyEndpoints,
+			NotReadyEndpoints: s.NotReadyEndpoints,
 		})
 	}
 
 	return serviceInfo
 }
 
-func (b *Boot) SendInfo() {
-	c, err := json.Marshal(b.BootInfo.NamespaceInfo)
+func (b *Boot) GetDaemonSets(namespace string) []info.DaemonSetInfo {
+	ds, err := info.NewDaemonSets(b.ClientSet, b.Context).GetDaemonSets(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to marshal agent body: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get daemonsets: %v", err))
 	}
-	ci := string(c)
-	logs.Infof("BootData: %s", ci)
 
-	// Send the data to the orchestrator
-	apiAddy := fmt.Sprintf("%s/agent/bootdata", b.Config.K8sDeploy.APIAddress)
-	req, err := http.NewRequest("POST", apiAddy, bytes.NewBuffer(c))
+	return ds
+}
+
+func (b *Boot) GetCronJobs(namespace string) []info.CronJobInfo {
+	cj, err := info.NewCronJobs(b.ClientSet, b.Context).GetCronJobs(namespace)
 	if err != nil {
-		b.ErrChan <- logs.Errorf("failed to create request: %v", err)
+		b.namespaceFailed(namespace, logs.Errorf("failed to get cronjobs: %v", err))
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Agent-Key", b.Config.K8sDeploy.Credentials.Agent.Key)
-	req.Header.Set("X-Agent-Secret", b.Config.K8sDeploy.Credentials.Agent.Secret)
 
-	if _, err := http.DefaultClient.Do(req); err != nil {
-		b.ErrChan <- logs.Errorf("failed to send request: %v", err)
+	return cj
+}
+
+func (b *Boot) GetHPAs(namespace string) []info.HPAInfo {
+	hpas, err := info.NewHPAs(b.ClientSet, b.Context).GetHPAs(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get hpas: %v", err))
 	}
-	logs.Infof("Sent boot data to orchestrator: %s", apiAddy)
+
+	return hpas
+}
+
+func (b *Boot) GetPVCs(namespace string) []info.PVCInfo {
+	pvcs, err := info.NewPVCs(b.ClientSet, b.Context).GetPVCs(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get pvcs: %v", err))
+	}
+
+	return pvcs
+}
+
+func (b *Boot) GetConfigMaps(namespace string) []info.ConfigMapInfo {
+	cms, err := info.NewConfigMaps(b.ClientSet, b.Context).GetConfigMaps(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get configmaps: %v", err))
+	}
+
+	return cms
+}
+
+func (b *Boot) GetSecrets(namespace string) []info.SecretInfo {
+	secrets, err := info.NewSecrets(b.ClientSet, b.Metadata, b.Context).GetSecrets(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get secrets: %v", err))
+	}
+
+	return secrets
+}
+
+func (b *Boot) GetNetworkPolicies(namespace string) []info.NetworkPolicyInfo {
+	nps, err := info.NewNetworkPolicies(b.ClientSet, b.Context).GetNetworkPolicies(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get network policies: %v", err))
+	}
+
+	return nps
+}
+
+func (b *Boot) GetGraph(namespace string) *info.Graph {
+	graph, err := info.NewGraph(b.ClientSet, b.Metadata, b.Context).GetGraph(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get graph: %v", err))
+	}
+
+	return graph
+}
+
+func (b *Boot) GetHTTPRoutes(namespace string) []info.HTTPRouteInfo {
+	routes, err := info.NewHTTPRoutes(b.ClientSet, b.Dynamic, b.Context).GetHTTPRoutes(namespace)
+	if err != nil {
+		b.namespaceFailed(namespace, logs.Errorf("failed to get httproutes: %v", err))
+	}
+
+	return routes
 }
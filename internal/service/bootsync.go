@@ -0,0 +1,184 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+)
+
+// Run syncs the inventory straight away and then on every sync interval
+func (b *Boot) Run(ctx context.Context) {
+	for {
+		if err := b.Sync(); err != nil {
+			b.ErrChan <- logs.Errorf("failed to sync %s boot data: %v", b.Cluster, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.Config.K8sDeploy.Boot.SyncInterval):
+		}
+	}
+}
+
+// Sync sends the whole inventory the first time, after that only namespaces
+// that changed since the last sync the orchestrator accepted are sent. Nothing
+// is sent when the namespaces can't be listed, and a namespace that only
+// partly listed keeps its last hash so it goes on the next sync that reads it
+func (b *Boot) Sync() error {
+	if err := b.GetInfo(); err != nil {
+		return logs.Errorf("failed to get boot data: %v", err)
+	}
+
+	var complete []NamespaceInfo
+	for _, ni := range b.BootInfo.NamespaceInfo {
+		if !b.failed[ni.Name] {
+			complete = append(complete, ni)
+		}
+	}
+	hashes, err := namespaceHashes(complete)
+	if err != nil {
+		return logs.Errorf("failed to hash namespaces: %v", err)
+	}
+	for name := range b.failed {
+		if hash, ok := b.hashes[name]; ok {
+			hashes[name] = hash
+		}
+	}
+
+	bi := *b.BootInfo
+	bi.NamespaceInfo = complete
+	if b.hashes != nil {
+		bi.Incremental = true
+		bi.NamespaceInfo = nil
+		for _, ni := range complete {
+			if b.hashes[ni.Name] != hashes[ni.Name] {
+				bi.NamespaceInfo = append(bi.NamespaceInfo, ni)
+			}
+		}
+
+		listed := make(map[string]bool, len(b.BootInfo.Namespaces))
+		for _, name := range b.BootInfo.Namespaces {
+			listed[name] = true
+		}
+		for name := range b.hashes {
+			if !listed[name] {
+				bi.Removed = append(bi.Removed, name)
+			}
+		}
+		sort.Strings(bi.Removed)
+
+		if len(bi.NamespaceInfo) == 0 && len(bi.Removed) == 0 {
+			return nil
+		}
+	}
+
+	if err := b.SendInfo(&bi); err != nil {
+		return logs.Errorf("failed to send boot data: %v", err)
+	}
+	b.hashes = hashes
+
+	return nil
+}
+
+func namespaceHashes(namespaces []NamespaceInfo) (map[string]string, error) {
+	hashes := make(map[string]string, len(namespaces))
+	for _, ni := range namespaces {
+		b, err := json.Marshal(ni)
+		if err != nil {
+			return nil, logs.Errorf("failed to marshal namespace %s: %v", ni.Name, err)
+		}
+
+		sum := sha256.Sum256(b)
+		hashes[ni.Name] = hex.EncodeToString(sum[:])
+	}
+
+	return hashes, nil
+}
+
+// SendInfo gzips the boot data and posts it in chunks, the orchestrator joins
+// the chunks back up and checks them against the checksum of the whole body
+func (b *Boot) SendInfo(bi *BootInfo) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(bi); err != nil {
+		return logs.Errorf("failed to encode boot data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return logs.Errorf("failed to compress boot data: %v", err)
+	}
+
+	data := buf.Bytes()
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	syncID := fmt.Sprintf("%s-%d", b.Cluster, time.Now().UnixNano())
+
+	chunkSize := b.Config.K8sDeploy.Boot.ChunkSize
+	if chunkSize < 1 {
+		chunkSize = len(data)
+	}
+	total := (len(data) + chunkSize - 1) / chunkSize
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := b.sendChunk(syncID, checksum, i, total, bi.Incremental, data[i*chunkSize:end]); err != nil {
+			return logs.Errorf("failed to send chunk %d of %d: %v", i+1, total, err)
+		}
+	}
+
+	logs.Infof("Sent %s boot data to orchestrator: %d namespaces in %d chunks", b.Cluster, len(bi.NamespaceInfo), total)
+	return nil
+}
+
+func (b *Boot) sendChunk(syncID, checksum string, index, total int, incremental bool, chunk []byte) error {
+	syncType := "full"
+	if incremental {
+		syncType = "incremental"
+	}
+
+	apiAddy := fmt.Sprintf("%s/agent/bootdata", b.Config.K8sDeploy.APIAddress)
+	req, err := http.NewRequestWithContext(b.Context, "POST", apiAddy, bytes.NewReader(chunk))
+	if err != nil {
+		return logs.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Agent-Key", b.Config.K8sDeploy.Credentials.Agent.Key)
+	req.Header.Set("X-Agent-Secret", b.Config.K8sDeploy.Credentials.Agent.Secret)
+	req.Header.Set("X-Agent-Cluster", b.Cluster)
+	req.Header.Set("X-Boot-Sync-ID", syncID)
+	req.Header.Set("X-Boot-Sync-Type", syncType)
+	req.Header.Set("X-Boot-Chunk", strconv.Itoa(index))
+	req.Header.Set("X-Boot-Chunks", strconv.Itoa(total))
+	req.Header.Set("X-Boot-Checksum", checksum)
+
+	// chunks are keyed on the sync id and index, so a repeat replaces itself
+	res, err := b.HTTPClient.Do(httpclient.RetrySafe(req))
+	if err != nil {
+		return logs.Errorf("failed to send request: %v", err)
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			_ = logs.Errorf("failed to close bootdata body: %v", err)
+		}
+	}()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return logs.Errorf("orchestrator rejected boot data: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/k8sdeploy/agent/internal/agent"
+	"github.com/k8sdeploy/agent/internal/agent/scope"
+	"github.com/k8sdeploy/agent/internal/config"
+	"github.com/k8sdeploy/agent/internal/httpclient"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// bootServer reassembles chunked boot data the way the orchestrator does
+type bootServer struct {
+	mu     sync.Mutex
+	chunks map[string][][]byte
+	syncs  []BootInfo
+}
+
+func (s *bootServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := r.Header.Get("X-Boot-Sync-ID")
+	index, _ := strconv.Atoi(r.Header.Get("X-Boot-Chunk"))
+	total, _ := strconv.Atoi(r.Header.Get("X-Boot-Chunks"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chunks[id] == nil {
+		s.chunks[id] = make([][]byte, total)
+	}
+	s.chunks[id][index] = body
+	for _, c := range s.chunks[id] {
+		if c == nil {
+			return
+		}
+	}
+
+	data := bytes.Join(s.chunks[id], nil)
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != r.Header.Get("X-Boot-Checksum") {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	var bi BootInfo
+	if err := json.NewDecoder(zr).Decode(&bi); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	s.syncs = append(s.syncs, bi)
+}
+
+func newTestBoot(t *testing.T, objects ...runtime.Object) (*Boot, *bootServer, *fake.Clientset) {
+	t.Helper()
+
+	bs := &bootServer{chunks: map[string][][]byte{}}
+	srv := httptest.NewServer(bs)
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{}
+	cfg.K8sDeploy.APIAddress = srv.URL
+	cfg.K8sDeploy.Boot.Concurrency = 2
+	cfg.K8sDeploy.Boot.ChunkSize = 64
+
+	errChan := make(chan error, 100)
+	client := fake.NewSimpleClientset(objects...)
+	scheme := metadatafake.NewTestScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+
+	return &Boot{
+		Config:     cfg,
+		Context:    context.Background(),
+		Cluster:    "local",
+		ClientSet:  client,
+		Metadata:   metadatafake.NewSimpleMetadataClient(scheme),
+		HTTPClient: httpclient.NewClient(cfg),
+		ErrChan:    errChan,
+	}, bs, client
+}
+
+func testNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func testService(name, namespace string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+	}
+}
+
+func TestBootSyncIncremental(t *testing.T) {
+	b, bs, client := newTestBoot(t,
+		testNamespace("alpha"),
+		testNamespace("beta"),
+		testNamespace("gamma"),
+		testService("api", "alpha"),
+	)
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("full sync failed: %v", err)
+	}
+	if len(bs.syncs) != 1 {
+		t.Fatalf("got %d syncs, want 1", len(bs.syncs))
+	}
+	if full := bs.syncs[0]; full.Incremental || len(full.NamespaceInfo) != 3 {
+		t.Fatalf("first sync = incremental %v with %d namespaces, want full with 3", full.Incremental, len(full.NamespaceInfo))
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("unchanged sync failed: %v", err)
+	}
+	if len(bs.syncs) != 1 {
+		t.Fatalf("unchanged cluster sent %d syncs, want 1", len(bs.syncs))
+	}
+
+	ctx := context.Background()
+	if _, err := client.CoreV1().Services("beta").Create(ctx, testService("web", "beta"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	if err := client.CoreV1().Namespaces().Delete(ctx, "gamma", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete namespace: %v", err)
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("incremental sync failed: %v", err)
+	}
+	if len(bs.syncs) != 2 {
+		t.Fatalf("got %d syncs, want 2", len(bs.syncs))
+	}
+
+	inc := bs.syncs[1]
+	if !inc.Incremental {
+		t.Error("second sync not marked incremental")
+	}
+	if len(inc.NamespaceInfo) != 1 || inc.NamespaceInfo[0].Name != "beta" {
+		t.Errorf("incremental namespaces = %+v, want only beta", inc.NamespaceInfo)
+	}
+	if len(inc.Removed) != 1 || inc.Removed[0] != "gamma" {
+		t.Errorf("removed = %v, want [gamma]", inc.Removed)
+	}
+}
+
+func TestBootSyncNamespacesFailed(t *testing.T) {
+	b, bs, client := newTestBoot(t, testNamespace("alpha"), testNamespace("beta"))
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("full sync failed: %v", err)
+	}
+	synced := b.hashes
+
+	client.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("api unavailable")
+	})
+	if err := b.Sync(); err == nil {
+		t.Fatal("expected sync to fail without namespaces")
+	}
+	if len(bs.syncs) != 1 {
+		t.Errorf("got %d syncs, want nothing sent after the failed list", len(bs.syncs))
+	}
+	if !reflect.DeepEqual(b.hashes, synced) {
+		t.Errorf("hashes = %v, want the last accepted %v", b.hashes, synced)
+	}
+}
+
+func TestBootSyncNamespacePartlyFailed(t *testing.T) {
+	b, bs, client := newTestBoot(t,
+		testNamespace("alpha"),
+		testNamespace("beta"),
+		testService("api", "alpha"),
+	)
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("full sync failed: %v", err)
+	}
+	alpha := b.hashes["alpha"]
+
+	failing := true
+	client.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failing && action.GetNamespace() == "alpha" {
+			return true, nil, errors.New("api unavailable")
+		}
+		return false, nil, nil
+	})
+	if _, err := client.CoreV1().Services("beta").Create(context.Background(), testService("web", "beta"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("incremental sync failed: %v", err)
+	}
+	if len(bs.syncs) != 2 {
+		t.Fatalf("got %d syncs, want 2", len(bs.syncs))
+	}
+	inc := bs.syncs[1]
+	if len(inc.NamespaceInfo) != 1 || inc.NamespaceInfo[0].Name != "beta" || len(inc.Removed) != 0 {
+		t.Errorf("incremental = %+v removed %v, want only beta and alpha left alone", inc.NamespaceInfo, inc.Removed)
+	}
+	if b.hashes["alpha"] != alpha {
+		t.Error("alpha's hash changed from a sync that couldn't read it")
+	}
+
+	failing = false
+	if err := b.Sync(); err != nil {
+		t.Fatalf("recovered sync failed: %v", err)
+	}
+	if len(bs.syncs) != 2 {
+		t.Errorf("got %d syncs, want alpha unchanged once it lists again", len(bs.syncs))
+	}
+}
+
+func TestBootSyncRejected(t *testing.T) {
+	b, _, _ := newTestBoot(t, testNamespace("alpha"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+	b.Config.K8sDeploy.APIAddress = srv.URL
+
+	if err := b.Sync(); err == nil {
+		t.Fatal("expected rejected sync to fail")
+	}
+	if b.hashes != nil {
+		t.Error("rejected sync recorded as the last successful sync")
+	}
+}
+
+func TestNewBootsSharesClusters(t *testing.T) {
+	cfg := &config.Config{}
+	client := httpclient.NewClient(cfg)
+
+	local := &agent.KubernetesClient{
+		ClientSet:    fake.NewSimpleClientset(),
+		Capabilities: scope.Capabilities{{Permission: scope.Permission{Resource: "pods", Verb: "list"}, Allowed: true}},
+	}
+	remote := &agent.KubernetesClient{
+		ClientSet:  fake.NewSimpleClientset(),
+		Namespaces: scope.Namespaces{"team"},
+	}
+	clusters := agent.NewClusters("local")
+	clusters.Add("local", local)
+	clusters.Add("remote", remote)
+
+	boots := NewBoots(cfg, clusters, client, make(chan error, 1))
+	if len(boots) != 2 {
+		t.Fatalf("got %d boots, want 2", len(boots))
+	}
+	for i, kc := range []*agent.KubernetesClient{local, remote} {
+		b := boots[i]
+		if b.ClientSet != kc.ClientSet || b.HTTPClient != client {
+			t.Errorf("boot %s made its own clients", b.Cluster)
+		}
+		if !reflect.DeepEqual(b.Capabilities, kc.Capabilities) || !reflect.DeepEqual(b.Namespaces, kc.Namespaces) {
+			t.Errorf("boot %s = %+v %v, want the agent's review", b.Cluster, b.Capabilities, b.Namespaces)
+		}
+	}
+}
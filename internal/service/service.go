@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"net/http"
@@ -9,8 +10,8 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/k8sdeploy/agent/internal/agent"
 	"github.com/k8sdeploy/agent/internal/config"
-	"github.com/keloran/go-healthcheck"
-	"github.com/keloran/go-probe"
+	"github.com/k8sdeploy/agent/internal/health"
+	"github.com/k8sdeploy/agent/internal/telemetry"
 )
 
 type Service struct {
@@ -18,28 +19,45 @@ type Service struct {
 }
 
 func (s *Service) LocalStart() error {
+	shutdown, err := telemetry.Setup(s.Config)
+	if err != nil {
+		return logs.Errorf("failed to setup tracing: %v", err)
+	}
+	defer stopTracing(shutdown)
+
 	errChan := make(chan error)
-	startAgent(s.Config, errChan)
+	a := agent.NewAgent(s.Config)
+	go startBoots(a)
+	startAgent(a, errChan)
 	return <-errChan
 }
 
 func (s *Service) Start() error {
+	shutdown, err := telemetry.Setup(s.Config)
+	if err != nil {
+		return logs.Errorf("failed to setup tracing: %v", err)
+	}
+	defer stopTracing(shutdown)
+
 	errChan := make(chan error)
+	a := agent.NewAgent(s.Config)
 	if !s.Config.Config.Local.Development {
-		go startHealth(s.Config, errChan)
+		go startHealth(s.Config, a.Health, errChan)
 	}
-	go startAgent(s.Config, errChan)
+	go startBoots(a)
+	go startAgent(a, errChan)
 
 	return <-errChan
 }
 
-func startHealth(cfg *config.Config, errChan chan error) {
+func startHealth(cfg *config.Config, h *health.Health, errChan chan error) {
 	p := fmt.Sprintf(":%d", cfg.Local.HTTPPort)
 	logs.Local().Infof("Starting agent healthchecks on %s", p)
 
 	r := chi.NewRouter()
-	r.Get("/health", healthcheck.HTTP)
-	r.Get("/probe", probe.HTTP)
+	r.Get("/health", h.ReadinessHTTP)
+	r.Get("/probe", h.LivenessHTTP)
+	r.Get("/status", h.StatusHTTP)
 
 	srv := &http.Server{
 		Addr:              p,
@@ -53,8 +71,36 @@ func startHealth(cfg *config.Config, errChan chan error) {
 	}
 }
 
-func startAgent(cfg *config.Config, errChan chan error) {
-	if err := agent.NewAgent(cfg).Start(); err != nil {
+func stopTracing(shutdown telemetry.Shutdown) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := shutdown(ctx); err != nil {
+		_ = logs.Errorf("failed to shutdown tracing: %v", err)
+	}
+}
+
+// startBoots keeps each cluster's inventory synced with the orchestrator once
+// the agent has loaded them, a failed sync is retried on the next interval so
+// its errors don't stop the service
+func startBoots(a *agent.Agent) {
+	errChan := make(chan error)
+	go func() {
+		for err := range errChan {
+			if err != nil {
+				logs.Infof("error in boot sync: %v", err)
+			}
+		}
+	}()
+
+	<-a.Started()
+	for _, b := range NewBoots(a.Config, a.Clusters, a.HTTPClient, errChan) {
+		go b.Run(context.Background())
+	}
+}
+
+func startAgent(a *agent.Agent, errChan chan error) {
+	if err := a.Start(); err != nil {
 		errChan <- err
 	}
 }
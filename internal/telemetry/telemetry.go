@@ -0,0 +1,113 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/k8sdeploy/agent/internal/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/k8sdeploy/agent"
+
+type Shutdown func(ctx context.Context) error
+
+func Setup(cfg *config.Config) (Shutdown, error) {
+	if !cfg.K8sDeploy.Tracing.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(cfg.K8sDeploy.Tracing.Endpoint),
+	}
+	if cfg.K8sDeploy.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, logs.Errorf("failed to create otlp exporter: %v", err)
+	}
+
+	return SetupWithExporter(cfg, exp)
+}
+
+// SetupWithExporter registers a global tracer provider that sends spans to exp,
+// this lets tests swap in tracetest.InMemoryExporter instead of a collector
+func SetupWithExporter(cfg *config.Config, exp sdktrace.SpanExporter) (Shutdown, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.K8sDeploy.Tracing.ServiceName),
+		semconv.ServiceVersion(cfg.K8sDeploy.BuildVersion),
+	))
+	if err != nil {
+		return nil, logs.Errorf("failed to create resource: %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.K8sDeploy.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End records err on the span (if there is one) and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract pulls the trace context out of queue message headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// Inject writes the trace context from ctx into headers for a published message
+func Inject(ctx context.Context) map[string]string {
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	return headers
+}
+
+// WrapTransport gives every kubernetes api call its own span, named by the
+// method alone as the path names the object
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(pathTransport{next: rt}, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return fmt.Sprintf("k8s %s", r.Method)
+	}))
+}
+
+// pathTransport puts the path on the span otelhttp started for the request
+type pathTransport struct {
+	next http.RoundTripper
+}
+
+func (p pathTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace.SpanFromContext(r.Context()).SetAttributes(semconv.URLPath(r.URL.Path))
+	return p.next.RoundTrip(r)
+}